@@ -0,0 +1,154 @@
+// Package acct lets Go programs use the profiles that the acct CLI stores,
+// without shelling out to it. A TokenSource reads a profile from the same
+// keyring and refreshes it through the same paths as acct refresh, writing
+// the refreshed tokens back so the CLI and every other consumer see them.
+//
+// A TokenSource is an oauth2.TokenSource, so an authorised client is
+//
+//	ts, err := acct.NewTokenSource("acme", "qbo")
+//	if err != nil {
+//		return err
+//	}
+//	client := &http.Client{Transport: &oauth2.Transport{Source: ts}}
+//
+// or, equivalently, oauth2.NewClient(ctx, ts).
+//
+// Opening the keyring can prompt for a passphrase or report that it is
+// waiting on an unlock dialog. Those messages go to standard error unless
+// WithStderr sends them elsewhere.
+package acct
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/cli"
+)
+
+// refreshMargin is how close to expiry a token may get before Token
+// refreshes it, so that a request started with it does not fail in flight.
+const refreshMargin = time.Minute
+
+// TokenSource supplies the access token of one stored profile. It is safe
+// for concurrent use; concurrent callers share a single refresh.
+type TokenSource struct {
+	app      *cli.App
+	name     string
+	provider string
+
+	mu   sync.Mutex
+	prof *cli.ProfileData
+}
+
+// Option configures a TokenSource made by NewTokenSource.
+type Option func(*TokenSource)
+
+// WithStderr sends the keyring's prompts and progress messages to w instead
+// of standard error. Passing io.Discard silences them, but then a keyring
+// waiting to be unlocked gives no sign of it.
+func WithStderr(w io.Writer) Option {
+	return func(ts *TokenSource) { ts.app.Stderr = w }
+}
+
+// NewTokenSource returns a TokenSource for the profile stored under name for
+// provider ("xero", "qbo", "deputy", "myob", "freshbooks" or
+// "custom:<name>"). It honours the CLI's environment: ACCOUNTING_OPS_BROKER,
+// ACCOUNTING_OPS_BROKER_PUBKEY and ACCOUNTING_OPS_BROKER_KEY for broker
+// refreshes, and XERO_CLIENT_ID for Xero, whose tokens are refreshed
+// locally.
+func NewTokenSource(name, provider string, opts ...Option) (*TokenSource, error) {
+	app, err := cli.NewApp()
+	if err != nil {
+		return nil, err
+	}
+	app.Stdout, app.Stderr = io.Discard, os.Stderr
+	ts := &TokenSource{app: app, name: name, provider: provider}
+	for _, opt := range opts {
+		opt(ts)
+	}
+	return ts, nil
+}
+
+// Token returns the profile's access token, refreshing and saving it first
+// when it is within a minute of expiry. The stored profile is read again
+// before refreshing, so a refresh made meanwhile by the CLI or another
+// process is picked up rather than repeated with a rotated-out token.
+func (ts *TokenSource) Token() (*oauth2.Token, error) {
+	prof, err := ts.current()
+	if err != nil {
+		return nil, err
+	}
+	return oauthToken(prof), nil
+}
+
+// current returns the profile with a usable access token, as for Token.
+func (ts *TokenSource) current() (cli.ProfileData, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.prof != nil && fresh(*ts.prof) {
+		return *ts.prof, nil
+	}
+	return ts.reload("")
+}
+
+// rejected refreshes the profile after the provider turned down stale, an
+// access token that had not yet expired. Concurrent callers that saw the
+// same token share one refresh.
+func (ts *TokenSource) rejected(stale string) (cli.ProfileData, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.prof != nil && ts.prof.AccessToken != stale && fresh(*ts.prof) {
+		return *ts.prof, nil
+	}
+	return ts.reload(stale)
+}
+
+// reload reads the stored profile and refreshes it when its access token is
+// near expiry or is stale. ts.mu must be held.
+func (ts *TokenSource) reload(stale string) (cli.ProfileData, error) {
+	prof, err := ts.app.LoadProfile(ts.name, ts.provider)
+	if err != nil {
+		return cli.ProfileData{}, err
+	}
+	if !fresh(prof) || (stale != "" && prof.AccessToken == stale) {
+		if prof, err = ts.app.RefreshProfile(prof); err != nil {
+			return cli.ProfileData{}, err
+		}
+	}
+	ts.prof = &prof
+	return prof, nil
+}
+
+// APIBaseURL returns the base URL of the profile's provider API, the prefix
+// under which a Transport authorises requests. For QuickBooks it is the
+// host for the profile's environment, without the company path.
+func (ts *TokenSource) APIBaseURL() (string, error) {
+	prof, err := ts.current()
+	if err != nil {
+		return "", err
+	}
+	return cli.APIBaseURL(prof)
+}
+
+// fresh reports whether prof's access token has more than refreshMargin
+// left.
+func fresh(prof cli.ProfileData) bool {
+	return prof.NonExpiring || time.Until(prof.ExpiresAt) > refreshMargin
+}
+
+// oauthToken converts a profile to the token handed to HTTP clients. The
+// refresh token stays behind: refreshing is the TokenSource's job.
+func oauthToken(prof cli.ProfileData) *oauth2.Token {
+	tok := &oauth2.Token{AccessToken: prof.AccessToken, TokenType: prof.TokenType}
+	if tok.TokenType == "" {
+		tok.TokenType = "Bearer"
+	}
+	if !prof.NonExpiring {
+		tok.Expiry = prof.ExpiresAt
+	}
+	return tok
+}
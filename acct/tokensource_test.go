@@ -0,0 +1,110 @@
+package acct
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/keyring"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+	"auth.industrial-linguistics.com/accounting-ops/internal/cli"
+)
+
+// testSource returns a TokenSource for a Deputy profile stored in an
+// in-memory keyring, refreshing through a brokertest broker.
+func testSource(t *testing.T, prof cli.ProfileData) (*TokenSource, *brokertest.Server) {
+	t.Helper()
+	srv := brokertest.NewServer(t)
+	app := &cli.App{
+		BrokerBaseURL: srv.URL,
+		ConfigDir:     t.TempDir(),
+		HTTPClient:    http.DefaultClient,
+		Keyring:       keyring.NewArrayKeyring(nil),
+		Stdout:        io.Discard,
+		Stderr:        io.Discard,
+		Stdin:         strings.NewReader(""),
+	}
+	data, err := json.Marshal(prof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Keyring.Set(keyring.Item{Key: prof.Provider + ":" + prof.Name, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	return &TokenSource{app: app, name: prof.Name, provider: prof.Provider}, srv
+}
+
+func deputyProfile(expiresIn time.Duration) cli.ProfileData {
+	return cli.ProfileData{
+		Provider:     "deputy",
+		Name:         "acme",
+		AccessToken:  "stored-access",
+		RefreshToken: "stored-refresh",
+		Endpoint:     "https://brokertest.example.com",
+		ExpiresAt:    time.Now().Add(expiresIn).UTC(),
+	}
+}
+
+func TestTokenReusesFreshToken(t *testing.T) {
+	ts, srv := testSource(t, deputyProfile(time.Hour))
+	for i := 0; i < 3; i++ {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != "stored-access" || tok.TokenType != "Bearer" {
+			t.Fatalf("token %d = %+v, want the stored access token", i, tok)
+		}
+	}
+	if n := srv.Upstream.TokensIssued(); n != 0 {
+		t.Fatalf("fresh token was refreshed %d times", n)
+	}
+}
+
+func TestTokenRefreshesNearExpiry(t *testing.T) {
+	for _, expiresIn := range []time.Duration{-time.Hour, 30 * time.Second} {
+		ts, srv := testSource(t, deputyProfile(expiresIn))
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatalf("expires in %v: %v", expiresIn, err)
+		}
+		if tok.AccessToken != "brokertest-access-1" {
+			t.Fatalf("expires in %v: access token %q, want the refreshed one", expiresIn, tok.AccessToken)
+		}
+		if time.Until(tok.Expiry) < 10*time.Minute {
+			t.Fatalf("expires in %v: refreshed expiry %v", expiresIn, tok.Expiry)
+		}
+		stored, err := ts.app.LoadProfile("acme", "deputy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.AccessToken != "brokertest-access-1" || stored.RefreshToken != "brokertest-refresh-1" {
+			t.Fatalf("expires in %v: stored profile not updated: %+v", expiresIn, stored)
+		}
+		if _, err := ts.Token(); err != nil {
+			t.Fatal(err)
+		}
+		if n := srv.Upstream.TokensIssued(); n != 1 {
+			t.Fatalf("expires in %v: %d refreshes, want 1", expiresIn, n)
+		}
+	}
+}
+
+func TestTokenReportsRefreshFailure(t *testing.T) {
+	ts, srv := testSource(t, deputyProfile(-time.Hour))
+	srv.Upstream.FailTokens(http.StatusBadRequest, `{"error":"invalid_grant"}`)
+	if _, err := ts.Token(); err == nil || !strings.Contains(err.Error(), "refresh failed") {
+		t.Fatalf("Token() error = %v, want a refresh failure", err)
+	}
+	stored, err := ts.app.LoadProfile("acme", "deputy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefreshToken != "stored-refresh" {
+		t.Fatalf("failed refresh changed the stored profile: %+v", stored)
+	}
+}
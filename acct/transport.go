@@ -0,0 +1,126 @@
+package acct
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/cli"
+)
+
+// Transport is an http.RoundTripper that authorises requests to the API of
+// its TokenSource's provider:
+//
+//	ts, err := acct.NewTokenSource("acme", "xero")
+//	if err != nil {
+//		return err
+//	}
+//	client := &http.Client{Transport: acct.NewTransport(ts)}
+//	resp, err := client.Get("https://api.xero.com/api.xro/2.0/Invoices")
+//
+// Requests under the provider's API base URL (TokenSource.APIBaseURL) get
+// the current access token, and for Xero the profile's Xero-tenant-id
+// unless the request sets one. For QuickBooks, a path that does not start
+// with /v3/ is placed under /v3/company/<realm id>, so
+// base+"/query?query=..." reaches the profile's company. A 401 refreshes
+// the token and retries the request once, provided its body can be
+// replayed (http.NewRequest arranges that for the common body types).
+// Requests to any other host pass through untouched, so the token never
+// leaves the provider.
+type Transport struct {
+	Source *TokenSource
+	// Base makes the actual requests; http.DefaultTransport when nil.
+	Base http.RoundTripper
+}
+
+// NewTransport returns a Transport drawing tokens from ts.
+func NewTransport(ts *TokenSource) *Transport {
+	return &Transport{Source: ts}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	prof, err := t.Source.current()
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	base, err := cli.APIBaseURL(prof)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	if !underBase(req.URL, base) {
+		return t.base().RoundTrip(req)
+	}
+	resp, err := t.base().RoundTrip(authorise(req, req.Body, prof))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	prof, err = t.Source.rejected(prof.AccessToken)
+	if err != nil {
+		// The 401 says more about the failure than the refresh error.
+		return resp, nil
+	}
+	body := io.ReadCloser(http.NoBody)
+	if req.GetBody != nil {
+		if body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return t.base().RoundTrip(authorise(req, body, prof))
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// authorise returns a copy of req, with body, carrying prof's credentials.
+// A RoundTripper must not modify the request it is given.
+func authorise(req *http.Request, body io.ReadCloser, prof cli.ProfileData) *http.Request {
+	out := req.Clone(req.Context())
+	out.Body = body
+	out.Header.Set("Authorization", "Bearer "+prof.AccessToken)
+	switch prof.Provider {
+	case "xero":
+		if prof.TenantID != "" && out.Header.Get("Xero-tenant-id") == "" {
+			out.Header.Set("Xero-tenant-id", prof.TenantID)
+		}
+	case "qbo":
+		if prof.RealmID != "" && !strings.HasPrefix(out.URL.Path, "/v3/") {
+			u := *out.URL
+			u.Path = "/v3/company/" + prof.RealmID + "/" + strings.TrimPrefix(u.Path, "/")
+			u.RawPath = ""
+			out.URL = &u
+		}
+	}
+	return out
+}
+
+// underBase reports whether u falls under the API base URL base.
+func underBase(u *url.URL, base string) bool {
+	b, err := url.Parse(base)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, b.Scheme) || !strings.EqualFold(u.Host, b.Host) {
+		return false
+	}
+	prefix := strings.TrimRight(b.Path, "/")
+	return prefix == "" || u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/")
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package acct
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI stands in for the provider API behind a Transport. It answers 401
+// to any token in rejected and records what each request carried.
+type fakeAPI struct {
+	rejected map[string]bool
+
+	mu     sync.Mutex
+	auths  []string
+	bodies []string
+}
+
+func (f *fakeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := req.Header.Get("Authorization")
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	f.mu.Lock()
+	f.auths = append(f.auths, auth)
+	f.bodies = append(f.bodies, string(body))
+	f.mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	if f.rejected[strings.TrimPrefix(auth, "Bearer ")] {
+		rec.WriteHeader(http.StatusUnauthorized)
+	} else {
+		rec.WriteHeader(http.StatusOK)
+	}
+	return rec.Result(), nil
+}
+
+func TestTransportRetriesOnceAfter401(t *testing.T) {
+	ts, srv := testSource(t, deputyProfile(time.Hour))
+	api := &fakeAPI{rejected: map[string]bool{"stored-access": true}}
+	client := &http.Client{Transport: &Transport{Source: ts, Base: api}}
+
+	resp, err := client.Post("https://brokertest.example.com/api/v1/resource/Employee/QUERY", "application/json", strings.NewReader(`{"search":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after the retry", resp.StatusCode)
+	}
+	want := []string{"Bearer stored-access", "Bearer brokertest-access-1"}
+	if strings.Join(api.auths, ",") != strings.Join(want, ",") {
+		t.Fatalf("requests carried %q, want %q", api.auths, want)
+	}
+	if api.bodies[1] != `{"search":{}}` {
+		t.Fatalf("retried body = %q, want the original", api.bodies[1])
+	}
+	if n := srv.Upstream.TokensIssued(); n != 1 {
+		t.Fatalf("%d refreshes, want 1", n)
+	}
+}
+
+func TestTransportGivesUpAfterSecond401(t *testing.T) {
+	ts, srv := testSource(t, deputyProfile(time.Hour))
+	api := &fakeAPI{rejected: map[string]bool{"stored-access": true, "brokertest-access-1": true}}
+	client := &http.Client{Transport: &Transport{Source: ts, Base: api}}
+
+	resp, err := client.Get("https://brokertest.example.com/api/v1/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want the second 401", resp.StatusCode)
+	}
+	if len(api.auths) != 2 {
+		t.Fatalf("%d requests, want the original and one retry", len(api.auths))
+	}
+	if n := srv.Upstream.TokensIssued(); n != 1 {
+		t.Fatalf("%d refreshes, want 1", n)
+	}
+}
+
+func TestTransportReusesToken(t *testing.T) {
+	ts, srv := testSource(t, deputyProfile(time.Hour))
+	api := &fakeAPI{}
+	client := &http.Client{Transport: &Transport{Source: ts, Base: api}}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("https://brokertest.example.com/api/v1/me")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for i, auth := range api.auths {
+		if auth != "Bearer stored-access" {
+			t.Fatalf("request %d carried %q", i, auth)
+		}
+	}
+	if n := srv.Upstream.TokensIssued(); n != 0 {
+		t.Fatalf("fresh token was refreshed %d times", n)
+	}
+}
+
+func TestTransportLeavesOtherHostsAlone(t *testing.T) {
+	ts, _ := testSource(t, deputyProfile(time.Hour))
+	api := &fakeAPI{}
+	client := &http.Client{Transport: &Transport{Source: ts, Base: api}}
+
+	resp, err := client.Get("https://elsewhere.example.com/api/v1/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if api.auths[0] != "" {
+		t.Fatalf("request to another host carried %q", api.auths[0])
+	}
+}
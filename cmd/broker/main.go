@@ -1,12 +1,25 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/cgi"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
 )
@@ -14,27 +27,146 @@ import (
 func main() {
 	var (
 		envPath = flag.String("env", defaultEnvPath(), "path to broker.env")
-		dbPath  = flag.String("db", defaultDBPath(), "path to broker sqlite database")
+		dbPath  = flag.String("db", defaultDBPath(), "broker sqlite database path, or a postgres:// URL")
 		addr    = flag.String("addr", ":8080", "listen address when running standalone")
+
+		reapInterval = flag.Duration("reap-interval", 0, "override REAP_INTERVAL_SECONDS for the standalone reaper (e.g. 30s)")
+
+		listSessions  = flag.Bool("list-sessions", false, "print session metadata from the database (no tokens), then exit")
+		listProvider  = flag.String("provider", "", "with -list-sessions, only show this provider")
+		listExpired   = flag.Bool("expired", false, "with -list-sessions, only show expired sessions")
+		lookupState   = flag.String("lookup-state", "", "explain what happened to the session with this OAuth state (honours -provider), then exit")
+		stats         = flag.Bool("stats", false, "print per-provider refresh success rates, then exit")
+		statsWindow   = flag.Duration("stats-window", time.Hour, "with -stats, how far back to count (at most 24h; longer windows are rejected)")
+		metricsSnap   = flag.Bool("export-metrics-snapshot", false, "print the counters stored with PERSIST_METRICS, then exit")
+		metricsFormat = flag.String("metrics-format", "text", "with -export-metrics-snapshot, text (Prometheus exposition) or json")
+		vacuum        = flag.Bool("vacuum", false, "compact the sqlite database, then exit (not needed for postgres)")
+		pruneConsumed = flag.Bool("prune-consumed", false, "delete completed sessions whose results were never collected, then exit")
+		selfCheck     = flag.Bool("selfcheck", false, "run an end-to-end flow against a fake provider, then exit")
+		importJSON    = flag.String("import-env-from-json", "", "convert a JSON config object to broker.env on stdout, then exit")
+		exportJSON    = flag.Bool("export-env-to-json", false, "print the -env file as a JSON object, then exit")
+		healthURL     = flag.String("healthcheck", "", "GET this broker healthz URL and exit 0 if it answers 200, 1 otherwise (for container probes)")
+		healthDeep    = flag.Bool("deep", false, "with -healthcheck, also require the broker's database to answer")
 	)
 	flag.Parse()
 
-	cfg, err := broker.LoadConfigFromEnvFile(*envPath)
+	if *healthURL != "" {
+		if err := checkHealth(*healthURL, *healthDeep); err != nil {
+			log.Fatalf("healthcheck: %v", err)
+		}
+		return
+	}
+
+	if *importJSON != "" {
+		f, err := os.Open(*importJSON)
+		if err != nil {
+			log.Fatalf("open json: %v", err)
+		}
+		defer f.Close()
+		if err := broker.ConvertJSONToEnv(f, os.Stdout); err != nil {
+			log.Fatalf("convert json: %v", err)
+		}
+		return
+	}
+	if *exportJSON {
+		if err := broker.ConvertEnvToJSON(*envPath, os.Stdout); err != nil {
+			log.Fatalf("convert env: %v", err)
+		}
+		return
+	}
+
+	if *listSessions {
+		if err := printSessions(adminDBPath(*dbPath, *envPath), broker.SessionFilter{Provider: *listProvider, ExpiredOnly: *listExpired}); err != nil {
+			log.Fatalf("list sessions: %v", err)
+		}
+		return
+	}
+
+	if *lookupState != "" {
+		if err := printStateDiagnosis(adminDBPath(*dbPath, *envPath), *listProvider, *lookupState); err != nil {
+			log.Fatalf("lookup state: %v", err)
+		}
+		return
+	}
+
+	if *stats {
+		if err := printStats(adminDBPath(*dbPath, *envPath), *statsWindow); err != nil {
+			log.Fatalf("stats: %v", err)
+		}
+		return
+	}
+
+	if *metricsSnap {
+		if err := printMetricsSnapshot(adminDBPath(*dbPath, *envPath), *metricsFormat); err != nil {
+			log.Fatalf("export metrics snapshot: %v", err)
+		}
+		return
+	}
+
+	if *pruneConsumed {
+		// The grace comes from the configuration, which is loaded but not
+		// validated, as the other database commands only need it to load.
+		cfg, err := loadConfig(*envPath, envFileChosen())
+		if err != nil {
+			log.Fatalf("prune consumed: load config: %v", err)
+		}
+		if err := pruneConsumedSessions(adminDBPath(*dbPath, *envPath), cfg.ConsumedGrace); err != nil {
+			log.Fatalf("prune consumed: %v", err)
+		}
+		return
+	}
+
+	if *vacuum {
+		if err := vacuumStore(adminDBPath(*dbPath, *envPath)); err != nil {
+			log.Fatalf("vacuum: %v", err)
+		}
+		return
+	}
+
+	if *selfCheck {
+		logger := log.New(os.Stderr, "selfcheck ", log.LstdFlags|log.LUTC)
+		if err := broker.SelfCheck(context.Background(), logger); err != nil {
+			logger.Fatalf("FAILED: %v", err)
+		}
+		logger.Println("all providers ok")
+		return
+	}
+
+	cfg, err := loadConfig(*envPath, envFileChosen())
 	if err != nil {
 		log.Fatalf("load config: %v", err)
 	}
 	if err := cfg.Validate(); err != nil {
 		log.Fatalf("invalid config: %v", err)
 	}
+	for _, w := range cfg.Warnings() {
+		log.Printf("config warning: %s", w)
+	}
 
-	store, err := broker.OpenStore(*dbPath)
+	store, err := broker.OpenStore(storeLocation(*dbPath, cfg))
 	if err != nil {
 		log.Fatalf("open store: %v", err)
 	}
 	defer store.Close()
 
-	logger := log.New(os.Stderr, "broker ", log.LstdFlags|log.LUTC)
-	server := broker.NewServer(cfg, store, logger)
+	slogger := broker.NewLogger(os.Stderr, cfg.LogFormat)
+	logger := slog.NewLogLogger(slogger.Handler(), slog.LevelInfo)
+
+	if cfg.OTelEnabled {
+		shutdown, err := broker.InitTracing(context.Background())
+		if err != nil {
+			logger.Fatalf("init tracing: %v", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				logger.Printf("flush traces: %v", err)
+			}
+		}()
+	}
+
+	server := broker.NewServer(cfg, store, slogger)
 
 	if isCGI() {
 		logger.Println("running in CGI mode")
@@ -44,10 +176,332 @@ func main() {
 		return
 	}
 
+	interval := cfg.ReapInterval
+	if *reapInterval != 0 {
+		if *reapInterval < broker.MinReapInterval {
+			logger.Fatalf("-reap-interval must be at least %s", broker.MinReapInterval)
+		}
+		interval = *reapInterval
+	}
+	// SIGINT or SIGTERM stops the reaper between batches and drains
+	// in-flight requests, so deferred store and trace cleanup still runs.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	live := broker.NewLiveServer(server)
+	go reloadOnHangup(ctx, live, *envPath, logger)
+	reaperDone := make(chan struct{})
+	go func() {
+		defer close(reaperDone)
+		live.RunReaper(ctx, interval)
+	}()
+
+	httpServer := &http.Server{
+		Addr:              *addr,
+		Handler:           live,
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTPReadTimeout,
+		WriteTimeout:      cfg.HTTPWriteTimeout,
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+		ErrorLog:          logger,
+	}
+	// ListenAndServe returns as soon as Shutdown starts, so main waits on
+	// drained before its deferred Close pulls the store from under
+	// exchanges that are still writing their sessions.
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		// A second signal now stops the broker without waiting.
+		stop()
+		logger.Println("shutting down; draining in-flight requests")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(cfg))
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("shutdown: %v; closing remaining connections", err)
+			httpServer.Close()
+		}
+	}()
 	logger.Printf("starting standalone broker on %s", *addr)
-	if err := http.ListenAndServe(*addr, server); err != nil {
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		logger.Fatalf("listen: %v", err)
 	}
+	<-drained
+	<-reaperDone
+	logger.Println("broker stopped")
+}
+
+// defaultShutdownTimeout bounds the drain when HTTP_WRITE_TIMEOUT_SECONDS
+// is 0, which leaves no request deadline to go by.
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout is how long a stopping broker waits for in-flight
+// requests: as long as any one of them may take to write its response.
+func shutdownTimeout(cfg broker.Config) time.Duration {
+	if cfg.HTTPWriteTimeout > 0 {
+		return cfg.HTTPWriteTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// adminDBPath is storeLocation for the commands that inspect the database
+// and exit, which must still work when the configuration does not load.
+func adminDBPath(dbPath, envPath string) string {
+	cfg, err := loadConfig(envPath, envFileChosen())
+	if err != nil {
+		return dbPath
+	}
+	return storeLocation(dbPath, cfg)
+}
+
+// storeLocation picks the database to open: -db or BROKER_DB_PATH from the
+// environment, as dbPath already holds, then BROKER_DB_PATH from broker.env,
+// then the default in dbPath.
+func storeLocation(dbPath string, cfg broker.Config) string {
+	if flagSet("db") || os.Getenv("BROKER_DB_PATH") != "" || cfg.DBPath == "" {
+		return dbPath
+	}
+	return cfg.DBPath
+}
+
+// reloadOnHangup reloads the configuration into live each time the broker
+// receives SIGHUP, until ctx ends. A configuration that fails to load or
+// validate, or that changes BROKER_DB_PATH, is logged and the current one
+// kept. The database, listen address, HTTP server timeouts, LOG_FORMAT,
+// tracing and the reap interval are fixed at start-up and still need a
+// restart.
+func reloadOnHangup(ctx context.Context, live *broker.LiveServer, envPath string, logger *log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := loadConfig(envPath, envFileChosen())
+		if err == nil {
+			err = live.Reload(cfg)
+		}
+		if err != nil {
+			logger.Printf("reload failed, keeping the current configuration: %v", err)
+			continue
+		}
+		for _, w := range cfg.Warnings() {
+			logger.Printf("config warning: %s", w)
+		}
+		logger.Println("configuration reloaded")
+	}
+}
+
+// printSessions lists sessions straight from the database, so it works
+// whether or not a broker is running. Session ids are bearer credentials for
+// polling, so they are shown hashed, as in the broker's logs.
+func printSessions(dbPath string, filter broker.SessionFilter) error {
+	store, err := broker.OpenStoreReadOnly(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	sessions, err := store.ListSessions(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tPROVIDER\tSTATUS\tCREATED\tEXPIRES\tREADY\tCLIENT")
+	for _, sess := range sessions {
+		ready := "-"
+		if sess.ReadyAt.Valid {
+			ready = sess.ReadyAt.Time.UTC().Format(time.RFC3339)
+		}
+		client := "-"
+		if sess.ClientIP.Valid {
+			client = sess.ClientIP.String
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", broker.SessionHash(sess.ID), sess.Provider, sess.Status(now),
+			sess.CreatedAt.UTC().Format(time.RFC3339), sess.ExpiresAt.UTC().Format(time.RFC3339), ready, client)
+	}
+	return tw.Flush()
+}
+
+// printStateDiagnosis explains a callback's "unknown or expired session" by
+// saying whether the state never existed, was already consumed, or expired.
+func printStateDiagnosis(dbPath, provider, state string) error {
+	store, err := broker.OpenStoreReadOnly(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	sess, err := store.GetByState(context.Background(), provider, state)
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Println("No session has this state: it was never issued by this database, or it expired and was reaped.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	fmt.Printf("Session %s (%s), created %s, expires %s\n", broker.SessionHash(sess.ID), sess.Provider,
+		sess.CreatedAt.UTC().Format(time.RFC3339), sess.ExpiresAt.UTC().Format(time.RFC3339))
+	switch {
+	case sess.Consumed:
+		fmt.Printf("Consumed: the callback completed at %s; later callbacks with this state are rejected.\n",
+			sess.ReadyAt.Time.UTC().Format(time.RFC3339))
+	case now.After(sess.ExpiresAt):
+		fmt.Println("Expired before a callback completed; the CLI must start a new flow.")
+	case sess.UsedAt.Valid:
+		fmt.Printf("Exchanging: a callback arrived at %s but the token exchange has not finished.\n",
+			sess.UsedAt.Time.UTC().Format(time.RFC3339))
+	default:
+		fmt.Println("Pending: no callback has arrived yet.")
+	}
+	return nil
+}
+
+// printStats reports refresh outcomes per provider over the last window.
+func printStats(dbPath string, window time.Duration) error {
+	if window <= 0 {
+		return errors.New("-stats-window must be positive")
+	}
+	if window > broker.RefreshOutcomeRetention {
+		return fmt.Errorf("-stats-window %s is longer than the 24h of refresh outcomes the broker keeps", window)
+	}
+	store, err := broker.OpenStoreReadOnly(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	byProvider, err := store.RefreshStatsSince(context.Background(), time.Now().Add(-window))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Refresh outcomes over the last %s:\n", window)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tSUCCESS\tFAILURE\tSUCCESS RATE")
+	names := append([]string(nil), broker.KnownProviders...)
+	var custom []string
+	for name := range byProvider {
+		if strings.HasPrefix(name, "custom:") {
+			custom = append(custom, name)
+		}
+	}
+	sort.Strings(custom)
+	for _, name := range append(names, custom...) {
+		st := byProvider[name]
+		rate := "-"
+		if st.Success+st.Failure > 0 {
+			rate = fmt.Sprintf("%.1f%%", st.SuccessRate()*100)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", name, st.Success, st.Failure, rate)
+	}
+	return tw.Flush()
+}
+
+// printMetricsSnapshot writes the stored counter totals to stdout.
+func printMetricsSnapshot(dbPath, format string) error {
+	store, err := broker.OpenStoreReadOnly(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	samples, err := store.Counters(context.Background())
+	if err != nil {
+		return err
+	}
+	return broker.WriteMetricsSnapshot(os.Stdout, samples, format)
+}
+
+// pruneConsumedSessions deletes sessions whose results went uncollected for
+// longer than grace.
+func pruneConsumedSessions(dbPath string, grace time.Duration) error {
+	store, err := broker.OpenStore(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	n, err := store.DeleteConsumedBefore(context.Background(), time.Now().Add(-grace), 0)
+	if err != nil {
+		return err
+	}
+	log.Printf("pruned %d consumed sessions", n)
+	return nil
+}
+
+// vacuumStore compacts a sqlite database in place.
+func vacuumStore(dbPath string) error {
+	store, err := broker.OpenStore(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	v, ok := store.(broker.Vacuumer)
+	if !ok {
+		return errors.New("only sqlite stores need compacting; postgres reclaims space with autovacuum")
+	}
+	before := v.FileSize()
+	if err := v.Vacuum(context.Background()); err != nil {
+		return err
+	}
+	log.Printf("vacuum complete size_before=%d size_after=%d", before, v.FileSize())
+	return nil
+}
+
+// healthcheckTimeout bounds a -healthcheck request, so a wedged broker
+// fails its probe rather than hanging it.
+const healthcheckTimeout = 5 * time.Second
+
+// checkHealth performs a container probe against a running broker's healthz
+// endpoint, so images need not ship curl. deep asks for the deep check.
+func checkHealth(rawURL string, deep bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", rawURL)
+	}
+	if deep {
+		q := u.Query()
+		q.Set("deep", "1")
+		u.RawQuery = q.Encode()
+	}
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s returned %s: %s", u.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// loadConfig reads the broker configuration. A file named with -env or
+// BROKER_ENV_PATH is always used; otherwise configuration in the process
+// environment is preferred to the default broker.env, which is only read
+// when the environment sets no config keys.
+func loadConfig(envPath string, fileChosen bool) (broker.Config, error) {
+	if !fileChosen && broker.EnvironHasConfig(os.Environ()) {
+		return broker.LoadConfigFromEnviron()
+	}
+	return broker.LoadConfigFromEnvFile(envPath)
+}
+
+// envFileChosen reports whether the operator named a broker.env, with -env
+// or BROKER_ENV_PATH, rather than leaving the default path.
+func envFileChosen() bool {
+	return os.Getenv("BROKER_ENV_PATH") != "" || flagSet("env")
+}
+
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func isCGI() bool {
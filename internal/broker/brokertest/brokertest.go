@@ -0,0 +1,329 @@
+// Package brokertest runs a real broker against fake provider endpoints, so
+// client code can exercise the whole auth start -> callback -> poll cycle,
+// refresh, revocation and Xero disconnection without mocks.
+package brokertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+// Server is a running broker whose providers all talk to Upstream.
+type Server struct {
+	// URL is the broker's base URL; endpoints hang off it, as in
+	// URL + "/v1/auth/start".
+	URL string
+	// Broker is the server handling requests, for inspecting its Config or
+	// its Store, a *broker.MemoryStore.
+	Broker *broker.Server
+	// Upstream is the fake OAuth provider behind every built-in provider.
+	Upstream *Upstream
+}
+
+// Option adjusts the broker configuration before the server starts, for
+// example to enable rate limits or restrict ENABLED_PROVIDERS.
+type Option func(*broker.Config)
+
+// NewServer starts a broker for the duration of tb. Rate limits are off
+// unless an Option turns them on.
+func NewServer(tb testing.TB, opts ...Option) *Server {
+	tb.Helper()
+	up := newUpstream()
+	tb.Cleanup(up.Close)
+
+	hs := httptest.NewUnstartedServer(nil)
+	brokerURL := "http://" + hs.Listener.Addr().String()
+	cfg := config(brokerURL, up.URL)
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	srv := broker.NewServer(cfg, broker.NewMemoryStore(), nil)
+	hs.Config.Handler = srv
+	hs.Start()
+	tb.Cleanup(hs.Close)
+
+	return &Server{URL: hs.URL, Broker: srv, Upstream: up}
+}
+
+func config(brokerURL, upstreamURL string) broker.Config {
+	cfg := broker.DefaultConfig()
+	cfg.RateLimitAuthStart = 0
+	cfg.RateLimitPoll = 0
+	cfg.RateLimitRefresh = 0
+	cfg.RateLimitGlobal = 0
+	cfg.MasterKey = []byte("brokertest-master-key")
+
+	callback := func(provider string) string { return brokerURL + "/v1/callback/" + provider }
+
+	cfg.XeroClientID = "brokertest-xero"
+	cfg.XeroRedirectURL = callback("xero")
+	cfg.XeroAuthURL = upstreamURL + "/authorize"
+	cfg.XeroTokenURL = upstreamURL + "/token"
+	cfg.XeroRevokeURL = upstreamURL + "/revoke"
+	cfg.XeroAPIBaseURL = upstreamURL
+
+	cfg.DeputyClientID = "brokertest-deputy"
+	cfg.DeputyClientSecret = "brokertest-secret"
+	cfg.DeputyRedirectURL = callback("deputy")
+	cfg.DeputyAuthURL = upstreamURL + "/authorize"
+	cfg.DeputyTokenURL = upstreamURL + "/token"
+
+	cfg.QBOClientID = "brokertest-qbo"
+	cfg.QBOClientSecret = "brokertest-secret"
+	cfg.QBORedirectURL = callback("qbo")
+	cfg.QBOAuthURL = upstreamURL + "/authorize"
+	cfg.QBOTokenURL = upstreamURL + "/token"
+	cfg.QBORevokeURL = upstreamURL + "/revoke"
+	cfg.QBOAPIBaseURL = upstreamURL
+
+	cfg.MYOBClientID = "brokertest-myob"
+	cfg.MYOBClientSecret = "brokertest-secret"
+	cfg.MYOBRedirectURL = callback("myob")
+	cfg.MYOBAuthURL = upstreamURL + "/authorize"
+	cfg.MYOBTokenURL = upstreamURL + "/token"
+	cfg.MYOBAPIBaseURL = upstreamURL + "/accountright"
+
+	cfg.FreshBooksClientID = "brokertest-freshbooks"
+	cfg.FreshBooksClientSecret = "brokertest-secret"
+	cfg.FreshBooksRedirectURL = callback("freshbooks")
+	cfg.FreshBooksAuthURL = upstreamURL + "/authorize"
+	cfg.FreshBooksTokenURL = upstreamURL + "/token"
+	cfg.FreshBooksRevokeURL = upstreamURL + "/revoke"
+	cfg.FreshBooksAPIBaseURL = upstreamURL
+	return cfg
+}
+
+// Authorize plays the user's part of a flow started with /v1/auth/start: it
+// consents at authURL and follows the provider redirect to the callback, as
+// a browser would. The redirect target comes from authURL, so loopback
+// flows are delivered to the caller's listener.
+func (s *Server) Authorize(authURL string) error {
+	return s.redirect(authURL, url.Values{
+		"code":    {"brokertest-code"},
+		"realmId": {"brokertest-realm"},
+	})
+}
+
+// Deny is like Authorize but the user declines consent, so the callback
+// carries error=access_denied.
+func (s *Server) Deny(authURL string) error {
+	return s.redirect(authURL, url.Values{"error": {"access_denied"}})
+}
+
+func (s *Server) redirect(authURL string, params url.Values) error {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return fmt.Errorf("parse auth url: %w", err)
+	}
+	q := u.Query()
+	state, redirectURI := q.Get("state"), q.Get("redirect_uri")
+	if state == "" || redirectURI == "" {
+		return fmt.Errorf("auth url lacks state or redirect_uri: %s", authURL)
+	}
+	params.Set("state", state)
+	sep := "?"
+	if strings.Contains(redirectURI, "?") {
+		sep = "&"
+	}
+	// A session started with a return_url is redirected to it, often a
+	// custom scheme, which the browser would hand to another app.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(redirectURI + sep + params.Encode())
+	if err != nil {
+		return fmt.Errorf("callback: %w", err)
+	}
+	defer resp.Body.Close()
+	if params.Get("error") == "" && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusFound {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("callback returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Upstream is a fake OAuth provider. Its token endpoint issues distinct,
+// rotating tokens; its hooks make token and revocation requests fail until
+// Reset.
+type Upstream struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	issued      int
+	failStatus  int
+	failBody    string
+	rateLimited bool
+	retryAfter  time.Duration
+	revoked     []string
+	removed     []string
+}
+
+func newUpstream() *Upstream {
+	u := &Upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serveHTTP))
+	return u
+}
+
+// FailTokens makes token, refresh and revocation requests answer status
+// with body, as a provider rejecting a grant or having an outage would.
+func (u *Upstream) FailTokens(status int, body string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failStatus, u.failBody = status, body
+}
+
+// RateLimit makes token, refresh and revocation requests answer 429 with
+// the given Retry-After. Xero, MYOB, FreshBooks and custom providers pass
+// this on as the broker's own 429; Deputy and QBO report a 502.
+func (u *Upstream) RateLimit(retryAfter time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rateLimited, u.retryAfter = true, retryAfter
+}
+
+// Reset clears any failure set with FailTokens or RateLimit.
+func (u *Upstream) Reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failStatus, u.failBody = 0, ""
+	u.rateLimited, u.retryAfter = false, 0
+}
+
+// TokensIssued reports how many token responses have been sent, counting
+// exchanges and refreshes.
+func (u *Upstream) TokensIssued() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.issued
+}
+
+// Revoked lists the tokens revoked so far, oldest first.
+func (u *Upstream) Revoked() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.revoked...)
+}
+
+// Disconnected lists the Xero connection ids deleted so far, oldest first.
+func (u *Upstream) Disconnected() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.removed...)
+}
+
+// failure writes the configured failure, if any, and reports whether it did.
+func (u *Upstream) failure(w http.ResponseWriter) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case u.rateLimited:
+		if u.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(u.retryAfter.Seconds())))
+		}
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate_limited"})
+		return true
+	case u.failStatus != 0:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(u.failStatus)
+		io.WriteString(w, u.failBody)
+		return true
+	}
+	return false
+}
+
+func (u *Upstream) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/token":
+		if u.failure(w) {
+			return
+		}
+		fields := requestFields(r)
+		if fields["code"] == "" && fields["refresh_token"] == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		u.mu.Lock()
+		u.issued++
+		n := u.issued
+		u.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token":  fmt.Sprintf("brokertest-access-%d", n),
+			"refresh_token": fmt.Sprintf("brokertest-refresh-%d", n),
+			"expires_in":    1800,
+			"token_type":    "Bearer",
+			"endpoint":      "https://brokertest.example.com",
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/revoke":
+		if u.failure(w) {
+			return
+		}
+		token := requestFields(r)["token"]
+		u.mu.Lock()
+		u.revoked = append(u.revoked, token)
+		u.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && r.URL.Path == "/connections":
+		writeJSON(w, http.StatusOK, []broker.XeroTenant{{
+			ID:         "brokertest-connection",
+			TenantID:   "brokertest-tenant",
+			TenantType: "ORGANISATION",
+			TenantName: "Broker Test Ltd",
+		}})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/connections/"):
+		if u.failure(w) {
+			return
+		}
+		u.mu.Lock()
+		u.removed = append(u.removed, strings.TrimPrefix(r.URL.Path, "/connections/"))
+		u.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Path == "/accountright/":
+		writeJSON(w, http.StatusOK, []broker.MYOBCompanyFile{{
+			ID:   "brokertest-file",
+			Name: "Broker Test Pty Ltd",
+			URI:  "https://brokertest.example.com/accountright/brokertest-file",
+		}})
+	case r.Method == http.MethodGet && r.URL.Path == "/auth/api/v1/users/me":
+		writeJSON(w, http.StatusOK, map[string]any{
+			"response": map[string]any{
+				"business_memberships": []map[string]any{{
+					"business": map[string]any{"id": 1, "account_id": "brokertest-account", "name": "Broker Test Inc"},
+				}},
+			},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// requestFields reads a form or JSON request body into a flat map.
+func requestFields(r *http.Request) map[string]string {
+	fields := map[string]string{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		_ = json.NewDecoder(r.Body).Decode(&fields)
+		return fields
+	}
+	if err := r.ParseForm(); err == nil {
+		for k := range r.PostForm {
+			fields[k] = r.PostForm.Get(k)
+		}
+	}
+	return fields
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,150 @@
+package broker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+func TestCallbackReplayRejected(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	session, authURL := startFlow(t, srv, "xero")
+	if err := srv.Authorize(authURL); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Authorize(authURL); err == nil {
+		t.Fatal("replayed callback succeeded")
+	}
+	if got := srv.Upstream.TokensIssued(); got != 1 {
+		t.Fatalf("provider issued %d tokens, want 1", got)
+	}
+	if code := getStatus(t, srv.URL+"/v1/auth/poll/"+session); code != http.StatusOK {
+		t.Fatalf("poll after replay returned %d, want 200", code)
+	}
+}
+
+func TestCallbackStateSurvivesFailedExchange(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	session, authURL := startFlow(t, srv, "xero")
+
+	srv.Upstream.FailTokens(http.StatusBadGateway, `{"error":"temporarily_unavailable"}`)
+	if err := srv.Authorize(authURL); err == nil {
+		t.Fatal("callback succeeded while the provider was failing")
+	}
+	srv.Upstream.Reset()
+	if err := srv.Authorize(authURL); err != nil {
+		t.Fatalf("callback after a failed exchange: %v", err)
+	}
+	if code := getStatus(t, srv.URL+"/v1/auth/poll/"+session); code != http.StatusOK {
+		t.Fatalf("poll returned %d, want 200", code)
+	}
+}
+
+func TestCallbackStateSurvivesBusyBroker(t *testing.T) {
+	srv := brokertest.NewServer(t, func(c *broker.Config) {
+		c.ExchangeConcurrency = 1
+		c.ExchangeWait = 20 * time.Millisecond
+	})
+	_, authURL := startFlow(t, srv, "xero")
+
+	slot, err := srv.Broker.Store.AcquireExchangeSlot(context.Background(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Authorize(authURL); err == nil {
+		t.Fatal("callback succeeded with every exchange slot taken")
+	}
+	if err := srv.Broker.Store.ReleaseExchangeSlot(context.Background(), slot); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Authorize(authURL); err != nil {
+		t.Fatalf("callback once a slot was free: %v", err)
+	}
+}
+
+func TestLoopbackExchangeReplay(t *testing.T) {
+	srv := brokertest.NewServer(t, func(c *broker.Config) {
+		c.LoopbackProviders = []string{"xero"}
+	})
+	var started struct {
+		AuthURL string `json:"auth_url"`
+		Session string `json:"session"`
+	}
+	start := map[string]string{"provider": "xero", "profile": "test", "redirect_uri": "http://127.0.0.1:9/callback"}
+	if code := postJSON(t, srv.URL+"/v1/auth/start", start, &started); code != http.StatusOK {
+		t.Fatalf("auth start returned %d", code)
+	}
+	u, err := url.Parse(started.AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := map[string]string{"session": started.Session, "state": u.Query().Get("state"), "code": "brokertest-code"}
+
+	srv.Upstream.FailTokens(http.StatusInternalServerError, `{"error":"server_error"}`)
+	if code := postJSON(t, srv.URL+"/v1/auth/exchange", exchange, nil); code != http.StatusBadGateway {
+		t.Fatalf("exchange with a failing provider returned %d, want 502", code)
+	}
+	srv.Upstream.Reset()
+	if code := postJSON(t, srv.URL+"/v1/auth/exchange", exchange, nil); code != http.StatusOK {
+		t.Fatalf("exchange after a provider failure returned %d, want 200", code)
+	}
+	if code := postJSON(t, srv.URL+"/v1/auth/exchange", exchange, nil); code == http.StatusOK {
+		t.Fatal("replayed exchange succeeded")
+	}
+	if got := srv.Upstream.TokensIssued(); got != 1 {
+		t.Fatalf("provider issued %d tokens, want 1", got)
+	}
+}
+
+// untouchableStore has no methods of its own: any store call panics on the
+// nil interface.
+type untouchableStore struct{ broker.SessionStore }
+
+func TestCallbackPaths(t *testing.T) {
+	srv := brokertest.NewServer(t, func(c *broker.Config) {
+		c.EnabledProviders = []string{"xero", "qbo"}
+	})
+	live := srv.Broker.Store
+
+	tests := []struct {
+		name  string
+		path  string
+		found bool
+	}{
+		{"valid", "/v1/callback/xero", true},
+		{"valid under a prefix", "/broker/v1/callback/qbo", true},
+		{"unknown provider", "/v1/callback/sage", false},
+		{"disabled provider", "/v1/callback/deputy", false},
+		{"trailing slash", "/v1/callback/xero/", false},
+		{"empty provider", "/v1/callback/", false},
+		{"extra segment", "/v1/callback/xero/extra", false},
+		{"doubled slash", "/v1/callback//xero", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv.Broker.Store = live
+			if !tt.found {
+				srv.Broker.Store = untouchableStore{}
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("store touched before the provider was rejected: %v", r)
+				}
+			}()
+			rec := httptest.NewRecorder()
+			srv.Broker.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path+"?code=abc&state=unknown", nil))
+			switch {
+			case tt.found && rec.Code == http.StatusNotFound:
+				t.Fatalf("%s returned 404", tt.path)
+			case !tt.found && rec.Code != http.StatusNotFound:
+				t.Fatalf("%s returned %d, want 404", tt.path, rec.Code)
+			}
+		})
+	}
+}
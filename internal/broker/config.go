@@ -2,10 +2,15 @@ package broker
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,7 +25,13 @@ type Config struct {
 	XeroEnvironment  string // "production" (default)
 	XeroAuthURL      string // override OAuth authorization URL
 	XeroTokenURL     string // override OAuth token URL
+	XeroRevokeURL    string // override token revocation URL
 	XeroAPIBaseURL   string // override API base URL
+	XeroJWKSURL      string // override id_token signing keys URL
+	XeroIssuer       string // override expected id_token issuer
+	XeroExtraAuth    url.Values
+	XeroClientCert   string // path to a PEM client certificate for mutual TLS
+	XeroClientKey    string // path to the PEM private key for XeroClientCert
 
 	DeputyClientID     string
 	DeputyClientSecret string
@@ -29,6 +40,10 @@ type Config struct {
 	DeputyEnvironment  string // "production" (default)
 	DeputyAuthURL      string // override OAuth authorization URL
 	DeputyTokenURL     string // override OAuth token URL
+	DeputyUsePKCE      bool   // send an S256 PKCE challenge; the secret becomes optional
+	DeputyExtraAuth    url.Values
+	DeputyClientCert   string // path to a PEM client certificate for mutual TLS
+	DeputyClientKey    string // path to the PEM private key for DeputyClientCert
 
 	QBOClientID     string
 	QBOClientSecret string
@@ -37,19 +52,213 @@ type Config struct {
 	QBOEnvironment  string // "sandbox" or "production" (default: production)
 	QBOAuthURL      string // override OAuth authorization URL
 	QBOTokenURL     string // override OAuth token URL
+	QBOUsePKCE      bool   // send an S256 PKCE challenge; the secret becomes optional
+	QBORevokeURL    string // override token revocation URL
 	QBOAPIBaseURL   string // override API base URL
+	QBOJWKSURL      string // override id_token signing keys URL
+	QBOIssuer       string // override expected id_token issuer
+	QBOExtraAuth    url.Values
+	QBOClientCert   string // path to a PEM client certificate for mutual TLS
+	QBOClientKey    string // path to the PEM private key for QBOClientCert
+
+	MYOBClientID     string // also sent as the x-myobapi-key header
+	MYOBClientSecret string
+	MYOBRedirectURL  string
+	MYOBScopes       []string
+	MYOBAuthURL      string // override OAuth authorization URL
+	MYOBTokenURL     string // override OAuth token URL
+	MYOBAPIBaseURL   string // override API base URL
+	MYOBExtraAuth    url.Values
+	MYOBClientCert   string // path to a PEM client certificate for mutual TLS
+	MYOBClientKey    string // path to the PEM private key for MYOBClientCert
+
+	FreshBooksClientID     string
+	FreshBooksClientSecret string
+	FreshBooksRedirectURL  string
+	FreshBooksScopes       []string
+	FreshBooksAuthURL      string // override OAuth authorization URL
+	FreshBooksTokenURL     string // override OAuth token URL
+	FreshBooksRevokeURL    string // override token revocation URL
+	FreshBooksAPIBaseURL   string // override API base URL
+	FreshBooksExtraAuth    url.Values
+	FreshBooksClientCert   string // path to a PEM client certificate for mutual TLS
+	FreshBooksClientKey    string // path to the PEM private key for FreshBooksClientCert
+
+	// CustomProviders are generic OAuth2 providers defined by
+	// CUSTOM_<NAME>_* keys, keyed by lower-case name and served as
+	// "custom:<name>".
+	CustomProviders map[string]CustomProvider
 
 	MasterKey []byte
 
+	// APIKey, when set, must accompany every token refresh, and every auth
+	// start too with APIKeyAuthStart, so that an intercepted refresh token
+	// cannot be redeemed through the broker on its own.
+	APIKey          []byte
+	APIKeyAuthStart bool
+
+	// OTelEnabled turns on OpenTelemetry tracing; the exporter itself is
+	// configured through the standard OTEL_* environment variables.
+	OTelEnabled bool
+
+	// MetricsEnabled serves GET /metrics under CGI; standalone brokers
+	// always serve it.
+	MetricsEnabled bool
+
+	// PersistMetrics also counts requests in the store, so totals survive
+	// CGI processes and can be read with -export-metrics-snapshot.
+	PersistMetrics bool
+
+	// LogFormat is "text" (slog key=value lines) or "json".
+	LogFormat string
+
+	// DBPath is BROKER_DB_PATH: the SQLite file or postgres:// URL holding
+	// the sessions. The -db flag takes precedence. The store is opened once,
+	// so a reload that changes it is refused.
+	DBPath string
+
+	// EnvOverride lets a process environment variable override the
+	// broker.env key of the same name. BROKER_ENV_OVERRIDE=false, in either
+	// place, turns it off.
+	EnvOverride bool
+
+	// SigningKey, when set, signs every token envelope the broker returns.
+	SigningKey ed25519.PrivateKey
+	// VerificationKeys are further public keys published alongside
+	// SigningKey's, so that clients keep accepting envelopes across a key
+	// rotation. They never sign.
+	VerificationKeys []ed25519.PublicKey
+
 	SessionTTL  time.Duration
 	PollTimeout time.Duration
 
+	// ProviderTimeout bounds each upstream token, refresh and connections call.
+	ProviderTimeout time.Duration
+
+	// Standalone HTTP server timeouts. WriteTimeout must exceed PollTimeout.
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+
+	// ConsumedGrace is how long a completed-but-uncollected session result is
+	// kept before the reaper discards it.
+	ConsumedGrace time.Duration
+
+	// ReapInterval is how often the standalone reaper runs; ReapBatchSize
+	// bounds each DELETE so a large backlog does not hold the database lock.
+	ReapInterval  time.Duration
+	ReapBatchSize int
+
+	// VacuumInterval is how often the reaper compacts the database; zero
+	// disables scheduled compaction.
+	VacuumInterval time.Duration
+
 	RateLimitAuthStart       int
 	RateLimitAuthStartWindow time.Duration
 	RateLimitPoll            int
 	RateLimitPollWindow      time.Duration
 	RateLimitRefresh         int
 	RateLimitRefreshWindow   time.Duration
+	// RateLimitGlobal caps calls for one provider from all clients
+	// together, on the endpoints that reach it, to protect the provider
+	// from aggregate abuse. The limits above are per client.
+	RateLimitGlobal       int
+	RateLimitGlobalWindow time.Duration
+
+	// RefreshMinInterval is the shortest time allowed between two refreshes
+	// of the same refresh token; a repeat inside it is answered with the
+	// earlier result, or refused. Zero disables the check.
+	RefreshMinInterval time.Duration
+
+	// ExchangeConcurrency caps simultaneous upstream token exchanges across
+	// all broker processes; zero disables the cap.
+	ExchangeConcurrency int
+	ExchangeWait        time.Duration
+
+	// CallbackMaxFailures is how many failed callbacks a session may see
+	// before it is deleted as locked; zero disables the lockout.
+	CallbackMaxFailures int
+
+	// TrustedProxyHeader names a header (e.g. X-Real-IP) carrying the client
+	// address. It is only honoured for requests from TrustedProxyCIDRs.
+	TrustedProxyHeader string
+	TrustedProxyCIDRs  []*net.IPNet
+	// TrustedProxyHops is how many proxies in front of the broker append to
+	// X-Forwarded-For. The header is only read for requests from
+	// TrustedProxyCIDRs. Zero, the default, ignores it, as a client could
+	// otherwise pick its own address.
+	TrustedProxyHops int
+
+	// EnabledProviders restricts the broker to a subset of KnownProviders;
+	// nil enables all of them.
+	EnabledProviders []string
+
+	// SuccessMessage replaces the text of the page shown after a completed
+	// callback; ProviderSuccessMessages overrides it per provider. Both may
+	// use {org} and {provider}.
+	SuccessMessage          string
+	ProviderSuccessMessages map[string]string
+
+	// SuccessTemplatePath and FailureTemplatePath name html/template files
+	// that replace the built-in callback pages, for deployments with their
+	// own branding. Empty uses the built-in pages.
+	SuccessTemplatePath string
+	FailureTemplatePath string
+
+	// SuccessPostMessageOrigin is the origin of a web app that opens the
+	// flow in a popup. When set, the success page posts a completion message
+	// to window.opener at that origin; empty sends none.
+	SuccessPostMessageOrigin string
+
+	// CORSAllowedOrigins lists the web origins whose browser scripts may
+	// call the broker's API. Empty, the default, sends no CORS headers.
+	CORSAllowedOrigins []string
+
+	// DeniedScopes maps a provider name to scopes its <PROVIDER>_SCOPES must
+	// never include, as a guardrail against widening access by accident.
+	DeniedScopes map[string][]string
+
+	// LoopbackProviders lists providers whose registered redirect URIs
+	// accept http://127.0.0.1 callbacks, enabling the CLI's local callback
+	// flow for them. Empty disables it.
+	LoopbackProviders []string
+
+	// ReturnURLAllowlist lists where a completed callback may send the
+	// browser instead of showing the success page: "scheme:" entries allow
+	// any URL with that scheme, "scheme://host" entries one host. Empty
+	// disables return_url.
+	ReturnURLAllowlist []string
+}
+
+// CustomProvider defines a standard OAuth2 authorization-code provider from
+// configuration alone.
+type CustomProvider struct {
+	ClientID     string
+	ClientSecret string // may be empty for a public client using PKCE
+	RedirectURL  string
+	Scopes       []string
+	AuthURL      string
+	TokenURL     string
+	RevokeURL    string // optional RFC 7009 endpoint
+	PKCE         bool
+	ClientAuth   string // "basic" (default) or "body" for form-field credentials
+	ExtraAuth    url.Values
+}
+
+// KnownProviders lists every built-in provider the broker can serve.
+var KnownProviders = []string{"xero", "deputy", "qbo", "myob", "freshbooks"}
+
+// ProviderNames lists the built-in providers followed by the configured
+// custom ones, in a stable order.
+func (c Config) ProviderNames() []string {
+	names := append([]string(nil), KnownProviders...)
+	custom := make([]string, 0, len(c.CustomProviders))
+	for name := range c.CustomProviders {
+		custom = append(custom, customProviderPrefix+name)
+	}
+	sort.Strings(custom)
+	return append(names, custom...)
 }
 
 // DefaultConfig returns a Config populated with safe defaults.
@@ -57,24 +266,173 @@ func DefaultConfig() Config {
 	return Config{
 		SessionTTL:               time.Minute * 10,
 		PollTimeout:              time.Second * 5,
+		ProviderTimeout:          time.Second * 30,
+		ConsumedGrace:            time.Minute * 5,
+		ReapInterval:             time.Minute,
+		ReapBatchSize:            500,
+		HTTPReadHeaderTimeout:    time.Second * 10,
+		HTTPReadTimeout:          time.Second * 30,
+		HTTPWriteTimeout:         time.Second * 60,
+		HTTPIdleTimeout:          time.Second * 120,
 		RateLimitAuthStart:       10,
 		RateLimitAuthStartWindow: time.Minute,
 		RateLimitPoll:            120,
 		RateLimitPollWindow:      time.Minute,
 		RateLimitRefresh:         60,
 		RateLimitRefreshWindow:   time.Minute,
+		RateLimitGlobal:          300,
+		RateLimitGlobalWindow:    time.Minute,
+		ExchangeConcurrency:      8,
+		ExchangeWait:             time.Second * 15,
+		CallbackMaxFailures:      5,
+		EnvOverride:              true,
 	}
 }
 
-// LoadConfigFromEnvFile parses a key=value file such as conf/broker.env.
+// LoadConfigFromEnvFile parses a key=value file such as conf/broker.env,
+// then applies any process environment variables named after config keys
+// unless EnvOverride is off.
 func LoadConfigFromEnvFile(path string) (Config, error) {
 	cfg := DefaultConfig()
+	entries, err := readEnvFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	for _, e := range entries {
+		if _, err := setConfigKey(&cfg, e.Key, e.Value); err != nil {
+			return cfg, err
+		}
+	}
+	if val, ok := os.LookupEnv("BROKER_ENV_OVERRIDE"); ok {
+		if _, err := setConfigKey(&cfg, "BROKER_ENV_OVERRIDE", val); err != nil {
+			return cfg, fmt.Errorf("environment: %w", err)
+		}
+	}
+	if cfg.EnvOverride {
+		if err := applyEnvOverrides(&cfg, os.Environ()); err != nil {
+			return cfg, err
+		}
+	}
+	return finishConfig(cfg)
+}
+
+// LoadConfigFromEnviron builds the configuration from process environment
+// variables alone, named as the broker.env keys are, for deployments that
+// inject configuration rather than mount a file.
+func LoadConfigFromEnviron() (Config, error) {
+	cfg := DefaultConfig()
+	if err := applyEnvOverrides(&cfg, os.Environ()); err != nil {
+		return cfg, err
+	}
+	return finishConfig(cfg)
+}
+
+// EnvironHasConfig reports whether environ, as from os.Environ, sets any
+// configuration key, so the broker can run without a broker.env.
+// BROKER_DB_PATH does not count: deployments set it beside a broker.env
+// long before it was also a configuration key.
+func EnvironHasConfig(environ []string) bool {
+	scratch := DefaultConfig()
+	for _, e := range environConfigEntries(environ) {
+		if e.Key == "BROKER_DB_PATH" {
+			continue
+		}
+		if known, _ := setConfigKey(&scratch, e.Key, e.Value); known {
+			return true
+		}
+	}
+	return false
+}
+
+// finishConfig fills in provider defaults and checks the session timings,
+// the steps shared by every configuration source.
+func finishConfig(cfg Config) (Config, error) {
+	applyProviderDefaults(&cfg)
+
+	if err := cfg.validateSessionTimings(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+const (
+	// MinSessionTTL leaves time for a user to sign in and consent.
+	MinSessionTTL = time.Minute
+	// largeSessionTTL is where Warnings starts flagging the TTL.
+	largeSessionTTL = time.Hour
+)
+
+// validateSessionTimings rejects session settings that make flows impossible
+// to complete.
+func (c Config) validateSessionTimings() error {
+	if c.SessionTTL < MinSessionTTL {
+		return fmt.Errorf("SESSION_TTL_SECONDS (%s) must be at least %s", c.SessionTTL, MinSessionTTL)
+	}
+	if c.PollTimeout >= c.SessionTTL {
+		return fmt.Errorf("POLL_TIMEOUT_SECONDS (%s) must be less than SESSION_TTL_SECONDS (%s)", c.PollTimeout, c.SessionTTL)
+	}
+	return nil
+}
+
+// Warnings lists settings that are allowed but probably unintended.
+func (c Config) Warnings() []string {
+	var out []string
+	if len(c.MasterKey) == 0 {
+		out = append(out, "BROKER_MASTER_KEY is not set; completed session tokens are stored unencrypted in the database")
+	}
+	if c.SessionTTL > largeSessionTTL {
+		out = append(out, fmt.Sprintf("SESSION_TTL_SECONDS (%s) is over %s; abandoned sessions will accumulate in the database", c.SessionTTL, largeSessionTTL))
+	}
+	return out
+}
+
+// applyEnvOverrides applies the config keys found in environ, a list of
+// KEY=value pairs as from os.Environ. Empty values are ignored, so an
+// exported but blank variable does not wipe out a secret. Under CGI,
+// HTTP_* variables are skipped: the web server derives them from request
+// headers, so a client could otherwise set HTTP_READ_TIMEOUT_SECONDS and
+// the like.
+func applyEnvOverrides(cfg *Config, environ []string) error {
+	for _, e := range environConfigEntries(environ) {
+		if _, err := setConfigKey(cfg, e.Key, e.Value); err != nil {
+			return fmt.Errorf("environment: %w", err)
+		}
+	}
+	return nil
+}
+
+// environConfigEntries returns the pairs in environ that may set config
+// keys, sorted by key, with the exclusions applyEnvOverrides describes.
+func environConfigEntries(environ []string) []envEntry {
+	underCGI := os.Getenv("GATEWAY_INTERFACE") != ""
+	sort.Strings(environ)
+	var entries []envEntry
+	for _, kv := range environ {
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok || val == "" || key == "BROKER_ENV_OVERRIDE" || (underCGI && strings.HasPrefix(key, "HTTP_")) {
+			continue
+		}
+		entries = append(entries, envEntry{Key: key, Value: val})
+	}
+	return entries
+}
+
+type envEntry struct {
+	Key   string
+	Value string
+}
+
+// readEnvFile reads the key=value pairs from a broker.env style file in order,
+// skipping blank lines and comments and stripping surrounding double quotes.
+func readEnvFile(path string) ([]envEntry, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return cfg, fmt.Errorf("open env file: %w", err)
+		return nil, fmt.Errorf("open env file: %w", err)
 	}
 	defer file.Close()
 
+	var entries []envEntry
 	scanner := bufio.NewScanner(file)
 	lineNo := 0
 	for scanner.Scan() {
@@ -85,137 +443,626 @@ func LoadConfigFromEnvFile(path string) (Config, error) {
 		}
 		idx := strings.IndexRune(line, '=')
 		if idx == -1 {
-			return cfg, fmt.Errorf("invalid line %d in %s", lineNo, filepath.Base(path))
+			return nil, fmt.Errorf("invalid line %d in %s", lineNo, filepath.Base(path))
 		}
 		key := strings.TrimSpace(line[:idx])
 		val := strings.TrimSpace(line[idx+1:])
 		if strings.HasPrefix(val, "\"") && strings.HasSuffix(val, "\"") && len(val) >= 2 {
 			val = strings.Trim(val, "\"")
 		}
-		switch key {
-		case "XERO_CLIENT_ID":
-			cfg.XeroClientID = val
-		case "XERO_CLIENT_SECRET":
-			cfg.XeroClientSecret = val
-		case "XERO_REDIRECT":
-			cfg.XeroRedirectURL = val
-		case "XERO_SCOPES":
-			cfg.XeroScopes = parseScopes(val)
-		case "XERO_ENVIRONMENT":
-			cfg.XeroEnvironment = val
-		case "XERO_AUTH_URL":
-			cfg.XeroAuthURL = val
-		case "XERO_TOKEN_URL":
-			cfg.XeroTokenURL = val
-		case "XERO_API_BASE_URL":
-			cfg.XeroAPIBaseURL = val
-		case "DEPUTY_CLIENT_ID":
-			cfg.DeputyClientID = val
-		case "DEPUTY_CLIENT_SECRET":
-			cfg.DeputyClientSecret = val
-		case "DEPUTY_REDIRECT":
-			cfg.DeputyRedirectURL = val
-		case "DEPUTY_SCOPES":
-			cfg.DeputyScopes = parseScopes(val)
-		case "DEPUTY_ENVIRONMENT":
-			cfg.DeputyEnvironment = val
-		case "DEPUTY_AUTH_URL":
-			cfg.DeputyAuthURL = val
-		case "DEPUTY_TOKEN_URL":
-			cfg.DeputyTokenURL = val
-		case "QBO_CLIENT_ID":
-			cfg.QBOClientID = val
-		case "QBO_CLIENT_SECRET":
-			cfg.QBOClientSecret = val
-		case "QBO_REDIRECT":
-			cfg.QBORedirectURL = val
-		case "QBO_SCOPES":
-			cfg.QBOScopes = parseScopes(val)
-		case "QBO_ENVIRONMENT":
-			cfg.QBOEnvironment = val
-		case "QBO_AUTH_URL":
-			cfg.QBOAuthURL = val
-		case "QBO_TOKEN_URL":
-			cfg.QBOTokenURL = val
-		case "QBO_API_BASE_URL":
-			cfg.QBOAPIBaseURL = val
-		case "BROKER_MASTER_KEY":
-			if val != "" {
-				cfg.MasterKey = []byte(val)
+		entries = append(entries, envEntry{Key: key, Value: val})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan env file: %w", err)
+	}
+	return entries, nil
+}
+
+// setConfigKey applies a single configuration key. It reports whether the key
+// is recognised; unknown keys are ignored by the env file loader. A secret
+// key may instead be given as KEY_FILE, naming a file that holds its value.
+func setConfigKey(cfg *Config, key, val string) (bool, error) {
+	if base, ok := strings.CutSuffix(key, "_FILE"); ok && isSecretKey(base) {
+		secret, err := readSecretFile(val)
+		if err != nil {
+			return true, fmt.Errorf("%s: %w", key, err)
+		}
+		return setConfigKey(cfg, base, secret)
+	}
+	switch key {
+	case "BROKER_DB_PATH":
+		cfg.DBPath = val
+	case "XERO_CLIENT_ID":
+		cfg.XeroClientID = val
+	case "XERO_CLIENT_SECRET":
+		cfg.XeroClientSecret = val
+	case "XERO_CLIENT_CERT":
+		cfg.XeroClientCert = val
+	case "XERO_CLIENT_KEY":
+		cfg.XeroClientKey = val
+	case "XERO_REDIRECT":
+		cfg.XeroRedirectURL = val
+	case "XERO_SCOPES":
+		cfg.XeroScopes = parseScopes(val)
+	case "XERO_ENVIRONMENT":
+		cfg.XeroEnvironment = val
+	case "XERO_AUTH_URL":
+		cfg.XeroAuthURL = val
+	case "XERO_TOKEN_URL":
+		cfg.XeroTokenURL = val
+	case "XERO_REVOKE_URL":
+		cfg.XeroRevokeURL = val
+	case "XERO_API_BASE_URL":
+		cfg.XeroAPIBaseURL = val
+	case "XERO_JWKS_URL":
+		cfg.XeroJWKSURL = val
+	case "XERO_ISSUER":
+		cfg.XeroIssuer = val
+	case "XERO_EXTRA_AUTH_PARAMS":
+		extra, err := parseExtraAuthParams(val)
+		if err != nil {
+			return true, fmt.Errorf("XERO_EXTRA_AUTH_PARAMS: %w", err)
+		}
+		cfg.XeroExtraAuth = extra
+	case "DEPUTY_CLIENT_ID":
+		cfg.DeputyClientID = val
+	case "DEPUTY_CLIENT_SECRET":
+		cfg.DeputyClientSecret = val
+	case "DEPUTY_CLIENT_CERT":
+		cfg.DeputyClientCert = val
+	case "DEPUTY_CLIENT_KEY":
+		cfg.DeputyClientKey = val
+	case "DEPUTY_REDIRECT":
+		cfg.DeputyRedirectURL = val
+	case "DEPUTY_SCOPES":
+		cfg.DeputyScopes = parseScopes(val)
+	case "DEPUTY_ENVIRONMENT":
+		cfg.DeputyEnvironment = val
+	case "DEPUTY_AUTH_URL":
+		cfg.DeputyAuthURL = val
+	case "DEPUTY_TOKEN_URL":
+		cfg.DeputyTokenURL = val
+	case "DEPUTY_USE_PKCE":
+		if val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return true, fmt.Errorf("DEPUTY_USE_PKCE: %w", err)
 			}
-		case "SESSION_TTL_SECONDS":
-			if val != "" {
-				d, err := parseSeconds(val)
-				if err != nil {
-					return cfg, fmt.Errorf("SESSION_TTL_SECONDS: %w", err)
-				}
-				cfg.SessionTTL = d
+			cfg.DeputyUsePKCE = b
+		}
+	case "DEPUTY_EXTRA_AUTH_PARAMS":
+		extra, err := parseExtraAuthParams(val)
+		if err != nil {
+			return true, fmt.Errorf("DEPUTY_EXTRA_AUTH_PARAMS: %w", err)
+		}
+		cfg.DeputyExtraAuth = extra
+	case "QBO_CLIENT_ID":
+		cfg.QBOClientID = val
+	case "QBO_CLIENT_SECRET":
+		cfg.QBOClientSecret = val
+	case "QBO_CLIENT_CERT":
+		cfg.QBOClientCert = val
+	case "QBO_CLIENT_KEY":
+		cfg.QBOClientKey = val
+	case "QBO_REDIRECT":
+		cfg.QBORedirectURL = val
+	case "QBO_SCOPES":
+		cfg.QBOScopes = parseScopes(val)
+	case "QBO_ENVIRONMENT":
+		cfg.QBOEnvironment = val
+	case "QBO_AUTH_URL":
+		cfg.QBOAuthURL = val
+	case "QBO_TOKEN_URL":
+		cfg.QBOTokenURL = val
+	case "QBO_USE_PKCE":
+		if val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return true, fmt.Errorf("QBO_USE_PKCE: %w", err)
 			}
-		case "POLL_TIMEOUT_SECONDS":
-			if val != "" {
-				d, err := parseSeconds(val)
-				if err != nil {
-					return cfg, fmt.Errorf("POLL_TIMEOUT_SECONDS: %w", err)
-				}
-				cfg.PollTimeout = d
+			cfg.QBOUsePKCE = b
+		}
+	case "QBO_REVOKE_URL":
+		cfg.QBORevokeURL = val
+	case "QBO_API_BASE_URL":
+		cfg.QBOAPIBaseURL = val
+	case "QBO_JWKS_URL":
+		cfg.QBOJWKSURL = val
+	case "QBO_ISSUER":
+		cfg.QBOIssuer = val
+	case "QBO_EXTRA_AUTH_PARAMS":
+		extra, err := parseExtraAuthParams(val)
+		if err != nil {
+			return true, fmt.Errorf("QBO_EXTRA_AUTH_PARAMS: %w", err)
+		}
+		cfg.QBOExtraAuth = extra
+	case "MYOB_CLIENT_ID":
+		cfg.MYOBClientID = val
+	case "MYOB_CLIENT_SECRET":
+		cfg.MYOBClientSecret = val
+	case "MYOB_CLIENT_CERT":
+		cfg.MYOBClientCert = val
+	case "MYOB_CLIENT_KEY":
+		cfg.MYOBClientKey = val
+	case "MYOB_REDIRECT":
+		cfg.MYOBRedirectURL = val
+	case "MYOB_SCOPES":
+		cfg.MYOBScopes = parseScopes(val)
+	case "MYOB_AUTH_URL":
+		cfg.MYOBAuthURL = val
+	case "MYOB_TOKEN_URL":
+		cfg.MYOBTokenURL = val
+	case "MYOB_API_BASE_URL":
+		cfg.MYOBAPIBaseURL = val
+	case "MYOB_EXTRA_AUTH_PARAMS":
+		extra, err := parseExtraAuthParams(val)
+		if err != nil {
+			return true, fmt.Errorf("MYOB_EXTRA_AUTH_PARAMS: %w", err)
+		}
+		cfg.MYOBExtraAuth = extra
+	case "FRESHBOOKS_CLIENT_ID":
+		cfg.FreshBooksClientID = val
+	case "FRESHBOOKS_CLIENT_SECRET":
+		cfg.FreshBooksClientSecret = val
+	case "FRESHBOOKS_CLIENT_CERT":
+		cfg.FreshBooksClientCert = val
+	case "FRESHBOOKS_CLIENT_KEY":
+		cfg.FreshBooksClientKey = val
+	case "FRESHBOOKS_REDIRECT":
+		cfg.FreshBooksRedirectURL = val
+	case "FRESHBOOKS_SCOPES":
+		cfg.FreshBooksScopes = parseScopes(val)
+	case "FRESHBOOKS_AUTH_URL":
+		cfg.FreshBooksAuthURL = val
+	case "FRESHBOOKS_TOKEN_URL":
+		cfg.FreshBooksTokenURL = val
+	case "FRESHBOOKS_REVOKE_URL":
+		cfg.FreshBooksRevokeURL = val
+	case "FRESHBOOKS_API_BASE_URL":
+		cfg.FreshBooksAPIBaseURL = val
+	case "FRESHBOOKS_EXTRA_AUTH_PARAMS":
+		extra, err := parseExtraAuthParams(val)
+		if err != nil {
+			return true, fmt.Errorf("FRESHBOOKS_EXTRA_AUTH_PARAMS: %w", err)
+		}
+		cfg.FreshBooksExtraAuth = extra
+	case "OTEL_ENABLED":
+		if val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return true, fmt.Errorf("OTEL_ENABLED: %w", err)
 			}
-		case "RATE_LIMIT_AUTH_START":
-			if val != "" {
-				n, err := strconv.Atoi(val)
-				if err != nil {
-					return cfg, fmt.Errorf("RATE_LIMIT_AUTH_START: %w", err)
-				}
-				cfg.RateLimitAuthStart = n
+			cfg.OTelEnabled = b
+		}
+	case "METRICS_ENABLED":
+		if val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return true, fmt.Errorf("METRICS_ENABLED: %w", err)
 			}
-		case "RATE_LIMIT_AUTH_START_WINDOW_SECONDS":
-			if val != "" {
-				d, err := parseSeconds(val)
-				if err != nil {
-					return cfg, fmt.Errorf("RATE_LIMIT_AUTH_START_WINDOW_SECONDS: %w", err)
-				}
-				cfg.RateLimitAuthStartWindow = d
+			cfg.MetricsEnabled = b
+		}
+	case "PERSIST_METRICS":
+		if val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return true, fmt.Errorf("PERSIST_METRICS: %w", err)
 			}
-		case "RATE_LIMIT_POLL":
-			if val != "" {
-				n, err := strconv.Atoi(val)
-				if err != nil {
-					return cfg, fmt.Errorf("RATE_LIMIT_POLL: %w", err)
-				}
-				cfg.RateLimitPoll = n
+			cfg.PersistMetrics = b
+		}
+	case "BROKER_ENV_OVERRIDE":
+		if val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return true, fmt.Errorf("BROKER_ENV_OVERRIDE: %w", err)
 			}
-		case "RATE_LIMIT_POLL_WINDOW_SECONDS":
-			if val != "" {
-				d, err := parseSeconds(val)
-				if err != nil {
-					return cfg, fmt.Errorf("RATE_LIMIT_POLL_WINDOW_SECONDS: %w", err)
-				}
-				cfg.RateLimitPollWindow = d
+			cfg.EnvOverride = b
+		}
+	case "LOG_FORMAT":
+		switch format := strings.ToLower(val); format {
+		case "":
+		case "text", "json":
+			cfg.LogFormat = format
+		default:
+			return true, fmt.Errorf("LOG_FORMAT must be text or json, got %q", val)
+		}
+	case "BROKER_SIGNING_KEY":
+		if val != "" {
+			key, err := parseSigningKey(val)
+			if err != nil {
+				return true, fmt.Errorf("BROKER_SIGNING_KEY: %w", err)
 			}
-		case "RATE_LIMIT_REFRESH":
-			if val != "" {
-				n, err := strconv.Atoi(val)
-				if err != nil {
-					return cfg, fmt.Errorf("RATE_LIMIT_REFRESH: %w", err)
-				}
-				cfg.RateLimitRefresh = n
+			cfg.SigningKey = key
+		}
+	case "BROKER_SIGNING_KEYS":
+		keys, err := parseVerificationKeys(val)
+		if err != nil {
+			return true, fmt.Errorf("BROKER_SIGNING_KEYS: %w", err)
+		}
+		cfg.VerificationKeys = keys
+	case "BROKER_MASTER_KEY":
+		if val != "" {
+			cfg.MasterKey = []byte(val)
+		}
+	case "BROKER_API_KEY":
+		if val != "" {
+			cfg.APIKey = []byte(val)
+		}
+	case "API_KEY_AUTH_START":
+		if val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return true, fmt.Errorf("API_KEY_AUTH_START: %w", err)
+			}
+			cfg.APIKeyAuthStart = b
+		}
+	case "SESSION_TTL_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("SESSION_TTL_SECONDS: %w", err)
+			}
+			cfg.SessionTTL = d
+		}
+	case "POLL_TIMEOUT_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("POLL_TIMEOUT_SECONDS: %w", err)
+			}
+			cfg.PollTimeout = d
+		}
+	case "HTTP_READ_HEADER_TIMEOUT_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("HTTP_READ_HEADER_TIMEOUT_SECONDS: %w", err)
+			}
+			cfg.HTTPReadHeaderTimeout = d
+		}
+	case "HTTP_READ_TIMEOUT_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("HTTP_READ_TIMEOUT_SECONDS: %w", err)
+			}
+			cfg.HTTPReadTimeout = d
+		}
+	case "HTTP_WRITE_TIMEOUT_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("HTTP_WRITE_TIMEOUT_SECONDS: %w", err)
+			}
+			cfg.HTTPWriteTimeout = d
+		}
+	case "HTTP_IDLE_TIMEOUT_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("HTTP_IDLE_TIMEOUT_SECONDS: %w", err)
+			}
+			cfg.HTTPIdleTimeout = d
+		}
+	case "PROVIDER_TIMEOUT_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("PROVIDER_TIMEOUT_SECONDS: %w", err)
 			}
-		case "RATE_LIMIT_REFRESH_WINDOW_SECONDS":
+			cfg.ProviderTimeout = d
+		}
+	case "CONSUMED_GRACE_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("CONSUMED_GRACE_SECONDS: %w", err)
+			}
+			cfg.ConsumedGrace = d
+		}
+	case "REAP_INTERVAL_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("REAP_INTERVAL_SECONDS: %w", err)
+			}
+			if d < MinReapInterval {
+				return true, fmt.Errorf("REAP_INTERVAL_SECONDS: must be at least %d", int(MinReapInterval.Seconds()))
+			}
+			cfg.ReapInterval = d
+		}
+	case "VACUUM_INTERVAL_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("VACUUM_INTERVAL_SECONDS: %w", err)
+			}
+			if d < 0 {
+				return true, errors.New("VACUUM_INTERVAL_SECONDS: must not be negative")
+			}
+			cfg.VacuumInterval = d
+		}
+	case "REAP_BATCH_SIZE":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("REAP_BATCH_SIZE: %w", err)
+			}
+			if n < 1 {
+				return true, errors.New("REAP_BATCH_SIZE: must be positive")
+			}
+			cfg.ReapBatchSize = n
+		}
+	case "RATE_LIMIT_AUTH_START":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_AUTH_START: %w", err)
+			}
+			cfg.RateLimitAuthStart = n
+		}
+	case "RATE_LIMIT_AUTH_START_WINDOW_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_AUTH_START_WINDOW_SECONDS: %w", err)
+			}
+			cfg.RateLimitAuthStartWindow = d
+		}
+	case "RATE_LIMIT_POLL":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_POLL: %w", err)
+			}
+			cfg.RateLimitPoll = n
+		}
+	case "RATE_LIMIT_POLL_WINDOW_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_POLL_WINDOW_SECONDS: %w", err)
+			}
+			cfg.RateLimitPollWindow = d
+		}
+	case "RATE_LIMIT_REFRESH":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_REFRESH: %w", err)
+			}
+			cfg.RateLimitRefresh = n
+		}
+	case "RATE_LIMIT_REFRESH_WINDOW_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_REFRESH_WINDOW_SECONDS: %w", err)
+			}
+			cfg.RateLimitRefreshWindow = d
+		}
+	case "RATE_LIMIT_GLOBAL":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_GLOBAL: %w", err)
+			}
+			cfg.RateLimitGlobal = n
+		}
+	case "RATE_LIMIT_GLOBAL_WINDOW_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("RATE_LIMIT_GLOBAL_WINDOW_SECONDS: %w", err)
+			}
+			cfg.RateLimitGlobalWindow = d
+		}
+	case "REFRESH_MIN_INTERVAL_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("REFRESH_MIN_INTERVAL_SECONDS: %w", err)
+			}
+			if d < 0 {
+				return true, fmt.Errorf("REFRESH_MIN_INTERVAL_SECONDS must not be negative, got %s", val)
+			}
+			cfg.RefreshMinInterval = d
+		}
+	case "EXCHANGE_CONCURRENCY":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("EXCHANGE_CONCURRENCY: %w", err)
+			}
+			cfg.ExchangeConcurrency = n
+		}
+	case "CALLBACK_MAX_FAILURES":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("CALLBACK_MAX_FAILURES: %w", err)
+			}
+			cfg.CallbackMaxFailures = n
+		}
+	case "EXCHANGE_WAIT_SECONDS":
+		if val != "" {
+			d, err := parseSeconds(val)
+			if err != nil {
+				return true, fmt.Errorf("EXCHANGE_WAIT_SECONDS: %w", err)
+			}
+			cfg.ExchangeWait = d
+		}
+	case "TRUSTED_PROXY_HEADER":
+		cfg.TrustedProxyHeader = http.CanonicalHeaderKey(val)
+	case "TRUSTED_PROXY_CIDRS":
+		nets, err := parseCIDRs(val)
+		if err != nil {
+			return true, fmt.Errorf("TRUSTED_PROXY_CIDRS: %w", err)
+		}
+		cfg.TrustedProxyCIDRs = nets
+	case "TRUSTED_PROXY_HOPS":
+		if val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return true, fmt.Errorf("TRUSTED_PROXY_HOPS: %w", err)
+			}
+			if n < 0 {
+				return true, errors.New("TRUSTED_PROXY_HOPS: must not be negative")
+			}
+			cfg.TrustedProxyHops = n
+		}
+	case "ENABLED_PROVIDERS":
+		providers, err := parseEnabledProviders(val)
+		if err != nil {
+			return true, fmt.Errorf("ENABLED_PROVIDERS: %w", err)
+		}
+		cfg.EnabledProviders = providers
+	case "LOOPBACK_PROVIDERS":
+		providers, err := parseEnabledProviders(val)
+		if err != nil {
+			return true, fmt.Errorf("LOOPBACK_PROVIDERS: %w", err)
+		}
+		cfg.LoopbackProviders = providers
+	case "RETURN_URL_ALLOWLIST":
+		entries, err := parseReturnURLAllowlist(val)
+		if err != nil {
+			return true, fmt.Errorf("RETURN_URL_ALLOWLIST: %w", err)
+		}
+		cfg.ReturnURLAllowlist = entries
+	case "SUCCESS_MESSAGE":
+		cfg.SuccessMessage = val
+	case "SUCCESS_TEMPLATE_PATH":
+		cfg.SuccessTemplatePath = val
+	case "FAILURE_TEMPLATE_PATH":
+		cfg.FailureTemplatePath = val
+	case "SUCCESS_POSTMESSAGE_ORIGIN":
+		origin, err := parseOrigin(val)
+		if err != nil {
+			return true, fmt.Errorf("SUCCESS_POSTMESSAGE_ORIGIN: %w", err)
+		}
+		cfg.SuccessPostMessageOrigin = origin
+	case "CORS_ALLOWED_ORIGINS":
+		var origins []string
+		for _, entry := range parseScopes(val) {
+			origin, err := parseOrigin(entry)
+			if err != nil {
+				return true, fmt.Errorf("CORS_ALLOWED_ORIGINS: %w", err)
+			}
+			origins = append(origins, origin)
+		}
+		cfg.CORSAllowedOrigins = origins
+	default:
+		if rest, ok := strings.CutPrefix(key, "CUSTOM_"); ok {
+			return true, setCustomProviderKey(cfg, key, rest, val)
+		}
+		if provider, ok := strings.CutSuffix(key, "_SUCCESS_MESSAGE"); ok {
+			name := strings.ToLower(provider)
+			if !isKnownProvider(name) {
+				return true, fmt.Errorf("%s: unknown provider %q", key, name)
+			}
+			if cfg.ProviderSuccessMessages == nil {
+				cfg.ProviderSuccessMessages = make(map[string]string)
+			}
+			cfg.ProviderSuccessMessages[name] = val
+			return true, nil
+		}
+		if provider, ok := strings.CutSuffix(key, "_DENIED_SCOPES"); ok {
+			name := strings.ToLower(provider)
+			if !isKnownProvider(name) {
+				return true, fmt.Errorf("%s: unknown provider %q", key, name)
+			}
+			setDeniedScopes(cfg, name, val)
+			return true, nil
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// setCustomProviderKey applies a CUSTOM_<NAME>_<SETTING> key; rest is the
+// key without its CUSTOM_ prefix.
+func setCustomProviderKey(cfg *Config, key, rest, val string) error {
+	for _, setting := range []string{
+		"CLIENT_ID", "CLIENT_SECRET", "CLIENT_AUTH", "REDIRECT", "DENIED_SCOPES", "SCOPES",
+		"AUTH_URL", "TOKEN_URL", "REVOKE_URL", "PKCE", "EXTRA_AUTH_PARAMS", "SUCCESS_MESSAGE",
+	} {
+		upper, ok := strings.CutSuffix(rest, "_"+setting)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(upper)
+		if !validCustomName(name) {
+			return fmt.Errorf("%s: invalid custom provider name %q", key, name)
+		}
+		if setting == "SUCCESS_MESSAGE" {
+			if cfg.ProviderSuccessMessages == nil {
+				cfg.ProviderSuccessMessages = make(map[string]string)
+			}
+			cfg.ProviderSuccessMessages[customProviderPrefix+name] = val
+			return nil
+		}
+		if setting == "DENIED_SCOPES" {
+			setDeniedScopes(cfg, customProviderPrefix+name, val)
+			return nil
+		}
+		if cfg.CustomProviders == nil {
+			cfg.CustomProviders = make(map[string]CustomProvider)
+		}
+		def := cfg.CustomProviders[name]
+		switch setting {
+		case "CLIENT_ID":
+			def.ClientID = val
+		case "CLIENT_SECRET":
+			def.ClientSecret = val
+		case "CLIENT_AUTH":
+			switch val {
+			case "", "basic", "body":
+				def.ClientAuth = val
+			default:
+				return fmt.Errorf("%s: want basic or body, got %q", key, val)
+			}
+		case "REDIRECT":
+			def.RedirectURL = val
+		case "SCOPES":
+			def.Scopes = parseScopes(val)
+		case "AUTH_URL":
+			def.AuthURL = val
+		case "TOKEN_URL":
+			def.TokenURL = val
+		case "REVOKE_URL":
+			def.RevokeURL = val
+		case "PKCE":
 			if val != "" {
-				d, err := parseSeconds(val)
+				b, err := strconv.ParseBool(val)
 				if err != nil {
-					return cfg, fmt.Errorf("RATE_LIMIT_REFRESH_WINDOW_SECONDS: %w", err)
+					return fmt.Errorf("%s: %w", key, err)
 				}
-				cfg.RateLimitRefreshWindow = d
+				def.PKCE = b
 			}
+		case "EXTRA_AUTH_PARAMS":
+			extra, err := parseExtraAuthParams(val)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			def.ExtraAuth = extra
 		}
+		cfg.CustomProviders[name] = def
+		return nil
 	}
-	if err := scanner.Err(); err != nil {
-		return cfg, fmt.Errorf("scan env file: %w", err)
-	}
-
-	applyProviderDefaults(&cfg)
+	return fmt.Errorf("%s: unknown custom provider setting", key)
+}
 
-	return cfg, nil
+// validCustomName reports whether name can come from a CUSTOM_<NAME>_* key.
+func validCustomName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
 }
 
 func applyProviderDefaults(cfg *Config) {
@@ -237,6 +1084,56 @@ func applyProviderDefaults(cfg *Config) {
 	if cfg.QBOEnvironment == "" {
 		cfg.QBOEnvironment = "production"
 	}
+	if len(cfg.MYOBScopes) == 0 {
+		cfg.MYOBScopes = []string{"CompanyFile"}
+	}
+	if len(cfg.FreshBooksScopes) == 0 {
+		cfg.FreshBooksScopes = []string{"user:profile:read"}
+	}
+}
+
+// setDeniedScopes records the scopes a provider may not request.
+func setDeniedScopes(cfg *Config, provider, val string) {
+	if cfg.DeniedScopes == nil {
+		cfg.DeniedScopes = make(map[string][]string)
+	}
+	cfg.DeniedScopes[provider] = parseScopes(val)
+}
+
+// providerScopes returns the scopes the broker requests for name.
+func (c Config) providerScopes(name string) []string {
+	switch name {
+	case "xero":
+		return c.XeroScopes
+	case "deputy":
+		return c.DeputyScopes
+	case "qbo":
+		return c.QBOScopes
+	case "myob":
+		return c.MYOBScopes
+	case "freshbooks":
+		return c.FreshBooksScopes
+	}
+	if custom, ok := strings.CutPrefix(name, customProviderPrefix); ok {
+		return c.CustomProviders[custom].Scopes
+	}
+	return nil
+}
+
+// checkRequestedScopes accepts the scopes a client asks for at auth start
+// only when each is among those configured for provider, so a client can
+// narrow what the broker requests but never widen it.
+func (c Config) checkRequestedScopes(provider string, scopes []string) error {
+	configured := make(map[string]bool)
+	for _, scope := range c.providerScopes(provider) {
+		configured[scope] = true
+	}
+	for _, scope := range scopes {
+		if !configured[scope] {
+			return fmt.Errorf("scope %q is not configured for %s", scope, provider)
+		}
+	}
+	return nil
 }
 
 func parseScopes(val string) []string {
@@ -255,6 +1152,235 @@ func parseScopes(val string) []string {
 	return out
 }
 
+// reservedAuthParams are authorize-URL parameters owned by the broker that
+// extra parameters from config may not override.
+var reservedAuthParams = map[string]bool{
+	"response_type":         true,
+	"client_id":             true,
+	"redirect_uri":          true,
+	"scope":                 true,
+	"state":                 true,
+	"code_challenge":        true,
+	"code_challenge_method": true,
+	"nonce":                 true,
+}
+
+// parseExtraAuthParams parses a query string of additional authorize-URL
+// parameters, rejecting any that would override broker-controlled values.
+func parseExtraAuthParams(val string) (url.Values, error) {
+	if val == "" {
+		return nil, nil
+	}
+	extra, err := url.ParseQuery(val)
+	if err != nil {
+		return nil, err
+	}
+	for k := range extra {
+		if reservedAuthParams[strings.ToLower(k)] {
+			return nil, fmt.Errorf("parameter %q is reserved", k)
+		}
+	}
+	return extra, nil
+}
+
+// parseCIDRs parses a comma or space separated list of CIDR blocks. Bare IP
+// addresses are treated as single-host networks.
+func parseCIDRs(val string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, part := range parseScopes(val) {
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", part)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// parseEnabledProviders parses a comma or space separated provider list,
+// rejecting names the broker does not know. Custom providers may be defined
+// later in the file, so Validate checks that those exist.
+func parseEnabledProviders(val string) ([]string, error) {
+	var out []string
+	for _, name := range parseScopes(strings.ToLower(val)) {
+		custom, isCustom := strings.CutPrefix(name, customProviderPrefix)
+		if !isKnownProvider(name) && !(isCustom && validCustomName(custom)) {
+			return nil, fmt.Errorf("unknown provider %q", name)
+		}
+		out = append(out, name)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no providers listed")
+	}
+	return out, nil
+}
+
+// isKnownProvider reports whether name is in KnownProviders.
+func isKnownProvider(name string) bool {
+	for _, k := range KnownProviders {
+		if name == k {
+			return true
+		}
+	}
+	return false
+}
+
+// LoopbackAllowed reports whether name may use a CLI loopback redirect.
+func (c Config) LoopbackAllowed(name string) bool {
+	for _, p := range c.LoopbackProviders {
+		if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReturnURLAllowlist parses a comma or space separated list of
+// "scheme:" and "scheme://host" entries into their canonical lower-case
+// form. http and https must name a host, or any web page could receive the
+// redirect.
+func parseReturnURLAllowlist(val string) ([]string, error) {
+	var out []string
+	for _, entry := range parseScopes(strings.ToLower(val)) {
+		scheme, host, hasHost := strings.Cut(strings.TrimSuffix(entry, ":"), "://")
+		if scheme == "" || strings.ContainsAny(scheme, ":/") || (hasHost && (host == "" || strings.ContainsAny(host, "/?#"))) {
+			return nil, fmt.Errorf("invalid entry %q: want scheme: or scheme://host", entry)
+		}
+		if !hasHost && (scheme == "http" || scheme == "https") {
+			return nil, fmt.Errorf("%s entries must name a host", scheme)
+		}
+		if hasHost {
+			out = append(out, scheme+"://"+host)
+		} else {
+			out = append(out, scheme+":")
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no entries listed")
+	}
+	return out, nil
+}
+
+// parseOrigin parses a web origin, scheme://host[:port] with nothing after
+// it, into the lower-case form browsers compare against.
+func parseOrigin(val string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(val, "/"))
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q is not an origin; want scheme://host[:port]", val)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// ReturnURLAllowed reports whether raw is an absolute URL that
+// ReturnURLAllowlist permits as a return_url.
+func (c Config) ReturnURLAllowed(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	for _, entry := range c.ReturnURLAllowlist {
+		if entry == scheme+":" || entry == scheme+"://"+strings.ToLower(u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// optInProviders are served without ENABLED_PROVIDERS only once their
+// client id is configured, so that adding one does not make existing
+// broker.env files fail validation.
+var optInProviders = map[string]func(Config) bool{
+	"myob":       func(c Config) bool { return c.MYOBClientID != "" },
+	"freshbooks": func(c Config) bool { return c.FreshBooksClientID != "" },
+}
+
+// ProviderEnabled reports whether name is served by this broker. Custom
+// providers are served once defined unless ENABLED_PROVIDERS leaves them out.
+func (c Config) ProviderEnabled(name string) bool {
+	if custom, ok := strings.CutPrefix(name, customProviderPrefix); ok {
+		if _, defined := c.CustomProviders[custom]; !defined {
+			return false
+		}
+		if c.EnabledProviders == nil {
+			return true
+		}
+	}
+	if c.EnabledProviders == nil {
+		for _, k := range KnownProviders {
+			if name == k {
+				if configured, ok := optInProviders[name]; ok {
+					return configured(c)
+				}
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range c.EnabledProviders {
+		if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTrustedProxy reports whether addr belongs to one of the configured proxy networks.
+func (c Config) IsTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.TrustedProxyCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSecretKey reports whether key holds a credential, and so may be read
+// from a mounted secret file with KEY_FILE.
+func isSecretKey(key string) bool {
+	switch key {
+	case "BROKER_SIGNING_KEY", "BROKER_SIGNING_KEYS", "BROKER_MASTER_KEY", "BROKER_API_KEY":
+		return true
+	}
+	return strings.HasSuffix(key, "_CLIENT_SECRET")
+}
+
+// readSecretFile returns the contents of a Docker or Kubernetes secret file,
+// without the surrounding whitespace such files usually end with.
+func readSecretFile(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("no file named")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, nil
+}
+
 func parseSeconds(val string) (time.Duration, error) {
 	if val == "" {
 		return 0, errors.New("empty value")
@@ -269,33 +1395,128 @@ func parseSeconds(val string) (time.Duration, error) {
 // Validate ensures the config has required values for production use.
 func (c Config) Validate() error {
 	var missing []string
-	if c.XeroClientID == "" {
-		missing = append(missing, "XERO_CLIENT_ID")
-	}
-	if c.XeroRedirectURL == "" {
-		missing = append(missing, "XERO_REDIRECT")
-	}
-	if c.DeputyClientID == "" {
-		missing = append(missing, "DEPUTY_CLIENT_ID")
+	if c.ProviderEnabled("xero") {
+		if c.XeroClientID == "" {
+			missing = append(missing, "XERO_CLIENT_ID")
+		}
+		if c.XeroRedirectURL == "" {
+			missing = append(missing, "XERO_REDIRECT")
+		}
 	}
-	if c.DeputyClientSecret == "" {
-		missing = append(missing, "DEPUTY_CLIENT_SECRET")
+	if c.ProviderEnabled("deputy") {
+		if c.DeputyClientID == "" {
+			missing = append(missing, "DEPUTY_CLIENT_ID")
+		}
+		if c.DeputyClientSecret == "" && c.DeputyClientCert == "" && !c.DeputyUsePKCE {
+			missing = append(missing, "DEPUTY_CLIENT_SECRET")
+		}
+		if c.DeputyRedirectURL == "" {
+			missing = append(missing, "DEPUTY_REDIRECT")
+		}
 	}
-	if c.DeputyRedirectURL == "" {
-		missing = append(missing, "DEPUTY_REDIRECT")
+	if c.ProviderEnabled("qbo") {
+		if c.QBOClientID == "" {
+			missing = append(missing, "QBO_CLIENT_ID")
+		}
+		if c.QBOClientSecret == "" && c.QBOClientCert == "" && !c.QBOUsePKCE {
+			missing = append(missing, "QBO_CLIENT_SECRET")
+		}
+		if c.QBORedirectURL == "" {
+			missing = append(missing, "QBO_REDIRECT")
+		}
 	}
-	if c.QBOClientID == "" {
-		missing = append(missing, "QBO_CLIENT_ID")
+	if c.ProviderEnabled("myob") {
+		if c.MYOBClientID == "" {
+			missing = append(missing, "MYOB_CLIENT_ID")
+		}
+		if c.MYOBClientSecret == "" && c.MYOBClientCert == "" {
+			missing = append(missing, "MYOB_CLIENT_SECRET")
+		}
+		if c.MYOBRedirectURL == "" {
+			missing = append(missing, "MYOB_REDIRECT")
+		}
 	}
-	if c.QBOClientSecret == "" {
-		missing = append(missing, "QBO_CLIENT_SECRET")
+	if c.ProviderEnabled("freshbooks") {
+		if c.FreshBooksClientID == "" {
+			missing = append(missing, "FRESHBOOKS_CLIENT_ID")
+		}
+		if c.FreshBooksClientSecret == "" && c.FreshBooksClientCert == "" {
+			missing = append(missing, "FRESHBOOKS_CLIENT_SECRET")
+		}
+		if c.FreshBooksRedirectURL == "" {
+			missing = append(missing, "FRESHBOOKS_REDIRECT")
+		}
 	}
-	if c.QBORedirectURL == "" {
-		missing = append(missing, "QBO_REDIRECT")
+	for _, name := range c.ProviderNames() {
+		custom, ok := strings.CutPrefix(name, customProviderPrefix)
+		if !ok || !c.ProviderEnabled(name) {
+			continue
+		}
+		def := c.CustomProviders[custom]
+		prefix := "CUSTOM_" + strings.ToUpper(custom) + "_"
+		if def.ClientID == "" {
+			missing = append(missing, prefix+"CLIENT_ID")
+		}
+		if def.ClientSecret == "" && !def.PKCE {
+			missing = append(missing, prefix+"CLIENT_SECRET")
+		}
+		if def.RedirectURL == "" {
+			missing = append(missing, prefix+"REDIRECT")
+		}
+		if def.AuthURL == "" {
+			missing = append(missing, prefix+"AUTH_URL")
+		}
+		if def.TokenURL == "" {
+			missing = append(missing, prefix+"TOKEN_URL")
+		}
 	}
 	if len(missing) > 0 {
 		return fmt.Errorf("missing configuration keys: %s", strings.Join(missing, ", "))
 	}
+	if len(c.VerificationKeys) > 0 && c.SigningKey == nil {
+		return errors.New("BROKER_SIGNING_KEYS needs BROKER_SIGNING_KEY to sign with")
+	}
+	if c.APIKeyAuthStart && len(c.APIKey) == 0 {
+		return errors.New("API_KEY_AUTH_START needs BROKER_API_KEY")
+	}
+	for _, list := range []struct {
+		key   string
+		names []string
+	}{{"ENABLED_PROVIDERS", c.EnabledProviders}, {"LOOPBACK_PROVIDERS", c.LoopbackProviders}} {
+		for _, name := range list.names {
+			if custom, ok := strings.CutPrefix(name, customProviderPrefix); ok {
+				if _, defined := c.CustomProviders[custom]; !defined {
+					return fmt.Errorf("%s lists %s but no CUSTOM_%s_* keys define it", list.key, name, strings.ToUpper(custom))
+				}
+			}
+		}
+	}
+	for _, name := range c.ProviderNames() {
+		if !c.ProviderEnabled(name) {
+			continue
+		}
+		denied := make(map[string]bool, len(c.DeniedScopes[name]))
+		for _, scope := range c.DeniedScopes[name] {
+			denied[scope] = true
+		}
+		for _, scope := range c.providerScopes(name) {
+			if denied[scope] {
+				key := strings.ToUpper(strings.ReplaceAll(name, ":", "_"))
+				return fmt.Errorf("%s_SCOPES requests %q, which %s_DENIED_SCOPES forbids", key, scope, key)
+			}
+		}
+	}
+	for _, name := range KnownProviders {
+		if !c.ProviderEnabled(name) {
+			continue
+		}
+		if err := c.validateClientCert(name); err != nil {
+			return err
+		}
+	}
+	if c.HTTPWriteTimeout > 0 && c.HTTPWriteTimeout <= c.PollTimeout {
+		return fmt.Errorf("HTTP_WRITE_TIMEOUT_SECONDS (%s) must exceed POLL_TIMEOUT_SECONDS (%s)", c.HTTPWriteTimeout, c.PollTimeout)
+	}
 	return nil
 }
 
@@ -315,6 +1536,14 @@ func (c Config) GetXeroTokenURL() string {
 	return "https://identity.xero.com/connect/token"
 }
 
+// GetXeroRevokeURL returns the Xero token revocation URL (with override support).
+func (c Config) GetXeroRevokeURL() string {
+	if c.XeroRevokeURL != "" {
+		return c.XeroRevokeURL
+	}
+	return "https://identity.xero.com/connect/revocation"
+}
+
 // GetXeroAPIBaseURL returns the Xero API base URL (with override support).
 func (c Config) GetXeroAPIBaseURL() string {
 	if c.XeroAPIBaseURL != "" {
@@ -323,6 +1552,22 @@ func (c Config) GetXeroAPIBaseURL() string {
 	return "https://api.xero.com"
 }
 
+// GetXeroJWKSURL returns the URL of Xero's id_token signing keys (with override support).
+func (c Config) GetXeroJWKSURL() string {
+	if c.XeroJWKSURL != "" {
+		return c.XeroJWKSURL
+	}
+	return "https://identity.xero.com/.well-known/openid-configuration/jwks"
+}
+
+// GetXeroIssuer returns the issuer Xero id_tokens must carry (with override support).
+func (c Config) GetXeroIssuer() string {
+	if c.XeroIssuer != "" {
+		return c.XeroIssuer
+	}
+	return "https://identity.xero.com"
+}
+
 // GetDeputyAuthURL returns the Deputy OAuth authorization URL (with override support).
 func (c Config) GetDeputyAuthURL() string {
 	if c.DeputyAuthURL != "" {
@@ -355,6 +1600,30 @@ func (c Config) GetQBOTokenURL() string {
 	return "https://oauth.platform.intuit.com/oauth2/v1/tokens/bearer"
 }
 
+// GetQBORevokeURL returns the QuickBooks token revocation URL (with override support).
+func (c Config) GetQBORevokeURL() string {
+	if c.QBORevokeURL != "" {
+		return c.QBORevokeURL
+	}
+	return "https://developer.api.intuit.com/v2/oauth2/tokens/revoke"
+}
+
+// GetQBOJWKSURL returns the URL of Intuit's id_token signing keys (with override support).
+func (c Config) GetQBOJWKSURL() string {
+	if c.QBOJWKSURL != "" {
+		return c.QBOJWKSURL
+	}
+	return "https://oauth.platform.intuit.com/op/v1/jwks"
+}
+
+// GetQBOIssuer returns the issuer Intuit id_tokens must carry (with override support).
+func (c Config) GetQBOIssuer() string {
+	if c.QBOIssuer != "" {
+		return c.QBOIssuer
+	}
+	return "https://oauth.platform.intuit.com/op/v1"
+}
+
 // GetQBOAPIBaseURL returns the QuickBooks API base URL based on environment.
 func (c Config) GetQBOAPIBaseURL() string {
 	if c.QBOAPIBaseURL != "" {
@@ -365,3 +1634,59 @@ func (c Config) GetQBOAPIBaseURL() string {
 	}
 	return "https://quickbooks.api.intuit.com"
 }
+
+// GetMYOBAuthURL returns the MYOB OAuth authorization URL (with override support).
+func (c Config) GetMYOBAuthURL() string {
+	if c.MYOBAuthURL != "" {
+		return c.MYOBAuthURL
+	}
+	return "https://secure.myob.com/oauth2/account/authorize"
+}
+
+// GetMYOBTokenURL returns the MYOB OAuth token exchange URL (with override support).
+func (c Config) GetMYOBTokenURL() string {
+	if c.MYOBTokenURL != "" {
+		return c.MYOBTokenURL
+	}
+	return "https://secure.myob.com/oauth2/v1/authorize"
+}
+
+// GetMYOBAPIBaseURL returns the MYOB AccountRight API base URL (with override support).
+func (c Config) GetMYOBAPIBaseURL() string {
+	if c.MYOBAPIBaseURL != "" {
+		return c.MYOBAPIBaseURL
+	}
+	return "https://api.myob.com/accountright"
+}
+
+// GetFreshBooksAuthURL returns the FreshBooks OAuth authorization URL (with override support).
+func (c Config) GetFreshBooksAuthURL() string {
+	if c.FreshBooksAuthURL != "" {
+		return c.FreshBooksAuthURL
+	}
+	return "https://auth.freshbooks.com/oauth/authorize"
+}
+
+// GetFreshBooksTokenURL returns the FreshBooks OAuth token exchange URL (with override support).
+func (c Config) GetFreshBooksTokenURL() string {
+	if c.FreshBooksTokenURL != "" {
+		return c.FreshBooksTokenURL
+	}
+	return "https://api.freshbooks.com/auth/oauth/token"
+}
+
+// GetFreshBooksRevokeURL returns the FreshBooks token revocation URL (with override support).
+func (c Config) GetFreshBooksRevokeURL() string {
+	if c.FreshBooksRevokeURL != "" {
+		return c.FreshBooksRevokeURL
+	}
+	return "https://api.freshbooks.com/auth/oauth/revoke"
+}
+
+// GetFreshBooksAPIBaseURL returns the FreshBooks API base URL (with override support).
+func (c Config) GetFreshBooksAPIBaseURL() string {
+	if c.FreshBooksAPIBaseURL != "" {
+		return c.FreshBooksAPIBaseURL
+	}
+	return "https://api.freshbooks.com"
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFromEnviron(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "master-key")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+		check   func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "overrides defaults",
+			env:  map[string]string{"SESSION_TTL_SECONDS": "900", "XERO_CLIENT_ID": "env-client", "HTTP_READ_TIMEOUT_SECONDS": "5"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.SessionTTL != 15*time.Minute || cfg.XeroClientID != "env-client" || cfg.HTTPReadTimeout != 5*time.Second {
+					t.Fatalf("overrides not applied: ttl %v, client %q, read timeout %v", cfg.SessionTTL, cfg.XeroClientID, cfg.HTTPReadTimeout)
+				}
+			},
+		},
+		{
+			name: "blank value keeps default",
+			env:  map[string]string{"SESSION_TTL_SECONDS": ""},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.SessionTTL != DefaultConfig().SessionTTL {
+					t.Fatalf("blank SESSION_TTL_SECONDS changed the TTL to %v", cfg.SessionTTL)
+				}
+			},
+		},
+		{
+			name: "secret read from file",
+			env:  map[string]string{"BROKER_MASTER_KEY_FILE": secret},
+			check: func(t *testing.T, cfg Config) {
+				if string(cfg.MasterKey) != "from-file" {
+					t.Fatalf("master key = %q, want the trimmed file contents", cfg.MasterKey)
+				}
+			},
+		},
+		{
+			name: "client secret read from file",
+			env:  map[string]string{"QBO_CLIENT_SECRET_FILE": secret},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.QBOClientSecret != "from-file" {
+					t.Fatalf("QBO client secret = %q, want the file contents", cfg.QBOClientSecret)
+				}
+			},
+		},
+		{
+			name: "non-secret key has no file form",
+			env:  map[string]string{"XERO_CLIENT_ID_FILE": secret},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.XeroClientID != "" {
+					t.Fatalf("XERO_CLIENT_ID_FILE set the client id to %q", cfg.XeroClientID)
+				}
+			},
+		},
+		{
+			name:    "missing secret file",
+			env:     map[string]string{"BROKER_MASTER_KEY_FILE": filepath.Join(t.TempDir(), "absent")},
+			wantErr: "BROKER_MASTER_KEY_FILE",
+		},
+		{
+			name:    "empty secret file",
+			env:     map[string]string{"BROKER_API_KEY_FILE": empty},
+			wantErr: "is empty",
+		},
+		{
+			name: "fractional seconds",
+			env:  map[string]string{"VACUUM_INTERVAL_SECONDS": "1.5"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.VacuumInterval != 1500*time.Millisecond {
+					t.Fatalf("vacuum interval = %v, want 1.5s", cfg.VacuumInterval)
+				}
+			},
+		},
+		{
+			name:    "negative interval",
+			env:     map[string]string{"VACUUM_INTERVAL_SECONDS": "-60"},
+			wantErr: "VACUUM_INTERVAL_SECONDS: must not be negative",
+		},
+		{
+			name:    "invalid value",
+			env:     map[string]string{"SESSION_TTL_SECONDS": "soon"},
+			wantErr: "environment: SESSION_TTL_SECONDS",
+		},
+		{
+			name: "HTTP_ variables honoured outside CGI",
+			env:  map[string]string{"HTTP_WRITE_TIMEOUT_SECONDS": "7"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.HTTPWriteTimeout != 7*time.Second {
+					t.Fatalf("write timeout = %v, want 7s", cfg.HTTPWriteTimeout)
+				}
+			},
+		},
+		{
+			name: "HTTP_ variables ignored under CGI",
+			env:  map[string]string{"GATEWAY_INTERFACE": "CGI/1.1", "HTTP_READ_TIMEOUT_SECONDS": "1", "HTTP_WRITE_TIMEOUT_SECONDS": "1", "XERO_CLIENT_ID": "env-client"},
+			check: func(t *testing.T, cfg Config) {
+				def := DefaultConfig()
+				if cfg.HTTPReadTimeout != def.HTTPReadTimeout || cfg.HTTPWriteTimeout != def.HTTPWriteTimeout {
+					t.Fatalf("request headers set timeouts: read %v, write %v", cfg.HTTPReadTimeout, cfg.HTTPWriteTimeout)
+				}
+				if cfg.XeroClientID != "env-client" {
+					t.Fatalf("other variables dropped under CGI: client %q", cfg.XeroClientID)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := LoadConfigFromEnviron()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
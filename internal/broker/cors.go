@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	// corsAllowedHeaders are the request headers the broker reads, plus the
+	// trace context a browser client may propagate.
+	corsAllowedHeaders = "Authorization, Content-Type, X-Broker-Key, traceparent, tracestate"
+	// corsExposedHeaders are the response headers a browser client needs.
+	corsExposedHeaders = "Retry-After, X-Request-ID"
+	corsMaxAge         = "600"
+)
+
+// applyCORS adds CORS headers for a request from an origin listed in
+// CORS_ALLOWED_ORIGINS. It returns true when it has answered the request
+// itself, as for a preflight. Requests from other origins, and every
+// request while the list is empty, get no CORS headers.
+func (s *Server) applyCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(s.Config.CORSAllowedOrigins) == 0 {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if !slices.Contains(s.Config.CORSAllowedOrigins, strings.ToLower(origin)) {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", "GET, POST")
+	h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	h.Set("Access-Control-Max-Age", corsMaxAge)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConvertJSONToEnv reads a JSON object of broker.env keys and writes the
+// equivalent broker.env file. Values may be strings, numbers, booleans or,
+// for list keys such as scopes, arrays of strings. Unknown keys and values
+// that would fail to load are rejected.
+func ConvertJSONToEnv(r io.Reader, w io.Writer) error {
+	var raw map[string]any
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return fmt.Errorf("decode json: %w", err)
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	scratch := DefaultConfig()
+	var b strings.Builder
+	for _, key := range keys {
+		val, err := envValueFromJSON(raw[key])
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		known, err := setConfigKey(&scratch, key, val)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("unknown configuration key %s", key)
+		}
+		if strings.ContainsAny(val, " \t#") {
+			val = `"` + val + `"`
+		}
+		fmt.Fprintf(&b, "%s=%s\n", key, val)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ConvertEnvToJSON reads a broker.env file and writes its keys as an indented
+// JSON object. Unknown keys are rejected so the output round-trips.
+func ConvertEnvToJSON(path string, w io.Writer) error {
+	entries, err := readEnvFile(path)
+	if err != nil {
+		return err
+	}
+	scratch := DefaultConfig()
+	out := make(map[string]string, len(entries))
+	for _, e := range entries {
+		known, err := setConfigKey(&scratch, e.Key, e.Value)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("unknown configuration key %s", e.Key)
+		}
+		out[e.Key] = e.Value
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func envValueFromJSON(v any) (string, error) {
+	switch t := v.(type) {
+	case string:
+		if strings.ContainsAny(t, "\r\n\"") {
+			return "", fmt.Errorf("value may not contain quotes or newlines")
+		}
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case nil:
+		return "", nil
+	case []any:
+		parts := make([]string, 0, len(t))
+		for _, item := range t {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("list values must be strings")
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, " "), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
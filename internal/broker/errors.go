@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ProviderRateLimitError reports that an upstream provider throttled a call.
+type ProviderRateLimitError struct {
+	Provider   string
+	RetryAfter time.Duration
+	Problem    string // Xero's X-Rate-Limit-Problem, e.g. "minute" or "daily"
+}
+
+func (e *ProviderRateLimitError) Error() string {
+	msg := fmt.Sprintf("%s rate limited; retry after %s", e.Provider, e.RetryAfter)
+	if e.Problem != "" {
+		msg += fmt.Sprintf(" (%s limit)", e.Problem)
+	}
+	return msg
+}
+
+// rateLimitErrorFromResponse returns a ProviderRateLimitError for a 429
+// response, or nil for any other status.
+func rateLimitErrorFromResponse(provider string, resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	return &ProviderRateLimitError{
+		Provider:   provider,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Problem:    resp.Header.Get("X-Rate-Limit-Problem"),
+	}
+}
+
+// parseRetryAfter accepts both the delay-seconds and HTTP-date forms.
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d.Round(time.Second)
+		}
+	}
+	return 0
+}
+
+// isUpstreamTimeout reports whether err came from a provider call that ran
+// past its deadline, as opposed to one that failed outright.
+func isUpstreamTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ErrRevokeUnsupported indicates the provider offers no token revocation API.
+var ErrRevokeUnsupported = errors.New("provider does not support token revocation")
+
+// ProviderError carries an upstream error response so handlers can relay it.
+type ProviderError struct {
+	Provider string
+	Status   int
+	Body     string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.Provider, e.Status, e.Body)
+}
@@ -0,0 +1,289 @@
+package broker
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publicIDTokenClaims are the standard OpenID claims safe to hand back to
+// clients. Anything else in the token (nonces, session ids, provider
+// extensions) is dropped.
+var publicIDTokenClaims = map[string]bool{
+	"iss":                true,
+	"sub":                true,
+	"aud":                true,
+	"exp":                true,
+	"iat":                true,
+	"auth_time":          true,
+	"name":               true,
+	"given_name":         true,
+	"family_name":        true,
+	"preferred_username": true,
+	"email":              true,
+	"email_verified":     true,
+}
+
+// decodeIDTokenClaims extracts the public claims from a JWT id_token. The
+// signature is not checked here: exchanges already ran verifyIDToken, and the
+// claims are informational only.
+func decodeIDTokenClaims(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id_token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]any
+	if err := jsonUnmarshal(payload, &all); err != nil {
+		return nil, err
+	}
+	claims := make(map[string]any)
+	for k, v := range all {
+		if publicIDTokenClaims[k] {
+			claims[k] = v
+		}
+	}
+	return claims, nil
+}
+
+// idTokenSkew is the clock difference tolerated when checking exp.
+const idTokenSkew = time.Minute
+
+// idTokenCheck is what an id_token returned by a code exchange must match.
+type idTokenCheck struct {
+	Issuer   string
+	JWKSURL  string
+	Audience string // the broker's client id
+	// Nonce is the session's nonce. Sessions started before nonces were
+	// stored have none, and only for those is the claim not compared.
+	Nonce string
+}
+
+// verifyIDToken checks an RS256 id_token against the issuer's published
+// keys and its iss, aud, exp and nonce claims, returning the public claims.
+func verifyIDToken(ctx context.Context, client *http.Client, token string, check idTokenCheck) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("ID token alg %q is not RS256", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %w", err)
+	}
+	key, err := idTokenKeys.key(ctx, client, check.JWKSURL, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("ID token signature does not verify")
+	}
+
+	var claims struct {
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   float64         `json:"exp"`
+		Nonce string          `json:"nonce"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %w", err)
+	}
+	if claims.Iss != check.Issuer {
+		return nil, fmt.Errorf("ID token issuer %q, want %q", claims.Iss, check.Issuer)
+	}
+	if !audienceIncludes(claims.Aud, check.Audience) {
+		return nil, fmt.Errorf("ID token audience does not include %s", check.Audience)
+	}
+	if claims.Exp == 0 || time.Now().Add(-idTokenSkew).After(time.Unix(int64(claims.Exp), 0)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if check.Nonce != "" {
+		if claims.Nonce == "" {
+			return nil, errors.New("ID token has no nonce but the session sent one")
+		}
+		if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(check.Nonce)) != 1 {
+			return nil, errors.New("ID token nonce does not match the session")
+		}
+	}
+	return decodeIDTokenClaims(token)
+}
+
+func decodeJWTSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return jsonUnmarshal(data, v)
+}
+
+// audienceIncludes reports whether an aud claim, a string or an array of
+// strings, names want.
+func audienceIncludes(raw json.RawMessage, want string) bool {
+	var one string
+	if jsonUnmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if jsonUnmarshal(raw, &many) != nil {
+		return false
+	}
+	for _, aud := range many {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+// requestsOpenID reports whether scopes ask for an id_token.
+func requestsOpenID(scopes []string) bool {
+	for _, s := range scopes {
+		if s == "openid" {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyEnvelopeIDToken verifies the id_token an exchange returned, if any,
+// and records the subject and email it asserts on env. A token that fails
+// verification fails the exchange.
+func (b providerBase) verifyEnvelopeIDToken(ctx context.Context, env *TokenEnvelope, sess *Session, issuer, jwksURL, clientID string) error {
+	if env.IDToken == "" {
+		return nil
+	}
+	check := idTokenCheck{Issuer: issuer, JWKSURL: jwksURL, Audience: clientID}
+	if sess != nil && sess.Nonce.Valid {
+		check.Nonce = sess.Nonce.String
+	}
+	claims, err := verifyIDToken(ctx, b.client, env.IDToken, check)
+	if err != nil {
+		return err
+	}
+	env.Subject, _ = claims["sub"].(string)
+	env.Email, _ = claims["email"].(string)
+	return nil
+}
+
+const (
+	// jwksTTL is how long fetched signing keys are trusted before a refetch.
+	jwksTTL = time.Hour
+	// jwksMinRefetch stops an unknown kid from triggering a fetch per token.
+	jwksMinRefetch = time.Minute
+	// jwksMinKeyBits is the smallest RSA modulus accepted for signing keys.
+	jwksMinKeyBits = 2048
+)
+
+// jwksCache holds each issuer's signing keys. A kid missing from a cached
+// set is refetched once the set is jwksMinRefetch old, which picks up key
+// rotation without hammering the provider.
+type jwksCache struct {
+	mu   sync.Mutex
+	sets map[string]jwksSet
+}
+
+type jwksSet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+var idTokenKeys = &jwksCache{sets: make(map[string]jwksSet)}
+
+func (c *jwksCache) key(ctx context.Context, client *http.Client, url, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	set, ok := c.sets[url]
+	c.mu.Unlock()
+	age := time.Since(set.fetched)
+	if ok && age < jwksTTL {
+		if k := set.keys[kid]; k != nil {
+			return k, nil
+		}
+		if age < jwksMinRefetch {
+			return nil, fmt.Errorf("ID token signed with unknown key %q", kid)
+		}
+	}
+	keys, err := fetchJWKS(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.sets[url] = jwksSet{keys: keys, fetched: time.Now()}
+	c.mu.Unlock()
+	if k := keys[kid]; k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("ID token signed with unknown key %q", kid)
+}
+
+// fetchJWKS downloads a JWK set and returns its RSA signing keys by kid.
+// Keys shorter than jwksMinKeyBits are ignored, so tokens they sign fail as
+// signed with an unknown key.
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("fetch jwks: %s: %s", resp.Status, body)
+	}
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode jwks: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < jwksMinKeyBits {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: modulus, E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
@@ -0,0 +1,208 @@
+package broker
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jwksServer publishes the public halves of keys by kid; the set can be
+// swapped to simulate rotation.
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func newJWKSServer(t *testing.T, keys map[string]*rsa.PrivateKey) *jwksServer {
+	t.Helper()
+	js := &jwksServer{keys: keys}
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		js.fetches++
+		var doc struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		for kid, k := range js.keys {
+			doc.Keys = append(doc.Keys, map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(js.Close)
+	return js
+}
+
+func (js *jwksServer) setKeys(keys map[string]*rsa.PrivateKey) {
+	js.mu.Lock()
+	js.keys = keys
+	js.mu.Unlock()
+}
+
+func (js *jwksServer) fetchCount() int {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.fetches
+}
+
+func rsaTestKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// signIDToken builds an RS256 JWT over claims.
+func signIDToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signing := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	key := rsaTestKey(t, 2048)
+	other := rsaTestKey(t, 2048)
+	js := newJWKSServer(t, map[string]*rsa.PrivateKey{"k1": key})
+	check := idTokenCheck{Issuer: "https://issuer.example", JWKSURL: js.URL, Audience: "client-1", Nonce: "n-123"}
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   check.Issuer,
+			"aud":   []string{"other", check.Audience},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"sub":   "user-1",
+			"nonce": check.Nonce,
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"valid", signIDToken(t, key, "k1", claims(nil)), ""},
+		{"bad signature", signIDToken(t, other, "k1", claims(nil)), "signature does not verify"},
+		{"wrong iss", signIDToken(t, key, "k1", claims(func(c map[string]any) { c["iss"] = "https://evil.example" })), "issuer"},
+		{"wrong aud", signIDToken(t, key, "k1", claims(func(c map[string]any) { c["aud"] = "client-2" })), "audience"},
+		{"expired", signIDToken(t, key, "k1", claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), "expired"},
+		{"no exp", signIDToken(t, key, "k1", claims(func(c map[string]any) { delete(c, "exp") })), "expired"},
+		{"nonce mismatch", signIDToken(t, key, "k1", claims(func(c map[string]any) { c["nonce"] = "n-456" })), "nonce does not match"},
+		{"missing nonce", signIDToken(t, key, "k1", claims(func(c map[string]any) { delete(c, "nonce") })), "no nonce"},
+		{"malformed", "not-a-jwt", "malformed"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := verifyIDToken(context.Background(), http.DefaultClient, tc.token, check)
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("valid token rejected: %v", err)
+				}
+				if got["sub"] != "user-1" || got["nonce"] != nil {
+					t.Fatalf("unexpected public claims %v", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+
+	// Sessions started before nonces were stored skip the comparison.
+	legacy := check
+	legacy.Nonce = ""
+	token := signIDToken(t, key, "k1", claims(func(c map[string]any) { delete(c, "nonce") }))
+	if _, err := verifyIDToken(context.Background(), http.DefaultClient, token, legacy); err != nil {
+		t.Fatalf("token for a session without a nonce rejected: %v", err)
+	}
+}
+
+func TestVerifyIDTokenKeyRotation(t *testing.T) {
+	oldKey := rsaTestKey(t, 2048)
+	newKey := rsaTestKey(t, 2048)
+	js := newJWKSServer(t, map[string]*rsa.PrivateKey{"old": oldKey})
+	check := idTokenCheck{Issuer: "https://issuer.example", JWKSURL: js.URL, Audience: "client-1"}
+	claims := map[string]any{"iss": check.Issuer, "aud": check.Audience, "exp": time.Now().Add(time.Hour).Unix()}
+	verify := func(key *rsa.PrivateKey, kid string) error {
+		_, err := verifyIDToken(context.Background(), http.DefaultClient, signIDToken(t, key, kid, claims), check)
+		return err
+	}
+
+	if err := verify(oldKey, "old"); err != nil {
+		t.Fatal(err)
+	}
+	js.setKeys(map[string]*rsa.PrivateKey{"new": newKey})
+
+	// A fresh cache does not refetch for an unknown kid.
+	if err := verify(newKey, "new"); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("got %v, want an unknown key error", err)
+	}
+	if n := js.fetchCount(); n != 1 {
+		t.Fatalf("fetched %d times within jwksMinRefetch, want 1", n)
+	}
+
+	// Once the set is old enough, the rotated key is fetched.
+	idTokenKeys.mu.Lock()
+	set := idTokenKeys.sets[js.URL]
+	set.fetched = time.Now().Add(-2 * jwksMinRefetch)
+	idTokenKeys.sets[js.URL] = set
+	idTokenKeys.mu.Unlock()
+	if err := verify(newKey, "new"); err != nil {
+		t.Fatalf("rotated key not picked up: %v", err)
+	}
+	if n := js.fetchCount(); n != 2 {
+		t.Fatalf("fetched %d times, want 2", n)
+	}
+}
+
+func TestFetchJWKSRejectsShortKeys(t *testing.T) {
+	js := newJWKSServer(t, map[string]*rsa.PrivateKey{
+		"weak":   rsaTestKey(t, 1024),
+		"strong": rsaTestKey(t, 2048),
+	})
+	keys, err := fetchJWKS(context.Background(), http.DefaultClient, js.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["weak"] != nil {
+		t.Error("1024-bit key accepted")
+	}
+	if keys["strong"] == nil {
+		t.Error("2048-bit key dropped")
+	}
+}
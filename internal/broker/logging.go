@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// NewLogger returns a structured logger writing to w. format is "json" for
+// one JSON object per line; anything else gives slog's key=value text form.
+// String and error values pass through sanitizeLogValue, so a token that
+// ends up in an upstream error body is still redacted.
+func NewLogger(w io.Writer, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{ReplaceAttr: redactAttr}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(sanitizeLogValue(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok && err != nil {
+			a.Value = slog.StringValue(sanitizeLogValue(err.Error()))
+		}
+	}
+	return a
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type requestLoggerKey struct{}
+
+// logger returns the logger for ctx: the request's own, tagged with its
+// request id, when ctx belongs to a request, otherwise the server's.
+func (s *Server) logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	if s.Log == nil {
+		return discardLogger
+	}
+	return s.Log
+}
+
+// logRequest gives the request an id, returned in X-Request-ID and attached
+// to every line logged through s.logger(r.Context()), and logs the status of
+// requests that fail. Successful requests are not logged; under CGI that
+// would only repeat the web server's access log.
+func (s *Server) logRequest(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	id, err := randomID(9)
+	if err != nil {
+		id = "unknown"
+	}
+	w.Header().Set("X-Request-ID", id)
+	l := s.logger(r.Context()).With("request_id", id)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	next(sw, r.WithContext(context.WithValue(r.Context(), requestLoggerKey{}, l)))
+	if sw.status < http.StatusBadRequest {
+		return
+	}
+	level := slog.LevelWarn
+	if sw.status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	l.Log(r.Context(), level, "request failed",
+		"method", r.Method,
+		"route", routeFor(r.URL.Path),
+		"status", sw.status,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+// SessionHash identifies a session in logs and admin output without
+// revealing the id, which is a bearer credential for polling.
+func SessionHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,425 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a SessionStore held in process memory, for tests that
+// should not touch disk. It mirrors Store's semantics, including the
+// sql.ErrNoRows and sentinel errors callers check for, but nothing is shared
+// between processes or survives a restart.
+type MemoryStore struct {
+	mu               sync.Mutex
+	sessions         map[string]Session
+	callbackFailures map[string]int
+	returnCodes      map[string]string // code hash -> session id
+	sessionCodes     map[string]string // session id -> code hash
+	rateLimits       map[string]memRateWindow
+	exchangeSlots    map[string]time.Time
+	refreshOutcomes  []memRefreshOutcome
+	refreshClaims    map[string]RecentRefresh
+	counters         map[string]int64
+}
+
+type memRateWindow struct {
+	start time.Time
+	count int
+}
+
+type memRefreshOutcome struct {
+	provider string
+	ok       bool
+	at       time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions:         make(map[string]Session),
+		callbackFailures: make(map[string]int),
+		returnCodes:      make(map[string]string),
+		sessionCodes:     make(map[string]string),
+		rateLimits:       make(map[string]memRateWindow),
+		exchangeSlots:    make(map[string]time.Time),
+		refreshClaims:    make(map[string]RecentRefresh),
+		counters:         make(map[string]int64),
+	}
+}
+
+// copySession returns sess with its own copy of the result, so callers
+// cannot modify stored state through the returned value.
+func copySession(sess Session) *Session {
+	if sess.Result != nil {
+		sess.Result = append([]byte(nil), sess.Result...)
+	}
+	return &sess
+}
+
+// InsertSession creates a new session.
+func (m *MemoryStore) InsertSession(ctx context.Context, sess Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.sessions[sess.ID]; exists {
+		return fmt.Errorf("insert session: duplicate id %s", sess.ID)
+	}
+	sess.ReadyAt, sess.UsedAt, sess.Result, sess.Consumed = sql.NullTime{}, sql.NullTime{}, nil, false
+	sess.AccessTokenHash = sql.NullString{}
+	m.sessions[sess.ID] = sess
+	return nil
+}
+
+// MarkReady stores the session result payload and the hash of the access
+// token it carries, and marks the session ready.
+func (m *MemoryStore) MarkReady(ctx context.Context, sessionID string, payload []byte, realmID *string, accessTokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok || sess.Consumed {
+		return sql.ErrNoRows
+	}
+	sess.ReadyAt = sql.NullTime{Time: time.Now(), Valid: true}
+	sess.Result = append([]byte(nil), payload...)
+	if realmID != nil {
+		sess.RealmID = sql.NullString{String: *realmID, Valid: true}
+	}
+	sess.AccessTokenHash = sql.NullString{String: accessTokenHash, Valid: accessTokenHash != ""}
+	sess.Consumed = true
+	m.sessions[sessionID] = sess
+	return nil
+}
+
+// LookupByState finds the newest pending session by provider and state.
+func (m *MemoryStore) LookupByState(ctx context.Context, provider, state string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found *Session
+	for _, sess := range m.sessions {
+		if sess.Provider != provider || sess.State != state || sess.Consumed {
+			continue
+		}
+		if found == nil || sess.CreatedAt.After(found.CreatedAt) {
+			found = copySession(sess)
+		}
+	}
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
+	return found, nil
+}
+
+// LoadForPoll retrieves the session for polling.
+func (m *MemoryStore) LoadForPoll(ctx context.Context, sessionID string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return copySession(sess), nil
+}
+
+// MarkStateUsed records that a session's state has been redeemed, failing
+// with ErrStateUsed on a second use.
+func (m *MemoryStore) MarkStateUsed(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok || sess.UsedAt.Valid {
+		return ErrStateUsed
+	}
+	sess.UsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	m.sessions[sessionID] = sess
+	return nil
+}
+
+// ReleaseState undoes MarkStateUsed for a session whose exchange failed.
+func (m *MemoryStore) ReleaseState(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sess, ok := m.sessions[sessionID]; ok && !sess.Consumed {
+		sess.UsedAt = sql.NullTime{}
+		m.sessions[sessionID] = sess
+	}
+	return nil
+}
+
+// SetReturnCode stores the hash of the one-time code a return_url redirect
+// carries, replacing any earlier one.
+func (m *MemoryStore) SetReturnCode(ctx context.Context, sessionID, codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.returnCodes, m.sessionCodes[sessionID])
+	m.returnCodes[codeHash] = sessionID
+	m.sessionCodes[sessionID] = codeHash
+	return nil
+}
+
+// RedeemReturnCode spends a return code and loads its session for polling.
+// An unknown or already spent code is sql.ErrNoRows.
+func (m *MemoryStore) RedeemReturnCode(ctx context.Context, codeHash string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.returnCodes[codeHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	delete(m.returnCodes, codeHash)
+	delete(m.sessionCodes, id)
+	sess, ok := m.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return copySession(sess), nil
+}
+
+// RecordCallbackFailure counts a failed callback against a session and
+// returns the new total.
+func (m *MemoryStore) RecordCallbackFailure(ctx context.Context, sessionID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[sessionID]; !ok {
+		return 0, fmt.Errorf("record callback failure: %w", sql.ErrNoRows)
+	}
+	m.callbackFailures[sessionID]++
+	return m.callbackFailures[sessionID], nil
+}
+
+// ClearResult drops a session's stored result but keeps the session.
+func (m *MemoryStore) ClearResult(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sess, ok := m.sessions[sessionID]; ok {
+		sess.Result = nil
+		m.sessions[sessionID] = sess
+	}
+	return nil
+}
+
+// Delete removes a session entirely.
+func (m *MemoryStore) Delete(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(sessionID)
+	return nil
+}
+
+func (m *MemoryStore) deleteLocked(sessionID string) {
+	delete(m.sessions, sessionID)
+	delete(m.callbackFailures, sessionID)
+	if h, ok := m.sessionCodes[sessionID]; ok {
+		delete(m.returnCodes, h)
+		delete(m.sessionCodes, sessionID)
+	}
+}
+
+// DeleteExpiredBefore removes up to limit sessions that expired before t.
+// A limit of zero or less removes them all.
+func (m *MemoryStore) DeleteExpiredBefore(ctx context.Context, t time.Time, limit int) (int64, error) {
+	return m.deleteWhere(limit, func(sess Session) bool {
+		return sess.ExpiresAt.Before(t)
+	}), nil
+}
+
+// DeleteConsumedBefore removes up to limit sessions whose result was stored
+// before t but never collected. A limit of zero or less removes them all.
+// Xero tombstones, whose result a poll already cleared, are left for the
+// expiry reap.
+func (m *MemoryStore) DeleteConsumedBefore(ctx context.Context, t time.Time, limit int) (int64, error) {
+	return m.deleteWhere(limit, func(sess Session) bool {
+		return sess.Consumed && sess.ReadyAt.Valid && sess.ReadyAt.Time.Before(t) && sess.Result != nil
+	}), nil
+}
+
+func (m *MemoryStore) deleteWhere(limit int, match func(Session) bool) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for id, sess := range m.sessions {
+		if limit > 0 && n >= int64(limit) {
+			break
+		}
+		if match(sess) {
+			m.deleteLocked(id)
+			n++
+		}
+	}
+	return n
+}
+
+// IncrementRateLimit records a call for key and fails with ErrRateLimited
+// once limit calls have been made in the current fixed window.
+func (m *MemoryStore) IncrementRateLimit(ctx context.Context, key string, limit int, window time.Duration) error {
+	if limit <= 0 {
+		return nil
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	w, ok := m.rateLimits[key]
+	switch {
+	case !ok || now.Sub(w.start) >= window:
+		w = memRateWindow{start: now, count: 1}
+	case w.count >= limit:
+		return &RateLimitedError{RetryAfter: max(w.start.Add(window).Sub(now), time.Second)}
+	default:
+		w.count++
+	}
+	m.rateLimits[key] = w
+	return nil
+}
+
+// AcquireExchangeSlot reserves one of limit upstream exchange slots, waiting
+// until ctx is done. The returned id must be passed to ReleaseExchangeSlot.
+func (m *MemoryStore) AcquireExchangeSlot(ctx context.Context, limit int, lease time.Duration) (string, error) {
+	id, err := randomID(16)
+	if err != nil {
+		return "", fmt.Errorf("allocate exchange slot id: %w", err)
+	}
+	for {
+		if m.tryAcquireSlot(id, limit, lease) {
+			return id, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ErrExchangeBusy
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (m *MemoryStore) tryAcquireSlot(id string, limit int, lease time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for slot, expires := range m.exchangeSlots {
+		if expires.Before(now) {
+			delete(m.exchangeSlots, slot)
+		}
+	}
+	if len(m.exchangeSlots) >= limit {
+		return false
+	}
+	m.exchangeSlots[id] = now.Add(lease)
+	return true
+}
+
+// ReleaseExchangeSlot frees a slot obtained from AcquireExchangeSlot.
+func (m *MemoryStore) ReleaseExchangeSlot(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.exchangeSlots, id)
+	return nil
+}
+
+// RecordRefreshOutcome logs one refresh attempt and drops history older
+// than the retention window.
+func (m *MemoryStore) RecordRefreshOutcome(ctx context.Context, provider string, ok bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	kept := m.refreshOutcomes[:0]
+	for _, o := range m.refreshOutcomes {
+		if !o.at.Before(now.Add(-RefreshOutcomeRetention)) {
+			kept = append(kept, o)
+		}
+	}
+	m.refreshOutcomes = append(kept, memRefreshOutcome{provider: provider, ok: ok, at: now})
+	return nil
+}
+
+// ClaimRefresh records a refresh of the token hashed as key, unless one was
+// recorded less than interval ago, which it returns instead.
+func (m *MemoryStore) ClaimRefresh(ctx context.Context, key string, interval time.Duration) (*RecentRefresh, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	cutoff := now.Add(-time.Duration(intervalSeconds(interval)) * time.Second)
+	for k, c := range m.refreshClaims {
+		if !c.At.After(cutoff) {
+			delete(m.refreshClaims, k)
+		}
+	}
+	if c, ok := m.refreshClaims[key]; ok {
+		c.Result = append([]byte(nil), c.Result...)
+		return &c, nil
+	}
+	m.refreshClaims[key] = RecentRefresh{At: now}
+	return nil, nil
+}
+
+// StoreRefreshResult keeps the sealed envelope of a claimed refresh.
+func (m *MemoryStore) StoreRefreshResult(ctx context.Context, key string, result []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.refreshClaims[key]; ok {
+		c.Result = append([]byte(nil), result...)
+		m.refreshClaims[key] = c
+	}
+	return nil
+}
+
+// ReleaseRefresh drops the claim on key after its refresh failed.
+func (m *MemoryStore) ReleaseRefresh(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.refreshClaims[key]; ok && len(c.Result) == 0 {
+		delete(m.refreshClaims, key)
+	}
+	return nil
+}
+
+// RefreshStatsSince returns per-provider refresh outcomes recorded at or
+// after since.
+func (m *MemoryStore) RefreshStatsSince(ctx context.Context, since time.Time) (map[string]RefreshStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]RefreshStats)
+	for _, o := range m.refreshOutcomes {
+		if o.at.Before(since) {
+			continue
+		}
+		st := out[o.provider]
+		if o.ok {
+			st.Success++
+		} else {
+			st.Failure++
+		}
+		out[o.provider] = st
+	}
+	return out, nil
+}
+
+// IncrementCounter adds one to the counter name{labels}.
+func (m *MemoryStore) IncrementCounter(ctx context.Context, name, labels string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name+"\x00"+labels]++
+	return nil
+}
+
+// Counters returns every counter total, ordered by name and labels.
+func (m *MemoryStore) Counters(ctx context.Context) ([]CounterSample, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]CounterSample, 0, len(m.counters))
+	for key, v := range m.counters {
+		name, labels, _ := strings.Cut(key, "\x00")
+		out = append(out, CounterSample{Name: name, Labels: labels, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Labels < out[j].Labels
+	})
+	return out, nil
+}
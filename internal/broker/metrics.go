@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Counter names, shared by the live registry and stored snapshots.
+const (
+	metricAuthStarts       = "broker_auth_starts_total"
+	metricCallbacks        = "broker_callbacks_total"
+	metricPolls            = "broker_polls_total"
+	metricRefreshes        = "broker_refreshes_total"
+	metricExchangeFailures = "broker_token_exchange_failures_total"
+)
+
+// counterDefs describes every broker counter. Only counters are persisted
+// with PERSIST_METRICS; the exchange latency histogram is live only.
+var counterDefs = []struct {
+	name, help string
+	labels     []string
+}{
+	{metricAuthStarts, "Authorisation flows started, by provider.", []string{"provider"}},
+	{metricCallbacks, "Provider callbacks received, by provider.", []string{"provider"}},
+	{metricPolls, "Polls for a known session, by provider.", []string{"provider"}},
+	{metricRefreshes, "Token refreshes, by provider and outcome (ok or error).", []string{"provider", "outcome"}},
+	{metricExchangeFailures, "Authorisation code exchanges the provider rejected or that failed, by provider.", []string{"provider"}},
+}
+
+// brokerMetrics counts broker traffic per provider for GET /metrics. Each
+// Server has its own registry, so several servers in one process (as in
+// selfcheck or brokertest) do not collide. Provider labels are only set
+// after the name has been checked against the registry, which keeps their
+// cardinality bounded.
+type brokerMetrics struct {
+	registry *prometheus.Registry
+
+	counters         map[string]*prometheus.CounterVec
+	exchangeDuration *prometheus.HistogramVec
+}
+
+func newBrokerMetrics() *brokerMetrics {
+	m := &brokerMetrics{
+		registry: prometheus.NewRegistry(),
+		counters: make(map[string]*prometheus.CounterVec, len(counterDefs)),
+		exchangeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "broker_token_exchange_duration_seconds",
+			Help:    "Time spent exchanging an authorisation code upstream, by provider.",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+		}, []string{"provider"}),
+	}
+	for _, def := range counterDefs {
+		c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: def.name, Help: def.help}, def.labels)
+		m.counters[def.name] = c
+		m.registry.MustRegister(c)
+	}
+	m.registry.MustRegister(
+		m.exchangeDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// count increments the named counter and, with PERSIST_METRICS, its total
+// in the store. A failed store write is logged rather than failing the
+// request.
+func (s *Server) count(ctx context.Context, name string, labels prometheus.Labels) {
+	s.metrics.counters[name].With(labels).Inc()
+	if !s.Config.PersistMetrics {
+		return
+	}
+	key, err := json.Marshal(labels)
+	if err == nil {
+		err = s.Store.IncrementCounter(ctx, name, string(key))
+	}
+	if err != nil {
+		s.logger(ctx).Error("persist metric failed", "metric", name, "error", err)
+	}
+}
+
+// exchangeTokens runs a provider code exchange, recording its latency and
+// any failure.
+func (s *Server) exchangeTokens(ctx context.Context, p Provider, params ExchangeParams) (TokenEnvelope, error) {
+	start := time.Now()
+	env, err := p.Exchange(ctx, params)
+	s.metrics.exchangeDuration.WithLabelValues(p.Name()).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.count(ctx, metricExchangeFailures, prometheus.Labels{"provider": p.Name()})
+	}
+	return env, err
+}
+
+// handleMetrics serves the Prometheus registry. Under CGI each process
+// starts from zero and the endpoint would sit on the public vhost, so it is
+// only served there when METRICS_ENABLED is set.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if os.Getenv("GATEWAY_INTERFACE") != "" && !s.Config.MetricsEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CounterSample is one stored counter total. Labels is the label set as a
+// JSON object, which is also its key in the store.
+type CounterSample struct {
+	Name   string
+	Labels string
+	Value  int64
+}
+
+// IncrementCounter adds one to the stored counter name{labels}. Totals live
+// in the database so a snapshot covers every CGI process.
+func (s *Store) IncrementCounter(ctx context.Context, name, labels string) error {
+	if _, err := s.db.ExecContext(ctx, `
+        INSERT INTO metrics(name, labels, value) VALUES(?, ?, 1)
+        ON CONFLICT(name, labels) DO UPDATE SET value = value + 1
+    `, name, labels); err != nil {
+		return fmt.Errorf("increment counter: %w", err)
+	}
+	return nil
+}
+
+// Counters returns every stored counter total, ordered by name and labels.
+func (s *Store) Counters(ctx context.Context) ([]CounterSample, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, labels, value FROM metrics ORDER BY name, labels`)
+	if err != nil {
+		return nil, fmt.Errorf("query counters: %w", err)
+	}
+	defer rows.Close()
+	var out []CounterSample
+	for rows.Next() {
+		var c CounterSample
+		if err := rows.Scan(&c.Name, &c.Labels, &c.Value); err != nil {
+			return nil, fmt.Errorf("scan counter: %w", err)
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// WriteMetricsSnapshot writes stored counter totals to w, as the Prometheus
+// text exposition format (format "text") or as a JSON document ("json"),
+// for pushing to a gateway from cron.
+func WriteMetricsSnapshot(w io.Writer, samples []CounterSample, format string) error {
+	switch format {
+	case "text":
+		return writeSnapshotText(w, samples)
+	case "json":
+		return writeSnapshotJSON(w, samples)
+	default:
+		return fmt.Errorf("unknown snapshot format %q (want text or json)", format)
+	}
+}
+
+func writeSnapshotText(w io.Writer, samples []CounterSample) error {
+	byName := make(map[string][]CounterSample)
+	for _, c := range samples {
+		byName[c.Name] = append(byName[c.Name], c)
+	}
+	var b strings.Builder
+	for _, def := range counterDefs {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", def.name, def.help, def.name)
+		for _, c := range byName[def.name] {
+			labels, err := decodeCounterLabels(c.Labels)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "%s%s %d\n", c.Name, formatPromLabels(labels), c.Value)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeSnapshotJSON(w io.Writer, samples []CounterSample) error {
+	type counter struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+		Value  int64             `json:"value"`
+	}
+	doc := struct {
+		Time     time.Time `json:"time"`
+		Counters []counter `json:"counters"`
+	}{Time: time.Now().UTC(), Counters: []counter{}}
+	for _, c := range samples {
+		labels, err := decodeCounterLabels(c.Labels)
+		if err != nil {
+			return err
+		}
+		doc.Counters = append(doc.Counters, counter{Name: c.Name, Labels: labels, Value: c.Value})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+func decodeCounterLabels(raw string) (map[string]string, error) {
+	labels := map[string]string{}
+	if err := json.Unmarshal([]byte(raw), &labels); err != nil {
+		return nil, fmt.Errorf("stored counter labels %q: %w", raw, err)
+	}
+	return labels, nil
+}
+
+func formatPromLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + strconv.Quote(labels[k])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// clientCertFiles returns the mutual TLS certificate and key paths configured
+// for provider, or empty strings when it authenticates with a secret only.
+func (c Config) clientCertFiles(provider string) (certFile, keyFile string) {
+	switch provider {
+	case "xero":
+		return c.XeroClientCert, c.XeroClientKey
+	case "deputy":
+		return c.DeputyClientCert, c.DeputyClientKey
+	case "qbo":
+		return c.QBOClientCert, c.QBOClientKey
+	case "myob":
+		return c.MYOBClientCert, c.MYOBClientKey
+	case "freshbooks":
+		return c.FreshBooksClientCert, c.FreshBooksClientKey
+	}
+	return "", ""
+}
+
+// validateClientCert checks that a provider's client certificate settings
+// come as a pair and that the pair loads.
+func (c Config) validateClientCert(provider string) error {
+	certFile, keyFile := c.clientCertFiles(provider)
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	prefix := strings.ToUpper(provider)
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("%s_CLIENT_CERT and %s_CLIENT_KEY must be set together", prefix, prefix)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("%s_CLIENT_CERT: %w", prefix, err)
+	}
+	return nil
+}
+
+// providerClient returns the HTTP client used for provider's upstream calls.
+// Providers with a client certificate get their own transport presenting it;
+// the rest share base.
+func providerClient(cfg Config, provider string, base *http.Client) *http.Client {
+	certFile, keyFile := cfg.clientCertFiles(provider)
+	if certFile == "" || keyFile == "" {
+		return base
+	}
+	var (
+		once sync.Once
+		cert tls.Certificate
+		err  error
+	)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Load on first handshake so a broken pair fails the provider call
+		// with a clear error rather than silently dropping to secret auth.
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			once.Do(func() {
+				cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("%s client certificate: %w", provider, err)
+			}
+			return &cert, nil
+		},
+	}
+	return &http.Client{
+		Timeout:   base.Timeout,
+		Transport: tracingTransport{base: transport},
+	}
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCert creates a self-signed client certificate and key under
+// dir and returns their paths with the parsed certificate.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// trustServer makes c's transport accept srv's self-signed certificate.
+func trustServer(t *testing.T, c *http.Client, srv *httptest.Server) {
+	t.Helper()
+	tt, ok := c.Transport.(tracingTransport)
+	if !ok {
+		t.Fatalf("provider client transport is %T", c.Transport)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tt.base.(*http.Transport).TLSClientConfig.RootCAs = roots
+}
+
+func TestProviderClientPresentsCertificate(t *testing.T) {
+	certFile, keyFile, cert := writeClientCert(t, t.TempDir())
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "broker-test" {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg := DefaultConfig()
+	cfg.QBOClientCert, cfg.QBOClientKey = certFile, keyFile
+	base := &http.Client{Timeout: 5 * time.Second}
+
+	if c := providerClient(cfg, "xero", base); c != base {
+		t.Fatal("provider without a certificate did not get the shared client")
+	}
+
+	c := providerClient(cfg, "qbo", base)
+	if c == base {
+		t.Fatal("provider with a certificate got the shared client")
+	}
+	if c.Timeout != base.Timeout {
+		t.Fatalf("timeout %v, want %v", c.Timeout, base.Timeout)
+	}
+	trustServer(t, c, srv)
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request with client certificate: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("server answered %d", resp.StatusCode)
+	}
+
+	// Without the certificate the server refuses the handshake.
+	plain := srv.Client()
+	if resp, err := plain.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("server accepted a client without a certificate")
+	}
+}
+
+func TestProviderClientUnreadableCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.WriteFile(f, []byte("not pem"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg := DefaultConfig()
+	cfg.DeputyClientCert, cfg.DeputyClientKey = certFile, keyFile
+	c := providerClient(cfg, "deputy", &http.Client{Timeout: 5 * time.Second})
+	trustServer(t, c, srv)
+	resp, err := c.Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("request succeeded with an unreadable certificate")
+	}
+	if !strings.Contains(err.Error(), "deputy client certificate") {
+		t.Fatalf("error does not name the provider's certificate: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// rejectUnsupportedNaming answers 400 when ?naming= asks for a form
+// respondEnvelope cannot produce. Handlers call it before touching the store
+// or the provider, since poll and exchange delete the session and refresh
+// rotates the token before the envelope is written.
+func rejectUnsupportedNaming(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Query().Get("naming") {
+	case "", "snake":
+		return false
+	}
+	respondJSONError(w, http.StatusBadRequest, "unsupported naming; use snake")
+	return true
+}
+
+// respondEnvelope writes a token envelope, honouring the optional ?naming=snake
+// query parameter. The default keeps the historical mixed field names so
+// existing clients are unaffected. The body is signed when key is set.
+func respondEnvelope(w http.ResponseWriter, r *http.Request, env TokenEnvelope, key ed25519.PrivateKey) {
+	switch r.URL.Query().Get("naming") {
+	case "":
+		respondSignedJSON(w, key, env)
+	case "snake":
+		data, err := jsonMarshal(env)
+		if err != nil {
+			respondJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		var generic any
+		if err := jsonUnmarshal(data, &generic); err != nil {
+			respondJSONError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		respondSignedJSON(w, key, snakeCaseKeys(generic))
+	default:
+		respondJSONError(w, http.StatusBadRequest, "unsupported naming; use snake")
+	}
+}
+
+// snakeCaseKeys rewrites every object key in a decoded JSON value to snake_case.
+func snakeCaseKeys(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, val := range t {
+			out[toSnakeCase(k)] = snakeCaseKeys(val)
+		}
+		return out
+	case []any:
+		for i, val := range t {
+			t[i] = snakeCaseKeys(val)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func toSnakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1])
+			if prevLower || nextLower {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package broker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+// postJSON sends body to the broker and decodes a JSON reply into out,
+// when out is non-nil.
+func postJSON(t *testing.T, target string, body any, out any) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(target, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decode %s reply: %v", target, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// startFlow begins an auth flow for provider and returns the session id and
+// the provider authorize URL.
+func startFlow(t *testing.T, srv *brokertest.Server, provider string) (session, authURL string) {
+	t.Helper()
+	var started struct {
+		AuthURL string `json:"auth_url"`
+		Session string `json:"session"`
+	}
+	if code := postJSON(t, srv.URL+"/v1/auth/start", map[string]string{"provider": provider, "profile": "test"}, &started); code != http.StatusOK {
+		t.Fatalf("auth start returned %d", code)
+	}
+	return started.Session, started.AuthURL
+}
+
+// completeFlow runs a whole flow and returns the session id, ready to poll.
+func completeFlow(t *testing.T, srv *brokertest.Server, provider string) string {
+	t.Helper()
+	session, authURL := startFlow(t, srv, provider)
+	if err := srv.Authorize(authURL); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func getStatus(t *testing.T, target string) int {
+	t.Helper()
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestUnsupportedNamingLeavesPollResult(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	session := completeFlow(t, srv, "xero")
+	poll := srv.URL + "/v1/auth/poll/" + session
+
+	if code := getStatus(t, poll+"?naming=kebab"); code != http.StatusBadRequest {
+		t.Fatalf("poll with naming=kebab returned %d, want 400", code)
+	}
+	if code := getStatus(t, poll+"?naming=snake"); code != http.StatusOK {
+		t.Fatalf("poll after rejected naming returned %d, want 200", code)
+	}
+}
+
+func TestUnsupportedNamingDoesNotRefresh(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	before := srv.Upstream.TokensIssued()
+	body := map[string]string{"provider": "xero", "refresh_token": "brokertest-refresh-0"}
+
+	if code := postJSON(t, srv.URL+"/v1/token/refresh?naming=kebab", body, nil); code != http.StatusBadRequest {
+		t.Fatalf("refresh with naming=kebab returned %d, want 400", code)
+	}
+	if got := srv.Upstream.TokensIssued(); got != before {
+		t.Fatalf("provider issued %d tokens for a rejected refresh", got-before)
+	}
+	var env map[string]any
+	if code := postJSON(t, srv.URL+"/v1/token/refresh?naming=snake", body, &env); code != http.StatusOK {
+		t.Fatalf("refresh with naming=snake returned %d, want 200", code)
+	}
+	if _, ok := env["access_token"]; !ok {
+		t.Fatalf("snake_case envelope lacks access_token: %v", env)
+	}
+}
@@ -0,0 +1,551 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+var (
+	//go:embed sql/schema_postgres.sql
+	postgresSchemaSQL string
+)
+
+// PostgresStore keeps sessions in PostgreSQL, for brokers run as several
+// standalone instances rather than CGI processes sharing one SQLite file.
+// Timestamps are stored as Unix seconds, as in Store, so the two backends
+// read and write the same values.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// OpenPostgresStore connects to dsn, a postgres:// URL, and applies the
+// schema. Credentials can come from the URL or the usual PG* environment
+// variables and ~/.pgpass.
+func OpenPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(postgresSchemaSQL); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("apply schema: %w", err)
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+// OpenPostgresStoreReadOnly connects to dsn with read-only transactions and
+// without applying the schema, for inspecting a live broker's database.
+func OpenPostgresStoreReadOnly(dsn string) (*PostgresStore, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parse postgres dsn: %w", err)
+	}
+	q := u.Query()
+	q.Set("default_transaction_read_only", "on")
+	u.RawQuery = q.Encode()
+	db, err := openPostgres(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db}, nil
+}
+
+func openPostgres(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open postgres: %w", err)
+	}
+	return db, nil
+}
+
+// isPostgresDSN reports whether dsn names a PostgreSQL database rather than
+// a SQLite file.
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// Close releases the underlying database handle.
+func (s *PostgresStore) Close() error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Ping checks that the database server can still be reached.
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// InsertSession creates a new session row.
+func (s *PostgresStore) InsertSession(ctx context.Context, sess Session) error {
+	_, err := s.db.ExecContext(ctx, `
+        INSERT INTO auth_session(id, provider, state, code_verifier, realm_id, created_at, expires_at, consumed, redirect_uri, nonce, return_url, client_ip)
+        VALUES($1, $2, $3, $4, $5, $6, $7, 0, $8, $9, $10, $11)
+    `, sess.ID, sess.Provider, sess.State, nullableString(sess.CodeVerifier), nullableString(sess.RealmID), sess.CreatedAt.Unix(), sess.ExpiresAt.Unix(), nullableString(sess.RedirectURI), nullableString(sess.Nonce), nullableString(sess.ReturnURL), nullableString(sess.ClientIP))
+	if err != nil {
+		return fmt.Errorf("insert session: %w", err)
+	}
+	return nil
+}
+
+// MarkReady stores the session result payload and the hash of the access
+// token it carries, and marks the session ready.
+func (s *PostgresStore) MarkReady(ctx context.Context, sessionID string, payload []byte, realmID *string, accessTokenHash string) error {
+	var realm sql.NullString
+	if realmID != nil {
+		realm = sql.NullString{String: *realmID, Valid: true}
+	}
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session
+           SET ready_at = $1, result_cipher = $2, realm_id = COALESCE($3, realm_id), access_token_hash = $4, consumed = 1
+         WHERE id = $5 AND consumed = 0
+    `, time.Now().Unix(), payload, nullableString(realm), nullableString(sql.NullString{String: accessTokenHash, Valid: accessTokenHash != ""}), sessionID)
+	if err != nil {
+		return fmt.Errorf("mark ready: %w", err)
+	}
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// LookupByState finds a pending session by provider and state value.
+func (s *PostgresStore) LookupByState(ctx context.Context, provider, state string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx, `
+        SELECT id, provider, state, code_verifier, realm_id, created_at, expires_at, ready_at, used_at, result_cipher, consumed, redirect_uri, nonce, return_url, client_ip, access_token_hash
+          FROM auth_session
+         WHERE provider = $1 AND state = $2 AND consumed = 0
+         ORDER BY created_at DESC
+         LIMIT 1
+    `, provider, state)
+	return scanSession(row)
+}
+
+// GetByState finds the newest session with state whether or not it has been
+// consumed. See Store.GetByState.
+func (s *PostgresStore) GetByState(ctx context.Context, provider, state string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx, `
+        SELECT id, provider, state, NULL, realm_id, created_at, expires_at, ready_at, used_at, NULL, consumed, redirect_uri, NULL, return_url, client_ip, NULL
+          FROM auth_session
+         WHERE state = $1 AND ($2 = '' OR provider = $2)
+         ORDER BY created_at DESC
+         LIMIT 1
+    `, state, provider)
+	return scanSession(row)
+}
+
+// LoadForPoll retrieves the session for polling.
+func (s *PostgresStore) LoadForPoll(ctx context.Context, sessionID string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx, `
+        SELECT id, provider, state, code_verifier, realm_id, created_at, expires_at, ready_at, used_at, result_cipher, consumed, redirect_uri, nonce, return_url, client_ip, access_token_hash
+          FROM auth_session
+         WHERE id = $1
+    `, sessionID)
+	return scanSession(row)
+}
+
+// ListSessions returns session metadata, newest first, without secrets.
+func (s *PostgresStore) ListSessions(ctx context.Context, filter SessionFilter) ([]Session, error) {
+	query := `
+        SELECT id, provider, '', NULL, realm_id, created_at, expires_at, ready_at, used_at, NULL, consumed, redirect_uri, NULL, return_url, client_ip, NULL,
+               ready_at IS NOT NULL AND result_cipher IS NULL
+          FROM auth_session
+         WHERE 1 = 1`
+	var args []any
+	if filter.Provider != "" {
+		args = append(args, filter.Provider)
+		query += fmt.Sprintf(` AND provider = $%d`, len(args))
+	}
+	if filter.ExpiredOnly {
+		args = append(args, time.Now().Unix())
+		query += fmt.Sprintf(` AND expires_at < $%d`, len(args))
+	}
+	query += ` ORDER BY created_at DESC`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	defer rows.Close()
+	var out []Session
+	for rows.Next() {
+		var collected bool
+		sess, err := scanSession(extraColumns{rows, []any{&collected}})
+		if err != nil {
+			return nil, err
+		}
+		sess.Collected = collected
+		out = append(out, *sess)
+	}
+	return out, rows.Err()
+}
+
+// MarkStateUsed records that a session's state has been redeemed, failing
+// with ErrStateUsed on a second use.
+func (s *PostgresStore) MarkStateUsed(ctx context.Context, sessionID string) error {
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET used_at = $1 WHERE id = $2 AND used_at IS NULL
+    `, time.Now().Unix(), sessionID)
+	if err != nil {
+		return fmt.Errorf("mark state used: %w", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrStateUsed
+	}
+	return nil
+}
+
+// ReleaseState undoes MarkStateUsed for a session whose exchange failed.
+func (s *PostgresStore) ReleaseState(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET used_at = NULL WHERE id = $1 AND consumed = 0
+    `, sessionID)
+	if err != nil {
+		return fmt.Errorf("release state: %w", err)
+	}
+	return nil
+}
+
+// SetReturnCode stores the hash of the one-time code a return_url redirect
+// carries, replacing any earlier one.
+func (s *PostgresStore) SetReturnCode(ctx context.Context, sessionID, codeHash string) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET return_code = $1 WHERE id = $2
+    `, codeHash, sessionID)
+	if err != nil {
+		return fmt.Errorf("set return code: %w", err)
+	}
+	return nil
+}
+
+// RedeemReturnCode spends a return code and loads its session for polling.
+// An unknown or already spent code is sql.ErrNoRows.
+func (s *PostgresStore) RedeemReturnCode(ctx context.Context, codeHash string) (*Session, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM auth_session WHERE return_code = $1`, codeHash).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET return_code = NULL WHERE id = $1 AND return_code = $2
+    `, id, codeHash)
+	if err != nil {
+		return nil, fmt.Errorf("redeem return code: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Another request spent it first.
+		return nil, sql.ErrNoRows
+	}
+	return s.LoadForPoll(ctx, id)
+}
+
+// Delete removes a session entirely.
+func (s *PostgresStore) Delete(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM auth_session WHERE id = $1`, sessionID)
+	if err != nil {
+		return fmt.Errorf("delete session: %w", err)
+	}
+	return nil
+}
+
+// RecordCallbackFailure counts a failed callback against a session and
+// returns the new total.
+func (s *PostgresStore) RecordCallbackFailure(ctx context.Context, sessionID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+        UPDATE auth_session
+           SET callback_failures = callback_failures + 1
+         WHERE id = $1
+     RETURNING callback_failures
+    `, sessionID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("record callback failure: %w", err)
+	}
+	return n, nil
+}
+
+// ClearResult drops a session's stored result but keeps the row until the
+// reaper removes it at expiry.
+func (s *PostgresStore) ClearResult(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE auth_session SET result_cipher = NULL WHERE id = $1`, sessionID)
+	if err != nil {
+		return fmt.Errorf("clear session result: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredBefore removes up to limit sessions whose TTL elapsed before t
+// and returns the number deleted. A limit of zero or less removes them all.
+func (s *PostgresStore) DeleteExpiredBefore(ctx context.Context, t time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+        DELETE FROM auth_session WHERE id IN (
+            SELECT id FROM auth_session WHERE expires_at < $1 LIMIT $2
+        )
+    `, t.Unix(), postgresLimit(limit))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// DeleteConsumedBefore removes up to limit sessions whose result was stored
+// before t but never collected by a poll, returning the number deleted. A
+// limit of zero or less removes them all. Xero tombstones, whose result a
+// poll already cleared, are left for the expiry reap.
+func (s *PostgresStore) DeleteConsumedBefore(ctx context.Context, t time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+        DELETE FROM auth_session WHERE id IN (
+            SELECT id FROM auth_session
+             WHERE consumed = 1 AND ready_at IS NOT NULL AND ready_at < $1
+               AND result_cipher IS NOT NULL
+             LIMIT $2
+        )
+    `, t.Unix(), postgresLimit(limit))
+	if err != nil {
+		return 0, fmt.Errorf("delete consumed sessions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// postgresLimit maps a non-positive limit to NULL, which PostgreSQL treats
+// as no limit.
+func postgresLimit(limit int) any {
+	if limit <= 0 {
+		return nil
+	}
+	return limit
+}
+
+// IncrementRateLimit records a call for key and fails with ErrRateLimited
+// once limit calls have been made in the current fixed window. The check and
+// the increment are one upsert, so concurrent brokers cannot both take the
+// last call in a window.
+func (s *PostgresStore) IncrementRateLimit(ctx context.Context, key string, limit int, window time.Duration) error {
+	if limit <= 0 {
+		return nil
+	}
+	windowSeconds := int64(window / time.Second)
+	if windowSeconds <= 0 {
+		windowSeconds = 1
+	}
+	// The conflict branch either starts a new window or counts the call, and
+	// updates nothing (so returns no row) when the window is already full.
+	now := time.Now().Unix()
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+        INSERT INTO rate_limit(key, window_start, count) VALUES($1, $2, 1)
+        ON CONFLICT (key) DO UPDATE SET
+            window_start = CASE WHEN $2 - rate_limit.window_start >= $3 THEN EXCLUDED.window_start ELSE rate_limit.window_start END,
+            count = CASE WHEN $2 - rate_limit.window_start >= $3 THEN 1 ELSE rate_limit.count + 1 END
+         WHERE $2 - rate_limit.window_start >= $3 OR rate_limit.count < $4
+        RETURNING count
+    `, key, now, windowSeconds, limit).Scan(&count)
+	switch {
+	case err == sql.ErrNoRows:
+		var start int64
+		if err := s.db.QueryRowContext(ctx, `SELECT window_start FROM rate_limit WHERE key = $1`, key).Scan(&start); err != nil {
+			return &RateLimitedError{RetryAfter: time.Duration(windowSeconds) * time.Second}
+		}
+		return windowFull(start, windowSeconds, now)
+	case err != nil:
+		return fmt.Errorf("increment rate limit: %w", err)
+	}
+	return nil
+}
+
+// AcquireExchangeSlot reserves one of limit shared upstream exchange slots,
+// waiting until ctx is done. An advisory lock serialises the count and the
+// insert across brokers. The returned id must be passed to
+// ReleaseExchangeSlot.
+func (s *PostgresStore) AcquireExchangeSlot(ctx context.Context, limit int, lease time.Duration) (string, error) {
+	id, err := randomID(16)
+	if err != nil {
+		return "", fmt.Errorf("allocate exchange slot id: %w", err)
+	}
+	for {
+		ok, err := s.tryAcquireSlot(ctx, id, limit, lease)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return id, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ErrExchangeBusy
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (s *PostgresStore) tryAcquireSlot(ctx context.Context, id string, limit int, lease time.Duration) (ok bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin exchange slot tx: %w", err)
+	}
+	defer func() {
+		if err != nil || !ok {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('exchange_slot'))`); err != nil {
+		return false, fmt.Errorf("lock exchange slots: %w", err)
+	}
+	now := time.Now()
+	if _, err = tx.ExecContext(ctx, `DELETE FROM exchange_slot WHERE expires_at < $1`, now.Unix()); err != nil {
+		return false, fmt.Errorf("expire exchange slots: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, `
+        INSERT INTO exchange_slot(id, expires_at)
+        SELECT $1::text, $2::bigint WHERE (SELECT COUNT(*) FROM exchange_slot) < $3
+    `, id, now.Add(lease).Unix(), limit)
+	if err != nil {
+		return false, fmt.Errorf("acquire exchange slot: %w", err)
+	}
+	if rows, _ := res.RowsAffected(); rows != 1 {
+		return false, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit exchange slot: %w", err)
+	}
+	return true, nil
+}
+
+// ReleaseExchangeSlot frees a slot obtained from AcquireExchangeSlot.
+func (s *PostgresStore) ReleaseExchangeSlot(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM exchange_slot WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("release exchange slot: %w", err)
+	}
+	return nil
+}
+
+// RecordRefreshOutcome logs one refresh attempt and drops history older than
+// the retention window.
+func (s *PostgresStore) RecordRefreshOutcome(ctx context.Context, provider string, ok bool) error {
+	now := time.Now()
+	okInt := 0
+	if ok {
+		okInt = 1
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO refresh_outcome(provider, ok, at) VALUES($1, $2, $3)`, provider, okInt, now.Unix()); err != nil {
+		return fmt.Errorf("record refresh outcome: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM refresh_outcome WHERE at < $1`, now.Add(-RefreshOutcomeRetention).Unix()); err != nil {
+		return fmt.Errorf("prune refresh outcomes: %w", err)
+	}
+	return nil
+}
+
+// ClaimRefresh records a refresh of the token hashed as key, unless one was
+// recorded less than interval ago, which it returns instead.
+func (s *PostgresStore) ClaimRefresh(ctx context.Context, key string, interval time.Duration) (*RecentRefresh, error) {
+	now := time.Now().Unix()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM refresh_claim WHERE refreshed_at <= $1`, now-intervalSeconds(interval)); err != nil {
+		return nil, fmt.Errorf("prune refresh claims: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO refresh_claim(key, refreshed_at) VALUES($1, $2) ON CONFLICT(key) DO NOTHING`, key, now)
+	if err != nil {
+		return nil, fmt.Errorf("claim refresh: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, fmt.Errorf("claim refresh: %w", err)
+	} else if n == 1 {
+		return nil, nil
+	}
+	var at int64
+	var result []byte
+	err = s.db.QueryRowContext(ctx, `SELECT refreshed_at, result_cipher FROM refresh_claim WHERE key = $1`, key).Scan(&at, &result)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Pruned by a concurrent claim between the insert and here.
+		return s.ClaimRefresh(ctx, key, interval)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query refresh claim: %w", err)
+	}
+	return &RecentRefresh{At: time.Unix(at, 0), Result: result}, nil
+}
+
+// StoreRefreshResult keeps the sealed envelope of a claimed refresh.
+func (s *PostgresStore) StoreRefreshResult(ctx context.Context, key string, result []byte) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE refresh_claim SET result_cipher = $1 WHERE key = $2`, result, key); err != nil {
+		return fmt.Errorf("store refresh result: %w", err)
+	}
+	return nil
+}
+
+// ReleaseRefresh drops the claim on key after its refresh failed.
+func (s *PostgresStore) ReleaseRefresh(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM refresh_claim WHERE key = $1 AND result_cipher IS NULL`, key); err != nil {
+		return fmt.Errorf("release refresh claim: %w", err)
+	}
+	return nil
+}
+
+// RefreshStatsSince returns per-provider refresh outcomes recorded at or
+// after since.
+func (s *PostgresStore) RefreshStatsSince(ctx context.Context, since time.Time) (map[string]RefreshStats, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT provider, SUM(ok), SUM(1 - ok)
+          FROM refresh_outcome
+         WHERE at >= $1
+         GROUP BY provider
+    `, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query refresh stats: %w", err)
+	}
+	defer rows.Close()
+	out := make(map[string]RefreshStats)
+	for rows.Next() {
+		var provider string
+		var st RefreshStats
+		if err := rows.Scan(&provider, &st.Success, &st.Failure); err != nil {
+			return nil, fmt.Errorf("scan refresh stats: %w", err)
+		}
+		out[provider] = st
+	}
+	return out, rows.Err()
+}
+
+// IncrementCounter adds one to the stored counter name{labels}.
+func (s *PostgresStore) IncrementCounter(ctx context.Context, name, labels string) error {
+	if _, err := s.db.ExecContext(ctx, `
+        INSERT INTO metrics(name, labels, value) VALUES($1, $2, 1)
+        ON CONFLICT (name, labels) DO UPDATE SET value = metrics.value + 1
+    `, name, labels); err != nil {
+		return fmt.Errorf("increment counter: %w", err)
+	}
+	return nil
+}
+
+// Counters returns every stored counter total, ordered by name and labels.
+func (s *PostgresStore) Counters(ctx context.Context) ([]CounterSample, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, labels, value FROM metrics ORDER BY name, labels`)
+	if err != nil {
+		return nil, fmt.Errorf("query counters: %w", err)
+	}
+	defer rows.Close()
+	var out []CounterSample
+	for rows.Next() {
+		var c CounterSample
+		if err := rows.Scan(&c.Name, &c.Labels, &c.Value); err != nil {
+			return nil, fmt.Errorf("scan counter: %w", err)
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestPostgresStore returns a PostgresStore in a schema of its own on
+// the server named by BROKER_TEST_POSTGRES_DSN, dropped when the test ends,
+// or nil when the variable is unset.
+func openTestPostgresStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	dsn := os.Getenv("BROKER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		return nil
+	}
+	admin, err := openPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	schema := "broker_test_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	st, err := OpenPostgresStore(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestIsPostgresDSN(t *testing.T) {
+	for dsn, want := range map[string]bool{
+		"postgres://broker@db/broker":   true,
+		"postgresql://broker@db/broker": true,
+		"/var/lib/broker/broker.db":     false,
+		"sqlite:/var/lib/broker.db":     false,
+	} {
+		if got := isPostgresDSN(dsn); got != want {
+			t.Errorf("isPostgresDSN(%q) = %v, want %v", dsn, got, want)
+		}
+	}
+}
+
+func TestDurableStoreLookups(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testDurableStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			for _, sess := range []Session{
+				{ID: "old", Provider: "xero", State: "old-state", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+				{ID: "new", Provider: "qbo", State: "new-state", CreatedAt: now, ExpiresAt: now.Add(time.Hour), CodeVerifier: sql.NullString{String: "verifier", Valid: true}},
+			} {
+				if err := st.InsertSession(ctx, sess); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := st.MarkReady(ctx, "new", []byte("sealed"), nil, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			// LookupByState only finds sessions still waiting for a
+			// callback; GetByState finds consumed ones too.
+			if _, err := st.LookupByState(ctx, "qbo", "new-state"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("LookupByState found a consumed session: %v", err)
+			}
+			got, err := st.GetByState(ctx, "qbo", "new-state")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != "new" || !got.Consumed {
+				t.Fatalf("GetByState returned %+v", got)
+			}
+
+			all, err := st.ListSessions(ctx, SessionFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 2 || all[0].ID != "new" || all[1].ID != "old" {
+				t.Fatalf("ListSessions returned %+v, want new then old", all)
+			}
+			if all[0].CodeVerifier.Valid || len(all[0].Result) != 0 {
+				t.Fatal("ListSessions returned secrets")
+			}
+			if got := all[0].Status(now); got != "ready" {
+				t.Fatalf("uncollected session status %q, want ready", got)
+			}
+			if err := st.ClearResult(ctx, "new"); err != nil {
+				t.Fatal(err)
+			}
+			if all, err = st.ListSessions(ctx, SessionFilter{Provider: "qbo"}); err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 1 || all[0].Status(now) != "consumed" {
+				t.Fatalf("collected session listed as %+v, want consumed", all)
+			}
+			expired, err := st.ListSessions(ctx, SessionFilter{ExpiredOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expired) != 1 || expired[0].ID != "old" {
+				t.Fatalf("expired filter returned %+v", expired)
+			}
+			byProvider, err := st.ListSessions(ctx, SessionFilter{Provider: "xero"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(byProvider) != 1 || byProvider[0].ID != "old" {
+				t.Fatalf("provider filter returned %+v", byProvider)
+			}
+		})
+	}
+}
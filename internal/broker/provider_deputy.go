@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// deputyProvider implements Deputy's confidential-client OAuth flow, which
+// returns the customer's install endpoint alongside the tokens.
+type deputyProvider struct {
+	providerBase
+}
+
+func (p *deputyProvider) Name() string { return "deputy" }
+
+// credentials: Deputy takes the client credentials as form fields.
+func (p *deputyProvider) credentials() clientCredentials {
+	return clientCredentials{ID: p.cfg.DeputyClientID, Secret: p.cfg.DeputyClientSecret, Auth: ClientAuthForm}
+}
+
+func (p *deputyProvider) StartAuth(state, nonce, redirectURI string, scopes []string) (string, sql.NullString, error) {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.DeputyClientID)
+	v.Set("redirect_uri", redirectOr(redirectURI, p.cfg.DeputyRedirectURL))
+	v.Set("scope", strings.Join(scopesOr(scopes, p.cfg.DeputyScopes), " "))
+	v.Set("state", state)
+	var verifier sql.NullString
+	if p.cfg.DeputyUsePKCE {
+		var challenge string
+		var err error
+		if verifier, challenge, err = newPKCE(); err != nil {
+			return "", sql.NullString{}, err
+		}
+		setPKCE(v, challenge)
+	}
+	mergeAuthParams(v, p.cfg.DeputyExtraAuth)
+	authURL := p.cfg.GetDeputyAuthURL() + "?" + v.Encode()
+	return authURL, verifier, nil
+}
+
+func (p *deputyProvider) Exchange(ctx context.Context, params ExchangeParams) (TokenEnvelope, error) {
+	if params.Code == "" {
+		return TokenEnvelope{}, fmt.Errorf("missing code")
+	}
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	p.credentials().setForm(data)
+	data.Set("redirect_uri", sessionRedirect(params.Session, p.cfg.DeputyRedirectURL))
+	data.Set("code", params.Code)
+	setCodeVerifier(data, params.Session)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetDeputyTokenURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return TokenEnvelope{}, fmt.Errorf("deputy token error: %s", body)
+	}
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+		Endpoint     string `json:"endpoint"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return TokenEnvelope{}, err
+	}
+	expiresAt, nonExpiring := tokenExpiry(payload.ExpiresIn)
+	return TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		Endpoint:     payload.Endpoint,
+		TokenType:    payload.TokenType,
+	}, nil
+}
+
+func (p *deputyProvider) Refresh(ctx context.Context, params RefreshParams) (TokenEnvelope, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", params.RefreshToken)
+	p.credentials().setForm(data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetDeputyTokenURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return TokenEnvelope{}, fmt.Errorf("deputy refresh error: %s", body)
+	}
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+		Endpoint     string `json:"endpoint"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return TokenEnvelope{}, err
+	}
+	expiresAt, nonExpiring := tokenExpiry(payload.ExpiresIn)
+	return TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		Endpoint:     payload.Endpoint,
+		TokenType:    payload.TokenType,
+	}, nil
+}
+
+// Revoke is unsupported: Deputy publishes no revocation endpoint, and its
+// logout only ends the browser session, leaving issued tokens valid.
+func (p *deputyProvider) Revoke(ctx context.Context, token, tokenTypeHint string) error {
+	return ErrRevokeUnsupported
+}
@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// freshBooksProvider implements FreshBooks' confidential-client OAuth flow.
+// Tokens are issued per user, so the businesses (and their account ids) the
+// user belongs to are resolved from the identity endpoint after exchange.
+type freshBooksProvider struct {
+	providerBase
+}
+
+func (p *freshBooksProvider) Name() string { return "freshbooks" }
+
+func (p *freshBooksProvider) StartAuth(state, nonce, redirectURI string, scopes []string) (string, sql.NullString, error) {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.FreshBooksClientID)
+	v.Set("redirect_uri", redirectOr(redirectURI, p.cfg.FreshBooksRedirectURL))
+	v.Set("scope", strings.Join(scopesOr(scopes, p.cfg.FreshBooksScopes), " "))
+	v.Set("state", state)
+	mergeAuthParams(v, p.cfg.FreshBooksExtraAuth)
+	authURL := p.cfg.GetFreshBooksAuthURL() + "?" + v.Encode()
+	return authURL, sql.NullString{}, nil
+}
+
+func (p *freshBooksProvider) Exchange(ctx context.Context, params ExchangeParams) (TokenEnvelope, error) {
+	if params.Code == "" {
+		return TokenEnvelope{}, fmt.Errorf("missing code")
+	}
+	env, err := p.token(ctx, map[string]string{
+		"grant_type":   "authorization_code",
+		"code":         params.Code,
+		"redirect_uri": sessionRedirect(params.Session, p.cfg.FreshBooksRedirectURL),
+	}, "token")
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+
+	businesses, err := p.fetchBusinesses(ctx, env.AccessToken)
+	if err != nil {
+		p.logger(ctx).Warn("fetch businesses failed", "provider", p.Name(), "error", err)
+	}
+	env.Businesses = businesses
+	if len(businesses) == 1 {
+		env.AccountID = businesses[0].AccountID
+	}
+	return env, nil
+}
+
+func (p *freshBooksProvider) Refresh(ctx context.Context, params RefreshParams) (TokenEnvelope, error) {
+	return p.token(ctx, map[string]string{
+		"grant_type":    "refresh_token",
+		"refresh_token": params.RefreshToken,
+		"redirect_uri":  p.cfg.FreshBooksRedirectURL,
+	}, "refresh")
+}
+
+func (p *freshBooksProvider) Revoke(ctx context.Context, token, tokenTypeHint string) error {
+	body, err := json.Marshal(p.withClient(map[string]string{"token": token}))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetFreshBooksRevokeURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	p.credentials().authorize(req)
+	return doRevoke(p.client, p.Name(), req)
+}
+
+// credentials: FreshBooks takes the client credentials in the JSON body
+// rather than as basic auth.
+func (p *freshBooksProvider) credentials() clientCredentials {
+	return clientCredentials{ID: p.cfg.FreshBooksClientID, Secret: p.cfg.FreshBooksClientSecret, Auth: ClientAuthForm}
+}
+
+// withClient adds the body credential fields to a JSON request.
+func (p *freshBooksProvider) withClient(fields map[string]string) map[string]string {
+	for k, v := range p.credentials().bodyFields() {
+		fields[k] = v
+	}
+	return fields
+}
+
+// token posts a grant to the FreshBooks token endpoint.
+func (p *freshBooksProvider) token(ctx context.Context, fields map[string]string, kind string) (TokenEnvelope, error) {
+	body, err := json.Marshal(p.withClient(fields))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetFreshBooksTokenURL(), bytes.NewReader(body))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	p.credentials().authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("freshbooks", resp); err != nil {
+		return TokenEnvelope{}, err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return TokenEnvelope{}, fmt.Errorf("freshbooks %s error: %s", kind, body)
+	}
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return TokenEnvelope{}, err
+	}
+	expiresAt, nonExpiring := tokenExpiry(payload.ExpiresIn)
+	return TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		TokenType:    payload.TokenType,
+	}, nil
+}
+
+// fetchBusinesses lists the businesses the token's user is a member of.
+func (p *freshBooksProvider) fetchBusinesses(ctx context.Context, accessToken string) (businesses []FreshBooksBusiness, err error) {
+	ctx, end := startProviderSpan(ctx, p.Name(), "identity")
+	defer func() { end(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.GetFreshBooksAPIBaseURL()+"/auth/api/v1/users/me", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("freshbooks", resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("freshbooks identity error: %s", body)
+	}
+	var payload struct {
+		Response struct {
+			BusinessMemberships []struct {
+				Business struct {
+					ID        int64  `json:"id"`
+					AccountID string `json:"account_id"`
+					Name      string `json:"name"`
+				} `json:"business"`
+			} `json:"business_memberships"`
+		} `json:"response"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("freshbooks identity: %w", err)
+	}
+	for _, m := range payload.Response.BusinessMemberships {
+		businesses = append(businesses, FreshBooksBusiness{
+			ID:        m.Business.ID,
+			AccountID: m.Business.AccountID,
+			Name:      m.Business.Name,
+		})
+	}
+	return businesses, nil
+}
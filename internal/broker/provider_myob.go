@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// myobProvider implements MYOB's confidential-client OAuth flow and resolves
+// the AccountRight company files the token can reach. Calls against a
+// company file also need an x-myobapi-cftoken built from the file's own
+// sign-on, which the CLI collects; the broker never sees it.
+type myobProvider struct {
+	providerBase
+}
+
+func (p *myobProvider) Name() string { return "myob" }
+
+func (p *myobProvider) StartAuth(state, nonce, redirectURI string, scopes []string) (string, sql.NullString, error) {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.MYOBClientID)
+	v.Set("redirect_uri", redirectOr(redirectURI, p.cfg.MYOBRedirectURL))
+	v.Set("scope", strings.Join(scopesOr(scopes, p.cfg.MYOBScopes), " "))
+	v.Set("state", state)
+	mergeAuthParams(v, p.cfg.MYOBExtraAuth)
+	authURL := p.cfg.GetMYOBAuthURL() + "?" + v.Encode()
+	return authURL, sql.NullString{}, nil
+}
+
+// myobTokenResponse is MYOB's token payload, which sends expires_in as a
+// quoted string.
+type myobTokenResponse struct {
+	AccessToken  string      `json:"access_token"`
+	RefreshToken string      `json:"refresh_token"`
+	ExpiresIn    json.Number `json:"expires_in"`
+	Scope        string      `json:"scope"`
+	TokenType    string      `json:"token_type"`
+}
+
+func (p *myobProvider) Exchange(ctx context.Context, params ExchangeParams) (TokenEnvelope, error) {
+	if params.Code == "" {
+		return TokenEnvelope{}, fmt.Errorf("missing code")
+	}
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", params.Code)
+	data.Set("redirect_uri", sessionRedirect(params.Session, p.cfg.MYOBRedirectURL))
+	data.Set("scope", strings.Join(p.cfg.MYOBScopes, " "))
+	payload, err := p.token(ctx, data, "token")
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+
+	files, err := p.fetchCompanyFiles(ctx, payload.AccessToken)
+	if err != nil {
+		p.logger(ctx).Warn("fetch company files failed", "provider", p.Name(), "error", err)
+	}
+	files = p.pickCompanyFile(files, params.BusinessID)
+
+	env := p.envelope(payload)
+	env.CompanyFiles = files
+	return env, nil
+}
+
+func (p *myobProvider) Refresh(ctx context.Context, params RefreshParams) (TokenEnvelope, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", params.RefreshToken)
+	payload, err := p.token(ctx, data, "refresh")
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	return p.envelope(payload), nil
+}
+
+// Revoke is unsupported: MYOB publishes no revocation endpoint; access is
+// withdrawn from the MYOB account's connected apps page.
+func (p *myobProvider) Revoke(ctx context.Context, token, tokenTypeHint string) error {
+	return ErrRevokeUnsupported
+}
+
+// credentials: MYOB expects the client credentials in the form body rather
+// than basic auth.
+func (p *myobProvider) credentials() clientCredentials {
+	return clientCredentials{ID: p.cfg.MYOBClientID, Secret: p.cfg.MYOBClientSecret, Auth: ClientAuthForm}
+}
+
+// token posts a grant to MYOB's token endpoint.
+func (p *myobProvider) token(ctx context.Context, data url.Values, kind string) (myobTokenResponse, error) {
+	p.credentials().setForm(data)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetMYOBTokenURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return myobTokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return myobTokenResponse{}, err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("myob", resp); err != nil {
+		return myobTokenResponse{}, err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return myobTokenResponse{}, fmt.Errorf("myob %s error: %s", kind, body)
+	}
+	var payload myobTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return myobTokenResponse{}, err
+	}
+	return payload, nil
+}
+
+func (p *myobProvider) envelope(payload myobTokenResponse) TokenEnvelope {
+	expiresIn, _ := payload.ExpiresIn.Int64()
+	expiresAt, nonExpiring := tokenExpiry(expiresIn)
+	return TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		TokenType:    payload.TokenType,
+	}
+}
+
+// fetchCompanyFiles lists the AccountRight company files accessToken can
+// reach, keeping only the fields the CLI needs.
+func (p *myobProvider) fetchCompanyFiles(ctx context.Context, accessToken string) (files []MYOBCompanyFile, err error) {
+	ctx, end := startProviderSpan(ctx, p.Name(), "company_files")
+	defer func() { end(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(p.cfg.GetMYOBAPIBaseURL(), "/")+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("x-myobapi-key", p.cfg.MYOBClientID)
+	req.Header.Set("x-myobapi-version", "v2")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("myob", resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("myob company files error: %s", body)
+	}
+	dec := json.NewDecoder(resp.Body)
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("myob company files: %w", err)
+	}
+	for dec.More() {
+		var f MYOBCompanyFile
+		if err := dec.Decode(&f); err != nil {
+			return nil, fmt.Errorf("myob company files: %w", err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// pickCompanyFile narrows files to the one chosen on MYOB's consent screen.
+// When that file is missing from the listing, its URI is derived from the
+// business id so the CLI can still use it.
+func (p *myobProvider) pickCompanyFile(files []MYOBCompanyFile, businessID string) []MYOBCompanyFile {
+	if businessID == "" {
+		return files
+	}
+	for _, f := range files {
+		if strings.EqualFold(f.ID, businessID) {
+			return []MYOBCompanyFile{f}
+		}
+	}
+	return []MYOBCompanyFile{{
+		ID:  businessID,
+		URI: strings.TrimRight(p.cfg.GetMYOBAPIBaseURL(), "/") + "/" + url.PathEscape(businessID),
+	}}
+}
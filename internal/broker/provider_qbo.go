@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// qboProvider implements QuickBooks Online OAuth; the company realm id
+// arrives on the callback rather than in the token response.
+type qboProvider struct {
+	providerBase
+}
+
+func (p *qboProvider) Name() string { return "qbo" }
+
+// credentials: Intuit takes basic auth, or just the client id when a TLS
+// client certificate stands in for the secret.
+func (p *qboProvider) credentials() clientCredentials {
+	return basicOrPublic(p.cfg.QBOClientID, p.cfg.QBOClientSecret)
+}
+
+func (p *qboProvider) StartAuth(state, nonce, redirectURI string, scopes []string) (string, sql.NullString, error) {
+	v := url.Values{}
+	v.Set("client_id", p.cfg.QBOClientID)
+	v.Set("redirect_uri", redirectOr(redirectURI, p.cfg.QBORedirectURL))
+	v.Set("response_type", "code")
+	scopes = scopesOr(scopes, p.cfg.QBOScopes)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	if nonce != "" && requestsOpenID(scopes) {
+		v.Set("nonce", nonce)
+	}
+	var verifier sql.NullString
+	if p.cfg.QBOUsePKCE {
+		var challenge string
+		var err error
+		if verifier, challenge, err = newPKCE(); err != nil {
+			return "", sql.NullString{}, err
+		}
+		setPKCE(v, challenge)
+	}
+	mergeAuthParams(v, p.cfg.QBOExtraAuth)
+	authURL := p.cfg.GetQBOAuthURL() + "?" + v.Encode()
+	return authURL, verifier, nil
+}
+
+func (p *qboProvider) Exchange(ctx context.Context, params ExchangeParams) (TokenEnvelope, error) {
+	if params.Code == "" {
+		return TokenEnvelope{}, fmt.Errorf("missing code")
+	}
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", params.Code)
+	data.Set("redirect_uri", sessionRedirect(params.Session, p.cfg.QBORedirectURL))
+	setCodeVerifier(data, params.Session)
+	p.credentials().setForm(data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetQBOTokenURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return TokenEnvelope{}, fmt.Errorf("qbo token error: %s", body)
+	}
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		XRefresh     int64  `json:"x_refresh_token_expires_in"`
+		Scope        string `json:"scope"`
+		TokenType    string `json:"token_type"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return TokenEnvelope{}, err
+	}
+	expiresAt, nonExpiring := tokenExpiry(payload.ExpiresIn)
+	env := TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		TokenType:    payload.TokenType,
+		IDToken:      payload.IDToken,
+		RealmID:      params.RealmID,
+		Environment:  p.cfg.QBOEnvironment,
+	}
+	if payload.XRefresh > 0 {
+		if env.Raw == nil {
+			env.Raw = make(map[string]any)
+		}
+		env.Raw["refresh_token_expires_in"] = payload.XRefresh
+	}
+	if err := p.verifyEnvelopeIDToken(ctx, &env, params.Session, p.cfg.GetQBOIssuer(), p.cfg.GetQBOJWKSURL(), p.cfg.QBOClientID); err != nil {
+		return TokenEnvelope{}, fmt.Errorf("qbo: %w", err)
+	}
+	return env, nil
+}
+
+func (p *qboProvider) Refresh(ctx context.Context, params RefreshParams) (TokenEnvelope, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", params.RefreshToken)
+	p.credentials().setForm(data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetQBOTokenURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return TokenEnvelope{}, fmt.Errorf("qbo refresh error: %s", body)
+	}
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		XRefresh     int64  `json:"x_refresh_token_expires_in"`
+		Scope        string `json:"scope"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return TokenEnvelope{}, err
+	}
+	expiresAt, nonExpiring := tokenExpiry(payload.ExpiresIn)
+	env := TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		TokenType:    payload.TokenType,
+		RealmID:      params.RealmID,
+		Environment:  p.cfg.QBOEnvironment,
+	}
+	if payload.XRefresh > 0 {
+		if env.Raw == nil {
+			env.Raw = make(map[string]any)
+		}
+		env.Raw["refresh_token_expires_in"] = payload.XRefresh
+	}
+	return env, nil
+}
+
+func (p *qboProvider) Revoke(ctx context.Context, token, tokenTypeHint string) error {
+	fields := map[string]string{"token": token}
+	for k, v := range p.credentials().bodyFields() {
+		fields[k] = v
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetQBORevokeURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	p.credentials().authorize(req)
+	return doRevoke(p.client, p.Name(), req)
+}
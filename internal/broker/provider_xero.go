@@ -0,0 +1,306 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// xeroProvider implements Auth Code + PKCE against Xero and resolves the
+// authorised tenants via the /connections API.
+type xeroProvider struct {
+	providerBase
+}
+
+func (p *xeroProvider) Name() string { return "xero" }
+
+// credentials: Xero web apps use basic auth; PKCE apps have no secret.
+func (p *xeroProvider) credentials() clientCredentials {
+	return basicOrPublic(p.cfg.XeroClientID, p.cfg.XeroClientSecret)
+}
+
+func (p *xeroProvider) StartAuth(state, nonce, redirectURI string, scopes []string) (string, sql.NullString, error) {
+	verifier, challenge, err := newPKCE()
+	if err != nil {
+		return "", sql.NullString{}, err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.XeroClientID)
+	v.Set("redirect_uri", redirectOr(redirectURI, p.cfg.XeroRedirectURL))
+	scopes = scopesOr(scopes, p.cfg.XeroScopes)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	setPKCE(v, challenge)
+	if nonce != "" && requestsOpenID(scopes) {
+		v.Set("nonce", nonce)
+	}
+	mergeAuthParams(v, p.cfg.XeroExtraAuth)
+	authURL := p.cfg.GetXeroAuthURL() + "?" + v.Encode()
+	return authURL, verifier, nil
+}
+
+func (p *xeroProvider) Exchange(ctx context.Context, params ExchangeParams) (TokenEnvelope, error) {
+	if params.Code == "" {
+		return TokenEnvelope{}, fmt.Errorf("missing code")
+	}
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", params.Code)
+	data.Set("redirect_uri", sessionRedirect(params.Session, p.cfg.XeroRedirectURL))
+	p.credentials().setForm(data)
+	setCodeVerifier(data, params.Session)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetXeroTokenURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return TokenEnvelope{}, fmt.Errorf("xero token error: %s", body)
+	}
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+		TokenType    string `json:"token_type"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return TokenEnvelope{}, err
+	}
+
+	tenants, err := p.fetchConnections(ctx, payload.AccessToken)
+	if err != nil {
+		p.logger(ctx).Warn("fetch connections failed", "provider", p.Name(), "error", err)
+	}
+	raw := connectionsErrorRaw(err)
+
+	expiresAt, nonExpiring := tokenExpiry(payload.ExpiresIn)
+	env := TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		TokenType:    payload.TokenType,
+		IDToken:      payload.IDToken,
+		Tenants:      tenants,
+		Raw:          raw,
+	}
+	if err := p.verifyEnvelopeIDToken(ctx, &env, params.Session, p.cfg.GetXeroIssuer(), p.cfg.GetXeroJWKSURL(), p.cfg.XeroClientID); err != nil {
+		return TokenEnvelope{}, fmt.Errorf("xero: %w", err)
+	}
+	return env, nil
+}
+
+func (p *xeroProvider) Refresh(ctx context.Context, params RefreshParams) (TokenEnvelope, error) {
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", params.RefreshToken)
+	p.credentials().setForm(data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetXeroTokenURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("xero", resp); err != nil {
+		return TokenEnvelope{}, err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return TokenEnvelope{}, fmt.Errorf("xero refresh error: %s", body)
+	}
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return TokenEnvelope{}, err
+	}
+	tenants, err := p.fetchConnections(ctx, payload.AccessToken)
+	if err != nil {
+		p.logger(ctx).Warn("fetch connections failed", "provider", p.Name(), "error", err)
+	}
+	raw := connectionsErrorRaw(err)
+	expiresAt, nonExpiring := tokenExpiry(payload.ExpiresIn)
+	return TokenEnvelope{
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		ExpiresAt:    expiresAt,
+		NonExpiring:  nonExpiring,
+		Scope:        payload.Scope,
+		TokenType:    payload.TokenType,
+		Tenants:      tenants,
+		Raw:          raw,
+	}, nil
+}
+
+// connectionsErrorRaw records a throttled /connections lookup in the envelope
+// so clients know why no tenants were returned and when to try again.
+func connectionsErrorRaw(err error) map[string]any {
+	var rl *ProviderRateLimitError
+	if !errors.As(err, &rl) {
+		return nil
+	}
+	return map[string]any{
+		"connections_error":       "provider_rate_limited",
+		"connections_retry_after": int64(rl.RetryAfter / time.Second),
+	}
+}
+
+func (p *xeroProvider) fetchConnections(ctx context.Context, accessToken string) (tenants []XeroTenant, err error) {
+	ctx, end := startProviderSpan(ctx, p.Name(), "connections")
+	defer func() { end(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.GetXeroAPIBaseURL()+"/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("xero", resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("xero connections error: %s", body)
+	}
+	// Decode one entry at a time, keeping only the essential fields, so a
+	// large connection list is never held in memory in full.
+	dec := json.NewDecoder(resp.Body)
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("xero connections: %w", err)
+	}
+	for dec.More() {
+		var t XeroTenant
+		if err := dec.Decode(&t); err != nil {
+			return nil, fmt.Errorf("xero connections: %w", err)
+		}
+		if strings.TrimSpace(t.TenantID) == "" {
+			// Nothing can be called against a tenant without an id.
+			p.logger(ctx).Warn("skipping xero connection without tenant id", "provider", p.Name(), "connection_id", t.ID, "tenant_name", t.TenantName)
+			continue
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// copyConnections streams the full /connections response for accessToken
+// to w, for callers that need more than the fields kept in XeroTenant.
+// started reports whether a response was already written to w.
+func (p *xeroProvider) copyConnections(ctx context.Context, accessToken string, w http.ResponseWriter) (started bool, err error) {
+	ctx, end := startProviderSpan(ctx, p.Name(), "connections")
+	defer func() { end(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.GetXeroAPIBaseURL()+"/connections", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("xero", resp); err != nil {
+		return false, err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, &ProviderError{Provider: p.Name(), Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, resp.Body)
+	return true, err
+}
+
+// connectionForTenant returns the id of accessToken's connection to
+// tenantID, or "" when that tenant is not among its connections.
+func (p *xeroProvider) connectionForTenant(ctx context.Context, accessToken, tenantID string) (string, error) {
+	tenants, err := p.fetchConnections(ctx, accessToken)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tenants {
+		if t.TenantID == tenantID {
+			return t.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// deleteConnection removes one organisation connection from the user's Xero
+// account. Revoking a token leaves its connections in place; this is the
+// only way to undo them.
+func (p *xeroProvider) deleteConnection(ctx context.Context, accessToken, connectionID string) (err error) {
+	ctx, end := startProviderSpan(ctx, p.Name(), "disconnect")
+	defer func() { end(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, p.cfg.GetXeroAPIBaseURL()+"/connections/"+url.PathEscape(connectionID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse("xero", resp); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &ProviderError{Provider: p.Name(), Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+func (p *xeroProvider) Revoke(ctx context.Context, token, tokenTypeHint string) error {
+	data := url.Values{}
+	data.Set("token", token)
+	if tokenTypeHint != "" {
+		data.Set("token_type_hint", tokenTypeHint)
+	}
+	p.credentials().setForm(data)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.GetXeroRevokeURL(), strings.NewReader(data.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.credentials().authorize(req)
+	return doRevoke(p.client, p.Name(), req)
+}
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestXeroConnectionsMixedCompleteness(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			{"id":"c1","tenantId":"t1","tenantType":"ORGANISATION","tenantName":"Complete Ltd"},
+			{"id":"c2","tenantId":"t2","tenantType":"ORGANISATION"},
+			{"id":"c3","tenantType":"ORGANISATION","tenantName":"No Id Ltd"},
+			{"id":"c4","tenantId":"  ","tenantType":"ORGANISATION","tenantName":"Blank Id Ltd"}
+		]`))
+	}))
+	defer upstream.Close()
+	cfg := DefaultConfig()
+	cfg.XeroAPIBaseURL = upstream.URL
+	p := &xeroProvider{NewServer(cfg, NewMemoryStore(), nil).providerBase("xero")}
+
+	tenants, err := p.fetchConnections(context.Background(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 2 || tenants[0].TenantID != "t1" || tenants[1].TenantID != "t2" {
+		t.Fatalf("want tenants t1 and t2, got %+v", tenants)
+	}
+	if got := tenants[0].Label(); got != "Complete Ltd" {
+		t.Errorf("named tenant label = %q", got)
+	}
+	if got := tenants[1].Label(); got != "t2 (name unavailable)" {
+		t.Errorf("unnamed tenant label = %q", got)
+	}
+	if got := envelopeOrg(TokenEnvelope{Tenants: tenants[1:]}); got != "t2 (name unavailable)" {
+		t.Errorf("success page organisation = %q", got)
+	}
+}
@@ -0,0 +1,223 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Provider implements the OAuth flow for a single upstream service.
+type Provider interface {
+	// Name is the identifier used in API requests and callback paths.
+	Name() string
+	// StartAuth builds the authorisation URL for state, returning the PKCE
+	// verifier to persist on the session when the flow uses one. OpenID
+	// providers send nonce so the id_token can be tied to the session. A
+	// non-empty redirectURI replaces the configured callback, and non-empty
+	// scopes (already checked against the configured ones) narrow the
+	// request.
+	StartAuth(state, nonce, redirectURI string, scopes []string) (authURL string, verifier sql.NullString, err error)
+	// Exchange trades an authorisation code for tokens.
+	Exchange(ctx context.Context, params ExchangeParams) (TokenEnvelope, error)
+	// Refresh mints a new access token from a refresh token.
+	Refresh(ctx context.Context, params RefreshParams) (TokenEnvelope, error)
+	// Revoke invalidates a token upstream. tokenTypeHint is the RFC 7009
+	// hint ("refresh_token" or "access_token") and may be empty.
+	Revoke(ctx context.Context, token, tokenTypeHint string) error
+}
+
+// ExchangeParams carries the callback values needed to complete a flow.
+type ExchangeParams struct {
+	Session *Session
+	Code    string
+	RealmID string
+	// BusinessID is the MYOB company file the user picked on the consent
+	// screen, when MYOB reports one.
+	BusinessID string
+}
+
+// RefreshParams carries the values a refresh request supplies.
+type RefreshParams struct {
+	RefreshToken string
+	// RealmID is the QBO company the token belongs to. Intuit does not
+	// return it on refresh, so the caller's value is carried into the
+	// envelope.
+	RealmID string
+}
+
+// ClientAuth is how a provider's token, refresh and revocation endpoints
+// expect the client credentials.
+type ClientAuth string
+
+const (
+	// ClientAuthBasic sends them as HTTP basic auth (RFC 6749 section 2.3.1).
+	ClientAuthBasic ClientAuth = "basic"
+	// ClientAuthForm sends client_id and client_secret in the request body.
+	ClientAuthForm ClientAuth = "form"
+	// ClientAuthNone sends only client_id, for public PKCE clients and
+	// clients that authenticate with a TLS certificate.
+	ClientAuthNone ClientAuth = "none"
+)
+
+// clientCredentials is a provider's client identity together with the way
+// its endpoints take it. Each provider declares one, so request code never
+// chooses an authentication style itself.
+type clientCredentials struct {
+	ID     string
+	Secret string
+	Auth   ClientAuth
+}
+
+// basicOrPublic is the credential style of providers that take basic auth
+// from confidential clients and just the client id from public ones.
+func basicOrPublic(id, secret string) clientCredentials {
+	if secret == "" {
+		return clientCredentials{ID: id, Auth: ClientAuthNone}
+	}
+	return clientCredentials{ID: id, Secret: secret, Auth: ClientAuthBasic}
+}
+
+// bodyFields returns the credential fields the request body must carry:
+// none for basic auth, and no client_secret when the secret is unset (as
+// with a TLS client certificate).
+func (c clientCredentials) bodyFields() map[string]string {
+	switch c.Auth {
+	case ClientAuthBasic:
+		return nil
+	case ClientAuthNone:
+		return map[string]string{"client_id": c.ID}
+	default:
+		fields := map[string]string{"client_id": c.ID}
+		if c.Secret != "" {
+			fields["client_secret"] = c.Secret
+		}
+		return fields
+	}
+}
+
+// setForm adds the body credential fields to a form request.
+func (c clientCredentials) setForm(data url.Values) {
+	for k, v := range c.bodyFields() {
+		data.Set(k, v)
+	}
+}
+
+// authorize sets the basic auth header when the credentials travel there.
+// Both halves are form-encoded first, as RFC 6749 section 2.3.1 requires.
+func (c clientCredentials) authorize(req *http.Request) {
+	if c.Auth == ClientAuthBasic {
+		req.SetBasicAuth(url.QueryEscape(c.ID), url.QueryEscape(c.Secret))
+	}
+}
+
+// redirectOr returns override when set, otherwise the configured redirect.
+func redirectOr(override, configured string) string {
+	if override != "" {
+		return override
+	}
+	return configured
+}
+
+// scopesOr returns requested when set, otherwise the configured scopes.
+func scopesOr(requested, configured []string) []string {
+	if len(requested) > 0 {
+		return requested
+	}
+	return configured
+}
+
+// sessionRedirect returns the redirect URI the session's flow was started
+// with, which the token exchange must repeat exactly.
+func sessionRedirect(sess *Session, configured string) string {
+	if sess != nil && sess.RedirectURI.Valid {
+		return sess.RedirectURI.String
+	}
+	return configured
+}
+
+// newPKCE returns a fresh PKCE verifier, to persist on the session, and its
+// S256 code challenge for the authorize URL.
+func newPKCE() (sql.NullString, string, error) {
+	verifier, err := randomID(64)
+	if err != nil {
+		return sql.NullString{}, "", err
+	}
+	hashed := sha256.Sum256([]byte(verifier))
+	return sql.NullString{String: verifier, Valid: true}, base64.RawURLEncoding.EncodeToString(hashed[:]), nil
+}
+
+// setPKCE adds the S256 challenge to authorize parameters.
+func setPKCE(v url.Values, challenge string) {
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+}
+
+// setCodeVerifier adds the session's PKCE verifier, if it has one, to a
+// code exchange.
+func setCodeVerifier(data url.Values, sess *Session) {
+	if sess != nil && sess.CodeVerifier.Valid {
+		data.Set("code_verifier", sess.CodeVerifier.String)
+	}
+}
+
+// providerBase holds what every provider needs to talk to its upstream.
+type providerBase struct {
+	cfg    Config
+	client *http.Client
+	logger func(context.Context) *slog.Logger
+}
+
+// providers builds the provider registry from the server's current config.
+func (s *Server) providers() map[string]Provider {
+	registry := map[string]Provider{
+		"xero":       tracedProvider{&xeroProvider{s.providerBase("xero")}},
+		"deputy":     tracedProvider{&deputyProvider{s.providerBase("deputy")}},
+		"qbo":        tracedProvider{&qboProvider{s.providerBase("qbo")}},
+		"myob":       tracedProvider{&myobProvider{s.providerBase("myob")}},
+		"freshbooks": tracedProvider{&freshBooksProvider{s.providerBase("freshbooks")}},
+	}
+	for name, def := range s.Config.CustomProviders {
+		p := &customProvider{providerBase: s.providerBase(customProviderPrefix + name), name: name, def: def}
+		registry[p.Name()] = tracedProvider{p}
+	}
+	return registry
+}
+
+// providerBase returns the shared dependencies for the named provider.
+func (s *Server) providerBase(name string) providerBase {
+	client := s.HTTPClient
+	if c, ok := s.certClients[name]; ok {
+		client = c
+	}
+	return providerBase{cfg: s.Config, client: client, logger: s.logger}
+}
+
+// provider looks up a provider by name.
+func (s *Server) provider(name string) (Provider, bool) {
+	p, ok := s.providers()[name]
+	return p, ok
+}
+
+// doRevoke sends a revocation request and converts an error status into a
+// ProviderError carrying the upstream body.
+func doRevoke(client *http.Client, provider string, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := rateLimitErrorFromResponse(provider, resp); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &ProviderError{Provider: provider, Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tokenRequest is what a fake token endpoint saw of a refresh request.
+type tokenRequest struct {
+	basicUser, basicPass string
+	hasBasic             bool
+	fields               map[string]string
+}
+
+// recordingTokenServer answers token requests with a fresh token and keeps
+// the last one it received. Other paths answer empty JSON, for the lookups
+// some providers make after refreshing.
+func recordingTokenServer(t *testing.T) (*httptest.Server, func() tokenRequest) {
+	t.Helper()
+	var (
+		mu   sync.Mutex
+		last tokenRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/token" {
+			if r.URL.Path == "/connections" {
+				w.Write([]byte(`[]`))
+			} else {
+				w.Write([]byte(`{}`))
+			}
+			return
+		}
+		var req tokenRequest
+		req.basicUser, req.basicPass, req.hasBasic = r.BasicAuth()
+		req.fields = map[string]string{}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			_ = json.NewDecoder(r.Body).Decode(&req.fields)
+		} else if err := r.ParseForm(); err == nil {
+			for k := range r.PostForm {
+				req.fields[k] = r.PostForm.Get(k)
+			}
+		}
+		mu.Lock()
+		last = req
+		mu.Unlock()
+		w.Write([]byte(`{"access_token":"a","refresh_token":"r2","expires_in":1800,"token_type":"Bearer"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() tokenRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
+
+func TestProviderClientAuthStyles(t *testing.T) {
+	tests := []struct {
+		provider string
+		setup    func(c *Config, tokenURL string)
+		want     ClientAuth
+	}{
+		{"xero", func(c *Config, u string) {
+			c.XeroClientID, c.XeroClientSecret, c.XeroTokenURL = "xero-id", "xero-secret", u
+		}, ClientAuthBasic},
+		{"xero", func(c *Config, u string) {
+			c.XeroClientID, c.XeroClientSecret, c.XeroTokenURL = "xero-id", "", u
+		}, ClientAuthNone},
+		{"qbo", func(c *Config, u string) {
+			c.QBOClientID, c.QBOClientSecret, c.QBOTokenURL = "qbo-id", "qbo-secret", u
+		}, ClientAuthBasic},
+		{"deputy", func(c *Config, u string) {
+			c.DeputyClientID, c.DeputyClientSecret, c.DeputyTokenURL = "deputy-id", "deputy-secret", u
+		}, ClientAuthForm},
+		{"myob", func(c *Config, u string) {
+			c.MYOBClientID, c.MYOBClientSecret, c.MYOBTokenURL = "myob-id", "myob-secret", u
+		}, ClientAuthForm},
+		{"freshbooks", func(c *Config, u string) {
+			c.FreshBooksClientID, c.FreshBooksClientSecret, c.FreshBooksTokenURL = "freshbooks-id", "freshbooks-secret", u
+		}, ClientAuthForm},
+		{"custom:basic", func(c *Config, u string) {
+			c.CustomProviders = map[string]CustomProvider{"basic": {ClientID: "basic-id", ClientSecret: "basic-secret", TokenURL: u}}
+		}, ClientAuthBasic},
+		{"custom:body", func(c *Config, u string) {
+			c.CustomProviders = map[string]CustomProvider{"body": {ClientID: "body-id", ClientSecret: "body-secret", TokenURL: u, ClientAuth: "body"}}
+		}, ClientAuthForm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider+"/"+string(tt.want), func(t *testing.T) {
+			upstream, last := recordingTokenServer(t)
+			cfg := DefaultConfig()
+			cfg.XeroAPIBaseURL = upstream.URL
+			cfg.QBOAPIBaseURL = upstream.URL
+			cfg.MYOBAPIBaseURL = upstream.URL
+			cfg.FreshBooksAPIBaseURL = upstream.URL
+			tt.setup(&cfg, upstream.URL+"/token")
+			s := NewServer(cfg, NewMemoryStore(), nil)
+			p, ok := s.provider(tt.provider)
+			if !ok {
+				t.Fatalf("no provider %s", tt.provider)
+			}
+			if _, err := p.Refresh(context.Background(), RefreshParams{RefreshToken: "r1"}); err != nil {
+				t.Fatalf("refresh: %v", err)
+			}
+
+			got := last()
+			if got.fields["refresh_token"] != "r1" {
+				t.Fatalf("token endpoint did not see the refresh: %+v", got)
+			}
+			name := strings.TrimPrefix(tt.provider, "custom:")
+			id, secret := name+"-id", name+"-secret"
+			switch tt.want {
+			case ClientAuthBasic:
+				if !got.hasBasic || got.basicUser != id || got.basicPass != secret {
+					t.Errorf("want basic auth as %s:%s, got %+v", id, secret, got)
+				}
+				if _, ok := got.fields["client_secret"]; ok {
+					t.Errorf("basic auth also sent client_secret in the body")
+				}
+			case ClientAuthForm:
+				if got.hasBasic {
+					t.Errorf("form auth also sent basic auth")
+				}
+				if got.fields["client_id"] != id || got.fields["client_secret"] != secret {
+					t.Errorf("want client_id %s and client_secret %s in the body, got %v", id, secret, got.fields)
+				}
+			case ClientAuthNone:
+				if got.hasBasic {
+					t.Errorf("public client sent basic auth")
+				}
+				if got.fields["client_id"] != id {
+					t.Errorf("want client_id %s in the body, got %v", id, got.fields)
+				}
+				if _, ok := got.fields["client_secret"]; ok {
+					t.Errorf("public client sent client_secret")
+				}
+			}
+		})
+	}
+}
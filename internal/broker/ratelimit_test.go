@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIPFromRequest(t *testing.T) {
+	cases := []struct {
+		name string
+		xff  []string
+		hops int
+		want string
+	}{
+		{"no hops ignores the header", []string{"203.0.113.9"}, 0, "10.0.0.2"},
+		{"no header", nil, 1, "10.0.0.2"},
+		{"empty header", []string{" , "}, 1, "10.0.0.2"},
+		{"one hop takes the rightmost entry", []string{"198.51.100.7, 203.0.113.9"}, 1, "203.0.113.9"},
+		{"two hops", []string{"198.51.100.7, 203.0.113.9, 192.0.2.1"}, 2, "203.0.113.9"},
+		{"entries across headers", []string{"198.51.100.7", "203.0.113.9, 192.0.2.1"}, 2, "203.0.113.9"},
+		{"more hops than entries", []string{"203.0.113.9, 192.0.2.1"}, 5, "10.0.0.2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "10.0.0.2:4711"
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIPFromRequest(r, tc.hops); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientIPTrustedHeader(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg := DefaultConfig()
+	cfg.TrustedProxyHeader = "X-Real-Ip"
+	cfg.TrustedProxyCIDRs = []*net.IPNet{proxies}
+	s := NewServer(cfg, NewMemoryStore(), nil)
+
+	for _, tc := range []struct {
+		remote, want string
+	}{
+		{"10.0.0.2:4711", "203.0.113.9"},
+		{"198.51.100.7:4711", "198.51.100.7"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		r.Header.Set("X-Real-Ip", "203.0.113.9")
+		if got := s.clientIP(r); got != tc.want {
+			t.Errorf("from %s: got %q, want %q", tc.remote, got, tc.want)
+		}
+	}
+}
+
+func TestClientIPIgnoresForwardedForFromUntrustedPeers(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg := DefaultConfig()
+	cfg.TrustedProxyHops = 1
+	cfg.TrustedProxyCIDRs = []*net.IPNet{proxies}
+	s := NewServer(cfg, NewMemoryStore(), nil)
+
+	for _, tc := range []struct {
+		name, remote, xff, want string
+	}{
+		{"trusted proxy", "10.0.0.2:4711", "198.51.100.7, 203.0.113.9", "203.0.113.9"},
+		{"direct client spoofing the header", "198.51.100.7:4711", "203.0.113.9", "198.51.100.7"},
+		{"trusted proxy with a short header", "10.0.0.2:4711", "", "10.0.0.2"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if got := s.clientIP(r); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// Without any trusted networks nobody may set X-Forwarded-For.
+	cfg.TrustedProxyCIDRs = nil
+	s = NewServer(cfg, NewMemoryStore(), nil)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.2:4711"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got := s.clientIP(r); got != "10.0.0.2" {
+		t.Errorf("without trusted networks got %q, want the peer address", got)
+	}
+}
+
+func TestRateLimitIsolatesClients(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg := DefaultConfig()
+	cfg.TrustedProxyHops = 1
+	cfg.TrustedProxyCIDRs = []*net.IPNet{proxies}
+	cfg.RateLimitGlobal = 0
+	s := NewServer(cfg, NewMemoryStore(), nil)
+
+	limited := func(client string) bool {
+		r := httptest.NewRequest(http.MethodPost, "/v1/auth/start", nil)
+		r.RemoteAddr = "10.0.0.2:4711"
+		// A flooding client cannot pick its own bucket: only the entry
+		// the proxy appended counts.
+		r.Header.Set("X-Forwarded-For", "198.51.100.1, "+client)
+		return s.enforceJSONRateLimit(httptest.NewRecorder(), r, "start", "xero", 3, time.Minute)
+	}
+	for i := 0; i < 3; i++ {
+		if limited("203.0.113.9") {
+			t.Fatalf("call %d was limited", i+1)
+		}
+	}
+	if !limited("203.0.113.9") {
+		t.Fatal("fourth call from the flooding client was not limited")
+	}
+	if limited("203.0.113.10") {
+		t.Fatal("another client was limited by the flood")
+	}
+
+	// The same client on another provider has its own bucket too.
+	r := httptest.NewRequest(http.MethodPost, "/v1/auth/start", nil)
+	r.RemoteAddr = "10.0.0.2:4711"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if s.enforceJSONRateLimit(httptest.NewRecorder(), r, "start", "qbo", 3, time.Minute) {
+		t.Fatal("flood on xero limited qbo")
+	}
+}
+
+func TestRateLimitGlobalCap(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RateLimitGlobal = 2
+	cfg.RateLimitGlobalWindow = time.Minute
+	s := NewServer(cfg, NewMemoryStore(), nil)
+
+	call := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/auth/start", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		s.enforceJSONRateLimit(w, r, "start", "xero", 100, time.Minute)
+		return w
+	}
+	call("203.0.113.1:1")
+	call("203.0.113.2:1")
+	w := call("203.0.113.3:1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third provider call returned %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("429 lacks Retry-After")
+	}
+}
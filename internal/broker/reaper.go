@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MinReapInterval is the shortest reaper cadence accepted, so a typo in
+// config cannot turn the reaper into a busy loop.
+const MinReapInterval = 5 * time.Second
+
+// RunReaper periodically removes expired sessions and completed sessions whose
+// results were never collected. It blocks until ctx is cancelled.
+func (s *Server) RunReaper(ctx context.Context, interval time.Duration) {
+	runReaper(ctx, interval, func() *Server { return s })
+}
+
+// runReaper is RunReaper for the Server current returns at each tick, so a
+// reloaded configuration applies from the next run.
+func runReaper(ctx context.Context, interval time.Duration, current func() *Server) {
+	if interval < MinReapInterval {
+		interval = MinReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastVacuum := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s := current()
+			s.reapOnce(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if s.Config.VacuumInterval > 0 && time.Since(lastVacuum) >= s.Config.VacuumInterval {
+				if s.vacuum(ctx) {
+					lastVacuum = time.Now()
+				}
+			}
+		}
+	}
+}
+
+// vacuum compacts the store and logs the size change. It reports false when
+// the store was busy so the caller can retry on the next tick. Stores that
+// are not file backed have nothing to compact.
+func (s *Server) vacuum(ctx context.Context) bool {
+	store, ok := s.Store.(Vacuumer)
+	if !ok {
+		return true
+	}
+	before := store.FileSize()
+	if err := store.Vacuum(ctx); err != nil {
+		if errors.Is(err, ErrStoreBusy) {
+			s.logger(ctx).Info("vacuum skipped: store busy")
+			return false
+		}
+		s.logger(ctx).Error("vacuum failed", "error", err)
+		return true
+	}
+	s.logger(ctx).Info("vacuum complete", "size_before", before, "size_after", store.FileSize())
+	return true
+}
+
+func (s *Server) reapOnce(ctx context.Context) {
+	s.reapAt(ctx, time.Now())
+}
+
+// reapAt is reapOnce as of now.
+func (s *Server) reapAt(ctx context.Context, now time.Time) {
+	expired, err := s.reapBatches(ctx, func(limit int) (int64, error) {
+		return s.Store.DeleteExpiredBefore(ctx, now, limit)
+	})
+	if err != nil {
+		s.logger(ctx).Error("reap expired sessions failed", "error", err)
+	}
+	consumed, err := s.reapBatches(ctx, func(limit int) (int64, error) {
+		return s.Store.DeleteConsumedBefore(ctx, now.Add(-s.Config.ConsumedGrace), limit)
+	})
+	if err != nil {
+		s.logger(ctx).Error("reap consumed sessions failed", "error", err)
+	}
+	// Most ticks find nothing to do; only report the ones that did work.
+	if expired > 0 || consumed > 0 {
+		s.logger(ctx).Info("reaped sessions", "expired", expired, "consumed", consumed)
+	}
+}
+
+// reapBatches calls del with the configured batch size until a batch comes
+// back short, so each DELETE holds the write lock only briefly.
+func (s *Server) reapBatches(ctx context.Context, del func(limit int) (int64, error)) (int64, error) {
+	limit := s.Config.ReapBatchSize
+	var total int64
+	for {
+		n, err := del(limit)
+		total += n
+		if err != nil || limit <= 0 || n < int64(limit) {
+			return total, err
+		}
+		if ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReapOnceLogsOnlyWhenSessionsRemoved(t *testing.T) {
+	var logs bytes.Buffer
+	store := NewMemoryStore()
+	s := NewServer(DefaultConfig(), store, slog.New(slog.NewTextHandler(&logs, nil)))
+	ctx := context.Background()
+
+	s.reapOnce(ctx)
+	if strings.Contains(logs.String(), "reaped sessions") {
+		t.Fatalf("idle reap was logged: %s", logs.String())
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if err := store.InsertSession(ctx, Session{ID: "old", Provider: "xero", State: "s", CreatedAt: past, ExpiresAt: past}); err != nil {
+		t.Fatal(err)
+	}
+	s.reapOnce(ctx)
+	if !strings.Contains(logs.String(), "reaped sessions") || !strings.Contains(logs.String(), "expired=1") {
+		t.Fatalf("reap of an expired session was not logged: %s", logs.String())
+	}
+}
+
+func TestReapKeepsPolledXeroTombstones(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			s := NewServer(cfg, st, nil)
+			now := time.Now()
+			for _, sess := range []Session{
+				{ID: "tombstone", Provider: "xero", State: "t", CreatedAt: now, ExpiresAt: now.Add(cfg.SessionTTL)},
+				{ID: "uncollected", Provider: "qbo", State: "u", CreatedAt: now, ExpiresAt: now.Add(cfg.SessionTTL)},
+			} {
+				if err := st.InsertSession(ctx, sess); err != nil {
+					t.Fatal(err)
+				}
+				if err := st.MarkReady(ctx, sess.ID, []byte("sealed"), nil, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A poll collects the Xero result but leaves the session for
+			// /v1/xero/tenants.
+			if err := st.ClearResult(ctx, "tombstone"); err != nil {
+				t.Fatal(err)
+			}
+
+			s.reapAt(ctx, now.Add(cfg.ConsumedGrace+time.Minute))
+			if _, err := st.LoadForPoll(ctx, "tombstone"); err != nil {
+				t.Fatalf("polled Xero session reaped before expiry: %v", err)
+			}
+			if _, err := st.LoadForPoll(ctx, "uncollected"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("uncollected result survived the grace period: %v", err)
+			}
+
+			s.reapAt(ctx, now.Add(cfg.SessionTTL+time.Minute))
+			if _, err := st.LoadForPoll(ctx, "tombstone"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("tombstone survived expiry: %v", err)
+			}
+		})
+	}
+}
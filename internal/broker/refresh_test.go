@@ -0,0 +1,68 @@
+package broker_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+func TestRefreshUpstreamTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer slow.Close()
+	defer close(hang)
+	srv := brokertest.NewServer(t, func(c *broker.Config) {
+		c.ProviderTimeout = 50 * time.Millisecond
+		c.XeroTokenURL = slow.URL + "/token"
+	})
+
+	var body map[string]string
+	code := postJSON(t, srv.URL+"/v1/token/refresh", map[string]string{"provider": "xero", "refresh_token": "r"}, &body)
+	if code != http.StatusGatewayTimeout || body["code"] != "upstream_timeout" {
+		t.Fatalf("slow provider: got %d %v, want 504 upstream_timeout", code, body)
+	}
+}
+
+func TestRefreshUpstreamFailure(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	srv.Upstream.FailTokens(http.StatusInternalServerError, `{"error":"server_error"}`)
+
+	var body map[string]string
+	code := postJSON(t, srv.URL+"/v1/token/refresh", map[string]string{"provider": "xero", "refresh_token": "r"}, &body)
+	if code != http.StatusBadGateway || body["code"] == "upstream_timeout" {
+		t.Fatalf("failing provider: got %d %v, want 502", code, body)
+	}
+}
+
+func TestRefreshThrottleReleasedOnFailure(t *testing.T) {
+	srv := brokertest.NewServer(t, func(c *broker.Config) {
+		c.RefreshMinInterval = time.Minute
+	})
+	body := map[string]string{"provider": "xero", "refresh_token": "r"}
+
+	srv.Upstream.FailTokens(http.StatusInternalServerError, `{"error":"server_error"}`)
+	if code := postJSON(t, srv.URL+"/v1/token/refresh", body, nil); code != http.StatusBadGateway {
+		t.Fatalf("failing refresh returned %d, want 502", code)
+	}
+	srv.Upstream.Reset()
+
+	var first, second map[string]any
+	if code := postJSON(t, srv.URL+"/v1/token/refresh", body, &first); code != http.StatusOK {
+		t.Fatalf("retry after a failed refresh returned %d, want 200", code)
+	}
+	if code := postJSON(t, srv.URL+"/v1/token/refresh", body, &second); code != http.StatusOK {
+		t.Fatalf("repeat of a successful refresh returned %d, want 200", code)
+	}
+	if first["access_token"] != second["access_token"] {
+		t.Errorf("repeat got %v, want the first refresh's %v", second["access_token"], first["access_token"])
+	}
+	if got := srv.Upstream.TokensIssued(); got != 1 {
+		t.Errorf("provider issued %d tokens, want 1", got)
+	}
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ClaimRefresh records that the refresh token hashed as key is being
+// refreshed now, unless a refresh of it was recorded less than interval ago,
+// in which case that one is returned instead. Older claims are pruned as a
+// side effect. Claims live in the database so the interval holds across CGI
+// processes.
+func (s *Store) ClaimRefresh(ctx context.Context, key string, interval time.Duration) (*RecentRefresh, error) {
+	now := time.Now().Unix()
+	cutoff := now - intervalSeconds(interval)
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM refresh_claim WHERE refreshed_at <= ?`, cutoff); err != nil {
+		return nil, fmt.Errorf("prune refresh claims: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO refresh_claim(key, refreshed_at) VALUES(?, ?) ON CONFLICT(key) DO NOTHING`, key, now)
+	if err != nil {
+		return nil, fmt.Errorf("claim refresh: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, fmt.Errorf("claim refresh: %w", err)
+	} else if n == 1 {
+		return nil, nil
+	}
+	var at int64
+	var result []byte
+	err = s.db.QueryRowContext(ctx, `SELECT refreshed_at, result_cipher FROM refresh_claim WHERE key = ?`, key).Scan(&at, &result)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Pruned by a concurrent claim between the insert and here.
+		return s.ClaimRefresh(ctx, key, interval)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query refresh claim: %w", err)
+	}
+	return &RecentRefresh{At: time.Unix(at, 0), Result: result}, nil
+}
+
+// StoreRefreshResult keeps the sealed envelope of a claimed refresh, so that
+// a repeat inside the interval can be given the same tokens.
+func (s *Store) StoreRefreshResult(ctx context.Context, key string, result []byte) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE refresh_claim SET result_cipher = ? WHERE key = ?`, result, key); err != nil {
+		return fmt.Errorf("store refresh result: %w", err)
+	}
+	return nil
+}
+
+// ReleaseRefresh drops the claim on key after its refresh failed, so a
+// retry goes to the provider instead of being throttled. A claim that has a
+// result is kept.
+func (s *Store) ReleaseRefresh(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM refresh_claim WHERE key = ? AND result_cipher IS NULL`, key); err != nil {
+		return fmt.Errorf("release refresh claim: %w", err)
+	}
+	return nil
+}
+
+// intervalSeconds converts a minimum refresh interval to the whole seconds
+// claims are stored in, rounding up so the interval is never shortened.
+func intervalSeconds(interval time.Duration) int64 {
+	secs := int64((interval + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// refreshThrottleKey identifies a refresh token in the claim table without
+// storing it.
+func refreshThrottleKey(provider, refreshToken string) string {
+	sum := sha256.Sum256([]byte(provider + "\x00" + refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// throttleRefresh enforces REFRESH_MIN_INTERVAL_SECONDS for one refresh
+// token. It returns true when it has answered the request itself: with the
+// envelope of a refresh made moments ago, or with 429 while that refresh is
+// still in flight. Otherwise the caller goes ahead and refreshes, and must
+// call forgetRefresh if it fails.
+func (s *Server) throttleRefresh(w http.ResponseWriter, r *http.Request, provider, key string) bool {
+	interval := s.Config.RefreshMinInterval
+	recent, err := s.Store.ClaimRefresh(r.Context(), key, interval)
+	if err != nil {
+		s.logger(r.Context()).Error("refresh throttle check failed", "provider", provider, "error", err)
+		respondJSONError(w, http.StatusInternalServerError, "internal error")
+		return true
+	}
+	if recent == nil {
+		return false
+	}
+	if len(recent.Result) > 0 {
+		env, err := openRefreshResult(s.Config.MasterKey, key, recent.Result)
+		if err == nil {
+			s.logger(r.Context()).Warn("repeated refresh answered from the previous result", "provider", provider)
+			respondEnvelope(w, r, env, s.Config.SigningKey)
+			return true
+		}
+		s.logger(r.Context()).Error("open stored refresh result failed", "provider", provider, "error", err)
+	}
+	wait := time.Until(recent.At.Add(time.Duration(intervalSeconds(interval)) * time.Second))
+	secs := int64((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	respondJSON(w, http.StatusTooManyRequests, map[string]any{
+		"error":               "this refresh token was refreshed moments ago",
+		"code":                "refresh_too_frequent",
+		"retry_after_seconds": secs,
+	})
+	return true
+}
+
+// rememberRefresh stores env against key for throttleRefresh, logging
+// rather than failing the request if it cannot.
+func (s *Server) rememberRefresh(ctx context.Context, key string, env TokenEnvelope) {
+	payload, err := jsonMarshal(env)
+	if err == nil {
+		var sealed []byte
+		if sealed, err = sealResult(s.Config.MasterKey, key, payload); err == nil {
+			err = s.Store.StoreRefreshResult(ctx, key, sealed)
+		}
+	}
+	if err != nil {
+		s.logger(ctx).Error("store refresh result failed", "provider", env.Provider, "error", err)
+	}
+}
+
+// forgetRefresh releases the claim on key after a failed refresh, so that
+// only successful refreshes hold off repeats. A claim left behind would only
+// delay a retry by the interval, so failure to release is logged.
+func (s *Server) forgetRefresh(ctx context.Context, provider, key string) {
+	if err := s.Store.ReleaseRefresh(ctx, key); err != nil {
+		s.logger(ctx).Error("release refresh claim failed", "provider", provider, "error", err)
+	}
+}
+
+func openRefreshResult(masterKey []byte, key string, stored []byte) (TokenEnvelope, error) {
+	payload, err := openResult(masterKey, key, stored)
+	if err != nil {
+		return TokenEnvelope{}, err
+	}
+	var env TokenEnvelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return TokenEnvelope{}, fmt.Errorf("decode refresh result: %w", err)
+	}
+	return env, nil
+}
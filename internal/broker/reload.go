@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// LiveServer serves each request with the Server built from the most
+// recently loaded configuration, so a standalone broker can rotate client
+// secrets or change scopes without a restart. A request keeps the Server it
+// started with, so in-flight exchanges finish under the old configuration.
+type LiveServer struct {
+	current atomic.Pointer[Server]
+}
+
+// NewLiveServer returns a LiveServer that starts out serving s.
+func NewLiveServer(s *Server) *LiveServer {
+	l := &LiveServer{}
+	l.current.Store(s)
+	return l
+}
+
+// Server returns the Server requests are currently handed to.
+func (l *LiveServer) Server() *Server {
+	return l.current.Load()
+}
+
+// ServeHTTP hands the request to the current Server.
+func (l *LiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.current.Load().ServeHTTP(w, r)
+}
+
+// Reload validates cfg and, if it is usable, swaps in a Server built from
+// it. The new Server shares the store, logger and metrics of the old one, so
+// counters carry on across reloads. An invalid cfg, or one that moves the
+// store to another BROKER_DB_PATH, is returned as an error and the current
+// configuration stays in force.
+func (l *LiveServer) Reload(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	old := l.current.Load()
+	if cfg.DBPath != old.Config.DBPath {
+		// The values are not logged: a postgres:// URL may carry a password.
+		return errors.New("BROKER_DB_PATH changed; restart the broker to switch databases")
+	}
+	next := NewServer(cfg, old.Store, old.Log)
+	next.metrics = old.metrics
+	l.current.Store(next)
+	return nil
+}
+
+// RunReaper runs the session reaper, as Server.RunReaper does, with the
+// configuration current at each run.
+func (l *LiveServer) RunReaper(ctx context.Context, interval time.Duration) {
+	runReaper(ctx, interval, l.Server)
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func reloadTestConfig() Config {
+	cfg := DefaultConfig()
+	cfg.EnabledProviders = []string{"xero"}
+	cfg.XeroClientID = "client-1"
+	cfg.XeroRedirectURL = "https://broker.example/v1/callback/xero"
+	return cfg
+}
+
+func TestLiveServerReload(t *testing.T) {
+	cfg := reloadTestConfig()
+	live := NewLiveServer(NewServer(cfg, NewMemoryStore(), nil))
+	first := live.Server()
+
+	next := reloadTestConfig()
+	next.XeroClientID = "client-2"
+	if err := live.Reload(next); err != nil {
+		t.Fatalf("valid reload failed: %v", err)
+	}
+	swapped := live.Server()
+	if swapped == first || swapped.Config.XeroClientID != "client-2" {
+		t.Fatalf("reload did not swap in the new configuration: %+v", swapped.Config.XeroClientID)
+	}
+	if swapped.Store != first.Store || swapped.metrics != first.metrics {
+		t.Fatal("reload did not carry the store and metrics over")
+	}
+	w := httptest.NewRecorder()
+	live.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("healthz after reload returned %d", w.Code)
+	}
+
+	invalid := reloadTestConfig()
+	invalid.XeroClientID = ""
+	if err := live.Reload(invalid); err == nil || !strings.Contains(err.Error(), "XERO_CLIENT_ID") {
+		t.Fatalf("invalid reload: got %v, want a missing XERO_CLIENT_ID error", err)
+	}
+	moved := reloadTestConfig()
+	moved.XeroClientID = "client-3"
+	moved.DBPath = "postgres://broker@db/broker"
+	if err := live.Reload(moved); err == nil || !strings.Contains(err.Error(), "restart") {
+		t.Fatalf("reload with a new BROKER_DB_PATH: got %v, want a restart error", err)
+	}
+	if live.Server() != swapped {
+		t.Fatal("a rejected reload replaced the running configuration")
+	}
+}
@@ -0,0 +1,73 @@
+package broker_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+func TestReturnURLCodeRedeemedOnce(t *testing.T) {
+	srv := brokertest.NewServer(t, func(c *broker.Config) {
+		c.ReturnURLAllowlist = []string{"acctops:"}
+	})
+	var started struct {
+		AuthURL string `json:"auth_url"`
+		Session string `json:"session"`
+	}
+	start := map[string]string{"provider": "xero", "profile": "test", "return_url": "acctops://connected"}
+	if code := postJSON(t, srv.URL+"/v1/auth/start", start, &started); code != http.StatusOK {
+		t.Fatalf("auth start returned %d", code)
+	}
+
+	// Play the browser by hand, to see where the callback sends it.
+	authURL, err := url.Parse(started.AuthURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := authURL.Query()
+	callback := q.Get("redirect_uri") + "?" + url.Values{"code": {"brokertest-code"}, "state": {q.Get("state")}}.Encode()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback returned %d, want 302", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "acctops://connected") {
+		t.Fatalf("callback redirected to %q", location)
+	}
+	if strings.Contains(location, started.Session) {
+		t.Fatalf("redirect %q carries the session id", location)
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnCode := loc.Query().Get("code")
+	if returnCode == "" {
+		t.Fatalf("redirect %q has no code", location)
+	}
+	if code := getStatus(t, srv.URL+"/v1/auth/poll/"+returnCode); code != http.StatusNotFound {
+		t.Fatalf("polling with the return code returned %d, want 404", code)
+	}
+
+	var env map[string]any
+	if code := postJSON(t, srv.URL+"/v1/auth/redeem", map[string]string{"code": returnCode}, &env); code != http.StatusOK {
+		t.Fatalf("redeem returned %d, want 200", code)
+	}
+	if _, ok := env["access_token"]; !ok {
+		t.Fatalf("redeemed envelope lacks access_token: %v", env)
+	}
+	if code := postJSON(t, srv.URL+"/v1/auth/redeem", map[string]string{"code": returnCode}, nil); code != http.StatusNotFound {
+		t.Fatalf("second redeem returned %d, want 404", code)
+	}
+}
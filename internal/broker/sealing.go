@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sealedPrefix marks a result_cipher value written by sealResult. Rows
+// without it predate encryption and hold the plaintext envelope.
+var sealedPrefix = []byte("gcm2:")
+
+// resultKeyInfo separates the result key from anything else that might be
+// derived from BROKER_MASTER_KEY.
+const resultKeyInfo = "accounting-ops broker result v2"
+
+// resultAEAD builds AES-256-GCM under a key derived from the master key
+// with HKDF-SHA256.
+func resultAEAD(masterKey []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte(resultKeyInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealResult encrypts a payload for storage in the row identified by rowID,
+// which is bound in as additional data so the ciphertext cannot be moved to
+// another row. With no master key the payload is stored as-is, matching
+// brokers deployed before encryption.
+func sealResult(masterKey []byte, rowID string, plaintext []byte) ([]byte, error) {
+	if len(masterKey) == 0 {
+		return plaintext, nil
+	}
+	aead, err := resultAEAD(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("seal result: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("seal result: %w", err)
+	}
+	out := append([]byte{}, sealedPrefix...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(rowID)), nil
+}
+
+// openResult reverses sealResult for the row identified by rowID. Unsealed
+// rows are returned unchanged so sessions written before a master key was
+// configured still complete.
+func openResult(masterKey []byte, rowID string, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	if len(masterKey) == 0 {
+		return nil, errors.New("open result: payload is encrypted but BROKER_MASTER_KEY is not set")
+	}
+	aead, err := resultAEAD(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("open result: %w", err)
+	}
+	data := stored[len(sealedPrefix):]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("open result: payload too short")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(rowID))
+	if err != nil {
+		return nil, fmt.Errorf("open result: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSealResultRoundTrip(t *testing.T) {
+	key := []byte("test-master-key")
+	plaintext := []byte(`{"access_token":"secret"}`)
+	sealed, err := sealResult(key, "sess-1", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, sealedPrefix) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("result not sealed: %q", sealed)
+	}
+	got, err := openResult(key, "sess-1", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("got %q, want %q", got, plaintext)
+	}
+
+	// Without a master key, and for rows from before one was set, the
+	// payload is stored and read as-is.
+	if raw, _ := sealResult(nil, "sess-1", plaintext); !bytes.Equal(raw, plaintext) {
+		t.Fatalf("unkeyed seal changed the payload: %q", raw)
+	}
+	if got, err := openResult(key, "sess-1", plaintext); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("plaintext row: got %q, %v", got, err)
+	}
+}
+
+func TestOpenResultRejects(t *testing.T) {
+	key := []byte("test-master-key")
+	sealed, err := sealResult(key, "sess-1", []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 0x01
+
+	for _, tc := range []struct {
+		name   string
+		key    []byte
+		row    string
+		stored []byte
+		want   string
+	}{
+		{"tampered ciphertext", key, "sess-1", tampered, "message authentication failed"},
+		{"another session's row", key, "sess-2", sealed, "message authentication failed"},
+		{"wrong key", []byte("other-key"), "sess-1", sealed, "message authentication failed"},
+		{"no key", nil, "sess-1", sealed, "BROKER_MASTER_KEY is not set"},
+		{"truncated", key, "sess-1", sealedPrefix, "too short"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := openResult(tc.key, tc.row, tc.stored)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SelfCheck runs a complete auth start -> callback -> poll cycle for every
+// built-in provider, and a sample custom one, against an in-process fake
+// OAuth provider and a throwaway store. It returns an error describing the
+// first failing step.
+func SelfCheck(ctx context.Context, logger *log.Logger) error {
+	fake := httptest.NewServer(http.HandlerFunc(fakeProviderHandler))
+	defer fake.Close()
+
+	dir, err := os.MkdirTemp("", "broker-selfcheck-")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenStore(filepath.Join(dir, "selfcheck.sqlite"))
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer store.Close()
+
+	return runSelfCheck(ctx, logger, selfCheckConfig(fake.URL), store)
+}
+
+// runSelfCheck is SelfCheck against the given configuration and store.
+func runSelfCheck(ctx context.Context, logger *log.Logger, cfg Config, store SessionStore) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("configuration: %w", err)
+	}
+	if db, ok := store.(Pinger); ok {
+		if err := db.Ping(ctx); err != nil {
+			return fmt.Errorf("store unreachable: %w", err)
+		}
+	}
+	var serverLog *slog.Logger
+	if logger != nil {
+		serverLog = NewLogger(logger.Writer(), "text")
+	}
+	server := NewServer(cfg, store, serverLog)
+	brokerSrv := httptest.NewServer(server)
+	defer brokerSrv.Close()
+
+	for _, provider := range cfg.ProviderNames() {
+		if err := selfCheckProvider(ctx, brokerSrv.URL, provider); err != nil {
+			return fmt.Errorf("%s: %w", provider, err)
+		}
+		if logger != nil {
+			logger.Printf("selfcheck %s ok", provider)
+		}
+	}
+	return nil
+}
+
+func selfCheckConfig(fakeURL string) Config {
+	cfg := DefaultConfig()
+	cfg.RateLimitAuthStart = 0
+	cfg.RateLimitPoll = 0
+	cfg.RateLimitRefresh = 0
+	cfg.MasterKey = []byte("selfcheck-master-key")
+
+	cfg.XeroClientID = "selfcheck-xero"
+	cfg.XeroRedirectURL = fakeURL + "/v1/callback/xero"
+	cfg.XeroAuthURL = fakeURL + "/authorize"
+	cfg.XeroTokenURL = fakeURL + "/token"
+	cfg.XeroAPIBaseURL = fakeURL
+
+	cfg.DeputyClientID = "selfcheck-deputy"
+	cfg.DeputyClientSecret = "selfcheck-secret"
+	cfg.DeputyRedirectURL = fakeURL + "/v1/callback/deputy"
+	cfg.DeputyAuthURL = fakeURL + "/authorize"
+	cfg.DeputyTokenURL = fakeURL + "/token"
+
+	cfg.QBOClientID = "selfcheck-qbo"
+	cfg.QBOClientSecret = "selfcheck-secret"
+	cfg.QBORedirectURL = fakeURL + "/v1/callback/qbo"
+	cfg.QBOAuthURL = fakeURL + "/authorize"
+	cfg.QBOTokenURL = fakeURL + "/token"
+	cfg.QBOAPIBaseURL = fakeURL
+
+	cfg.MYOBClientID = "selfcheck-myob"
+	cfg.MYOBClientSecret = "selfcheck-secret"
+	cfg.MYOBRedirectURL = fakeURL + "/v1/callback/myob"
+	cfg.MYOBAuthURL = fakeURL + "/authorize"
+	cfg.MYOBTokenURL = fakeURL + "/token"
+	cfg.MYOBAPIBaseURL = fakeURL + "/accountright"
+
+	cfg.FreshBooksClientID = "selfcheck-freshbooks"
+	cfg.FreshBooksClientSecret = "selfcheck-secret"
+	cfg.FreshBooksRedirectURL = fakeURL + "/v1/callback/freshbooks"
+	cfg.FreshBooksAuthURL = fakeURL + "/authorize"
+	cfg.FreshBooksTokenURL = fakeURL + "/token"
+	cfg.FreshBooksAPIBaseURL = fakeURL
+
+	cfg.CustomProviders = map[string]CustomProvider{
+		"selfcheck": {
+			ClientID:    "selfcheck-custom",
+			RedirectURL: fakeURL + "/v1/callback/custom:selfcheck",
+			AuthURL:     fakeURL + "/authorize",
+			TokenURL:    fakeURL + "/token",
+			PKCE:        true,
+		},
+	}
+
+	applyProviderDefaults(&cfg)
+	return cfg
+}
+
+func fakeProviderHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/token":
+		if !fakeGrantPresent(r) {
+			respondJSONError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]any{
+			"access_token":  "selfcheck-access",
+			"refresh_token": "selfcheck-refresh",
+			"expires_in":    1800,
+			"token_type":    "Bearer",
+			"endpoint":      "https://selfcheck.example.com",
+		})
+	case r.Method == http.MethodGet && r.URL.Path == "/connections":
+		respondJSON(w, http.StatusOK, []XeroTenant{{
+			ID:         "selfcheck-connection",
+			TenantID:   "selfcheck-tenant",
+			TenantType: "ORGANISATION",
+			TenantName: "Self Check Ltd",
+		}})
+	case r.Method == http.MethodGet && r.URL.Path == "/accountright/":
+		respondJSON(w, http.StatusOK, []MYOBCompanyFile{{
+			ID:   "selfcheck-file",
+			Name: "Self Check Pty Ltd",
+			URI:  "https://selfcheck.example.com/accountright/selfcheck-file",
+		}})
+	case r.Method == http.MethodGet && r.URL.Path == "/auth/api/v1/users/me":
+		respondJSON(w, http.StatusOK, map[string]any{
+			"response": map[string]any{
+				"business_memberships": []map[string]any{{
+					"business": map[string]any{"id": 1, "account_id": "selfcheck-account", "name": "Self Check Inc"},
+				}},
+			},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fakeGrantPresent reports whether a token request carries a code or refresh
+// token, in either a form or a JSON body.
+func fakeGrantPresent(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return false
+		}
+		return body["code"] != "" || body["refresh_token"] != ""
+	}
+	if err := r.ParseForm(); err != nil {
+		return false
+	}
+	return r.PostForm.Get("code") != "" || r.PostForm.Get("refresh_token") != ""
+}
+
+func selfCheckProvider(ctx context.Context, brokerURL, provider string) error {
+	body := strings.NewReader(fmt.Sprintf(`{"provider":%q,"profile":"selfcheck"}`, provider))
+	var start struct {
+		AuthURL string `json:"auth_url"`
+		PollURL string `json:"poll_url"`
+	}
+	if err := selfCheckJSON(ctx, http.MethodPost, brokerURL+"/v1/auth/start", body, &start); err != nil {
+		return fmt.Errorf("auth start: %w", err)
+	}
+	authURL, err := url.Parse(start.AuthURL)
+	if err != nil {
+		return fmt.Errorf("parse auth url: %w", err)
+	}
+	state := authURL.Query().Get("state")
+	if state == "" {
+		return fmt.Errorf("auth url missing state: %s", start.AuthURL)
+	}
+
+	cb := url.Values{}
+	cb.Set("code", "selfcheck-code")
+	cb.Set("state", state)
+	cb.Set("realmId", "selfcheck-realm")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, brokerURL+"/v1/callback/"+provider+"?"+cb.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("callback: %w", err)
+	}
+	page, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("callback returned %d: %s", resp.StatusCode, page)
+	}
+
+	var env TokenEnvelope
+	if err := selfCheckJSON(ctx, http.MethodGet, brokerURL+start.PollURL, nil, &env); err != nil {
+		return fmt.Errorf("poll: %w", err)
+	}
+	if env.AccessToken == "" {
+		return fmt.Errorf("poll returned no access token")
+	}
+	return nil
+}
+
+func selfCheckJSON(ctx context.Context, method, target string, body io.Reader, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(payload)))
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfCheck(t *testing.T) {
+	var out bytes.Buffer
+	if err := SelfCheck(context.Background(), log.New(&out, "", 0)); err != nil {
+		t.Fatalf("self-check failed: %v", err)
+	}
+	for _, provider := range []string{"xero", "qbo", "custom:selfcheck"} {
+		if !strings.Contains(out.String(), "selfcheck "+provider+" ok") {
+			t.Errorf("log does not report %s: %s", provider, out.String())
+		}
+	}
+}
+
+func TestSelfCheckFailures(t *testing.T) {
+	fake := httptest.NewServer(http.HandlerFunc(fakeProviderHandler))
+	defer fake.Close()
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondJSONError(w, http.StatusBadRequest, "invalid_grant")
+	}))
+	defer refusing.Close()
+
+	tests := []struct {
+		name    string
+		config  func(*Config)
+		store   func(t *testing.T) SessionStore
+		wantErr string
+	}{
+		{
+			name: "store unreachable",
+			store: func(t *testing.T) SessionStore {
+				st := openTestStore(t)
+				st.Close()
+				return st
+			},
+			wantErr: "store unreachable",
+		},
+		{
+			name:    "missing client id",
+			config:  func(c *Config) { c.QBOClientID = "" },
+			wantErr: "QBO_CLIENT_ID",
+		},
+		{
+			name:    "missing client secret",
+			config:  func(c *Config) { c.DeputyClientSecret = "" },
+			wantErr: "DEPUTY_CLIENT_SECRET",
+		},
+		{
+			name: "provider refuses the code",
+			config: func(c *Config) {
+				c.XeroTokenURL = refusing.URL + "/token"
+			},
+			wantErr: "xero: callback returned",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := selfCheckConfig(fake.URL)
+			if tt.config != nil {
+				tt.config(&cfg)
+			}
+			var st SessionStore = NewMemoryStore()
+			if tt.store != nil {
+				st = tt.store(t)
+			}
+			err := runSelfCheck(context.Background(), nil, cfg, st)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
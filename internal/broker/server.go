@@ -4,32 +4,45 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Server implements the CGI HTTP handlers for the broker endpoints.
 type Server struct {
 	Config     Config
-	Store      *Store
+	Store      SessionStore
 	HTTPClient *http.Client
-	Logger     *log.Logger
+	// Log receives the broker's structured log lines; nil discards them.
+	Log *slog.Logger
+
+	// certClients holds per-provider clients for providers configured
+	// with a mutual TLS client certificate.
+	certClients map[string]*http.Client
 
 	successTemplate *template.Template
 	failureTemplate *template.Template
+
+	metrics *brokerMetrics
 }
 
 var (
@@ -38,34 +51,69 @@ var (
 )
 
 // NewServer constructs a broker Server.
-func NewServer(cfg Config, store *Store, logger *log.Logger) *Server {
-	return &Server{
+func NewServer(cfg Config, store SessionStore, logger *slog.Logger) *Server {
+	s := &Server{
 		Config: cfg,
 		Store:  store,
 		HTTPClient: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout:   cfg.ProviderTimeout,
+			Transport: tracingTransport{base: http.DefaultTransport},
 		},
-		Logger:          logger,
-		successTemplate: template.Must(template.New("success").Parse(successHTML)),
-		failureTemplate: template.Must(template.New("failure").Parse(failureHTML)),
+		Log:         logger,
+		certClients: make(map[string]*http.Client),
+		metrics:     newBrokerMetrics(),
+	}
+	s.successTemplate = loadPageTemplate(s.logger(context.Background()), "SUCCESS_TEMPLATE_PATH", cfg.SuccessTemplatePath, builtinSuccessTemplate, successPage{})
+	s.failureTemplate = loadPageTemplate(s.logger(context.Background()), "FAILURE_TEMPLATE_PATH", cfg.FailureTemplatePath, builtinFailureTemplate, failurePage{})
+	for _, name := range KnownProviders {
+		if c := providerClient(cfg, name, s.HTTPClient); c != s.HTTPClient {
+			s.certClients[name] = c
+		}
 	}
+	return s
 }
 
-// ServeHTTP routes incoming requests.
+// ServeHTTP routes incoming requests, each with its own request id and
+// inside a trace span. CORS preflights are answered before routing.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.logRequest(w, r, func(w http.ResponseWriter, r *http.Request) {
+		if s.applyCORS(w, r) {
+			return
+		}
+		traceRequest(w, r, s.route)
+	})
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/v1/auth/start"):
 		s.handleAuthStart(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/v1/auth/exchange"):
+		s.handleExchange(w, r)
 	case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/callback/"):
 		s.handleCallback(w, r)
 	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/v1/auth/poll/"):
 		http.NotFound(w, r)
 	case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/v1/auth/poll/"):
 		s.handlePoll(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/v1/auth/redeem"):
+		s.handleRedeem(w, r)
 	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/v1/token/refresh"):
 		s.handleRefresh(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/v1/token/revoke"):
+		s.handleRevoke(w, r)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/v1/xero/tenants"):
+		s.handleXeroTenants(w, r)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/v1/xero/disconnect"):
+		s.handleXeroDisconnect(w, r)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/v1/jwks"):
+		s.handleJWKS(w, r)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/v1/providers"):
+		s.handleProviders(w, r)
 	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/healthz"):
 		s.handleHealthz(w, r)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/metrics"):
+		s.handleMetrics(w, r)
 	default:
 		http.NotFound(w, r)
 	}
@@ -80,18 +128,24 @@ func (s *Server) basePathForRequest(r *http.Request, suffix string) string {
 }
 
 func (s *Server) handleAuthStart(w http.ResponseWriter, r *http.Request) {
-	if s.enforceJSONRateLimit(w, r, "auth_start", s.Config.RateLimitAuthStart, s.Config.RateLimitAuthStartWindow) {
-		return
-	}
 	var req struct {
-		Provider string `json:"provider"`
-		Profile  string `json:"profile"`
-		PubKey   string `json:"pubkey"`
+		Provider    string   `json:"provider"`
+		Profile     string   `json:"profile"`
+		PubKey      string   `json:"pubkey"`
+		RedirectURI string   `json:"redirect_uri"`
+		ReturnURL   string   `json:"return_url"`
+		Scopes      []string `json:"scopes"`
 	}
 	if err := decodeJSONBody(r.Body, &req); err != nil {
 		respondJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if s.enforceJSONRateLimit(w, r, "auth_start", s.rateLimitProvider(req.Provider), s.Config.RateLimitAuthStart, s.Config.RateLimitAuthStartWindow) {
+		return
+	}
+	if s.Config.APIKeyAuthStart && s.rejectWithoutAPIKey(w, r) {
+		return
+	}
 	provider := strings.ToLower(strings.TrimSpace(req.Provider))
 	if provider == "" {
 		respondJSONError(w, http.StatusBadRequest, "provider is required")
@@ -113,21 +167,53 @@ func (s *Server) handleAuthStart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var authURL string
-	var codeVerifier sql.NullString
-	switch provider {
-	case "xero":
-		authURL, codeVerifier, err = s.startXeroAuth(state)
-	case "deputy":
-		authURL, err = s.startDeputyAuth(state)
-	case "qbo":
-		authURL, err = s.startQBOAuth(state)
-	default:
+	p, ok := s.provider(provider)
+	if !ok {
 		respondJSONError(w, http.StatusBadRequest, "unsupported provider")
 		return
 	}
+	if !s.Config.ProviderEnabled(provider) {
+		respondJSONError(w, http.StatusBadRequest, "provider not enabled")
+		return
+	}
+	if req.RedirectURI != "" {
+		if !s.Config.LoopbackAllowed(provider) {
+			respondJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "provider does not accept loopback redirects on this broker",
+				"code":  "loopback_unsupported",
+			})
+			return
+		}
+		if !isLoopbackRedirect(req.RedirectURI) {
+			respondJSONError(w, http.StatusBadRequest, "redirect_uri must be an http://127.0.0.1 or http://[::1] URL with a port")
+			return
+		}
+	}
+	if req.ReturnURL != "" {
+		if req.RedirectURI != "" {
+			respondJSONError(w, http.StatusBadRequest, "return_url cannot be combined with a loopback redirect_uri")
+			return
+		}
+		if !s.Config.ReturnURLAllowed(req.ReturnURL) {
+			respondJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "return_url is not allowed on this broker",
+				"code":  "return_url_not_allowed",
+			})
+			return
+		}
+	}
+	if err := s.Config.checkRequestedScopes(provider, req.Scopes); err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	nonce, err := randomID(24)
+	if err != nil {
+		respondJSONError(w, http.StatusInternalServerError, "failed to allocate nonce")
+		return
+	}
+	authURL, codeVerifier, err := p.StartAuth(state, nonce, req.RedirectURI, req.Scopes)
 	if err != nil {
-		s.logf("start auth error provider=%s error=%v", provider, err)
+		s.logger(r.Context()).Error("start auth failed", "provider", provider, "error", err)
 		respondJSONError(w, http.StatusInternalServerError, "unable to start authorisation flow")
 		return
 	}
@@ -140,12 +226,17 @@ func (s *Server) handleAuthStart(w http.ResponseWriter, r *http.Request) {
 		CodeVerifier: codeVerifier,
 		CreatedAt:    time.Now(),
 		ExpiresAt:    expires,
+		RedirectURI:  sql.NullString{String: req.RedirectURI, Valid: req.RedirectURI != ""},
+		Nonce:        sql.NullString{String: nonce, Valid: true},
+		ReturnURL:    sql.NullString{String: req.ReturnURL, Valid: req.ReturnURL != ""},
+		ClientIP:     sql.NullString{String: s.clientIP(r), Valid: true},
 	}
 	if err := s.Store.InsertSession(r.Context(), sess); err != nil {
-		s.logf("insert session error: %v", err)
+		s.logger(r.Context()).Error("insert session failed", "provider", provider, "session", SessionHash(sessionID), "error", err)
 		respondJSONError(w, http.StatusInternalServerError, "unable to persist session")
 		return
 	}
+	s.count(r.Context(), metricAuthStarts, prometheus.Labels{"provider": provider})
 
 	base := s.basePathForRequest(r, "/v1/auth/start")
 	pollURL := fmt.Sprintf("%s/v1/auth/poll/%s", base, sessionID)
@@ -159,59 +250,93 @@ func (s *Server) handleAuthStart(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 	provider := providerFromCallbackPath(r.URL.Path)
-	if provider == "" {
+	p, ok := s.provider(provider)
+	if !ok || !s.Config.ProviderEnabled(provider) {
 		http.NotFound(w, r)
 		return
 	}
+	s.count(r.Context(), metricCallbacks, prometheus.Labels{"provider": provider})
+	logger := s.logger(r.Context()).With("provider", provider)
 	q := r.URL.Query()
+	state := q.Get("state")
+	var sess *Session
+	if state != "" {
+		found, err := s.Store.LookupByState(r.Context(), provider, state)
+		switch {
+		case err == nil:
+			sess = found
+		case errors.Is(err, sql.ErrNoRows):
+		default:
+			logger.Error("lookup session failed", "error", err)
+			s.renderFailure(w, r, "internal error")
+			return
+		}
+	}
 	if errStr := q.Get("error"); errStr != "" {
-		s.renderFailure(w, fmt.Sprintf("%s: %s", errStr, q.Get("error_description")))
+		s.callbackFailed(w, r, sess, fmt.Sprintf("%s: %s", errStr, q.Get("error_description")))
 		return
 	}
-	state := q.Get("state")
 	if state == "" {
-		s.renderFailure(w, "missing state parameter")
+		s.renderFailure(w, r, "missing state parameter")
+		return
+	}
+	if sess == nil {
+		s.renderFailure(w, r, "unknown or expired session")
+		return
+	}
+	logger = logger.With("session", SessionHash(sess.ID))
+	if time.Now().After(sess.ExpiresAt) {
+		s.renderFailure(w, r, "session expired")
 		return
 	}
-	sess, err := s.Store.LookupByState(r.Context(), provider, state)
+	claim, err := s.claimState(r.Context(), logger, sess.ID)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			s.renderFailure(w, "unknown or expired session")
+		if errors.Is(err, ErrStateUsed) {
+			logger.Warn("replayed callback rejected")
+			s.callbackFailed(w, r, sess, "this authorisation link has already been used")
 			return
 		}
-		s.logf("lookup session failed: %v", err)
-		s.renderFailure(w, "internal error")
+		logger.Error("mark state used failed", "error", err)
+		s.renderFailure(w, r, "internal error")
 		return
 	}
-	if time.Now().After(sess.ExpiresAt) {
-		s.renderFailure(w, "session expired")
+
+	defer claim.release()
+
+	release, err := s.acquireExchangeSlot(r.Context())
+	if err != nil {
+		logger.Warn("exchange slot unavailable", "error", err)
+		s.renderFailure(w, r, "the broker is busy; please retry in a moment")
 		return
 	}
+	defer release()
 
-	var envelope TokenEnvelope
-	switch provider {
-	case "xero":
-		envelope, err = s.exchangeXero(r.Context(), sess, q.Get("code"))
-	case "deputy":
-		envelope, err = s.exchangeDeputy(r.Context(), q.Get("code"))
-	case "qbo":
-		envelope, err = s.exchangeQBO(r.Context(), q.Get("code"), q.Get("realmId"))
-	default:
-		err = fmt.Errorf("unknown provider")
-	}
+	envelope, err := s.exchangeTokens(r.Context(), p, ExchangeParams{
+		Session:    sess,
+		Code:       q.Get("code"),
+		RealmID:    q.Get("realmId"),
+		BusinessID: q.Get("businessId"),
+	})
 	if err != nil {
-		s.logf("exchange tokens failed provider=%s error=%v", provider, err)
-		s.renderFailure(w, "token exchange failed")
+		logger.Error("exchange tokens failed", "error", err)
+		s.callbackFailed(w, r, sess, "token exchange failed")
 		return
 	}
 
 	envelope.Provider = provider
-	envelope.ExpiresUnix = envelope.ExpiresAt.Unix()
+	envelope.NormalizeExpiry()
 
 	payload, err := jsonMarshal(envelope)
 	if err != nil {
-		s.logf("marshal envelope error: %v", err)
-		s.renderFailure(w, "internal serialisation error")
+		logger.Error("marshal envelope failed", "error", err)
+		s.renderFailure(w, r, "internal serialisation error")
+		return
+	}
+
+	sealed, err := sealResult(s.Config.MasterKey, sess.ID, payload)
+	if err != nil {
+		logger.Error("seal result failed", "error", err)
+		s.renderFailure(w, r, "internal serialisation error")
 		return
 	}
 
@@ -219,467 +344,684 @@ func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 	if envelope.RealmID != "" {
 		realmID = &envelope.RealmID
 	}
-	if err := s.Store.MarkReady(r.Context(), sess.ID, payload, realmID); err != nil {
+	if err := s.Store.MarkReady(r.Context(), sess.ID, sealed, realmID, accessTokenHash(envelope.AccessToken)); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			s.renderFailure(w, "session already consumed")
+			s.renderFailure(w, r, "session already consumed")
 			return
 		}
-		s.logf("mark ready failed: %v", err)
-		s.renderFailure(w, "internal persistence error")
+		logger.Error("mark ready failed", "error", err)
+		s.renderFailure(w, r, "internal persistence error")
 		return
 	}
+	claim.keep()
 
-	if err := s.successTemplate.Execute(w, envelope); err != nil {
-		s.logf("render success error: %v", err)
+	if sess.ReturnURL.Valid {
+		if code, err := s.issueReturnCode(r.Context(), sess.ID); err != nil {
+			// The tokens can still be polled for with the session id.
+			logger.Error("issue return code failed", "error", err)
+		} else {
+			http.Redirect(w, r, returnRedirect(sess.ReturnURL.String, code), http.StatusFound)
+			return
+		}
 	}
+	s.renderPage(w, r, http.StatusOK, s.successTemplate, builtinSuccessTemplate, s.successPageFor(envelope, sess.ID))
 }
 
-func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
-	if s.enforceJSONRateLimit(w, r, "poll", s.Config.RateLimitPoll, s.Config.RateLimitPollWindow) {
+// issueReturnCode mints the one-time code a return_url redirect carries in
+// place of the session id, which is a polling credential and would
+// otherwise end up in browser history and in whichever app handles the
+// return URL. Only its hash is stored.
+func (s *Server) issueReturnCode(ctx context.Context, sessionID string) (string, error) {
+	code, err := randomID(24)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Store.SetReturnCode(ctx, sessionID, returnCodeHash(code)); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func returnCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// accessTokenHash is what a session keeps of the access token its exchange
+// issued, so later requests can prove they hold it.
+func accessTokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// returnRedirect adds code to returnURL as its code parameter. The calling
+// app redeems it once at /v1/auth/redeem; after that it is spent.
+func returnRedirect(returnURL, code string) string {
+	u, err := url.Parse(returnURL)
+	if err != nil {
+		// Validated at start, so this cannot happen.
+		return returnURL
+	}
+	q := u.Query()
+	q.Set("code", code)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// handleExchange completes a loopback flow: the CLI caught the provider
+// redirect on its own listener and forwards the code here, so the tokens go
+// straight back in the response rather than through the session row.
+func (s *Server) handleExchange(w http.ResponseWriter, r *http.Request) {
+	if rejectUnsupportedNaming(w, r) {
 		return
 	}
-	sessionID := lastPathComponent(r.URL.Path)
-	if sessionID == "" {
-		http.NotFound(w, r)
+	if s.enforceJSONRateLimit(w, r, "exchange", "", s.Config.RateLimitAuthStart, s.Config.RateLimitAuthStartWindow) {
 		return
 	}
-	sess, err := s.Store.LoadForPoll(r.Context(), sessionID)
+	var req struct {
+		Session    string `json:"session"`
+		State      string `json:"state"`
+		Code       string `json:"code"`
+		RealmID    string `json:"realm_id"`
+		BusinessID string `json:"business_id"`
+	}
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Session == "" || req.State == "" || req.Code == "" {
+		respondJSONError(w, http.StatusBadRequest, "session, state and code are required")
+		return
+	}
+	logger := s.logger(r.Context()).With("session", SessionHash(req.Session))
+	sess, err := s.Store.LoadForPoll(r.Context(), req.Session)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			respondJSONError(w, http.StatusNotFound, "session not found")
 			return
 		}
-		s.logf("load session error: %v", err)
+		logger.Error("load session failed", "error", err)
 		respondJSONError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
+	logger = logger.With("provider", sess.Provider)
+	if !sess.RedirectURI.Valid {
+		respondJSONError(w, http.StatusBadRequest, "session was not started with a loopback redirect")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(sess.State), []byte(req.State)) != 1 {
+		respondJSONError(w, http.StatusBadRequest, "state mismatch")
+		return
+	}
 	if time.Now().After(sess.ExpiresAt) {
-		_ = s.Store.Delete(r.Context(), sessionID)
+		_ = s.Store.Delete(r.Context(), sess.ID)
 		respondJSONError(w, http.StatusGone, "session expired")
 		return
 	}
-	if !sess.ReadyAt.Valid || len(sess.Result) == 0 {
-		respondJSON(w, http.StatusOK, map[string]any{"status": "pending"})
+	p, ok := s.provider(sess.Provider)
+	if !ok || !s.Config.ProviderEnabled(sess.Provider) {
+		respondJSONError(w, http.StatusBadRequest, "provider not enabled")
 		return
 	}
-
-	var envelope TokenEnvelope
-	if err := json.Unmarshal(sess.Result, &envelope); err != nil {
-		s.logf("unmarshal session result error: %v", err)
+	claim, err := s.claimState(r.Context(), logger, sess.ID)
+	if err != nil {
+		if errors.Is(err, ErrStateUsed) {
+			logger.Warn("replayed loopback exchange rejected")
+			respondJSONError(w, http.StatusConflict, "this authorisation code has already been redeemed")
+			return
+		}
+		logger.Error("mark state used failed", "error", err)
 		respondJSONError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
-	if err := s.Store.Delete(r.Context(), sessionID); err != nil {
-		s.logf("delete session error: %v", err)
+
+	defer claim.release()
+
+	release, err := s.acquireExchangeSlot(r.Context())
+	if err != nil {
+		logger.Warn("exchange slot unavailable", "error", err)
+		respondJSONError(w, http.StatusServiceUnavailable, "the broker is busy; please retry in a moment")
+		return
+	}
+	defer release()
+
+	envelope, err := s.exchangeTokens(r.Context(), p, ExchangeParams{
+		Session:    sess,
+		Code:       req.Code,
+		RealmID:    req.RealmID,
+		BusinessID: req.BusinessID,
+	})
+	if err != nil {
+		logger.Error("exchange tokens failed", "error", err)
+		var rl *ProviderRateLimitError
+		switch {
+		case errors.As(err, &rl):
+			respondProviderRateLimited(w, rl)
+		case isUpstreamTimeout(err):
+			respondJSON(w, http.StatusGatewayTimeout, map[string]string{
+				"error": "provider timed out",
+				"code":  "upstream_timeout",
+			})
+		default:
+			respondJSONError(w, http.StatusBadGateway, "token exchange failed")
+		}
+		return
+	}
+	claim.keep()
+	if err := s.Store.Delete(r.Context(), sess.ID); err != nil {
+		logger.Error("delete session failed", "error", err)
 	}
-	respondJSON(w, http.StatusOK, envelope)
+	envelope.Provider = sess.Provider
+	envelope.NormalizeExpiry()
+	respondEnvelope(w, r, envelope, s.Config.SigningKey)
 }
 
-func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
-	if s.enforceJSONRateLimit(w, r, "refresh", s.Config.RateLimitRefresh, s.Config.RateLimitRefreshWindow) {
+// releaseStateTimeout bounds handing back a claimed state. The release
+// runs after the request may have been cancelled, so it cannot use the
+// request's context.
+const releaseStateTimeout = 5 * time.Second
+
+// stateClaim is a session's state claimed with MarkStateUsed for one token
+// exchange. The claim only sticks once the exchange completes: release
+// hands it back on every failure, so a busy broker or a provider error does
+// not burn the state and the flow can still be finished with it.
+type stateClaim struct {
+	store     SessionStore
+	logger    *slog.Logger
+	sessionID string
+	kept      bool
+}
+
+// claimState claims sessionID's state, failing with ErrStateUsed if another
+// callback or exchange already holds it. Callers defer release and call
+// keep once the exchange has succeeded.
+func (s *Server) claimState(ctx context.Context, logger *slog.Logger, sessionID string) (*stateClaim, error) {
+	if err := s.Store.MarkStateUsed(ctx, sessionID); err != nil {
+		return nil, err
+	}
+	return &stateClaim{store: s.Store, logger: logger, sessionID: sessionID}, nil
+}
+
+// keep makes the claim permanent.
+func (c *stateClaim) keep() { c.kept = true }
+
+// release hands the state back unless keep was called.
+func (c *stateClaim) release() {
+	if c.kept {
 		return
 	}
-	var req struct {
-		Provider     string `json:"provider"`
-		RefreshToken string `json:"refresh_token"`
+	ctx, cancel := context.WithTimeout(context.Background(), releaseStateTimeout)
+	defer cancel()
+	if err := c.store.ReleaseState(ctx, c.sessionID); err != nil {
+		c.logger.Error("release state failed", "error", err)
 	}
-	if err := decodeJSONBody(r.Body, &req); err != nil {
-		respondJSONError(w, http.StatusBadRequest, err.Error())
+}
+
+// acquireExchangeSlot waits for a shared upstream exchange slot. The returned
+// release function is safe to defer and never fails the request.
+func (s *Server) acquireExchangeSlot(ctx context.Context) (func(), error) {
+	if s.Config.ExchangeConcurrency <= 0 {
+		return func() {}, nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, s.Config.ExchangeWait)
+	defer cancel()
+	// Hold the slot for longer than an upstream call can take so a crashed
+	// process eventually frees it.
+	lease := s.HTTPClient.Timeout*2 + s.Config.ExchangeWait
+	id, err := s.Store.AcquireExchangeSlot(waitCtx, s.Config.ExchangeConcurrency, lease)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := s.Store.ReleaseExchangeSlot(context.Background(), id); err != nil {
+			s.logger(ctx).Error("release exchange slot failed", "error", err)
+		}
+	}, nil
+}
+
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if rejectUnsupportedNaming(w, r) {
 		return
 	}
-	provider := strings.ToLower(req.Provider)
-	if provider == "" || req.RefreshToken == "" {
-		respondJSONError(w, http.StatusBadRequest, "provider and refresh_token are required")
+	if s.enforceJSONRateLimit(w, r, "poll", "", s.Config.RateLimitPoll, s.Config.RateLimitPollWindow) {
 		return
 	}
-
-	var (
-		envelope TokenEnvelope
-		err      error
-	)
-	switch provider {
-	case "deputy":
-		envelope, err = s.refreshDeputy(r.Context(), req.RefreshToken)
-	case "qbo":
-		envelope, err = s.refreshQBO(r.Context(), req.RefreshToken)
-	case "xero":
-		envelope, err = s.refreshXero(r.Context(), req.RefreshToken)
-	default:
-		respondJSONError(w, http.StatusBadRequest, "unsupported provider")
+	sessionID := lastPathComponent(r.URL.Path)
+	if sessionID == "" {
+		http.NotFound(w, r)
 		return
 	}
+	logger := s.logger(r.Context()).With("session", SessionHash(sessionID))
+	sess, err := s.Store.LoadForPoll(r.Context(), sessionID)
 	if err != nil {
-		s.logf("refresh failed provider=%s error=%v", provider, err)
-		respondJSONError(w, http.StatusBadGateway, "token refresh failed")
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSONError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		logger.Error("load session failed", "error", err)
+		respondJSONError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
-	envelope.Provider = provider
-	respondJSON(w, http.StatusOK, envelope)
-}
-
-func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	logger = logger.With("provider", sess.Provider)
+	s.count(r.Context(), metricPolls, prometheus.Labels{"provider": sess.Provider})
+	s.deliverResult(w, r, logger, sess)
 }
 
-func (s *Server) startXeroAuth(state string) (string, sql.NullString, error) {
-	verifier, err := randomID(64)
-	if err != nil {
-		return "", sql.NullString{}, err
-	}
-	hashed := sha256.Sum256([]byte(verifier))
-	challenge := base64.RawURLEncoding.EncodeToString(hashed[:])
-
-	v := url.Values{}
-	v.Set("response_type", "code")
-	v.Set("client_id", s.Config.XeroClientID)
-	v.Set("redirect_uri", s.Config.XeroRedirectURL)
-	v.Set("scope", strings.Join(s.Config.XeroScopes, " "))
-	v.Set("state", state)
-	v.Set("code_challenge", challenge)
-	v.Set("code_challenge_method", "S256")
-	authURL := s.Config.GetXeroAuthURL() + "?" + v.Encode()
-	return authURL, sql.NullString{String: verifier, Valid: true}, nil
-}
-
-func (s *Server) startDeputyAuth(state string) (string, error) {
-	v := url.Values{}
-	v.Set("response_type", "code")
-	v.Set("client_id", s.Config.DeputyClientID)
-	v.Set("redirect_uri", s.Config.DeputyRedirectURL)
-	v.Set("scope", strings.Join(s.Config.DeputyScopes, " "))
-	v.Set("state", state)
-	authURL := s.Config.GetDeputyAuthURL() + "?" + v.Encode()
-	return authURL, nil
-}
-
-func (s *Server) startQBOAuth(state string) (string, error) {
-	v := url.Values{}
-	v.Set("client_id", s.Config.QBOClientID)
-	v.Set("redirect_uri", s.Config.QBORedirectURL)
-	v.Set("response_type", "code")
-	v.Set("scope", strings.Join(s.Config.QBOScopes, " "))
-	v.Set("state", state)
-	authURL := s.Config.GetQBOAuthURL() + "?" + v.Encode()
-	return authURL, nil
-}
-
-func (s *Server) exchangeXero(ctx context.Context, sess *Session, code string) (TokenEnvelope, error) {
-	if code == "" {
-		return TokenEnvelope{}, fmt.Errorf("missing code")
-	}
-	data := url.Values{}
-	data.Set("grant_type", "authorization_code")
-	data.Set("code", code)
-	data.Set("redirect_uri", s.Config.XeroRedirectURL)
-	data.Set("client_id", s.Config.XeroClientID)
-	if sess.CodeVerifier.Valid {
-		data.Set("code_verifier", sess.CodeVerifier.String)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Config.GetXeroTokenURL(), strings.NewReader(data.Encode()))
-	if err != nil {
-		return TokenEnvelope{}, err
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if s.Config.XeroClientSecret != "" {
-		req.SetBasicAuth(s.Config.XeroClientID, s.Config.XeroClientSecret)
+// handleRedeem hands over the tokens of a return_url flow in exchange for
+// the one-time code the callback added to the return URL. The code is spent
+// by the lookup, whatever the outcome.
+func (s *Server) handleRedeem(w http.ResponseWriter, r *http.Request) {
+	if rejectUnsupportedNaming(w, r) {
+		return
 	}
-
-	resp, err := s.HTTPClient.Do(req)
-	if err != nil {
-		return TokenEnvelope{}, err
+	if s.enforceJSONRateLimit(w, r, "poll", "", s.Config.RateLimitPoll, s.Config.RateLimitPollWindow) {
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return TokenEnvelope{}, fmt.Errorf("xero token error: %s", body)
+	var req struct {
+		Code string `json:"code"`
 	}
-	var payload struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int64  `json:"expires_in"`
-		Scope        string `json:"scope"`
-		TokenType    string `json:"token_type"`
-		IDToken      string `json:"id_token"`
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return TokenEnvelope{}, err
+	if req.Code == "" {
+		respondJSONError(w, http.StatusBadRequest, "code is required")
+		return
 	}
-
-	tenants, err := s.fetchXeroConnections(ctx, payload.AccessToken)
+	sess, err := s.Store.RedeemReturnCode(r.Context(), returnCodeHash(req.Code))
 	if err != nil {
-		s.logf("fetch connections failed: %v", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSONError(w, http.StatusNotFound, "unknown or already redeemed code")
+			return
+		}
+		s.logger(r.Context()).Error("redeem return code failed", "error", err)
+		respondJSONError(w, http.StatusInternalServerError, "internal error")
+		return
 	}
-
-	return TokenEnvelope{
-		AccessToken:  payload.AccessToken,
-		RefreshToken: payload.RefreshToken,
-		ExpiresAt:    time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second),
-		Scope:        payload.Scope,
-		TokenType:    payload.TokenType,
-		IDToken:      payload.IDToken,
-		Tenants:      tenants,
-	}, nil
+	logger := s.logger(r.Context()).With("session", SessionHash(sess.ID), "provider", sess.Provider)
+	s.deliverResult(w, r, logger, sess)
 }
 
-func (s *Server) exchangeDeputy(ctx context.Context, code string) (TokenEnvelope, error) {
-	if code == "" {
-		return TokenEnvelope{}, fmt.Errorf("missing code")
+// deliverResult answers a poll or redemption for sess: pending, expired,
+// already collected, or the tokens, after which only a Xero tombstone
+// remains.
+func (s *Server) deliverResult(w http.ResponseWriter, r *http.Request, logger *slog.Logger, sess *Session) {
+	sessionID := sess.ID
+	if time.Now().After(sess.ExpiresAt) {
+		_ = s.Store.Delete(r.Context(), sessionID)
+		respondJSONError(w, http.StatusGone, "session expired")
+		return
+	}
+	if !sess.ReadyAt.Valid {
+		respondJSON(w, http.StatusOK, map[string]any{"status": "pending"})
+		return
+	}
+	if len(sess.Result) == 0 {
+		respondJSONError(w, http.StatusGone, "session already collected")
+		return
 	}
-	data := url.Values{}
-	data.Set("grant_type", "authorization_code")
-	data.Set("client_id", s.Config.DeputyClientID)
-	data.Set("client_secret", s.Config.DeputyClientSecret)
-	data.Set("redirect_uri", s.Config.DeputyRedirectURL)
-	data.Set("code", code)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Config.GetDeputyTokenURL(), strings.NewReader(data.Encode()))
+	payload, err := openResult(s.Config.MasterKey, sess.ID, sess.Result)
 	if err != nil {
-		return TokenEnvelope{}, err
+		logger.Error("open session result failed", "error", err)
+		respondJSONError(w, http.StatusInternalServerError, "internal error")
+		return
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := s.HTTPClient.Do(req)
-	if err != nil {
-		return TokenEnvelope{}, err
+	var envelope TokenEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		logger.Error("unmarshal session result failed", "error", err)
+		respondJSONError(w, http.StatusInternalServerError, "internal error")
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return TokenEnvelope{}, fmt.Errorf("deputy token error: %s", body)
+	// Xero sessions stay behind as a tombstone until expiry so that
+	// /v1/xero/tenants can still be used for them.
+	if sess.Provider == "xero" {
+		if err := s.Store.ClearResult(r.Context(), sessionID); err != nil {
+			logger.Error("clear session result failed", "error", err)
+		}
+	} else if err := s.Store.Delete(r.Context(), sessionID); err != nil {
+		logger.Error("delete session failed", "error", err)
+	}
+	if r.URL.Query().Get("claims") == "1" && envelope.IDToken != "" {
+		claims, err := decodeIDTokenClaims(envelope.IDToken)
+		if err != nil {
+			logger.Warn("decode id_token failed", "error", err)
+		} else {
+			envelope.Claims = claims
+		}
 	}
-	var payload struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int64  `json:"expires_in"`
-		Scope        string `json:"scope"`
-		Endpoint     string `json:"endpoint"`
-		TokenType    string `json:"token_type"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return TokenEnvelope{}, err
-	}
-	return TokenEnvelope{
-		AccessToken:  payload.AccessToken,
-		RefreshToken: payload.RefreshToken,
-		ExpiresAt:    time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second),
-		Scope:        payload.Scope,
-		Endpoint:     payload.Endpoint,
-		TokenType:    payload.TokenType,
-	}, nil
+	respondEnvelope(w, r, envelope, s.Config.SigningKey)
 }
 
-func (s *Server) exchangeQBO(ctx context.Context, code, realmID string) (TokenEnvelope, error) {
-	if code == "" {
-		return TokenEnvelope{}, fmt.Errorf("missing code")
+// handleXeroTenants returns the full /connections metadata for a Xero flow
+// whose envelope carried only the essential tenant fields. The caller
+// presents the access token it received, which must be the one that
+// session's exchange issued. It is rate limited with the poll limits but
+// counted separately, so fetching tenants does not use up polls.
+func (s *Server) handleXeroTenants(w http.ResponseWriter, r *http.Request) {
+	if s.enforceJSONRateLimit(w, r, "tenants", "xero", s.Config.RateLimitPoll, s.Config.RateLimitPollWindow) {
+		return
 	}
-	data := url.Values{}
-	data.Set("grant_type", "authorization_code")
-	data.Set("code", code)
-	data.Set("redirect_uri", s.Config.QBORedirectURL)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Config.GetQBOTokenURL(), strings.NewReader(data.Encode()))
-	if err != nil {
-		return TokenEnvelope{}, err
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		respondJSONError(w, http.StatusBadRequest, "session is required")
+		return
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(s.Config.QBOClientID, s.Config.QBOClientSecret)
-
-	resp, err := s.HTTPClient.Do(req)
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		respondJSONError(w, http.StatusUnauthorized, "bearer access token required")
+		return
+	}
+	if !s.Config.ProviderEnabled("xero") {
+		respondJSONError(w, http.StatusBadRequest, "provider not enabled")
+		return
+	}
+	sess, err := s.Store.LoadForPoll(r.Context(), sessionID)
 	if err != nil {
-		return TokenEnvelope{}, err
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSONError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		s.logger(r.Context()).Error("load session failed", "session", SessionHash(sessionID), "error", err)
+		respondJSONError(w, http.StatusInternalServerError, "internal error")
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return TokenEnvelope{}, fmt.Errorf("qbo token error: %s", body)
+	if sess.Provider != "xero" {
+		respondJSONError(w, http.StatusBadRequest, "not a xero session")
+		return
 	}
-	var payload struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int64  `json:"expires_in"`
-		XRefresh     int64  `json:"x_refresh_token_expires_in"`
-		Scope        string `json:"scope"`
-		TokenType    string `json:"token_type"`
+	if time.Now().After(sess.ExpiresAt) {
+		respondJSONError(w, http.StatusGone, "session expired")
+		return
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return TokenEnvelope{}, err
+	if !sess.ReadyAt.Valid {
+		respondJSONError(w, http.StatusConflict, "authorisation not complete")
+		return
 	}
-	env := TokenEnvelope{
-		AccessToken:  payload.AccessToken,
-		RefreshToken: payload.RefreshToken,
-		ExpiresAt:    time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second),
-		Scope:        payload.Scope,
-		TokenType:    payload.TokenType,
-		RealmID:      realmID,
+	if subtle.ConstantTimeCompare([]byte(accessTokenHash(token)), []byte(sess.AccessTokenHash.String)) != 1 {
+		respondJSONError(w, http.StatusForbidden, "access token was not issued for this session")
+		return
 	}
-	if payload.XRefresh > 0 {
-		if env.Raw == nil {
-			env.Raw = make(map[string]any)
+	xp := &xeroProvider{s.providerBase("xero")}
+	if started, err := xp.copyConnections(r.Context(), token, w); err != nil {
+		s.logger(r.Context()).Error("fetch xero tenants failed", "provider", "xero", "session", SessionHash(sessionID), "error", err)
+		if started {
+			// Part of the body is already out; nothing more can be sent.
+			return
+		}
+		var rl *ProviderRateLimitError
+		var pe *ProviderError
+		switch {
+		case errors.As(err, &rl):
+			respondProviderRateLimited(w, rl)
+		case errors.As(err, &pe):
+			respondJSON(w, http.StatusBadGateway, map[string]any{
+				"error":             "xero connections request failed",
+				"provider_status":   pe.Status,
+				"provider_response": pe.Body,
+			})
+		case isUpstreamTimeout(err):
+			respondJSON(w, http.StatusGatewayTimeout, map[string]string{
+				"error": "provider timed out",
+				"code":  "upstream_timeout",
+			})
+		default:
+			respondJSONError(w, http.StatusBadGateway, "xero connections request failed")
 		}
-		env.Raw["refresh_token_expires_in"] = payload.XRefresh
 	}
-	return env, nil
 }
 
-func (s *Server) refreshDeputy(ctx context.Context, refreshToken string) (TokenEnvelope, error) {
-	data := url.Values{}
-	data.Set("grant_type", "refresh_token")
-	data.Set("refresh_token", refreshToken)
-	data.Set("client_id", s.Config.DeputyClientID)
-	data.Set("client_secret", s.Config.DeputyClientSecret)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Config.GetDeputyTokenURL(), strings.NewReader(data.Encode()))
-	if err != nil {
-		return TokenEnvelope{}, err
+// handleXeroDisconnect removes an organisation connection from the caller's
+// Xero account, which revoking the token does not do. The connection is
+// named by connection_id or, failing that, found from tenant_id in the
+// access token's live connections.
+func (s *Server) handleXeroDisconnect(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AccessToken  string `json:"access_token"`
+		ConnectionID string `json:"connection_id"`
+		TenantID     string `json:"tenant_id"`
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := s.HTTPClient.Do(req)
-	if err != nil {
-		return TokenEnvelope{}, err
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return TokenEnvelope{}, fmt.Errorf("deputy refresh error: %s", body)
+	if s.enforceJSONRateLimit(w, r, "revoke", "xero", s.Config.RateLimitRefresh, s.Config.RateLimitRefreshWindow) {
+		return
 	}
-	var payload struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int64  `json:"expires_in"`
-		Scope        string `json:"scope"`
-		Endpoint     string `json:"endpoint"`
-		TokenType    string `json:"token_type"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return TokenEnvelope{}, err
-	}
-	return TokenEnvelope{
-		AccessToken:  payload.AccessToken,
-		RefreshToken: payload.RefreshToken,
-		ExpiresAt:    time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second),
-		Scope:        payload.Scope,
-		Endpoint:     payload.Endpoint,
-		TokenType:    payload.TokenType,
-	}, nil
-}
-
-func (s *Server) refreshQBO(ctx context.Context, refreshToken string) (TokenEnvelope, error) {
-	data := url.Values{}
-	data.Set("grant_type", "refresh_token")
-	data.Set("refresh_token", refreshToken)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Config.GetQBOTokenURL(), strings.NewReader(data.Encode()))
-	if err != nil {
-		return TokenEnvelope{}, err
+	if req.AccessToken == "" || (req.ConnectionID == "" && req.TenantID == "") {
+		respondJSONError(w, http.StatusBadRequest, "access_token and connection_id or tenant_id are required")
+		return
+	}
+	if !s.Config.ProviderEnabled("xero") {
+		respondJSONError(w, http.StatusBadRequest, "provider not enabled")
+		return
+	}
+	xp := &xeroProvider{s.providerBase("xero")}
+	connectionID := req.ConnectionID
+	var err error
+	if connectionID == "" {
+		connectionID, err = xp.connectionForTenant(r.Context(), req.AccessToken, req.TenantID)
+	}
+	if err == nil {
+		if connectionID == "" {
+			respondJSONError(w, http.StatusNotFound, "tenant is not connected to this authorisation")
+			return
+		}
+		err = xp.deleteConnection(r.Context(), req.AccessToken, connectionID)
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(s.Config.QBOClientID, s.Config.QBOClientSecret)
-
-	resp, err := s.HTTPClient.Do(req)
 	if err != nil {
-		return TokenEnvelope{}, err
+		s.logger(r.Context()).Error("xero disconnect failed", "provider", "xero", "connection_id", connectionID, "error", err)
+		var rl *ProviderRateLimitError
+		var pe *ProviderError
+		switch {
+		case errors.As(err, &rl):
+			respondProviderRateLimited(w, rl)
+		case errors.As(err, &pe):
+			respondJSON(w, http.StatusBadGateway, map[string]any{
+				"error":             "xero disconnect failed",
+				"provider_status":   pe.Status,
+				"provider_response": pe.Body,
+			})
+		case isUpstreamTimeout(err):
+			respondJSON(w, http.StatusGatewayTimeout, map[string]string{
+				"error": "provider timed out",
+				"code":  "upstream_timeout",
+			})
+		default:
+			respondJSONError(w, http.StatusBadGateway, "xero disconnect failed")
+		}
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return TokenEnvelope{}, fmt.Errorf("qbo refresh error: %s", body)
+	respondJSON(w, http.StatusOK, map[string]string{"status": "disconnected", "connection_id": connectionID})
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if rejectUnsupportedNaming(w, r) {
+		return
 	}
-	var payload struct {
-		AccessToken  string `json:"access_token"`
+	var req struct {
+		Provider     string `json:"provider"`
 		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int64  `json:"expires_in"`
-		XRefresh     int64  `json:"x_refresh_token_expires_in"`
-		Scope        string `json:"scope"`
-		TokenType    string `json:"token_type"`
+		RealmID      string `json:"realmId"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return TokenEnvelope{}, err
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	env := TokenEnvelope{
-		AccessToken:  payload.AccessToken,
-		RefreshToken: payload.RefreshToken,
-		ExpiresAt:    time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second),
-		Scope:        payload.Scope,
-		TokenType:    payload.TokenType,
+	if s.enforceJSONRateLimit(w, r, "refresh", s.rateLimitProvider(req.Provider), s.Config.RateLimitRefresh, s.Config.RateLimitRefreshWindow) {
+		return
 	}
-	if payload.XRefresh > 0 {
-		if env.Raw == nil {
-			env.Raw = make(map[string]any)
-		}
-		env.Raw["refresh_token_expires_in"] = payload.XRefresh
+	if s.rejectWithoutAPIKey(w, r) {
+		return
+	}
+	provider := strings.ToLower(req.Provider)
+	if provider == "" || req.RefreshToken == "" {
+		respondJSONError(w, http.StatusBadRequest, "provider and refresh_token are required")
+		return
 	}
-	return env, nil
-}
-
-func (s *Server) refreshXero(ctx context.Context, refreshToken string) (TokenEnvelope, error) {
-	data := url.Values{}
-	data.Set("grant_type", "refresh_token")
-	data.Set("refresh_token", refreshToken)
-	data.Set("client_id", s.Config.XeroClientID)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Config.GetXeroTokenURL(), strings.NewReader(data.Encode()))
+	p, ok := s.provider(provider)
+	if !ok {
+		respondJSONError(w, http.StatusBadRequest, "unsupported provider")
+		return
+	}
+	if !s.Config.ProviderEnabled(provider) {
+		respondJSONError(w, http.StatusBadRequest, "provider not enabled")
+		return
+	}
+	var throttleKey string
+	if s.Config.RefreshMinInterval > 0 && s.Store != nil {
+		throttleKey = refreshThrottleKey(provider, req.RefreshToken)
+		if s.throttleRefresh(w, r, provider, throttleKey) {
+			return
+		}
+	}
+	envelope, err := p.Refresh(r.Context(), RefreshParams{RefreshToken: req.RefreshToken, RealmID: req.RealmID})
+	s.recordRefreshOutcome(r.Context(), provider, err)
 	if err != nil {
-		return TokenEnvelope{}, err
+		s.logger(r.Context()).Error("refresh failed", "provider", provider, "error", err)
+		if throttleKey != "" {
+			s.forgetRefresh(r.Context(), provider, throttleKey)
+		}
+		var rl *ProviderRateLimitError
+		if errors.As(err, &rl) {
+			respondProviderRateLimited(w, rl)
+			return
+		}
+		if isUpstreamTimeout(err) {
+			respondJSON(w, http.StatusGatewayTimeout, map[string]string{
+				"error": "provider timed out",
+				"code":  "upstream_timeout",
+			})
+			return
+		}
+		respondJSONError(w, http.StatusBadGateway, "token refresh failed")
+		return
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if s.Config.XeroClientSecret != "" {
-		req.SetBasicAuth(s.Config.XeroClientID, s.Config.XeroClientSecret)
+	envelope.Provider = provider
+	if throttleKey != "" {
+		s.rememberRefresh(r.Context(), throttleKey, envelope)
 	}
+	respondEnvelope(w, r, envelope, s.Config.SigningKey)
+}
 
-	resp, err := s.HTTPClient.Do(req)
-	if err != nil {
-		return TokenEnvelope{}, err
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Provider      string `json:"provider"`
+		Token         string `json:"token"`
+		TokenTypeHint string `json:"token_type_hint"`
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return TokenEnvelope{}, fmt.Errorf("xero refresh error: %s", body)
+	if err := decodeJSONBody(r.Body, &req); err != nil {
+		respondJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	var payload struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		ExpiresIn    int64  `json:"expires_in"`
-		Scope        string `json:"scope"`
-		TokenType    string `json:"token_type"`
+	if s.enforceJSONRateLimit(w, r, "revoke", s.rateLimitProvider(req.Provider), s.Config.RateLimitRefresh, s.Config.RateLimitRefreshWindow) {
+		return
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return TokenEnvelope{}, err
+	provider := strings.ToLower(req.Provider)
+	if provider == "" || req.Token == "" {
+		respondJSONError(w, http.StatusBadRequest, "provider and token are required")
+		return
 	}
-	tenants, err := s.fetchXeroConnections(ctx, payload.AccessToken)
-	if err != nil {
-		s.logf("fetch connections failed: %v", err)
-	}
-	return TokenEnvelope{
-		AccessToken:  payload.AccessToken,
-		RefreshToken: payload.RefreshToken,
-		ExpiresAt:    time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second),
-		Scope:        payload.Scope,
-		TokenType:    payload.TokenType,
-		Tenants:      tenants,
-	}, nil
+	switch req.TokenTypeHint {
+	case "", "refresh_token", "access_token":
+	default:
+		respondJSONError(w, http.StatusBadRequest, "token_type_hint must be refresh_token or access_token")
+		return
+	}
+
+	p, ok := s.provider(provider)
+	if !ok {
+		respondJSONError(w, http.StatusBadRequest, "unsupported provider")
+		return
+	}
+	if !s.Config.ProviderEnabled(provider) {
+		respondJSONError(w, http.StatusBadRequest, "provider not enabled")
+		return
+	}
+	if err := p.Revoke(r.Context(), req.Token, req.TokenTypeHint); err != nil {
+		s.logger(r.Context()).Error("revoke failed", "provider", provider, "error", err)
+		var rl *ProviderRateLimitError
+		var pe *ProviderError
+		switch {
+		case errors.Is(err, ErrRevokeUnsupported):
+			respondJSONError(w, http.StatusNotImplemented, err.Error())
+		case errors.As(err, &rl):
+			respondProviderRateLimited(w, rl)
+		case errors.As(err, &pe):
+			respondJSON(w, http.StatusBadGateway, map[string]any{
+				"error":             "token revocation failed",
+				"provider_status":   pe.Status,
+				"provider_response": pe.Body,
+			})
+		case isUpstreamTimeout(err):
+			respondJSON(w, http.StatusGatewayTimeout, map[string]string{
+				"error": "provider timed out",
+				"code":  "upstream_timeout",
+			})
+		default:
+			respondJSONError(w, http.StatusBadGateway, "token revocation failed")
+		}
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
 }
 
-func (s *Server) fetchXeroConnections(ctx context.Context, accessToken string) ([]XeroTenant, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Config.GetXeroAPIBaseURL()+"/connections", nil)
-	if err != nil {
-		return nil, err
+func (s *Server) handleProviders(w http.ResponseWriter, r *http.Request) {
+	enabled := []string{}
+	for _, name := range s.Config.ProviderNames() {
+		if s.Config.ProviderEnabled(name) {
+			enabled = append(enabled, name)
+		}
 	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	resp, err := s.HTTPClient.Do(req)
-	if err != nil {
-		return nil, err
+	respondJSON(w, http.StatusOK, map[string]any{"providers": enabled})
+}
+
+// healthPingTimeout bounds the database check of a deep health probe, well
+// inside the few seconds container probes usually allow.
+const healthPingTimeout = 2 * time.Second
+
+// handleHealthz answers liveness probes. With ?deep=1 it also checks that
+// the session database answers, so a broker that has lost it reports 503.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("deep") == "" {
+		respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return nil, fmt.Errorf("xero connections error: %s", body)
+	if db, ok := s.Store.(Pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+		if err := db.Ping(ctx); err != nil {
+			s.logger(r.Context()).Error("deep health check failed", "error", err)
+			respondJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "database": "unreachable"})
+			return
+		}
 	}
-	var tenants []XeroTenant
-	if err := json.NewDecoder(resp.Body).Decode(&tenants); err != nil {
-		return nil, err
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok", "database": "ok"})
+}
+
+// mergeAuthParams adds configured extra authorize parameters without
+// replacing any the broker has already set.
+func mergeAuthParams(v url.Values, extra url.Values) {
+	for k, vals := range extra {
+		if _, exists := v[k]; exists {
+			continue
+		}
+		v[k] = append([]string(nil), vals...)
 	}
-	return tenants, nil
+}
+
+// tokenExpiry converts a provider expires_in value into an absolute expiry.
+// Providers that omit expires_in issue non-expiring tokens; those keep a zero
+// expiry instead of being reported as already expired.
+func tokenExpiry(expiresIn int64) (time.Time, bool) {
+	if expiresIn <= 0 {
+		return time.Time{}, true
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second), false
 }
 
 func decodeJSONBody(body io.ReadCloser, dst any) error {
@@ -703,6 +1045,20 @@ func respondJSONError(w http.ResponseWriter, status int, msg string) {
 	respondJSON(w, status, map[string]string{"error": msg})
 }
 
+// respondProviderRateLimited relays an upstream 429 to the client with the
+// provider's suggested delay.
+func respondProviderRateLimited(w http.ResponseWriter, rl *ProviderRateLimitError) {
+	secs := int64(rl.RetryAfter / time.Second)
+	if secs > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+	respondJSON(w, http.StatusTooManyRequests, map[string]any{
+		"error":               "provider rate limited",
+		"code":                "provider_rate_limited",
+		"retry_after_seconds": secs,
+	})
+}
+
 func randomID(n int) (string, error) {
 	b := make([]byte, n)
 	if _, err := rand.Read(b); err != nil {
@@ -711,12 +1067,32 @@ func randomID(n int) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// providerFromCallbackPath returns the single path segment following
+// /callback/ in p, or "" if there is none or more follow, as in
+// /callback/xero/ or /callback/xero/extra. Callers must check the result
+// against the registry.
 func providerFromCallbackPath(p string) string {
 	idx := strings.Index(p, "/callback/")
 	if idx == -1 {
 		return ""
 	}
-	return strings.Trim(strings.TrimPrefix(p[idx+len("/callback/"):], "/"), "/")
+	name := p[idx+len("/callback/"):]
+	if strings.Contains(name, "/") {
+		return ""
+	}
+	return name
+}
+
+// isLoopbackRedirect reports whether raw is a plain-http redirect to an IP
+// loopback address with an explicit port, the only form accepted for the
+// CLI's local callback (RFC 8252 section 7.3).
+func isLoopbackRedirect(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" || u.User != nil || u.Port() == "" || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
 }
 
 func lastPathComponent(p string) string {
@@ -727,48 +1103,148 @@ func lastPathComponent(p string) string {
 	return parts[len(parts)-1]
 }
 
-func (s *Server) renderFailure(w http.ResponseWriter, msg string) {
-	w.WriteHeader(http.StatusBadRequest)
-	if err := s.failureTemplate.Execute(w, map[string]string{"Message": msg}); err != nil {
-		s.logf("render failure template error: %v", err)
+func (s *Server) renderFailure(w http.ResponseWriter, r *http.Request, msg string) {
+	s.renderPage(w, r, http.StatusBadRequest, s.failureTemplate, builtinFailureTemplate, s.failurePageFor(r, "", msg))
+}
+
+// failurePageFor builds the failure page for a callback request, naming
+// the provider from its path.
+func (s *Server) failurePageFor(r *http.Request, title, msg string) failurePage {
+	page := failurePage{Title: title, Message: msg}
+	if provider := providerFromCallbackPath(r.URL.Path); provider != "" {
+		page.Provider, page.ProviderID = providerDisplayName(provider), provider
+	}
+	return page
+}
+
+// callbackFailed renders a callback failure and counts it against sess.
+// Once a session reaches CallbackMaxFailures it is deleted, which breaks
+// redirect loops and bounds guessing, and the locked page is shown instead.
+func (s *Server) callbackFailed(w http.ResponseWriter, r *http.Request, sess *Session, msg string) {
+	if sess != nil && s.Config.CallbackMaxFailures > 0 {
+		logger := s.logger(r.Context()).With("provider", sess.Provider, "session", SessionHash(sess.ID))
+		n, err := s.Store.RecordCallbackFailure(r.Context(), sess.ID)
+		if err != nil {
+			logger.Error("record callback failure failed", "error", err)
+		} else if n >= s.Config.CallbackMaxFailures {
+			if err := s.Store.Delete(r.Context(), sess.ID); err != nil {
+				logger.Error("delete locked session failed", "error", err)
+			}
+			logger.Warn("session locked after failed callbacks", "failures", n)
+			s.renderPage(w, r, http.StatusLocked, s.failureTemplate, builtinFailureTemplate, s.failurePageFor(r, "Session locked",
+				"This sign-in session saw too many failed attempts and has been closed. Start again from the command line."))
+			return
+		}
 	}
+	s.renderFailure(w, r, msg)
 }
 
-func (s *Server) enforceJSONRateLimit(w http.ResponseWriter, r *http.Request, scope string, limit int, window time.Duration) bool {
-	if s.Store == nil || limit <= 0 {
+// rejectWithoutAPIKey answers 401 and returns true unless the request
+// carries BROKER_API_KEY, as X-Broker-Key or as a bearer token. Under CGI
+// X-Broker-Key is the safer choice, as web servers often withhold
+// Authorization from scripts. Without a configured key every request passes.
+func (s *Server) rejectWithoutAPIKey(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.Config.APIKey) == 0 {
 		return false
 	}
-	key := s.rateLimitKey(r, scope)
-	if err := s.Store.IncrementRateLimit(r.Context(), key, limit, window); err != nil {
-		if errors.Is(err, ErrRateLimited) {
-			respondJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
-			return true
-		}
-		s.logf("rate limit error scope=%s error=%v", scope, err)
-		respondJSONError(w, http.StatusInternalServerError, "internal error")
+	key := r.Header.Get("X-Broker-Key")
+	if key == "" {
+		key, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), s.Config.APIKey) == 1 {
+		return false
+	}
+	s.logger(r.Context()).Warn("request without a valid broker API key rejected", "path", r.URL.Path)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="broker"`)
+	respondJSON(w, http.StatusUnauthorized, map[string]string{
+		"error": "a valid broker API key is required",
+		"code":  "api_key_required",
+	})
+	return true
+}
+
+// enforceJSONRateLimit applies the per-client limit for scope, the
+// endpoint, and provider, then the global limit for provider, answering 429
+// and returning true once either is spent. Clients have separate buckets, so
+// one flooding client exhausts only its own before the shared global bucket
+// is touched. provider is empty where the request does not name one, and
+// then only the per-client limit applies.
+func (s *Server) enforceJSONRateLimit(w http.ResponseWriter, r *http.Request, scope, provider string, limit int, window time.Duration) bool {
+	if s.Store == nil {
+		return false
+	}
+	if limit > 0 && s.rateLimited(w, r, scope, rateLimitKey(scope, provider, s.clientIP(r)), limit, window) {
 		return true
 	}
+	if provider != "" && s.Config.RateLimitGlobal > 0 {
+		return s.rateLimited(w, r, scope, "global:"+provider, s.Config.RateLimitGlobal, s.Config.RateLimitGlobalWindow)
+	}
 	return false
 }
 
-func (s *Server) rateLimitKey(r *http.Request, scope string) string {
-	ip := clientIPFromRequest(r)
-	if scope == "" {
-		return ip
+// rateLimited counts a call against key, answering the request and
+// returning true when the limit has been reached or cannot be checked.
+func (s *Server) rateLimited(w http.ResponseWriter, r *http.Request, scope, key string, limit int, window time.Duration) bool {
+	err := s.Store.IncrementRateLimit(r.Context(), key, limit, window)
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) {
+		// The window is fixed, so waiting one full window always clears it;
+		// stores that know when it started say how much of it is left.
+		wait := window
+		var rl *RateLimitedError
+		if errors.As(err, &rl) {
+			wait = rl.RetryAfter
+		}
+		secs := max(int64((wait+time.Second-1)/time.Second), 1)
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+		respondJSON(w, http.StatusTooManyRequests, map[string]any{
+			"error":               "rate_limited",
+			"code":                "rate_limited",
+			"retry_after_seconds": secs,
+		})
+		return true
 	}
-	return fmt.Sprintf("%s:%s", scope, ip)
+	s.logger(r.Context()).Error("rate limit check failed", "scope", scope, "error", err)
+	respondJSONError(w, http.StatusInternalServerError, "internal error")
+	return true
 }
 
-func clientIPFromRequest(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			candidate := strings.TrimSpace(parts[0])
-			if candidate != "" {
-				return candidate
-			}
+// rateLimitKey is the per-client bucket for an endpoint and provider:
+// "refresh:qbo:203.0.113.9", or "poll::203.0.113.9" without a provider.
+func rateLimitKey(scope, provider, ip string) string {
+	return scope + ":" + provider + ":" + ip
+}
+
+// rateLimitProvider returns name as a rate limit key component when it is
+// a provider this broker serves, and "" otherwise, so that made-up names
+// cannot mint fresh buckets.
+func (s *Server) rateLimitProvider(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if slices.Contains(s.Config.ProviderNames(), name) {
+		return name
+	}
+	return ""
+}
+
+// clientIP identifies the caller for rate limiting and session metadata.
+// The trusted proxy header and X-Forwarded-For are only believed when the
+// request arrives from a trusted proxy, so clients that reach the broker
+// directly cannot spoof their identity by sending either header.
+func (s *Server) clientIP(r *http.Request) string {
+	if !s.Config.IsTrustedProxy(remoteHost(r)) {
+		return remoteHost(r)
+	}
+	if s.Config.TrustedProxyHeader != "" {
+		if v := strings.TrimSpace(r.Header.Get(s.Config.TrustedProxyHeader)); v != "" {
+			return v
 		}
 	}
+	return clientIPFromRequest(r, s.Config.TrustedProxyHops)
+}
+
+func remoteHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		return r.RemoteAddr
@@ -776,6 +1252,30 @@ func clientIPFromRequest(r *http.Request) string {
 	return host
 }
 
+// clientIPFromRequest returns the client address as seen by the outermost
+// of hops trusted proxies, each of which appends the address it received
+// from to X-Forwarded-For. Entries left of that were written by the client
+// and are ignored; with no trusted hops the header is not read at all. When
+// there are fewer entries than hops the request did not pass through every
+// proxy, so no entry can be trusted and the peer address is used.
+func clientIPFromRequest(r *http.Request, hops int) string {
+	if hops <= 0 {
+		return remoteHost(r)
+	}
+	var entries []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if len(entries) < hops {
+		return remoteHost(r)
+	}
+	return entries[len(entries)-hops]
+}
+
 func sanitizeLogValue(val string) string {
 	if val == "" {
 		return val
@@ -785,34 +1285,6 @@ func sanitizeLogValue(val string) string {
 	return redacted
 }
 
-func (s *Server) logf(format string, args ...interface{}) {
-	if s.Logger == nil {
-		return
-	}
-	sanitized := make([]interface{}, len(args))
-	for i, arg := range args {
-		switch v := arg.(type) {
-		case error:
-			if v == nil {
-				sanitized[i] = ""
-			} else {
-				sanitized[i] = sanitizeLogValue(v.Error())
-			}
-		case fmt.Stringer:
-			if v == nil {
-				sanitized[i] = ""
-			} else {
-				sanitized[i] = sanitizeLogValue(v.String())
-			}
-		case string:
-			sanitized[i] = sanitizeLogValue(v)
-		default:
-			sanitized[i] = arg
-		}
-	}
-	s.Logger.Printf(format, sanitized...)
-}
-
 const successHTML = `<!DOCTYPE html>
 <html lang="en">
   <head>
@@ -826,9 +1298,16 @@ const successHTML = `<!DOCTYPE html>
   </head>
   <body>
     <div class="card">
-      <h1>Authorisation complete</h1>
-      <p>You can return to the Accounting Ops application to finish setup.</p>
+      <h1>Connected to {{ .Provider }}</h1>
+      <p>{{ .Message }}</p>
     </div>
+    {{- with .PostMessage }}
+    <script>
+      if (window.opener) {
+        window.opener.postMessage({status: "completed", provider: {{ .Provider }}, session: {{ .Session }}}, {{ .Origin }});
+      }
+    </script>
+    {{- end }}
   </body>
 </html>`
 
@@ -836,7 +1315,7 @@ const failureHTML = `<!DOCTYPE html>
 <html lang="en">
   <head>
     <meta charset="utf-8">
-    <title>Authorisation failed</title>
+    <title>{{ with .Title }}{{ . }}{{ else }}Authorisation failed{{ end }}</title>
     <style>
       body { font-family: sans-serif; margin: 2rem; }
       .card { max-width: 520px; padding: 1.5rem; border: 1px solid #fcc; border-radius: 8px; background: #fff5f5; }
@@ -847,7 +1326,7 @@ const failureHTML = `<!DOCTYPE html>
   </head>
   <body>
     <div class="card">
-      <h1>Authorisation failed</h1>
+      <h1>{{ with .Title }}{{ . }}{{ else }}Authorisation failed{{ end }}</h1>
       <p>{{ .Message }}</p>
     </div>
   </body>
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// SessionStore is the persistence the Server needs. Store keeps it in
+// SQLite, shared across CGI processes; PostgresStore keeps it in PostgreSQL,
+// shared across standalone brokers; MemoryStore keeps it in process for
+// tests.
+type SessionStore interface {
+	InsertSession(ctx context.Context, sess Session) error
+	MarkReady(ctx context.Context, sessionID string, payload []byte, realmID *string, accessTokenHash string) error
+	LookupByState(ctx context.Context, provider, state string) (*Session, error)
+	LoadForPoll(ctx context.Context, sessionID string) (*Session, error)
+	MarkStateUsed(ctx context.Context, sessionID string) error
+	ReleaseState(ctx context.Context, sessionID string) error
+	SetReturnCode(ctx context.Context, sessionID, codeHash string) error
+	RedeemReturnCode(ctx context.Context, codeHash string) (*Session, error)
+	RecordCallbackFailure(ctx context.Context, sessionID string) (int, error)
+	ClearResult(ctx context.Context, sessionID string) error
+	Delete(ctx context.Context, sessionID string) error
+
+	DeleteExpiredBefore(ctx context.Context, t time.Time, limit int) (int64, error)
+	DeleteConsumedBefore(ctx context.Context, t time.Time, limit int) (int64, error)
+
+	IncrementRateLimit(ctx context.Context, key string, limit int, window time.Duration) error
+	AcquireExchangeSlot(ctx context.Context, limit int, lease time.Duration) (string, error)
+	ReleaseExchangeSlot(ctx context.Context, id string) error
+	RecordRefreshOutcome(ctx context.Context, provider string, ok bool) error
+	ClaimRefresh(ctx context.Context, key string, interval time.Duration) (*RecentRefresh, error)
+	StoreRefreshResult(ctx context.Context, key string, result []byte) error
+	ReleaseRefresh(ctx context.Context, key string) error
+	IncrementCounter(ctx context.Context, name, labels string) error
+}
+
+// DurableStore is a SessionStore backed by a database, which the broker's
+// admin commands can also read.
+type DurableStore interface {
+	SessionStore
+	ListSessions(ctx context.Context, filter SessionFilter) ([]Session, error)
+	GetByState(ctx context.Context, provider, state string) (*Session, error)
+	RefreshStatsSince(ctx context.Context, since time.Time) (map[string]RefreshStats, error)
+	Counters(ctx context.Context) ([]CounterSample, error)
+	Close() error
+}
+
+// RecentRefresh is a refresh recorded by ClaimRefresh inside the minimum
+// interval. Result is the sealed envelope it produced, or nil while it is in
+// flight. A failed refresh releases its claim.
+type RecentRefresh struct {
+	At     time.Time
+	Result []byte
+}
+
+// Vacuumer is implemented by stores backed by a file that can be compacted.
+type Vacuumer interface {
+	Vacuum(ctx context.Context) error
+	FileSize() int64
+}
+
+// Pinger is implemented by stores backed by a database connection that the
+// deep health check can test.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+var (
+	_ DurableStore = (*Store)(nil)
+	_ DurableStore = (*PostgresStore)(nil)
+	_ SessionStore = (*MemoryStore)(nil)
+	_ Vacuumer     = (*Store)(nil)
+	_ Pinger       = (*Store)(nil)
+	_ Pinger       = (*PostgresStore)(nil)
+)
+
+// OpenStore opens (and initialises) the store named by dsn. A postgres:// or
+// postgresql:// URL selects PostgreSQL; anything else is a SQLite file path,
+// optionally written with a sqlite: prefix.
+func OpenStore(dsn string) (DurableStore, error) {
+	if isPostgresDSN(dsn) {
+		return OpenPostgresStore(dsn)
+	}
+	return OpenSQLiteStore(strings.TrimPrefix(dsn, "sqlite:"))
+}
+
+// OpenStoreReadOnly opens the existing store named by dsn, as OpenStore
+// does, without applying the schema or writing to it.
+func OpenStoreReadOnly(dsn string) (DurableStore, error) {
+	if isPostgresDSN(dsn) {
+		return OpenPostgresStoreReadOnly(dsn)
+	}
+	return OpenSQLiteStoreReadOnly(strings.TrimPrefix(dsn, "sqlite:"))
+}
@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// SignatureHeader carries the broker's detached Ed25519 signature over the
+// exact response body of a token envelope.
+const SignatureHeader = "X-Broker-Signature"
+
+const signaturePrefix = "ed25519="
+
+// parseSigningKey decodes a base64 Ed25519 seed (32 bytes) or full private
+// key (64 bytes).
+func parseSigningKey(val string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+	if err != nil {
+		return nil, err
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	default:
+		return nil, fmt.Errorf("expected %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+}
+
+// parseVerificationKeys decodes a comma-separated list of keys in the
+// BROKER_SIGNING_KEY format and returns their public halves.
+func parseVerificationKeys(val string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for i, part := range strings.Split(val, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, err := parseSigningKey(part)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		keys = append(keys, key.Public().(ed25519.PublicKey))
+	}
+	return keys, nil
+}
+
+// PublicKeys returns every key envelopes may be verified with: the signing
+// key's first, then VerificationKeys, without duplicates.
+func (c Config) PublicKeys() []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	if c.SigningKey != nil {
+		keys = append(keys, c.SigningKey.Public().(ed25519.PublicKey))
+	}
+	for _, k := range c.VerificationKeys {
+		if !slices.ContainsFunc(keys, func(have ed25519.PublicKey) bool { return have.Equal(k) }) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// respondSignedJSON writes payload like respondJSON and, when key is set,
+// adds a signature over the bytes written.
+func respondSignedJSON(w http.ResponseWriter, key ed25519.PrivateKey, payload any) {
+	if key == nil {
+		respondJSON(w, http.StatusOK, payload)
+		return
+	}
+	body, err := jsonMarshal(payload)
+	if err != nil {
+		respondJSONError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	body = append(body, '\n')
+	sig := ed25519.Sign(key, body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(SignatureHeader, signaturePrefix+base64.RawURLEncoding.EncodeToString(sig))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// VerifyEnvelopeSignature checks a SignatureHeader value against body. The
+// signature may be by any of keys, so a verifier configured with both the
+// old and new key accepts envelopes throughout a rotation.
+func VerifyEnvelopeSignature(keys []ed25519.PublicKey, body []byte, header string) error {
+	if header == "" {
+		return errors.New("response is not signed")
+	}
+	if !strings.HasPrefix(header, signaturePrefix) {
+		return errors.New("unsupported signature scheme")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(header, signaturePrefix))
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	for _, pub := range keys {
+		if ed25519.Verify(pub, body, sig) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match")
+}
+
+// ParsePublicKey decodes a base64 (standard or URL-safe) Ed25519 public key.
+func ParsePublicKey(val string) (ed25519.PublicKey, error) {
+	val = strings.TrimRight(strings.TrimSpace(val), "=")
+	raw, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		raw, err = base64.RawStdEncoding.DecodeString(val)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// ParsePublicKeys decodes a comma-separated list of keys in the
+// ParsePublicKey format.
+func ParsePublicKeys(val string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for i, part := range strings.Split(val, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		pub, err := ParsePublicKey(part)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+// handleJWKS publishes the public keys envelopes may be signed with as a
+// JWK set: the signing key's first, then those only kept for verification
+// while a rotation completes. The set is empty when signing is not
+// configured.
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	keys := []map[string]string{}
+	for _, pub := range s.Config.PublicKeys() {
+		sum := sha256.Sum256(pub)
+		keys = append(keys, map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"use": "sig",
+			"alg": "EdDSA",
+			"kid": base64.RawURLEncoding.EncodeToString(sum[:8]),
+			"x":   base64.RawURLEncoding.EncodeToString(pub),
+		})
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
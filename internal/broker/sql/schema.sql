@@ -7,8 +7,16 @@ CREATE TABLE IF NOT EXISTS auth_session (
   created_at INTEGER NOT NULL,
   expires_at INTEGER NOT NULL,
   ready_at INTEGER,
+  used_at INTEGER,
   result_cipher BLOB,
-  consumed INTEGER NOT NULL DEFAULT 0
+  consumed INTEGER NOT NULL DEFAULT 0,
+  redirect_uri TEXT,
+  callback_failures INTEGER NOT NULL DEFAULT 0,
+  nonce TEXT,
+  return_url TEXT,
+  client_ip TEXT,
+  return_code TEXT,
+  access_token_hash TEXT
 );
 
 CREATE INDEX IF NOT EXISTS idx_auth_session_exp ON auth_session(expires_at);
@@ -18,3 +26,29 @@ CREATE TABLE IF NOT EXISTS rate_limit (
   window_start INTEGER NOT NULL,
   count INTEGER NOT NULL
 );
+
+CREATE TABLE IF NOT EXISTS exchange_slot (
+  id TEXT PRIMARY KEY,
+  expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_outcome (
+  provider TEXT NOT NULL,
+  ok INTEGER NOT NULL,
+  at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_outcome_at ON refresh_outcome(at);
+
+CREATE TABLE IF NOT EXISTS metrics (
+  name TEXT NOT NULL,
+  labels TEXT NOT NULL,
+  value INTEGER NOT NULL,
+  PRIMARY KEY (name, labels)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_claim (
+  key TEXT PRIMARY KEY,
+  refreshed_at INTEGER NOT NULL,
+  result_cipher BLOB
+);
@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS auth_session (
+  id TEXT PRIMARY KEY,
+  provider TEXT NOT NULL,
+  state TEXT NOT NULL,
+  code_verifier TEXT,
+  realm_id TEXT,
+  created_at BIGINT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  ready_at BIGINT,
+  used_at BIGINT,
+  result_cipher BYTEA,
+  consumed INTEGER NOT NULL DEFAULT 0,
+  redirect_uri TEXT,
+  callback_failures INTEGER NOT NULL DEFAULT 0,
+  nonce TEXT,
+  return_url TEXT,
+  client_ip TEXT,
+  return_code TEXT,
+  access_token_hash TEXT
+);
+
+-- Columns added after the first PostgreSQL release.
+ALTER TABLE auth_session ADD COLUMN IF NOT EXISTS nonce TEXT;
+ALTER TABLE auth_session ADD COLUMN IF NOT EXISTS return_url TEXT;
+ALTER TABLE auth_session ADD COLUMN IF NOT EXISTS client_ip TEXT;
+ALTER TABLE auth_session ADD COLUMN IF NOT EXISTS return_code TEXT;
+ALTER TABLE auth_session ADD COLUMN IF NOT EXISTS access_token_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_auth_session_exp ON auth_session(expires_at);
+CREATE INDEX IF NOT EXISTS idx_auth_session_state ON auth_session(state);
+CREATE INDEX IF NOT EXISTS idx_auth_session_return_code ON auth_session(return_code) WHERE return_code IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS rate_limit (
+  key TEXT PRIMARY KEY,
+  window_start BIGINT NOT NULL,
+  count INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS exchange_slot (
+  id TEXT PRIMARY KEY,
+  expires_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS refresh_outcome (
+  provider TEXT NOT NULL,
+  ok INTEGER NOT NULL,
+  at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_outcome_at ON refresh_outcome(at);
+
+CREATE TABLE IF NOT EXISTS metrics (
+  name TEXT NOT NULL,
+  labels TEXT NOT NULL,
+  value BIGINT NOT NULL,
+  PRIMARY KEY (name, labels)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_claim (
+  key TEXT PRIMARY KEY,
+  refreshed_at BIGINT NOT NULL,
+  result_cipher BYTEA
+);
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RefreshOutcomeRetention bounds how much refresh history is kept, and so
+// how far back RefreshStatsSince can count.
+const RefreshOutcomeRetention = 24 * time.Hour
+
+// RefreshStats counts refresh outcomes for one provider.
+type RefreshStats struct {
+	Success int64 `json:"success"`
+	Failure int64 `json:"failure"`
+}
+
+// SuccessRate returns the fraction of refreshes that succeeded, or 1 when
+// there were none.
+func (r RefreshStats) SuccessRate() float64 {
+	total := r.Success + r.Failure
+	if total == 0 {
+		return 1
+	}
+	return float64(r.Success) / float64(total)
+}
+
+// RecordRefreshOutcome logs one refresh attempt and drops history older than
+// the retention window. Outcomes live in the database so the counts cover
+// every CGI process, not just the current one.
+func (s *Store) RecordRefreshOutcome(ctx context.Context, provider string, ok bool) error {
+	now := time.Now()
+	okInt := 0
+	if ok {
+		okInt = 1
+	}
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO refresh_outcome(provider, ok, at) VALUES(?, ?, ?)`, provider, okInt, now.Unix()); err != nil {
+		return fmt.Errorf("record refresh outcome: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM refresh_outcome WHERE at < ?`, now.Add(-RefreshOutcomeRetention).Unix()); err != nil {
+		return fmt.Errorf("prune refresh outcomes: %w", err)
+	}
+	return nil
+}
+
+// RefreshStatsSince returns per-provider refresh outcomes recorded at or
+// after since.
+func (s *Store) RefreshStatsSince(ctx context.Context, since time.Time) (map[string]RefreshStats, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT provider, SUM(ok), SUM(1 - ok)
+          FROM refresh_outcome
+         WHERE at >= ?
+         GROUP BY provider
+    `, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("query refresh stats: %w", err)
+	}
+	defer rows.Close()
+	out := make(map[string]RefreshStats)
+	for rows.Next() {
+		var provider string
+		var st RefreshStats
+		if err := rows.Scan(&provider, &st.Success, &st.Failure); err != nil {
+			return nil, fmt.Errorf("scan refresh stats: %w", err)
+		}
+		out[provider] = st
+	}
+	return out, rows.Err()
+}
+
+// recordRefreshOutcome notes a refresh result, logging rather than failing
+// the request if the write does not go through.
+func (s *Server) recordRefreshOutcome(ctx context.Context, provider string, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	s.count(ctx, metricRefreshes, prometheus.Labels{"provider": provider, "outcome": outcome})
+	if recErr := s.Store.RecordRefreshOutcome(ctx, provider, err == nil); recErr != nil {
+		s.logger(ctx).Error("record refresh outcome failed", "provider", provider, "error", recErr)
+	}
+}
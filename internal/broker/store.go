@@ -6,6 +6,8 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -26,20 +28,80 @@ type Session struct {
 	CreatedAt    time.Time
 	ExpiresAt    time.Time
 	ReadyAt      sql.NullTime
+	UsedAt       sql.NullTime
 	Result       []byte
 	Consumed     bool
+	// Collected is set by ListSessions once a poll has taken the result,
+	// leaving the row behind as a tombstone until it expires.
+	Collected bool
+	// RedirectURI is the loopback redirect the CLI supplied at start, for
+	// flows that bypass the broker callback; unset for the normal flow.
+	RedirectURI sql.NullString
+	// Nonce is the OpenID Connect nonce sent on the authorize URL, which an
+	// id_token from the exchange must echo.
+	Nonce sql.NullString
+	// ReturnURL is where the callback sends the browser once the tokens are
+	// ready, for clients that asked to be returned to rather than shown the
+	// success page.
+	ReturnURL sql.NullString
+	// ClientIP is the caller that started the session, as identified for
+	// rate limiting, so operators can trace a flow back to its client.
+	ClientIP sql.NullString
+	// AccessTokenHash is the hex SHA-256 of the access token the exchange
+	// issued, which the Xero tenants endpoint requires its caller to hold.
+	AccessTokenHash sql.NullString
 }
 
 // Store wraps SQLite persistence for session management.
 type Store struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
+
+	vacuumMu sync.Mutex
 }
 
 // ErrRateLimited indicates a caller has exceeded the configured quota.
 var ErrRateLimited = errors.New("rate limit exceeded")
 
-// OpenStore opens (and initialises) the session store database.
-func OpenStore(path string) (*Store, error) {
+// RateLimitedError is the ErrRateLimited a store returns, with the time left
+// in the full window.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string { return ErrRateLimited.Error() }
+
+// Is makes errors.Is(err, ErrRateLimited) hold.
+func (e *RateLimitedError) Is(target error) bool { return target == ErrRateLimited }
+
+// windowFull returns the RateLimitedError for a window of windowSeconds that
+// started at start, both in Unix seconds.
+func windowFull(start, windowSeconds, now int64) error {
+	return &RateLimitedError{RetryAfter: time.Duration(max(start+windowSeconds-now, 1)) * time.Second}
+}
+
+// ErrExchangeBusy indicates no upstream exchange slot became free in time.
+var ErrExchangeBusy = errors.New("too many concurrent token exchanges")
+
+// ErrStoreBusy indicates maintenance was skipped because the store is in use.
+var ErrStoreBusy = errors.New("store busy")
+
+// OpenSQLiteStoreReadOnly opens an existing session store without applying
+// the schema or taking write locks, for inspecting a live broker's database.
+func OpenSQLiteStoreReadOnly(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	return &Store{db: db, path: path}, nil
+}
+
+// OpenSQLiteStore opens (and initialises) the session store database.
+func OpenSQLiteStore(path string) (*Store, error) {
 	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_pragma=journal_mode(WAL)", path))
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
@@ -48,11 +110,49 @@ func OpenStore(path string) (*Store, error) {
 		db.Close()
 		return nil, fmt.Errorf("apply schema: %w", err)
 	}
-	if err := ensureConsumedColumn(db); err != nil {
+	if err := ensureColumn(db, "consumed", `ALTER TABLE auth_session ADD COLUMN consumed INTEGER NOT NULL DEFAULT 0`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "used_at", `ALTER TABLE auth_session ADD COLUMN used_at INTEGER`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "redirect_uri", `ALTER TABLE auth_session ADD COLUMN redirect_uri TEXT`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "callback_failures", `ALTER TABLE auth_session ADD COLUMN callback_failures INTEGER NOT NULL DEFAULT 0`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "nonce", `ALTER TABLE auth_session ADD COLUMN nonce TEXT`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "return_url", `ALTER TABLE auth_session ADD COLUMN return_url TEXT`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "client_ip", `ALTER TABLE auth_session ADD COLUMN client_ip TEXT`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "return_code", `ALTER TABLE auth_session ADD COLUMN return_code TEXT`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := ensureColumn(db, "access_token_hash", `ALTER TABLE auth_session ADD COLUMN access_token_hash TEXT`); err != nil {
 		db.Close()
 		return nil, err
 	}
-	return &Store{db: db}, nil
+	// The index needs the column, so it cannot live in schema.sql for
+	// databases that predate return codes.
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_auth_session_return_code ON auth_session(return_code) WHERE return_code IS NOT NULL`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("apply schema: %w", err)
+	}
+	return &Store{db: db, path: path}, nil
 }
 
 // Close releases the underlying database handle.
@@ -63,29 +163,35 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// Ping checks that the database can still be reached.
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
 // InsertSession creates a new session row.
 func (s *Store) InsertSession(ctx context.Context, sess Session) error {
 	_, err := s.db.ExecContext(ctx, `
-        INSERT INTO auth_session(id, provider, state, code_verifier, realm_id, created_at, expires_at, consumed)
-        VALUES(?, ?, ?, ?, ?, ?, ?, 0)
-    `, sess.ID, sess.Provider, sess.State, nullableString(sess.CodeVerifier), nullableString(sess.RealmID), sess.CreatedAt.Unix(), sess.ExpiresAt.Unix())
+        INSERT INTO auth_session(id, provider, state, code_verifier, realm_id, created_at, expires_at, consumed, redirect_uri, nonce, return_url, client_ip)
+        VALUES(?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?)
+    `, sess.ID, sess.Provider, sess.State, nullableString(sess.CodeVerifier), nullableString(sess.RealmID), sess.CreatedAt.Unix(), sess.ExpiresAt.Unix(), nullableString(sess.RedirectURI), nullableString(sess.Nonce), nullableString(sess.ReturnURL), nullableString(sess.ClientIP))
 	if err != nil {
 		return fmt.Errorf("insert session: %w", err)
 	}
 	return nil
 }
 
-// MarkReady stores the session result payload and marks the session ready.
-func (s *Store) MarkReady(ctx context.Context, sessionID string, payload []byte, realmID *string) error {
+// MarkReady stores the session result payload and the hash of the access
+// token it carries, and marks the session ready.
+func (s *Store) MarkReady(ctx context.Context, sessionID string, payload []byte, realmID *string, accessTokenHash string) error {
 	var realm sql.NullString
 	if realmID != nil {
 		realm = sql.NullString{String: *realmID, Valid: true}
 	}
 	res, err := s.db.ExecContext(ctx, `
         UPDATE auth_session
-           SET ready_at = ?, result_cipher = ?, realm_id = COALESCE(?, realm_id), consumed = 1
+           SET ready_at = ?, result_cipher = ?, realm_id = COALESCE(?, realm_id), access_token_hash = ?, consumed = 1
          WHERE id = ? AND consumed = 0
-    `, time.Now().Unix(), payload, nullableString(realm), sessionID)
+    `, time.Now().Unix(), payload, nullableString(realm), nullableString(sql.NullString{String: accessTokenHash, Valid: accessTokenHash != ""}), sessionID)
 	if err != nil {
 		return fmt.Errorf("mark ready: %w", err)
 	}
@@ -99,7 +205,7 @@ func (s *Store) MarkReady(ctx context.Context, sessionID string, payload []byte,
 // LookupByState finds a pending session by provider and state value.
 func (s *Store) LookupByState(ctx context.Context, provider, state string) (*Session, error) {
 	row := s.db.QueryRowContext(ctx, `
-        SELECT id, provider, state, code_verifier, realm_id, created_at, expires_at, ready_at, result_cipher, consumed
+        SELECT id, provider, state, code_verifier, realm_id, created_at, expires_at, ready_at, used_at, result_cipher, consumed, redirect_uri, nonce, return_url, client_ip, access_token_hash
           FROM auth_session
          WHERE provider = ? AND state = ? AND consumed = 0
          ORDER BY created_at DESC
@@ -108,16 +214,154 @@ func (s *Store) LookupByState(ctx context.Context, provider, state string) (*Ses
 	return scanSession(row)
 }
 
+// GetByState finds the newest session with state whether or not it has been
+// consumed, so diagnostics can tell an unknown state from a used or expired
+// one. An empty provider matches any. Like ListSessions it never reads the
+// verifier or result. The callback path must keep using LookupByState.
+func (s *Store) GetByState(ctx context.Context, provider, state string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx, `
+        SELECT id, provider, state, NULL, realm_id, created_at, expires_at, ready_at, used_at, NULL, consumed, redirect_uri, NULL, return_url, client_ip, NULL
+          FROM auth_session
+         WHERE state = ? AND (? = '' OR provider = ?)
+         ORDER BY created_at DESC
+         LIMIT 1
+    `, state, provider, provider)
+	return scanSession(row)
+}
+
 // LoadForPoll retrieves the session for polling.
 func (s *Store) LoadForPoll(ctx context.Context, sessionID string) (*Session, error) {
 	row := s.db.QueryRowContext(ctx, `
-        SELECT id, provider, state, code_verifier, realm_id, created_at, expires_at, ready_at, result_cipher, consumed
+        SELECT id, provider, state, code_verifier, realm_id, created_at, expires_at, ready_at, used_at, result_cipher, consumed, redirect_uri, nonce, return_url, client_ip, access_token_hash
           FROM auth_session
          WHERE id = ?
     `, sessionID)
 	return scanSession(row)
 }
 
+// SessionFilter narrows ListSessions. Zero values match everything.
+type SessionFilter struct {
+	Provider    string
+	ExpiredOnly bool
+}
+
+// ListSessions returns session metadata, newest first. State, verifier and
+// result columns are never read, so the returned sessions carry no secrets.
+func (s *Store) ListSessions(ctx context.Context, filter SessionFilter) ([]Session, error) {
+	query := `
+        SELECT id, provider, '', NULL, realm_id, created_at, expires_at, ready_at, used_at, NULL, consumed, redirect_uri, NULL, return_url, client_ip, NULL,
+               ready_at IS NOT NULL AND result_cipher IS NULL
+          FROM auth_session
+         WHERE 1 = 1`
+	var args []any
+	if filter.Provider != "" {
+		query += ` AND provider = ?`
+		args = append(args, filter.Provider)
+	}
+	if filter.ExpiredOnly {
+		query += ` AND expires_at < ?`
+		args = append(args, time.Now().Unix())
+	}
+	query += ` ORDER BY created_at DESC`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	defer rows.Close()
+	var out []Session
+	for rows.Next() {
+		var collected bool
+		sess, err := scanSession(extraColumns{rows, []any{&collected}})
+		if err != nil {
+			return nil, err
+		}
+		sess.Collected = collected
+		out = append(out, *sess)
+	}
+	return out, rows.Err()
+}
+
+// Status summarises where a session is in the flow as of now. Only
+// sessions from ListSessions can report "consumed".
+func (sess Session) Status(now time.Time) string {
+	switch {
+	case sess.Collected:
+		return "consumed"
+	case now.After(sess.ExpiresAt):
+		return "expired"
+	case sess.ReadyAt.Valid:
+		return "ready"
+	case sess.UsedAt.Valid:
+		return "exchanging"
+	default:
+		return "pending"
+	}
+}
+
+// ErrStateUsed indicates a callback presented a state that was already redeemed.
+var ErrStateUsed = errors.New("state already used")
+
+// MarkStateUsed records that a session's state has been redeemed by a
+// callback. It fails with ErrStateUsed if the state was used before, which
+// closes the replay window left when a database is restored from backup.
+func (s *Store) MarkStateUsed(ctx context.Context, sessionID string) error {
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET used_at = ? WHERE id = ? AND used_at IS NULL
+    `, time.Now().Unix(), sessionID)
+	if err != nil {
+		return fmt.Errorf("mark state used: %w", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrStateUsed
+	}
+	return nil
+}
+
+// ReleaseState undoes MarkStateUsed for a session whose exchange failed, so
+// the state can be redeemed again. Completed sessions are left alone.
+func (s *Store) ReleaseState(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET used_at = NULL WHERE id = ? AND consumed = 0
+    `, sessionID)
+	if err != nil {
+		return fmt.Errorf("release state: %w", err)
+	}
+	return nil
+}
+
+// SetReturnCode stores the hash of the one-time code a return_url redirect
+// carries, replacing any earlier one.
+func (s *Store) SetReturnCode(ctx context.Context, sessionID, codeHash string) error {
+	_, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET return_code = ? WHERE id = ?
+    `, codeHash, sessionID)
+	if err != nil {
+		return fmt.Errorf("set return code: %w", err)
+	}
+	return nil
+}
+
+// RedeemReturnCode spends a return code and loads its session for polling.
+// An unknown or already spent code is sql.ErrNoRows.
+func (s *Store) RedeemReturnCode(ctx context.Context, codeHash string) (*Session, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM auth_session WHERE return_code = ?`, codeHash).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE auth_session SET return_code = NULL WHERE id = ? AND return_code = ?
+    `, id, codeHash)
+	if err != nil {
+		return nil, fmt.Errorf("redeem return code: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Another request spent it first.
+		return nil, sql.ErrNoRows
+	}
+	return s.LoadForPoll(ctx, id)
+}
+
 // Delete removes a session entirely.
 func (s *Store) Delete(ctx context.Context, sessionID string) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM auth_session WHERE id = ?`, sessionID)
@@ -127,12 +371,97 @@ func (s *Store) Delete(ctx context.Context, sessionID string) error {
 	return nil
 }
 
-func scanSession(row *sql.Row) (*Session, error) {
+// RecordCallbackFailure counts a failed callback against a session and
+// returns the new total.
+func (s *Store) RecordCallbackFailure(ctx context.Context, sessionID string) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+        UPDATE auth_session
+           SET callback_failures = callback_failures + 1
+         WHERE id = ?
+     RETURNING callback_failures
+    `, sessionID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("record callback failure: %w", err)
+	}
+	return n, nil
+}
+
+// ClearResult drops a session's stored result but keeps the row, as a
+// tombstone, until the reaper removes it at expiry.
+func (s *Store) ClearResult(ctx context.Context, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE auth_session SET result_cipher = NULL WHERE id = ?`, sessionID)
+	if err != nil {
+		return fmt.Errorf("clear session result: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredBefore removes up to limit sessions whose TTL elapsed before t
+// and returns the number deleted. A limit of zero or less removes them all.
+func (s *Store) DeleteExpiredBefore(ctx context.Context, t time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+        DELETE FROM auth_session WHERE id IN (
+            SELECT id FROM auth_session WHERE expires_at < ? LIMIT ?
+        )
+    `, t.Unix(), sqlLimit(limit))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// DeleteConsumedBefore removes up to limit sessions whose result was stored
+// before t but never collected by a poll, returning the number deleted. A
+// limit of zero or less removes them all. Xero tombstones, whose result a
+// poll already cleared, are left for the expiry reap.
+func (s *Store) DeleteConsumedBefore(ctx context.Context, t time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+        DELETE FROM auth_session WHERE id IN (
+            SELECT id FROM auth_session
+             WHERE consumed = 1 AND ready_at IS NOT NULL AND ready_at < ?
+               AND result_cipher IS NOT NULL
+             LIMIT ?
+        )
+    `, t.Unix(), sqlLimit(limit))
+	if err != nil {
+		return 0, fmt.Errorf("delete consumed sessions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// sqlLimit maps a non-positive limit to SQLite's "no limit".
+func sqlLimit(limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// extraColumns scans the columns a query selects after the ones
+// scanSession reads into extra.
+type extraColumns struct {
+	rowScanner
+	extra []any
+}
+
+func (e extraColumns) Scan(dest ...any) error {
+	return e.rowScanner.Scan(append(dest, e.extra...)...)
+}
+
+func scanSession(row rowScanner) (*Session, error) {
 	var sess Session
 	var created, expires sql.NullInt64
-	var ready sql.NullInt64
+	var ready, used sql.NullInt64
 	var consumed sql.NullInt64
-	err := row.Scan(&sess.ID, &sess.Provider, &sess.State, &sess.CodeVerifier, &sess.RealmID, &created, &expires, &ready, &sess.Result, &consumed)
+	err := row.Scan(&sess.ID, &sess.Provider, &sess.State, &sess.CodeVerifier, &sess.RealmID, &created, &expires, &ready, &used, &sess.Result, &consumed, &sess.RedirectURI, &sess.Nonce, &sess.ReturnURL, &sess.ClientIP, &sess.AccessTokenHash)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, err
 	}
@@ -148,6 +477,9 @@ func scanSession(row *sql.Row) (*Session, error) {
 	if ready.Valid {
 		sess.ReadyAt = sql.NullTime{Time: time.Unix(ready.Int64, 0), Valid: true}
 	}
+	if used.Valid {
+		sess.UsedAt = sql.NullTime{Time: time.Unix(used.Int64, 0), Valid: true}
+	}
 	sess.Consumed = consumed.Valid && consumed.Int64 != 0
 	return &sess, nil
 }
@@ -159,7 +491,8 @@ func nullableString(ns sql.NullString) interface{} {
 	return nil
 }
 
-func ensureConsumedColumn(db *sql.DB) error {
+// ensureColumn adds a column to auth_session when upgrading an older database.
+func ensureColumn(db *sql.DB, column, ddl string) error {
 	rows, err := db.Query(`PRAGMA table_info(auth_session)`)
 	if err != nil {
 		return fmt.Errorf("inspect auth_session schema: %w", err)
@@ -178,15 +511,15 @@ func ensureConsumedColumn(db *sql.DB) error {
 		if scanErr := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); scanErr != nil {
 			return fmt.Errorf("scan auth_session schema: %w", scanErr)
 		}
-		if name == "consumed" {
+		if name == column {
 			return nil
 		}
 	}
 	if err := rows.Err(); err != nil {
 		return fmt.Errorf("iterate auth_session schema: %w", err)
 	}
-	if _, err := db.Exec(`ALTER TABLE auth_session ADD COLUMN consumed INTEGER NOT NULL DEFAULT 0`); err != nil {
-		return fmt.Errorf("add consumed column: %w", err)
+	if _, err := db.Exec(ddl); err != nil {
+		return fmt.Errorf("add %s column: %w", column, err)
 	}
 	return nil
 }
@@ -228,7 +561,7 @@ func (s *Store) IncrementRateLimit(ctx context.Context, key string, limit int, w
 				return fmt.Errorf("reset rate limit: %w", err)
 			}
 		} else if count.Valid && count.Int64 >= int64(limit) {
-			return ErrRateLimited
+			return windowFull(start.Int64, windowSeconds, now)
 		} else {
 			if _, err = tx.ExecContext(ctx, `UPDATE rate_limit SET count = count + 1 WHERE key = ?`, key); err != nil {
 				return fmt.Errorf("increment rate limit: %w", err)
@@ -241,3 +574,79 @@ func (s *Store) IncrementRateLimit(ctx context.Context, key string, limit int, w
 	}
 	return nil
 }
+
+// AcquireExchangeSlot reserves one of limit shared upstream exchange slots,
+// waiting until ctx is done. Slots are held in the database so the cap applies
+// across CGI processes; lease bounds how long a crashed holder can keep one.
+// The returned id must be passed to ReleaseExchangeSlot.
+func (s *Store) AcquireExchangeSlot(ctx context.Context, limit int, lease time.Duration) (string, error) {
+	id, err := randomID(16)
+	if err != nil {
+		return "", fmt.Errorf("allocate exchange slot id: %w", err)
+	}
+	for {
+		now := time.Now()
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM exchange_slot WHERE expires_at < ?`, now.Unix()); err != nil {
+			return "", fmt.Errorf("expire exchange slots: %w", err)
+		}
+		res, err := s.db.ExecContext(ctx, `
+            INSERT INTO exchange_slot(id, expires_at)
+            SELECT ?, ? WHERE (SELECT COUNT(*) FROM exchange_slot) < ?
+        `, id, now.Add(lease).Unix(), limit)
+		if err != nil {
+			return "", fmt.Errorf("acquire exchange slot: %w", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 1 {
+			return id, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ErrExchangeBusy
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// ReleaseExchangeSlot frees a slot obtained from AcquireExchangeSlot.
+func (s *Store) ReleaseExchangeSlot(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM exchange_slot WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("release exchange slot: %w", err)
+	}
+	return nil
+}
+
+// Vacuum rebuilds the database file so space freed by deleted sessions is
+// returned to the filesystem. VACUUM holds an exclusive lock for its whole
+// run, so it is skipped with ErrStoreBusy while token exchanges are in flight
+// or another Vacuum is running.
+func (s *Store) Vacuum(ctx context.Context) error {
+	if !s.vacuumMu.TryLock() {
+		return ErrStoreBusy
+	}
+	defer s.vacuumMu.Unlock()
+	var inFlight int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM exchange_slot WHERE expires_at >= ?`, time.Now().Unix()).Scan(&inFlight); err != nil {
+		return fmt.Errorf("count exchange slots: %w", err)
+	}
+	if inFlight > 0 {
+		return ErrStoreBusy
+	}
+	if _, err := s.db.ExecContext(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+	return nil
+}
+
+// FileSize returns the combined size in bytes of the database and its WAL.
+func (s *Store) FileSize() int64 {
+	var total int64
+	for _, p := range []string{s.path, s.path + "-wal"} {
+		if info, err := os.Stat(p); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
@@ -0,0 +1,257 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStore returns a SQLite store in a temporary directory.
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	st, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// testSessionStores returns every SessionStore implementation the contract
+// tests run against: SQLite, memory, and PostgreSQL when
+// BROKER_TEST_POSTGRES_DSN is set.
+func testSessionStores(t *testing.T) map[string]SessionStore {
+	t.Helper()
+	stores := map[string]SessionStore{"sqlite": openTestStore(t), "memory": NewMemoryStore()}
+	if pg := openTestPostgresStore(t); pg != nil {
+		stores["postgres"] = pg
+	}
+	return stores
+}
+
+// testDurableStores is testSessionStores without the memory store.
+func testDurableStores(t *testing.T) map[string]DurableStore {
+	t.Helper()
+	stores := map[string]DurableStore{"sqlite": openTestStore(t)}
+	if pg := openTestPostgresStore(t); pg != nil {
+		stores["postgres"] = pg
+	}
+	return stores
+}
+
+func TestReleaseState(t *testing.T) {
+	ctx := context.Background()
+	stores := testSessionStores(t)
+	for name, st := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"pending", "done"} {
+				sess := Session{ID: id, Provider: "xero", State: id + "-state", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+				if err := st.InsertSession(ctx, sess); err != nil {
+					t.Fatal(err)
+				}
+				if err := st.MarkStateUsed(ctx, id); err != nil {
+					t.Fatal(err)
+				}
+				if err := st.MarkStateUsed(ctx, id); !errors.Is(err, ErrStateUsed) {
+					t.Fatalf("second MarkStateUsed: got %v, want ErrStateUsed", err)
+				}
+			}
+			if err := st.MarkReady(ctx, "done", []byte("sealed"), nil, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range []string{"pending", "done"} {
+				if err := st.ReleaseState(ctx, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := st.MarkStateUsed(ctx, "pending"); err != nil {
+				t.Fatalf("released state could not be claimed again: %v", err)
+			}
+			if err := st.MarkStateUsed(ctx, "done"); !errors.Is(err, ErrStateUsed) {
+				t.Fatalf("completed session's state was released: got %v", err)
+			}
+		})
+	}
+}
+
+func TestStateClaim(t *testing.T) {
+	srv := NewServer(DefaultConfig(), NewMemoryStore(), nil)
+	for _, id := range []string{"failed", "completed"} {
+		sess := Session{ID: id, Provider: "xero", State: id + "-state", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+		if err := srv.Store.InsertSession(context.Background(), sess); err != nil {
+			t.Fatal(err)
+		}
+		// The request that claimed the state may be gone by the time the
+		// claim is handed back.
+		ctx, cancel := context.WithCancel(context.Background())
+		claim, err := srv.claimState(ctx, slog.Default(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := srv.claimState(ctx, slog.Default(), id); !errors.Is(err, ErrStateUsed) {
+			t.Fatalf("%s: second claim: got %v, want ErrStateUsed", id, err)
+		}
+		if id == "completed" {
+			claim.keep()
+		}
+		cancel()
+		claim.release()
+	}
+	if err := srv.Store.MarkStateUsed(context.Background(), "failed"); err != nil {
+		t.Fatalf("released state could not be claimed again: %v", err)
+	}
+	if err := srv.Store.MarkStateUsed(context.Background(), "completed"); !errors.Is(err, ErrStateUsed) {
+		t.Fatalf("kept claim was released: got %v", err)
+	}
+}
+
+func TestReleaseRefresh(t *testing.T) {
+	ctx := context.Background()
+	stores := testSessionStores(t)
+	for name, st := range stores {
+		t.Run(name, func(t *testing.T) {
+			claim := func(key string) *RecentRefresh {
+				t.Helper()
+				recent, err := st.ClaimRefresh(ctx, key, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return recent
+			}
+			if claim("failed") != nil || claim("done") != nil {
+				t.Fatal("first claims found an earlier refresh")
+			}
+			if err := st.StoreRefreshResult(ctx, "done", []byte("sealed")); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"failed", "done"} {
+				if err := st.ReleaseRefresh(ctx, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if recent := claim("failed"); recent != nil {
+				t.Errorf("released claim still throttles: %+v", recent)
+			}
+			if recent := claim("done"); recent == nil || string(recent.Result) != "sealed" {
+				t.Errorf("claim with a result was released: %+v", recent)
+			}
+		})
+	}
+}
+
+func TestRedeemReturnCode(t *testing.T) {
+	ctx := context.Background()
+	stores := testSessionStores(t)
+	for name, st := range stores {
+		t.Run(name, func(t *testing.T) {
+			sess := Session{ID: "sess", Provider: "xero", State: "state", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+			if err := st.InsertSession(ctx, sess); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.SetReturnCode(ctx, "sess", "old"); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.SetReturnCode(ctx, "sess", "new"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.RedeemReturnCode(ctx, "old"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("replaced code: got %v, want sql.ErrNoRows", err)
+			}
+			got, err := st.RedeemReturnCode(ctx, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != "sess" {
+				t.Fatalf("redeemed session %q, want sess", got.ID)
+			}
+			if _, err := st.RedeemReturnCode(ctx, "new"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("second redemption: got %v, want sql.ErrNoRows", err)
+			}
+		})
+	}
+}
+
+func TestReturnCodeDeletedWithSession(t *testing.T) {
+	ctx := context.Background()
+	stores := testSessionStores(t)
+	mem := stores["memory"].(*MemoryStore)
+	for name, st := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			for _, sess := range []Session{
+				{ID: "deleted", Provider: "xero", State: "s1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+				{ID: "reaped", Provider: "xero", State: "s2", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+			} {
+				if err := st.InsertSession(ctx, sess); err != nil {
+					t.Fatal(err)
+				}
+				if err := st.SetReturnCode(ctx, sess.ID, sess.ID+"-code"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := st.Delete(ctx, "deleted"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.DeleteExpiredBefore(ctx, now, 0); err != nil {
+				t.Fatal(err)
+			}
+			for _, code := range []string{"deleted-code", "reaped-code"} {
+				if _, err := st.RedeemReturnCode(ctx, code); !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("%s outlived its session: got %v", code, err)
+				}
+			}
+		})
+	}
+	if len(mem.returnCodes) != 0 || len(mem.sessionCodes) != 0 {
+		t.Fatalf("memory store kept codes %v %v", mem.returnCodes, mem.sessionCodes)
+	}
+}
+
+func TestDeleteExpiredAndConsumed(t *testing.T) {
+	ctx := context.Background()
+	for name, st := range testSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			past := now.Add(-2 * time.Hour)
+			for _, sess := range []Session{
+				{ID: "expired-1", Provider: "xero", State: "e1", CreatedAt: past, ExpiresAt: now.Add(-time.Hour)},
+				{ID: "expired-2", Provider: "xero", State: "e2", CreatedAt: past, ExpiresAt: now.Add(-time.Hour)},
+				{ID: "pending", Provider: "xero", State: "p", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+				{ID: "uncollected", Provider: "qbo", State: "u", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+			} {
+				if err := st.InsertSession(ctx, sess); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := st.MarkReady(ctx, "uncollected", []byte("sealed"), nil, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if n, err := st.DeleteExpiredBefore(ctx, now, 1); err != nil || n != 1 {
+				t.Fatalf("limited reap removed %d (%v), want 1", n, err)
+			}
+			if n, err := st.DeleteExpiredBefore(ctx, now, 0); err != nil || n != 1 {
+				t.Fatalf("unlimited reap removed %d (%v), want the other expired session", n, err)
+			}
+			if n, err := st.DeleteConsumedBefore(ctx, now.Add(-time.Minute), 0); err != nil || n != 0 {
+				t.Fatalf("removed %d results stored after the cutoff (%v)", n, err)
+			}
+			if n, err := st.DeleteConsumedBefore(ctx, now.Add(time.Minute), 0); err != nil || n != 1 {
+				t.Fatalf("consumed reap removed %d (%v), want 1", n, err)
+			}
+			if _, err := st.LoadForPoll(ctx, "pending"); err != nil {
+				t.Fatalf("pending session was reaped: %v", err)
+			}
+			for _, id := range []string{"expired-1", "expired-2", "uncollected"} {
+				if _, err := st.LoadForPoll(ctx, id); !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("%s survived reaping: %v", id, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaultSuccessMessage is shown after a completed callback unless
+// SUCCESS_MESSAGE or a provider's <PROVIDER>_SUCCESS_MESSAGE replaces it.
+const defaultSuccessMessage = "You connected {org}; you can close this tab and return to your terminal."
+
+// providerDisplayNames are the names shown to people for each provider.
+var providerDisplayNames = map[string]string{
+	"xero":       "Xero",
+	"deputy":     "Deputy",
+	"qbo":        "QuickBooks Online",
+	"myob":       "MYOB",
+	"freshbooks": "FreshBooks",
+}
+
+func providerDisplayName(name string) string {
+	if d, ok := providerDisplayNames[name]; ok {
+		return d
+	}
+	if custom, ok := strings.CutPrefix(name, customProviderPrefix); ok {
+		return custom
+	}
+	return name
+}
+
+var (
+	builtinSuccessTemplate = template.Must(template.New("success").Parse(successHTML))
+	builtinFailureTemplate = template.Must(template.New("failure").Parse(failureHTML))
+)
+
+// successPage is the model for the callback success template. Every field
+// exists for every provider; those a provider does not supply are empty.
+type successPage struct {
+	Provider   string   // display name, such as "QuickBooks Online"
+	ProviderID string   // configured name, such as "qbo" or "custom:acme"
+	Org        string   // the connected organisation, when the provider names one
+	Tenants    []string // every Xero organisation the flow connected
+	Message    string
+	// PostMessage, when SUCCESS_POSTMESSAGE_ORIGIN is set, is what the page
+	// posts to the window that opened it.
+	PostMessage *completionMessage
+}
+
+// completionMessage tells a web app's opener window that a flow finished.
+// It carries the public session id, which the app polls with; never tokens.
+type completionMessage struct {
+	Origin   string
+	Provider string
+	Session  string
+}
+
+// failurePage is the model for the callback failure template. Provider and
+// ProviderID are empty when the failure cannot be tied to a provider.
+type failurePage struct {
+	Title      string
+	Message    string
+	Provider   string
+	ProviderID string
+}
+
+// successPageFor builds the success page for the completed flow of
+// session sessionID. Messages may use {org} and {provider}; {org} falls
+// back to the provider's name when the envelope does not identify an
+// organisation.
+func (s *Server) successPageFor(env TokenEnvelope, sessionID string) successPage {
+	page := successPage{Provider: providerDisplayName(env.Provider), ProviderID: env.Provider, Org: envelopeOrg(env)}
+	if origin := s.Config.SuccessPostMessageOrigin; origin != "" {
+		page.PostMessage = &completionMessage{Origin: origin, Provider: env.Provider, Session: sessionID}
+	}
+	for _, t := range env.Tenants {
+		page.Tenants = append(page.Tenants, t.Label())
+	}
+	msg := s.Config.ProviderSuccessMessages[env.Provider]
+	if msg == "" {
+		msg = s.Config.SuccessMessage
+	}
+	if msg == "" {
+		msg = defaultSuccessMessage
+	}
+	org := page.Org
+	if org == "" {
+		org = page.Provider
+	}
+	page.Message = strings.NewReplacer("{org}", org, "{provider}", page.Provider).Replace(msg)
+	return page
+}
+
+// envelopeOrg names the organisation a completed flow connected, when the
+// envelope says.
+func envelopeOrg(env TokenEnvelope) string {
+	switch {
+	case len(env.Tenants) == 1:
+		return env.Tenants[0].Label()
+	case len(env.Tenants) > 1:
+		return fmt.Sprintf("%d Xero organisations", len(env.Tenants))
+	case len(env.CompanyFiles) == 1 && env.CompanyFiles[0].Name != "":
+		return env.CompanyFiles[0].Name
+	case len(env.Businesses) == 1:
+		return env.Businesses[0].Name
+	case env.RealmID != "":
+		return "QuickBooks company " + env.RealmID
+	case env.Endpoint != "":
+		if u, err := url.Parse(env.Endpoint); err == nil && u.Host != "" {
+			return u.Host
+		}
+		return env.Endpoint
+	}
+	return ""
+}
+
+// loadPageTemplate returns the template in the file at path, or builtin when
+// path is empty. The file must also render sample, a page with every
+// optional field empty, so that a template leaning on a field some provider
+// leaves unset, or on one that does not exist, is caught here. Any problem
+// is logged and the built-in page used instead.
+func loadPageTemplate(logger *slog.Logger, key, path string, builtin *template.Template, sample any) *template.Template {
+	if path == "" {
+		return builtin
+	}
+	src, err := os.ReadFile(path)
+	if err == nil {
+		var t *template.Template
+		if t, err = template.New(builtin.Name()).Parse(string(src)); err == nil {
+			if err = t.Execute(&bytes.Buffer{}, sample); err == nil {
+				return t
+			}
+		}
+	}
+	logger.Error("page template unusable, using the built-in page", "key", key, "path", path, "error", err)
+	return builtin
+}
+
+// renderPage writes t executed with data, falling back to builtin if t
+// fails part-way, so the browser never gets a truncated page.
+func (s *Server) renderPage(w http.ResponseWriter, r *http.Request, status int, t, builtin *template.Template, data any) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		s.logger(r.Context()).Error("render page failed, using the built-in page", "page", t.Name(), "error", err)
+		buf.Reset()
+		if err := builtin.Execute(&buf, data); err != nil {
+			s.logger(r.Context()).Error("render built-in page failed", "page", t.Name(), "error", err)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
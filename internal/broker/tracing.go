@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "auth.industrial-linguistics.com/accounting-ops/broker"
+
+// tracer returns the broker's tracer. Until InitTracing installs a provider
+// the global one is a no-op, so spans cost nothing when tracing is off.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// InitTracing installs an OTLP/HTTP trace exporter configured from the
+// standard OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME environment variables.
+// The returned function flushes pending spans and must be called before exit.
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("otlp exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "accounting-ops-broker")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("otel resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// routeFor maps a request path to its route template so span names and
+// attributes never carry session ids.
+func routeFor(p string) string {
+	switch {
+	case strings.HasSuffix(p, "/v1/auth/start"):
+		return "/v1/auth/start"
+	case strings.HasSuffix(p, "/v1/auth/exchange"):
+		return "/v1/auth/exchange"
+	case strings.Contains(p, "/callback/"):
+		return "/v1/callback/{provider}"
+	case strings.Contains(p, "/v1/auth/poll/"):
+		return "/v1/auth/poll/{session}"
+	case strings.HasSuffix(p, "/v1/token/refresh"):
+		return "/v1/token/refresh"
+	case strings.HasSuffix(p, "/v1/token/revoke"):
+		return "/v1/token/revoke"
+	case strings.HasSuffix(p, "/v1/xero/tenants"):
+		return "/v1/xero/tenants"
+	case strings.HasSuffix(p, "/v1/jwks"):
+		return "/v1/jwks"
+	case strings.HasSuffix(p, "/v1/providers"):
+		return "/v1/providers"
+	case strings.HasSuffix(p, "/healthz"):
+		return "/healthz"
+	case strings.HasSuffix(p, "/metrics"):
+		return "/metrics"
+	default:
+		return "unmatched"
+	}
+}
+
+// statusWriter records the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// traceRequest wraps a handler invocation in a server span.
+func traceRequest(w http.ResponseWriter, r *http.Request, next func(http.ResponseWriter, *http.Request)) {
+	route := routeFor(r.URL.Path)
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+		),
+	)
+	defer span.End()
+	sw := &statusWriter{ResponseWriter: w}
+	next(sw, r.WithContext(ctx))
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+	if sw.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(sw.status))
+	}
+}
+
+// startProviderSpan opens a child span around an upstream provider call. The
+// returned function ends it, recording err if non-nil.
+func startProviderSpan(ctx context.Context, provider, op string) (context.Context, func(error)) {
+	ctx, span := tracer().Start(ctx, "provider."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("provider", provider)),
+	)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// tracedProvider adds a span around each upstream call a Provider makes.
+type tracedProvider struct {
+	Provider
+}
+
+func (p tracedProvider) Exchange(ctx context.Context, params ExchangeParams) (TokenEnvelope, error) {
+	ctx, end := startProviderSpan(ctx, p.Name(), "exchange")
+	env, err := p.Provider.Exchange(ctx, params)
+	end(err)
+	return env, err
+}
+
+func (p tracedProvider) Refresh(ctx context.Context, params RefreshParams) (TokenEnvelope, error) {
+	ctx, end := startProviderSpan(ctx, p.Name(), "refresh")
+	env, err := p.Provider.Refresh(ctx, params)
+	end(err)
+	return env, err
+}
+
+func (p tracedProvider) Revoke(ctx context.Context, token, tokenTypeHint string) error {
+	ctx, end := startProviderSpan(ctx, p.Name(), "revoke")
+	err := p.Provider.Revoke(ctx, token, tokenTypeHint)
+	end(err)
+	return err
+}
+
+// tracingTransport records the upstream HTTP status on the active span.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(req.Context())
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
@@ -4,38 +4,86 @@ import "time"
 
 // TokenEnvelope is the serialised response handed to CLI clients.
 type TokenEnvelope struct {
-	Provider     string         `json:"provider"`
-	Profile      string         `json:"profile,omitempty"`
-	AccessToken  string         `json:"access_token"`
-	RefreshToken string         `json:"refresh_token,omitempty"`
-	ExpiresAt    time.Time      `json:"-"`
-	ExpiresUnix  int64          `json:"expires_at"`
-	Scope        string         `json:"scope,omitempty"`
-	RealmID      string         `json:"realmId,omitempty"`
-	Endpoint     string         `json:"endpoint,omitempty"`
-	TokenType    string         `json:"token_type,omitempty"`
-	IDToken      string         `json:"id_token,omitempty"`
-	Tenants      []XeroTenant   `json:"tenants,omitempty"`
-	Raw          map[string]any `json:"raw,omitempty"`
-}
-
-// XeroTenant captures metadata returned by /connections.
+	Provider     string               `json:"provider"`
+	Profile      string               `json:"profile,omitempty"`
+	AccessToken  string               `json:"access_token"`
+	RefreshToken string               `json:"refresh_token,omitempty"`
+	ExpiresAt    time.Time            `json:"-"`
+	ExpiresUnix  int64                `json:"expires_at"`
+	NonExpiring  bool                 `json:"non_expiring,omitempty"`
+	Scope        string               `json:"scope,omitempty"`
+	RealmID      string               `json:"realmId,omitempty"`
+	AccountID    string               `json:"account_id,omitempty"`  // FreshBooks, when the user has one business
+	Environment  string               `json:"environment,omitempty"` // QBO: "sandbox" or "production"
+	Endpoint     string               `json:"endpoint,omitempty"`
+	TokenType    string               `json:"token_type,omitempty"`
+	IDToken      string               `json:"id_token,omitempty"`
+	Subject      string               `json:"subject,omitempty"` // verified id_token sub
+	Email        string               `json:"email,omitempty"`   // verified id_token email
+	Claims       map[string]any       `json:"claims,omitempty"`
+	Tenants      []XeroTenant         `json:"tenants,omitempty"`
+	CompanyFiles []MYOBCompanyFile    `json:"company_files,omitempty"`
+	Businesses   []FreshBooksBusiness `json:"businesses,omitempty"`
+	Raw          map[string]any       `json:"raw,omitempty"`
+}
+
+// XeroTenant holds the essential fields of a /connections entry. Envelopes
+// carry only these so that organisations with hundreds of tenants keep the
+// session payload small; GET /v1/xero/tenants returns the full metadata.
 type XeroTenant struct {
-	ID         string    `json:"id"`
-	TenantID   string    `json:"tenantId"`
-	TenantType string    `json:"tenantType"`
-	CreatedAt  time.Time `json:"createdDateUtc"`
-	UpdatedAt  time.Time `json:"updatedDateUtc"`
-	TenantName string    `json:"tenantName"`
+	ID         string `json:"id"`
+	TenantID   string `json:"tenantId"`
+	TenantType string `json:"tenantType"`
+	TenantName string `json:"tenantName"`
+}
+
+// Label names the tenant for display. Xero omits the name of an
+// organisation still pending activation, so its id stands in.
+func (t XeroTenant) Label() string {
+	if t.TenantName != "" {
+		return t.TenantName
+	}
+	return t.TenantID + " (name unavailable)"
+}
+
+// MYOBCompanyFile is an AccountRight company file the token can reach. URI
+// is the base for that file's API calls.
+type MYOBCompanyFile struct {
+	ID   string `json:"Id"`
+	Name string `json:"Name"`
+	URI  string `json:"Uri"`
+}
+
+// FreshBooksBusiness is a business the FreshBooks user belongs to. Most
+// accounting endpoints are addressed by AccountID; ID serves the newer
+// business-scoped APIs.
+type FreshBooksBusiness struct {
+	ID        int64  `json:"id"`
+	AccountID string `json:"account_id"`
+	Name      string `json:"name"`
+}
+
+// NormalizeExpiry reconciles ExpiresAt and ExpiresUnix. ExpiresAt wins when
+// set, truncated to whole seconds in UTC; otherwise it is derived from
+// ExpiresUnix. Non-expiring envelopes carry neither.
+func (t *TokenEnvelope) NormalizeExpiry() {
+	switch {
+	case t.NonExpiring:
+		t.ExpiresAt = time.Time{}
+		t.ExpiresUnix = 0
+	case !t.ExpiresAt.IsZero():
+		t.ExpiresUnix = t.ExpiresAt.Unix()
+		t.ExpiresAt = time.Unix(t.ExpiresUnix, 0).UTC()
+	case t.ExpiresUnix != 0:
+		t.ExpiresAt = time.Unix(t.ExpiresUnix, 0).UTC()
+	}
 }
 
 // MarshalJSON customises expiry serialisation.
 func (t TokenEnvelope) MarshalJSON() ([]byte, error) {
 	type Alias TokenEnvelope
+	t.NormalizeExpiry()
 	a := Alias(t)
-	if t.ExpiresUnix == 0 && !t.ExpiresAt.IsZero() {
-		a.ExpiresUnix = t.ExpiresAt.Unix()
-	}
 	a.ExpiresAt = time.Time{}
 	return jsonMarshal(a)
 }
@@ -48,8 +96,6 @@ func (t *TokenEnvelope) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	*t = TokenEnvelope(a)
-	if a.ExpiresUnix != 0 {
-		t.ExpiresAt = time.Unix(a.ExpiresUnix, 0).UTC()
-	}
+	t.NormalizeExpiry()
 	return nil
 }
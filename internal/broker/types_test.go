@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTokenEnvelopeNormalizeExpiry(t *testing.T) {
+	at := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	local := at.Add(750 * time.Millisecond).In(time.FixedZone("NZDT", 13*3600))
+
+	tests := []struct {
+		name     string
+		env      TokenEnvelope
+		wantAt   time.Time
+		wantUnix int64
+	}{
+		{
+			name:     "both set, ExpiresAt wins",
+			env:      TokenEnvelope{ExpiresAt: local, ExpiresUnix: at.Unix() - 3600},
+			wantAt:   at,
+			wantUnix: at.Unix(),
+		},
+		{
+			name: "neither set",
+			env:  TokenEnvelope{},
+		},
+		{
+			name:     "only ExpiresAt",
+			env:      TokenEnvelope{ExpiresAt: local},
+			wantAt:   at,
+			wantUnix: at.Unix(),
+		},
+		{
+			name:     "only ExpiresUnix",
+			env:      TokenEnvelope{ExpiresUnix: at.Unix()},
+			wantAt:   at,
+			wantUnix: at.Unix(),
+		},
+		{
+			name: "non-expiring clears both",
+			env:  TokenEnvelope{NonExpiring: true, ExpiresAt: local, ExpiresUnix: at.Unix()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := func(stage string, got TokenEnvelope) {
+				t.Helper()
+				if !got.ExpiresAt.Equal(tt.wantAt) || got.ExpiresUnix != tt.wantUnix {
+					t.Errorf("%s: got ExpiresAt %v, ExpiresUnix %d; want %v, %d", stage, got.ExpiresAt, got.ExpiresUnix, tt.wantAt, tt.wantUnix)
+				}
+				if !got.ExpiresAt.IsZero() && got.ExpiresAt.Location() != time.UTC {
+					t.Errorf("%s: ExpiresAt is in %v, want UTC", stage, got.ExpiresAt.Location())
+				}
+			}
+
+			env := tt.env
+			env.NormalizeExpiry()
+			check("NormalizeExpiry", env)
+
+			data, err := json.Marshal(tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var wire map[string]any
+			if err := json.Unmarshal(data, &wire); err != nil {
+				t.Fatal(err)
+			}
+			if got := int64(wire["expires_at"].(float64)); got != tt.wantUnix {
+				t.Errorf("marshalled expires_at = %d, want %d", got, tt.wantUnix)
+			}
+
+			var back TokenEnvelope
+			if err := json.Unmarshal(data, &back); err != nil {
+				t.Fatal(err)
+			}
+			check("round trip", back)
+		})
+	}
+}
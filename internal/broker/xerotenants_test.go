@@ -0,0 +1,49 @@
+package broker_test
+
+import (
+	"net/http"
+	"testing"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+func getTenants(t *testing.T, srv *brokertest.Server, session, token string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/xero/tenants?session="+session, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestXeroTenantsRequiresSessionToken(t *testing.T) {
+	srv := brokertest.NewServer(t, func(c *broker.Config) {
+		c.RateLimitPoll = 2
+	})
+	session := completeFlow(t, srv, "xero")
+	// The poll bucket is spent on the poll itself; the tenants endpoint
+	// counts its calls separately.
+	if code := getStatus(t, srv.URL+"/v1/auth/poll/"+session); code != http.StatusOK {
+		t.Fatalf("poll returned %d, want 200", code)
+	}
+	if code := getStatus(t, srv.URL+"/v1/auth/poll/"+session); code == http.StatusTooManyRequests {
+		t.Fatal("second poll was rate limited")
+	}
+
+	if code := getTenants(t, srv, session, "someone-elses-token"); code != http.StatusForbidden {
+		t.Fatalf("tenants with another token returned %d, want 403", code)
+	}
+	if code := getTenants(t, srv, session, "brokertest-access-1"); code != http.StatusOK {
+		t.Fatalf("tenants with the session's token returned %d, want 200", code)
+	}
+	if code := getTenants(t, srv, session, "brokertest-access-1"); code != http.StatusTooManyRequests {
+		t.Fatalf("third tenants call returned %d, want 429", code)
+	}
+}
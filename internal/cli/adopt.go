@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+// adoptRefreshToken mints tokens from a refresh token obtained elsewhere, so
+// it can become a profile without a browser flow. Xero tenants are looked up
+// with the new access token since a refresh does not return them.
+func (a *App) adoptRefreshToken(baseURL, provider, refreshToken string) (broker.TokenEnvelope, error) {
+	seed := ProfileData{Provider: provider, RefreshToken: refreshToken}
+	var env broker.TokenEnvelope
+	var err error
+	switch {
+	case provider == "xero":
+		env, err = a.refreshXero(seed)
+	case refreshedByBroker(provider):
+		env, err = a.refreshViaBroker(baseURL, seed)
+	default:
+		return broker.TokenEnvelope{}, fmt.Errorf("provider %s does not support refresh", provider)
+	}
+	if err != nil {
+		return broker.TokenEnvelope{}, fmt.Errorf("refresh token rejected: %w", err)
+	}
+	if env.RefreshToken == "" {
+		env.RefreshToken = refreshToken
+	} else if env.RefreshToken != refreshToken {
+		fmt.Fprintln(a.Stderr, "Note: the provider rotated the refresh token; the one you supplied no longer works anywhere else.")
+	}
+	if provider == "xero" {
+		tenants, err := a.fetchXeroTenants(env.AccessToken)
+		if err != nil {
+			return broker.TokenEnvelope{}, fmt.Errorf("list xero tenants: %w", err)
+		}
+		env.Tenants = tenants
+	}
+	return env, nil
+}
+
+// fetchXeroTenants lists the Xero organisations accessToken can reach,
+// without the connections that carry no tenant id.
+func (a *App) fetchXeroTenants(accessToken string) ([]broker.XeroTenant, error) {
+	req, err := http.NewRequest(http.MethodGet, xeroAPIBaseURL+"/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w (%d)", errTokenRejected, resp.StatusCode)
+	}
+	if resp.StatusCode >= 400 {
+		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, rateLimitedFromResponse(resp, payload)
+		}
+		return nil, fmt.Errorf("xero returned %d: %s", resp.StatusCode, strings.TrimSpace(string(payload)))
+	}
+	var tenants []broker.XeroTenant
+	if err := json.NewDecoder(resp.Body).Decode(&tenants); err != nil {
+		return nil, err
+	}
+	return a.usableTenants(tenants), nil
+}
+
+// qboRealm returns the QuickBooks company id from the flag, or asks for it
+// when running interactively.
+func (a *App) qboRealm(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if !a.isInteractive() {
+		return "", errors.New("--realm is required for QuickBooks when adopting a refresh token")
+	}
+	fmt.Fprint(a.Stdout, "QuickBooks company (realm) id: ")
+	line, err := a.input().ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	realm := strings.TrimSpace(line)
+	if realm == "" {
+		return "", errors.New("no realm id given")
+	}
+	return realm, nil
+}
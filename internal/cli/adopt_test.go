@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/99designs/keyring"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+// readOnlyKeyring refuses every write, as a locked or full credential store
+// would.
+type readOnlyKeyring struct{ keyring.Keyring }
+
+func (readOnlyKeyring) Set(keyring.Item) error { return errors.New("keyring is read-only") }
+
+func TestAdoptKeepsRotatedTokenOutOfOutput(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	a, errb := archiveTestApp(t)
+	a.BrokerBaseURL = srv.URL
+	a.HTTPClient = http.DefaultClient
+	a.Keyring = readOnlyKeyring{a.Keyring}
+
+	args := []string{"--profile", "acme", "--refresh-token", "supplied-refresh", "deputy"}
+	if code := a.runConnect(args); code == 0 {
+		t.Fatal("connect succeeded although the profile could not be saved")
+	}
+	if strings.Contains(errb.String(), "brokertest-refresh-1") {
+		t.Fatalf("rotated refresh token printed: %s", errb)
+	}
+	path := a.recoveryPath(ProfileData{Provider: "deputy", Name: "acme"})
+	if !strings.Contains(errb.String(), path) {
+		t.Fatalf("recovery file %s not named in: %s", path, errb)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("recovery file mode %v, want 0600", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved ProfileData
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.RefreshToken != "brokertest-refresh-1" {
+		t.Fatalf("recovery file holds refresh token %q, want the rotated one", saved.RefreshToken)
+	}
+	if srv.Upstream.TokensIssued() != 1 {
+		t.Fatalf("provider issued %d tokens, want 1", srv.Upstream.TokensIssued())
+	}
+}
@@ -3,14 +3,18 @@ package cli
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -25,11 +29,31 @@ import (
 // App wraps the CLI runtime state.
 type App struct {
 	BrokerBaseURL string
-	HTTPClient    *http.Client
-	Keyring       keyring.Keyring
-	Stdout        io.Writer
-	Stderr        io.Writer
-	Stdin         io.Reader
+	// BrokerPublicKeys, when set, verify the token envelopes the broker
+	// signs; a signature by any one of them is accepted.
+	BrokerPublicKeys []ed25519.PublicKey
+	// BrokerAPIKey is sent with every broker request, for brokers that set
+	// BROKER_API_KEY.
+	BrokerAPIKey string
+	ConfigDir    string
+	HTTPClient   *http.Client
+	Keyring      keyring.Keyring
+	Stdout       io.Writer
+	Stderr       io.Writer
+	Stdin        io.Reader
+
+	keyringReady bool
+	stdin        *bufio.Reader
+	// jsonOutput is set by the global --json flag; wroteJSON records that
+	// the command already emitted its JSON result.
+	jsonOutput bool
+	wroteJSON  bool
+	// profileFile, set by connect --save-to-file or --profile-file, keeps
+	// the command's profile in that JSON file instead of the keyring.
+	profileFile string
+	// authScopes, set by connect --scopes-from-profile, are sent to
+	// /v1/auth/start in place of the broker's configured scopes.
+	authScopes []string
 }
 
 // NewApp creates a new CLI app with default configuration.
@@ -55,8 +79,18 @@ func NewApp() (*App, error) {
 	if envURL := os.Getenv("ACCOUNTING_OPS_BROKER"); envURL != "" {
 		brokerURL = strings.TrimRight(envURL, "/")
 	}
+	var pub []ed25519.PublicKey
+	if envKey := os.Getenv("ACCOUNTING_OPS_BROKER_PUBKEY"); envKey != "" {
+		pub, err = broker.ParsePublicKeys(envKey)
+		if err != nil {
+			return nil, fmt.Errorf("ACCOUNTING_OPS_BROKER_PUBKEY: %w", err)
+		}
+	}
 	return &App{
-		BrokerBaseURL: brokerURL,
+		BrokerBaseURL:    brokerURL,
+		BrokerPublicKeys: pub,
+		BrokerAPIKey:     os.Getenv("ACCOUNTING_OPS_BROKER_KEY"),
+		ConfigDir:        filepath.Join(cfgDir, "accounting-ops"),
 		HTTPClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
@@ -69,7 +103,40 @@ func NewApp() (*App, error) {
 
 // Run executes the CLI with the provided arguments.
 func (a *App) Run(args []string) int {
+	global := flag.NewFlagSet("acct", flag.ContinueOnError)
+	global.SetOutput(a.Stderr)
+	global.Usage = a.printUsage
+	brokerAlias := global.String("broker-alias", "", "use the broker URL saved under this alias")
+	asJSON := global.Bool("json", false, "write list and whoami results, and any error, as JSON on stdout")
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 1
+	}
+	args = global.Args()
+	if *asJSON {
+		a.jsonOutput = true
+		return a.runJSONMode(func() int { return a.dispatch(args, *brokerAlias) })
+	}
+	return a.dispatch(args, *brokerAlias)
+}
+
+// dispatch resolves the broker alias and runs the command named by args[0].
+func (a *App) dispatch(args []string, brokerAlias string) int {
+	if brokerAlias != "" {
+		u, err := a.resolveBrokerAlias(brokerAlias)
+		if err != nil {
+			fmt.Fprintln(a.Stderr, err)
+			return 1
+		}
+		a.BrokerBaseURL = u
+	}
 	if len(args) == 0 {
+		if a.jsonOutput {
+			fmt.Fprintln(a.Stderr, "command required")
+			return 1
+		}
 		a.printUsage()
 		return 1
 	}
@@ -78,18 +145,44 @@ func (a *App) Run(args []string) int {
 		return a.runConnect(args[1:])
 	case "list":
 		return a.runList(args[1:])
+	case "status":
+		return a.runStatus(args[1:])
 	case "whoami":
 		return a.runWhoAmI(args[1:])
 	case "refresh":
 		return a.runRefresh(args[1:])
+	case "export":
+		return a.runExport(args[1:])
+	case "backup":
+		return a.runBackup(args[1:])
+	case "restore":
+		return a.runRestore(args[1:])
+	case "token":
+		return a.runToken(args[1:])
 	case "revoke":
 		return a.runRevoke(args[1:])
+	case "disconnect":
+		return a.runDisconnect(args[1:])
+	case "rename":
+		return a.runRename(args[1:])
+	case "broker":
+		return a.runBroker(args[1:])
+	case "tenant":
+		return a.runTenant(args[1:])
+	case "tenants":
+		return a.runTenants(args[1:])
+	case "completion":
+		return a.runCompletion(args[1:])
+	case "__complete":
+		return a.runComplete(args[1:])
 	case "help", "-h", "--help":
 		a.printUsage()
 		return 0
 	default:
 		fmt.Fprintf(a.Stderr, "unknown command %q\n", args[0])
-		a.printUsage()
+		if !a.jsonOutput {
+			a.printUsage()
+		}
 		return 1
 	}
 }
@@ -97,17 +190,49 @@ func (a *App) Run(args []string) int {
 func (a *App) printUsage() {
 	fmt.Fprintf(a.Stdout, `Accounting Ops CLI
 
+Usage: acct [--broker-alias NAME] [--json] <command> [flags]
+
 Commands:
-  connect <provider> --profile NAME [--broker URL]
-  list
-  whoami --profile NAME --provider PROVIDER
-  refresh --profile NAME --provider PROVIDER [--broker URL]
-  revoke --profile NAME --provider PROVIDER
+  connect <provider> [--profile NAME] [--broker URL] [--tenant ID|NAME] [--no-tenant-prompt] [--force]
+          [--local-callback | --resume SESSION | --refresh-token TOKEN [--realm ID]]
+          [--company-file ID|NAME|URI] [--cf-user NAME] [--account ID|NAME] [--save-to-file PATH]
+          [--timeout DURATION] [--poll-interval DURATION] [--retry-on-expire N]
+          [--scopes-from-profile NAME] [--tags TAG,...]
+  list [--stale]
+  status [--check] [--warn-within DURATION] [--json]
+  whoami --profile NAME --provider PROVIDER [--probe] [--live] [--no-refresh] [--json]
+  whoami --profile-file PATH [--probe] [--live] [--no-refresh] [--json]
+  whoami (--profile NAME --provider PROVIDER | --profile-file PATH) --expires-in [--json]
+  whoami --all [--json] [--show-secrets]
+  refresh --profile NAME --provider PROVIDER [--broker URL] [--stdout --allow-unsafe]
+          [--org-name NAME|ID] [--clear-missing-tenant]
+  refresh --profile-file PATH [--broker URL]
+  refresh --all [--only-expiring DURATION] [--broker URL]
+  revoke --profile NAME --provider PROVIDER [--broker URL] [--local-only]
+  disconnect --profile NAME [--broker URL]  (Xero: remove the organisation connections)
+  rename --provider PROVIDER --old-name NAME --new-name NAME
+  backup --out FILE [--passphrase PASS | --passphrase-file FILE]  (same as export --all)
+  restore --in FILE [--passphrase PASS | --passphrase-file FILE] [--force]
+  export --all --out FILE [--passphrase PASS | --passphrase-file FILE]
+  export --profile NAME [--provider PROVIDER] [--format env|dotenv|json] [--no-refresh]
+         [--fd N | --output FILE]  (writes live tokens, e.g. eval "$(acct export --profile NAME)")
+  token --profile NAME [--provider PROVIDER] [--no-refresh] [--fd N | --output FILE]
+  token --profile-file PATH [--no-refresh] [--fd N | --output FILE]
+  tenant use --profile NAME --tenant-id ID|NAME [--profile-file PATH]
+  tenants --profile NAME [--profile-file PATH] [--diff [--json]]
+  broker add NAME URL | broker list | broker remove NAME
+  completion bash|zsh|fish  (e.g. source <(acct completion bash))
 
 Environment Variables:
   ACCOUNTING_OPS_BROKER  Override default broker URL
                          Production (default): https://auth.industrial-linguistics.com/v1/broker
                          Development: https://auth-dev.industrial-linguistics.com/v1/broker
+  ACCOUNTING_OPS_BROKER_PUBKEY  Base64 Ed25519 key, or a comma-separated list during a key
+                                rotation; reject broker responses not signed by one of them
+  ACCOUNTING_OPS_BROKER_KEY  API key sent to brokers that require one (BROKER_API_KEY)
+  ACCOUNTING_OPS_REFRESH_LEEWAY  Seconds before expiry that whoami refreshes a token (default 60)
+  MYOB_CF_PASSWORD  Company file password for connect myob --cf-user (prompted if unset)
+  MYOB_API_KEY      The broker's MYOB client id, needed for whoami --probe on MYOB profiles
 `)
 }
 
@@ -116,105 +241,431 @@ func (a *App) runConnect(args []string) int {
 	fs.SetOutput(a.Stderr)
 	profile := fs.String("profile", "", "profile name")
 	brokerURL := fs.String("broker", "", "override broker base URL")
+	tenant := fs.String("tenant", "", "Xero tenant id or name to select without prompting")
+	noTenantPrompt := fs.Bool("no-tenant-prompt", false, "fail instead of prompting when several Xero tenants match (implied when stdin is not a terminal)")
+	resume := fs.String("resume", "", "resume polling an existing broker session instead of starting a new one")
+	refreshToken := fs.String("refresh-token", "", "adopt an existing refresh token instead of running the browser flow")
+	realm := fs.String("realm", "", "QuickBooks company (realm) id, for --refresh-token")
+	force := fs.Bool("force", false, "percent-escape disallowed characters in the profile name instead of rejecting it")
+	localCallback := fs.Bool("local-callback", false, "receive the provider redirect on a local loopback listener instead of polling the broker")
+	companyFile := fs.String("company-file", "", "MYOB company file id, name or URI to select without prompting")
+	account := fs.String("account", "", "FreshBooks account id or business name to select without prompting")
+	cfUser := fs.String("cf-user", "", "MYOB company file sign-on user; the password comes from MYOB_CF_PASSWORD or a prompt")
+	fs.StringVar(&a.profileFile, "save-to-file", "", "write the profile as JSON to this path (mode 0600) instead of the keyring")
+	timeout := fs.Duration("timeout", defaultConnectTimeout, "give up if authorisation has not completed within this long, retries included (0 for no limit)")
+	pollInterval := fs.Duration("poll-interval", defaultPollInterval, "wait this long between polls of the broker while authorisation is pending")
+	scopesFrom := fs.String("scopes-from-profile", "", "request the scopes recorded on this existing profile of the same provider")
+	retryOnExpire := fs.Int("retry-on-expire", 0, "start a new session and reopen the browser up to this many times if the session expires before authorisation")
+	tags := fs.String("tags", "", "comma-separated labels to store with the profile")
 	if err := fs.Parse(args); err != nil {
 		return 1
 	}
+	if *timeout < 0 || *retryOnExpire < 0 {
+		fmt.Fprintln(a.Stderr, "--timeout and --retry-on-expire must not be negative")
+		return 1
+	}
+	if *pollInterval <= 0 {
+		fmt.Fprintln(a.Stderr, "--poll-interval must be positive")
+		return 1
+	}
+	if *retryOnExpire > 0 && (*refreshToken != "" || *localCallback) {
+		fmt.Fprintln(a.Stderr, "--retry-on-expire cannot be combined with --refresh-token or --local-callback")
+		return 1
+	}
+	if *refreshToken != "" && *resume != "" {
+		fmt.Fprintln(a.Stderr, "--refresh-token and --resume cannot be combined")
+		return 1
+	}
+	if *localCallback && (*refreshToken != "" || *resume != "") {
+		fmt.Fprintln(a.Stderr, "--local-callback cannot be combined with --refresh-token or --resume")
+		return 1
+	}
+	if *scopesFrom != "" && (*refreshToken != "" || *resume != "") {
+		fmt.Fprintln(a.Stderr, "--scopes-from-profile cannot be combined with --refresh-token or --resume")
+		return 1
+	}
 	if fs.NArg() < 1 {
 		fmt.Fprintln(a.Stderr, "provider argument required")
 		return 1
 	}
 	provider := strings.ToLower(fs.Arg(0))
+	if *scopesFrom != "" {
+		scopes, err := a.profileScopes(*scopesFrom, provider)
+		if err != nil {
+			fmt.Fprintln(a.Stderr, err)
+			return 1
+		}
+		a.authScopes = scopes
+	}
+	// Without --profile an interactive user is offered a name once the
+	// organisation is known; scripts must still name the profile.
+	promptName := false
 	if *profile == "" {
-		fmt.Fprintln(a.Stderr, "--profile is required")
+		if !a.isInteractive() {
+			fmt.Fprintln(a.Stderr, "--profile is required")
+			return 1
+		}
+		promptName = true
+	} else if name, err := a.checkProfileName(*profile, *force); err != nil {
+		fmt.Fprintln(a.Stderr, err)
 		return 1
+	} else {
+		*profile = name
 	}
 	baseURL := a.BrokerBaseURL
 	if *brokerURL != "" {
 		baseURL = strings.TrimRight(*brokerURL, "/")
 	}
 
-	startResp, err := a.startAuth(baseURL, provider, *profile)
+	// Ctrl-C while waiting on the browser abandons the flow cleanly; once
+	// the tokens are in, it interrupts as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	limits := connectLimits{retries: *retryOnExpire, pollInterval: *pollInterval}
+	var envelope broker.TokenEnvelope
+	var err error
+	if *refreshToken != "" {
+		envelope, err = a.adoptRefreshToken(baseURL, provider, *refreshToken)
+	} else {
+		startProfile := *profile
+		if startProfile == "" {
+			startProfile = provider
+		}
+		if *localCallback {
+			envelope, err = a.localCallbackAuthorise(ctx, baseURL, provider, startProfile)
+			if errors.Is(err, errLoopbackUnavailable) {
+				fmt.Fprintf(a.Stderr, "%v; falling back to broker polling.\n", err)
+				envelope, err = a.browserAuthorise(ctx, baseURL, provider, startProfile, "", limits)
+			}
+		} else {
+			envelope, err = a.browserAuthorise(ctx, baseURL, provider, startProfile, *resume, limits)
+		}
+	}
+	stop()
 	if err != nil {
-		fmt.Fprintf(a.Stderr, "start auth failed: %v\n", err)
+		fmt.Fprintln(a.Stderr, err)
 		return 1
 	}
-	fmt.Fprintf(a.Stdout, "Opening browser for %s authorisation...\n", provider)
-	if err := browser.OpenURL(startResp.AuthURL); err != nil {
-		fmt.Fprintf(a.Stderr, "unable to open browser automatically: %v\n", err)
-		fmt.Fprintf(a.Stdout, "Please open this URL manually:\n%s\n", startResp.AuthURL)
-	}
+	envelope.Provider = provider
 
-	pollURL := startResp.PollURL
-	if !strings.HasPrefix(pollURL, "http") {
-		base, err := url.Parse(baseURL)
-		if err != nil {
-			fmt.Fprintf(a.Stderr, "invalid broker URL: %v\n", err)
+	prof := envelopeToProfile(envelope, *profile)
+	prof.ConnectedAt = time.Now().UTC()
+	prof.Tags = parseTags(*tags)
+
+	if provider == "qbo" && prof.RealmID == "" {
+		if prof.RealmID, err = a.qboRealm(*realm); err != nil {
+			fmt.Fprintln(a.Stderr, err)
 			return 1
 		}
-		rel, err := url.Parse(pollURL)
-		if err != nil {
-			fmt.Fprintf(a.Stderr, "invalid poll URL from broker: %v\n", err)
+	}
+	if provider == "qbo" {
+		a.checkQBOEnvironment(&prof)
+	}
+
+	if provider == "myob" {
+		if err := a.selectMYOBCompanyFile(&prof, envelope.CompanyFiles, *companyFile, !a.isInteractive()); err != nil {
+			fmt.Fprintf(a.Stderr, "company file selection failed: %v\n", err)
 			return 1
 		}
-		pollURL = base.ResolveReference(rel).String()
+		if *cfUser != "" {
+			if prof.CFToken, err = a.myobCFToken(*cfUser); err != nil {
+				fmt.Fprintf(a.Stderr, "company file sign-on: %v\n", err)
+				return 1
+			}
+		}
 	}
 
-	fmt.Fprintln(a.Stdout, "Waiting for authorisation...")
-	envelope, err := a.pollForTokens(pollURL)
-	if err != nil {
-		fmt.Fprintf(a.Stderr, "authorisation failed: %v\n", err)
-		return 1
+	if provider == "freshbooks" {
+		if err := a.selectFreshBooksAccount(&prof, envelope.Businesses, *account, !a.isInteractive()); err != nil {
+			fmt.Fprintf(a.Stderr, "account selection failed: %v\n", err)
+			return 1
+		}
 	}
-	envelope.Provider = provider
-
-	prof := envelopeToProfile(envelope, *profile)
 
 	if provider == "xero" {
-		if err := a.promptForXeroTenant(&prof, envelope); err != nil {
+		envelope.Tenants = a.usableTenants(envelope.Tenants)
+		recordTenantScopes(&prof, envelope.Tenants, envelope.Scope)
+		prof.Tenants = envelope.Tenants
+		if err := a.promptForXeroTenant(&prof, envelope, *tenant, *noTenantPrompt || !a.isInteractive()); err != nil {
 			fmt.Fprintf(a.Stderr, "tenant selection failed: %v\n", err)
 			return 1
 		}
 	}
 
+	if promptName {
+		name, err := a.confirmProfileName(suggestProfileName(prof))
+		if err == nil {
+			name, err = a.checkProfileName(name, *force)
+		}
+		if err != nil {
+			fmt.Fprintf(a.Stderr, "profile naming failed: %v\n", err)
+			return 1
+		}
+		prof.Name = name
+		if provider == "xero" && *tenant == "" && prof.TenantID != "" {
+			if err := a.savePreferredTenant(prof.Name, prof.TenantID); err != nil {
+				fmt.Fprintf(a.Stderr, "warning: unable to save tenant preference: %v\n", err)
+			}
+		}
+	}
+
 	if err := a.saveProfile(prof); err != nil {
 		fmt.Fprintf(a.Stderr, "unable to save credentials: %v\n", err)
+		if *refreshToken != "" && prof.RefreshToken != *refreshToken {
+			// The token supplied no longer works, so the rotated one must
+			// not be lost, but nor should it land in a terminal log.
+			if path, err := a.writeRecovery(prof); err != nil {
+				fmt.Fprintf(a.Stderr, "The refresh token was rotated and could not be kept either: %v\n", err)
+			} else {
+				fmt.Fprintf(a.Stderr, "The refresh token was rotated; the new credentials were saved to %s (mode 0600); pass its refresh_token to connect --refresh-token once saving works.\n", path)
+			}
+		}
 		return 1
 	}
+	if a.profileFile != "" {
+		a.warnProfileFile()
+	}
 
 	a.printProfileSummary(prof)
 	return 0
 }
 
+// profileScopes returns the scopes recorded on the keyring profile name for
+// provider, for connect --scopes-from-profile. It reads the keyring even
+// under --save-to-file, which names the output rather than a source.
+func (a *App) profileScopes(name, provider string) ([]string, error) {
+	item, err := a.Keyring.Get(makeProfileKey(provider, name))
+	if errors.Is(err, keyring.ErrKeyNotFound) {
+		return nil, fmt.Errorf("--scopes-from-profile: no %s profile named %s", provider, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("--scopes-from-profile: unable to read profile %s: %w", name, err)
+	}
+	var prof ProfileData
+	if err := json.Unmarshal(item.Data, &prof); err != nil {
+		return nil, fmt.Errorf("--scopes-from-profile: unable to read profile %s: %w", name, err)
+	}
+	scopes := strings.Fields(prof.Scope)
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("--scopes-from-profile: profile %s has no recorded scopes", name)
+	}
+	return scopes, nil
+}
+
+const (
+	// defaultConnectTimeout outlasts a broker session at its default
+	// SESSION_TTL_SECONDS, so a user who abandons the browser is told so
+	// rather than left waiting.
+	defaultConnectTimeout = 15 * time.Minute
+	defaultPollInterval   = 2 * time.Second
+)
+
+// connectLimits shapes connect's browser flow: retries is how many times a
+// session that expires before the user finishes is replaced by a new one,
+// and pollInterval is the pause between polls while it is pending.
+type connectLimits struct {
+	retries      int
+	pollInterval time.Duration
+}
+
+// errSessionExpired means the broker session lapsed before authorisation
+// completed.
+var errSessionExpired = errors.New("session expired")
+
+// errConnectTimeout means connect --timeout elapsed first.
+var errConnectTimeout = errors.New("authorisation timed out")
+
+// errConnectInterrupted means the user pressed Ctrl-C during the flow.
+var errConnectInterrupted = errors.New("authorisation cancelled")
+
+// connectAborted translates the end of connect's context into
+// errConnectTimeout or errConnectInterrupted, or returns nil while it is
+// still live.
+func connectAborted(ctx context.Context) error {
+	switch {
+	case ctx.Err() == nil:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return errConnectTimeout
+	default:
+		return errConnectInterrupted
+	}
+}
+
+// browserAuthorise runs the broker's browser flow, or resumes polling an
+// earlier session when resume is set, and returns the resulting tokens. A
+// session that expires is restarted, with a fresh browser window, up to
+// limits.retries times.
+func (a *App) browserAuthorise(ctx context.Context, baseURL, provider, startProfile, resume string, limits connectLimits) (broker.TokenEnvelope, error) {
+	for attempt := 1; ; attempt++ {
+		envelope, err := a.browserAttempt(ctx, baseURL, provider, startProfile, resume, limits.pollInterval)
+		if !errors.Is(err, errSessionExpired) || attempt > limits.retries {
+			return envelope, err
+		}
+		fmt.Fprintf(a.Stderr, "The session expired before authorisation completed; starting again (retry %d of %d).\n", attempt, limits.retries)
+		resume = ""
+	}
+}
+
+// browserAttempt runs one broker session of the browser flow.
+func (a *App) browserAttempt(ctx context.Context, baseURL, provider, startProfile, resume string, pollInterval time.Duration) (broker.TokenEnvelope, error) {
+	var pollURL string
+	session := resume
+	if resume != "" {
+		// The browser leg already happened in an earlier run; only the
+		// poll remains.
+		pollURL = baseURL + "/v1/auth/poll/" + url.PathEscape(resume)
+		fmt.Fprintf(a.Stdout, "Resuming session %s...\n", resume)
+	} else {
+		startResp, err := a.startAuth(ctx, baseURL, provider, startProfile, "")
+		if err != nil {
+			return broker.TokenEnvelope{}, fmt.Errorf("start auth failed: %w", err)
+		}
+		fmt.Fprintf(a.Stdout, "Opening browser for %s authorisation...\n", provider)
+		if startResp.Session != "" {
+			fmt.Fprintf(a.Stdout, "Session %s (resume with --resume %s if interrupted)\n", startResp.Session, startResp.Session)
+		}
+		session = startResp.Session
+		if err := browser.OpenURL(startResp.AuthURL); err != nil {
+			fmt.Fprintf(a.Stderr, "unable to open browser automatically: %v\n", err)
+			fmt.Fprintf(a.Stdout, "Please open this URL manually:\n%s\n", startResp.AuthURL)
+		}
+		pollURL = startResp.PollURL
+	}
+
+	if !strings.HasPrefix(pollURL, "http") {
+		base, err := url.Parse(baseURL)
+		if err != nil {
+			return broker.TokenEnvelope{}, fmt.Errorf("invalid broker URL: %w", err)
+		}
+		rel, err := url.Parse(pollURL)
+		if err != nil {
+			return broker.TokenEnvelope{}, fmt.Errorf("invalid poll URL from broker: %w", err)
+		}
+		pollURL = base.ResolveReference(rel).String()
+	}
+
+	fmt.Fprintln(a.Stdout, "Waiting for authorisation...")
+	envelope, err := a.pollForTokens(ctx, pollURL, pollInterval)
+	switch {
+	case errors.Is(err, errConnectInterrupted) && session != "":
+		// The broker has no way to cancel a session; it lapses on its own.
+		return broker.TokenEnvelope{}, fmt.Errorf("%w; session %s will expire unused unless resumed with --resume %s", err, session, session)
+	case errors.Is(err, errConnectTimeout), errors.Is(err, errConnectInterrupted):
+		return broker.TokenEnvelope{}, err
+	case err != nil:
+		return broker.TokenEnvelope{}, fmt.Errorf("authorisation failed: %w", err)
+	}
+	return envelope, nil
+}
+
 func (a *App) runList(args []string) int {
 	fs := flag.NewFlagSet("list", flag.ContinueOnError)
 	fs.SetOutput(a.Stderr)
+	stale := fs.Bool("stale", false, "only show profiles that are expired or fail a live provider check")
 	if err := fs.Parse(args); err != nil {
 		return 1
 	}
-	keys, err := a.Keyring.Keys()
+	if err := a.ensureKeyringReady(); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to unlock credential store: %v\n", err)
+		return 1
+	}
+	entries, err := a.storedProfiles()
 	if err != nil {
 		fmt.Fprintf(a.Stderr, "unable to enumerate profiles: %v\n", err)
 		return 1
 	}
-	if len(keys) == 0 {
+	if *stale {
+		return a.listStale(entries)
+	}
+	if a.jsonOutput {
+		list := make([]profileJSON, 0, len(entries))
+		for _, e := range entries {
+			if e.Err != nil {
+				list = append(list, profileJSON{Key: e.Key, Error: e.Err.Error()})
+				continue
+			}
+			list = append(list, newProfileJSON(e.Profile))
+		}
+		return a.writeJSON(list)
+	}
+	if len(entries) == 0 {
 		fmt.Fprintln(a.Stdout, "No stored profiles.")
 		return 0
 	}
-	fmt.Fprintf(a.Stdout, "Stored profiles (%d):\n", len(keys))
+	fmt.Fprintf(a.Stdout, "Stored profiles (%d):\n", len(entries))
+	for _, e := range entries {
+		if e.Err != nil {
+			fmt.Fprintf(a.Stderr, "  %s: %v\n", e.Key, e.Err)
+			continue
+		}
+		prof := e.Profile
+		fmt.Fprintf(a.Stdout, "  %s (%s) – expires %s\n", prof.Name, prof.Provider, expiryLabel(prof))
+		if prof.Provider == "xero" && prof.TenantID != "" {
+			fmt.Fprintf(a.Stdout, "    Tenant: %s\n", describeTenant(prof.TenantName, prof.TenantID))
+			a.printOtherTenants(prof, "    ")
+		}
+	}
+	return 0
+}
+
+// ensureKeyringReady touches the keyring once so that backends which prompt
+// to unlock do so before a command starts its run of reads, not part-way
+// through them.
+func (a *App) ensureKeyringReady() error {
+	if a.keyringReady {
+		return nil
+	}
+	fmt.Fprintln(a.Stderr, "Unlocking credential store...")
+	keys, err := a.Keyring.Keys()
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		// Listing keys does not decrypt anything on the file backend;
+		// reading one item does.
+		if _, err := a.Keyring.Get(keys[0]); err != nil && !errors.Is(err, keyring.ErrKeyNotFound) {
+			return err
+		}
+	}
+	a.keyringReady = true
+	return nil
+}
+
+// storedProfile pairs a keyring key with its decoded profile, or the error
+// encountered reading it.
+type storedProfile struct {
+	Key     string
+	Profile ProfileData
+	Err     error
+}
+
+// storedProfiles reads every profile in the keyring. Unreadable entries are
+// reported per key rather than aborting the enumeration.
+func (a *App) storedProfiles() ([]storedProfile, error) {
+	keys, err := a.Keyring.Keys()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]storedProfile, 0, len(keys))
 	for _, key := range keys {
 		item, err := a.Keyring.Get(key)
 		if err != nil {
-			fmt.Fprintf(a.Stderr, "  %s: error reading: %v\n", key, err)
+			out = append(out, storedProfile{Key: key, Err: fmt.Errorf("error reading: %w", err)})
 			continue
 		}
 		var prof ProfileData
 		if err := json.Unmarshal(item.Data, &prof); err != nil {
-			fmt.Fprintf(a.Stderr, "  %s: corrupt entry: %v\n", key, err)
+			out = append(out, storedProfile{Key: key, Err: fmt.Errorf("corrupt entry: %w", err)})
 			continue
 		}
-		fmt.Fprintf(a.Stdout, "  %s (%s) – expires %s\n", prof.Name, prof.Provider, prof.ExpiresAt.Format(time.RFC3339))
+		out = append(out, storedProfile{Key: key, Profile: prof})
 	}
-	return 0
+	return out, nil
 }
 
 func (a *App) runWhoAmI(args []string) int {
@@ -222,60 +673,341 @@ func (a *App) runWhoAmI(args []string) int {
 	fs.SetOutput(a.Stderr)
 	profile := fs.String("profile", "", "profile name")
 	provider := fs.String("provider", "", "provider name")
+	all := fs.Bool("all", false, "show details for every stored profile")
+	asJSON := fs.Bool("json", false, "emit JSON, as the global --json does")
+	showSecrets := fs.Bool("show-secrets", false, "include tokens in --all output")
+	probe := fs.Bool("probe", false, "check the token against the provider API")
+	live := fs.Bool("live", false, "ask the provider API for the name of the organisation the token reaches")
+	expiresIn := fs.Bool("expires-in", false, "print only the seconds until the stored access token expires (never refreshes)")
+	noRefresh := fs.Bool("no-refresh", false, "show the stored profile without refreshing an expired access token")
+	a.addProfileFileFlag(fs)
 	if err := fs.Parse(args); err != nil {
 		return 1
 	}
+	if *expiresIn && (*all || *probe || *live) {
+		fmt.Fprintln(a.Stderr, "--expires-in cannot be combined with --all, --probe or --live")
+		return 1
+	}
+	if *all && *live {
+		fmt.Fprintln(a.Stderr, "--live cannot be combined with --all")
+		return 1
+	}
+	if *all && a.profileFile != "" {
+		fmt.Fprintln(a.Stderr, "--all cannot be combined with --profile-file")
+		return 1
+	}
+	jsonOut := *asJSON || a.jsonOutput
+	if *all {
+		return a.whoAmIAll(jsonOut, *showSecrets)
+	}
 	prof, err := a.loadProfile(*profile, *provider)
 	if err != nil {
 		fmt.Fprintf(a.Stderr, "unable to load profile: %v\n", err)
 		return 1
 	}
+	if *expiresIn {
+		if jsonOut {
+			return a.writeJSON(map[string]int64{"expires_in": secondsUntilExpiry(*prof, time.Now())})
+		}
+		fmt.Fprintln(a.Stdout, secondsUntilExpiry(*prof, time.Now()))
+		return 0
+	}
+	if !*noRefresh {
+		fresh, err := a.ensureFreshToken(*prof)
+		if err != nil {
+			fmt.Fprintf(a.Stderr, "unable to refresh profile: %v\n", err)
+			return 1
+		}
+		prof = &fresh
+	}
+	if jsonOut {
+		return a.whoAmIJSON(*prof, *probe, *live)
+	}
+	a.printProfileDetails(*prof)
+	code := 0
+	if *live {
+		code = a.printLiveOrganisation(*prof)
+	}
+	if *probe {
+		code = max(code, a.printProbe(*prof))
+	}
+	return code
+}
+
+// printLiveOrganisation shows the organisation name the provider reports
+// for prof, under the ids printProfileDetails listed.
+func (a *App) printLiveOrganisation(prof ProfileData) int {
+	name, err := a.liveOrganisation(prof)
+	if err != nil {
+		fmt.Fprintf(a.Stdout, "  Organisation (live): unavailable (%s)\n", liveOrganisationHint(prof, err))
+		return 1
+	}
+	fmt.Fprintf(a.Stdout, "  Organisation (live): %s\n", name)
+	return 0
+}
+
+// printProbe reports a live provider check along with any warnings about
+// the profile's configuration.
+func (a *App) printProbe(prof ProfileData) int {
+	code := 0
+	err := a.probeProfile(prof)
+	if err != nil {
+		fmt.Fprintf(a.Stdout, "  Live check: failed (%v)\n", err)
+		code = 1
+	} else {
+		fmt.Fprintln(a.Stdout, "  Live check: ok")
+	}
+	for _, w := range a.probeWarnings(prof, err) {
+		fmt.Fprintf(a.Stdout, "  Warning: %s\n", w)
+	}
+	return code
+}
+
+// probeWarnings explains likely causes behind a live check: for Xero, an
+// active organisation that was not granted the scopes the toolkit relies on;
+// for QBO, a realm that belongs to the other environment.
+func (a *App) probeWarnings(prof ProfileData, probeErr error) []string {
+	var warnings []string
+	if prof.Provider == "xero" {
+		if missing := missingTenantScopes(prof); len(missing) > 0 {
+			warnings = append(warnings, fmt.Sprintf("organisation %s lacks %s", describeTenant(prof.TenantName, prof.TenantID), strings.Join(missing, ", ")))
+		}
+	}
+	if prof.Provider == "qbo" && probeErr != nil {
+		if other := a.qboEnvironmentMismatch(prof); other != "" {
+			warnings = append(warnings, fmt.Sprintf("realm %s answers on the %s API, not %s; reconnect against the %s broker configuration", prof.RealmID, other, qboEnvironment(prof), other))
+		}
+	}
+	return warnings
+}
+
+// identityLabel describes the user an OpenID id_token identified.
+func identityLabel(prof ProfileData) string {
+	switch {
+	case prof.Email != "" && prof.Subject != "":
+		return fmt.Sprintf("%s (subject %s)", prof.Email, prof.Subject)
+	case prof.Email != "":
+		return prof.Email
+	default:
+		return "subject " + prof.Subject
+	}
+}
+
+func (a *App) printProfileDetails(prof ProfileData) {
 	fmt.Fprintf(a.Stdout, "Profile %s (%s)\n", prof.Name, prof.Provider)
-	fmt.Fprintf(a.Stdout, "  Access token expires: %s\n", prof.ExpiresAt.Format(time.RFC3339))
+	fmt.Fprintf(a.Stdout, "  Access token expires: %s\n", expiryLabel(prof))
+	if !prof.ConnectedAt.IsZero() {
+		fmt.Fprintf(a.Stdout, "  Connected: %s\n", prof.ConnectedAt.Local().Format(time.RFC3339))
+	}
+	if len(prof.Tags) > 0 {
+		fmt.Fprintf(a.Stdout, "  Tags: %s\n", strings.Join(prof.Tags, ", "))
+	}
+	if prof.Email != "" || prof.Subject != "" {
+		fmt.Fprintf(a.Stdout, "  Signed in as: %s\n", identityLabel(prof))
+	}
 	if prof.Provider == "xero" {
 		fmt.Fprintf(a.Stdout, "  Tenant ID: %s\n", prof.TenantID)
 		fmt.Fprintf(a.Stdout, "  Tenant Name: %s\n", prof.TenantName)
+		a.printOtherTenants(prof, "  ")
 	}
 	if prof.Provider == "deputy" {
 		fmt.Fprintf(a.Stdout, "  Endpoint: %s\n", prof.Endpoint)
 	}
 	if prof.Provider == "qbo" {
 		fmt.Fprintf(a.Stdout, "  Realm ID: %s\n", prof.RealmID)
+		fmt.Fprintf(a.Stdout, "  Environment: %s\n", qboEnvironmentLabel(prof))
+	}
+	if prof.Provider == "myob" {
+		fmt.Fprintf(a.Stdout, "  Company File: %s\n", prof.CompanyFileName)
+		fmt.Fprintf(a.Stdout, "  Company File URI: %s\n", prof.CompanyFileURI)
+	}
+	if prof.Provider == "freshbooks" {
+		fmt.Fprintf(a.Stdout, "  Business: %s\n", prof.BusinessName)
+		fmt.Fprintf(a.Stdout, "  Account ID: %s\n", prof.AccountID)
+	}
+}
+
+// whoAmIAll dumps every stored profile. Tokens are redacted unless
+// showSecrets is set, and unreadable entries are reported without stopping
+// the dump.
+func (a *App) whoAmIAll(asJSON, showSecrets bool) int {
+	if err := a.ensureKeyringReady(); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to unlock credential store: %v\n", err)
+		return 1
+	}
+	entries, err := a.storedProfiles()
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to enumerate profiles: %v\n", err)
+		return 1
+	}
+	type dumpEntry struct {
+		Key     string       `json:"key"`
+		Profile *ProfileData `json:"profile,omitempty"`
+		Error   string       `json:"error,omitempty"`
+	}
+	dump := make([]dumpEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Err != nil {
+			dump = append(dump, dumpEntry{Key: e.Key, Error: e.Err.Error()})
+			continue
+		}
+		prof := e.Profile
+		if !showSecrets {
+			prof.AccessToken = redactSecret(prof.AccessToken)
+			prof.RefreshToken = redactSecret(prof.RefreshToken)
+			prof.CFToken = redactSecret(prof.CFToken)
+		}
+		dump = append(dump, dumpEntry{Key: e.Key, Profile: &prof})
+	}
+
+	if asJSON {
+		return a.writeJSON(dump)
+	}
+	if len(dump) == 0 {
+		fmt.Fprintln(a.Stdout, "No stored profiles.")
+		return 0
+	}
+	for i, d := range dump {
+		if i > 0 {
+			fmt.Fprintln(a.Stdout)
+		}
+		if d.Profile == nil {
+			fmt.Fprintf(a.Stdout, "Profile key %s\n  Error: %s\n", d.Key, d.Error)
+			continue
+		}
+		a.printProfileDetails(*d.Profile)
+		fmt.Fprintf(a.Stdout, "  Scope: %s\n", d.Profile.Scope)
+		fmt.Fprintf(a.Stdout, "  Access token: %s\n", d.Profile.AccessToken)
+		fmt.Fprintf(a.Stdout, "  Refresh token: %s\n", d.Profile.RefreshToken)
 	}
 	return 0
 }
 
+// redactSecret hides a token while still showing whether one is present.
+func redactSecret(val string) string {
+	if val == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
 func (a *App) runRefresh(args []string) int {
 	fs := flag.NewFlagSet("refresh", flag.ContinueOnError)
 	fs.SetOutput(a.Stderr)
 	profile := fs.String("profile", "", "profile name")
 	provider := fs.String("provider", "", "provider name")
 	brokerURL := fs.String("broker", "", "override broker base URL")
+	toStdout := fs.Bool("stdout", false, "print the refreshed envelope instead of saving it (requires --allow-unsafe)")
+	allowUnsafe := fs.Bool("allow-unsafe", false, "acknowledge that --stdout can lose a rotated refresh token")
+	orgName := fs.String("org-name", "", "Xero: make the connected organisation with this name or tenant id the active one")
+	clearMissing := fs.Bool("clear-missing-tenant", false, "Xero: clear the active tenant if its organisation is no longer connected")
+	all := fs.Bool("all", false, "refresh every stored profile, continuing past failures")
+	onlyExpiring := fs.Duration("only-expiring", 0, "with --all, only refresh profiles whose access token expires within this long (e.g. 2h)")
+	a.addProfileFileFlag(fs)
 	if err := fs.Parse(args); err != nil {
 		return 1
 	}
+	if *onlyExpiring != 0 && !*all {
+		fmt.Fprintln(a.Stderr, "--only-expiring requires --all")
+		return 1
+	}
+	if *all {
+		if *profile != "" || *provider != "" || a.profileFile != "" || *toStdout || *orgName != "" || *clearMissing {
+			fmt.Fprintln(a.Stderr, "--all cannot be combined with --profile, --provider, --profile-file, --stdout, --org-name or --clear-missing-tenant")
+			return 1
+		}
+		if *onlyExpiring < 0 {
+			fmt.Fprintln(a.Stderr, "--only-expiring must not be negative")
+			return 1
+		}
+		baseURL := a.BrokerBaseURL
+		if *brokerURL != "" {
+			baseURL = strings.TrimRight(*brokerURL, "/")
+		}
+		return a.refreshAll(baseURL, *onlyExpiring)
+	}
+	if *toStdout && !*allowUnsafe {
+		fmt.Fprintln(a.Stderr, "--stdout does not save the refreshed credentials; if the provider rotates refresh tokens the stored one stops working. Pass --allow-unsafe to proceed.")
+		return 1
+	}
 	prof, err := a.loadProfile(*profile, *provider)
 	if err != nil {
 		fmt.Fprintf(a.Stderr, "unable to load profile: %v\n", err)
 		return 1
 	}
+	if recovered := a.offerRecovery(*prof, a.isInteractive()); recovered != nil {
+		prof = recovered
+	}
+
+	baseURL := a.BrokerBaseURL
+	if *brokerURL != "" {
+		baseURL = strings.TrimRight(*brokerURL, "/")
+	}
+	if (*orgName != "" || *clearMissing) && prof.Provider != "xero" {
+		fmt.Fprintln(a.Stderr, "--org-name and --clear-missing-tenant apply only to Xero profiles")
+		return 1
+	}
+	envelope, updated, err := a.fetchRefreshed(baseURL, *prof)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "refresh failed: %v\n", err)
+		return 1
+	}
+	var tenantErr error
+	if prof.Provider == "xero" {
+		tenantErr = a.revalidateXeroTenant(&updated, *orgName, *clearMissing)
+	}
 
-	var envelope broker.TokenEnvelope
-	switch prof.Provider {
-	case "xero":
-		envelope, err = a.refreshXero(*prof)
-	case "deputy", "qbo":
-		baseURL := a.BrokerBaseURL
-		if *brokerURL != "" {
-			baseURL = strings.TrimRight(*brokerURL, "/")
+	if *toStdout {
+		fmt.Fprintln(a.Stderr, "WARNING: refreshed credentials are NOT being saved.")
+		if updated.RefreshToken != prof.RefreshToken {
+			fmt.Fprintf(a.Stderr, "WARNING: %s rotated the refresh token. The stored profile's token is now invalid; the new one exists only in this output.\n", prof.Provider)
+		}
+		if envelope.RefreshToken == "" {
+			envelope.RefreshToken = updated.RefreshToken
 		}
-		envelope, err = a.refreshViaBroker(baseURL, *prof)
+		enc := json.NewEncoder(a.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(envelope); err != nil {
+			fmt.Fprintf(a.Stderr, "unable to write envelope: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := a.storeRefreshed(*prof, updated); err != nil {
+		return 1
+	}
+	fmt.Fprintln(a.Stdout, "Token refreshed.")
+	if tenantErr != nil {
+		fmt.Fprintf(a.Stderr, "tenant selection failed: %v\n", tenantErr)
+		return 1
+	}
+	if *orgName != "" {
+		fmt.Fprintf(a.Stdout, "Active tenant: %s\n", describeTenant(updated.TenantName, updated.TenantID))
+		if a.profileFile == "" {
+			if err := a.savePreferredTenant(updated.Name, updated.TenantID); err != nil {
+				fmt.Fprintf(a.Stderr, "warning: unable to save tenant preference: %v\n", err)
+			}
+		}
+	}
+	return 0
+}
+
+// fetchRefreshed refreshes prof's tokens through the provider's refresh path
+// and returns the raw envelope along with the merged profile to store.
+func (a *App) fetchRefreshed(baseURL string, prof ProfileData) (broker.TokenEnvelope, ProfileData, error) {
+	var envelope broker.TokenEnvelope
+	var err error
+	switch {
+	case prof.Provider == "xero":
+		envelope, err = a.refreshXero(prof)
+	case refreshedByBroker(prof.Provider):
+		envelope, err = a.refreshViaBroker(baseURL, prof)
 	default:
 		err = fmt.Errorf("unsupported provider %s", prof.Provider)
 	}
 	if err != nil {
-		fmt.Fprintf(a.Stderr, "refresh failed: %v\n", err)
-		return 1
+		return broker.TokenEnvelope{}, ProfileData{}, err
 	}
 
 	updated := envelopeToProfile(envelope, prof.Name)
@@ -283,6 +1015,11 @@ func (a *App) runRefresh(args []string) int {
 		updated.TenantID = prof.TenantID
 		updated.TenantName = prof.TenantName
 		updated.TenantType = prof.TenantType
+		updated.TenantScopes = prof.TenantScopes
+		updated.Tenants = prof.Tenants
+		if updated.Scope != "" && updated.TenantID != "" {
+			recordTenantScopes(&updated, []broker.XeroTenant{{TenantID: updated.TenantID}}, updated.Scope)
+		}
 	}
 	if prof.Provider == "deputy" && updated.Endpoint == "" {
 		updated.Endpoint = prof.Endpoint
@@ -290,13 +1027,102 @@ func (a *App) runRefresh(args []string) int {
 	if prof.Provider == "qbo" && updated.RealmID == "" {
 		updated.RealmID = prof.RealmID
 	}
+	if prof.Provider == "qbo" && updated.Environment == "" {
+		updated.Environment = prof.Environment
+	}
+	if prof.Provider == "myob" {
+		updated.CompanyFileURI = prof.CompanyFileURI
+		updated.CompanyFileName = prof.CompanyFileName
+		updated.CFToken = prof.CFToken
+	}
+	if prof.Provider == "freshbooks" {
+		updated.AccountID = prof.AccountID
+		updated.BusinessName = prof.BusinessName
+	}
+	// Refreshes carry no id_token, so keep the identity verified at connect.
+	updated.Subject, updated.Email = prof.Subject, prof.Email
+	updated.ConnectedAt, updated.Tags = prof.ConnectedAt, prof.Tags
+	// Providers that don't rotate refresh tokens omit them from the response;
+	// keep using the existing one.
+	if updated.RefreshToken == "" {
+		updated.RefreshToken = prof.RefreshToken
+	}
+	return envelope, updated, nil
+}
 
+// refreshedByBroker reports whether provider's tokens are refreshed through
+// the broker, which holds its client secret. Custom providers always are.
+func refreshedByBroker(provider string) bool {
+	switch provider {
+	case "deputy", "qbo", "myob", "freshbooks":
+		return true
+	}
+	return strings.HasPrefix(provider, "custom:")
+}
+
+// storeRefreshed saves refreshed credentials over prof, reporting problems on
+// Stderr. A rotated refresh token invalidates the stored one, so the new
+// credentials are stashed on disk until the keyring write has succeeded.
+func (a *App) storeRefreshed(prof, updated ProfileData) error {
+	rotated := updated.RefreshToken != prof.RefreshToken
+	var recoveryPath string
+	if rotated {
+		var err error
+		recoveryPath, err = a.writeRecovery(updated)
+		if err != nil {
+			fmt.Fprintf(a.Stderr, "warning: unable to write recovery file: %v\n", err)
+		}
+	}
 	if err := a.saveProfile(updated); err != nil {
 		fmt.Fprintf(a.Stderr, "unable to save refreshed credentials: %v\n", err)
-		return 1
+		if rotated {
+			fmt.Fprintf(a.Stderr, "The refresh token was rotated and the old one may no longer work.\n")
+			if recoveryPath != "" {
+				fmt.Fprintf(a.Stderr, "Refreshed credentials were saved to %s (mode 0600); re-run refresh to restore them.\n", recoveryPath)
+			}
+		}
+		return err
 	}
-	fmt.Fprintln(a.Stdout, "Token refreshed.")
-	return 0
+	if recoveryPath != "" {
+		a.clearRecovery(updated)
+	}
+	return nil
+}
+
+// defaultRefreshLeeway is how close to expiry an access token may get before
+// reads such as whoami refresh it first.
+const defaultRefreshLeeway = 60 * time.Second
+
+// refreshLeeway returns ACCOUNTING_OPS_REFRESH_LEEWAY (in seconds) when set
+// to a valid value, otherwise defaultRefreshLeeway.
+func refreshLeeway() time.Duration {
+	if v := os.Getenv("ACCOUNTING_OPS_REFRESH_LEEWAY"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return defaultRefreshLeeway
+}
+
+// ensureFreshToken returns prof unchanged while its access token has more
+// than the refresh leeway left; otherwise it refreshes and persists the
+// profile and returns the refreshed copy.
+func (a *App) ensureFreshToken(prof ProfileData) (ProfileData, error) {
+	if prof.NonExpiring || prof.ExpiresAt.IsZero() || time.Until(prof.ExpiresAt) > refreshLeeway() {
+		return prof, nil
+	}
+	if prof.Provider == "xero" && os.Getenv("XERO_CLIENT_ID") == "" {
+		return prof, errors.New("the access token has expired and Xero tokens are refreshed locally; export XERO_CLIENT_ID (or pass --no-refresh to show the stored token as is)")
+	}
+	_, updated, err := a.fetchRefreshed(a.BrokerBaseURL, prof)
+	if err != nil {
+		return prof, fmt.Errorf("the access token has expired and refreshing it failed: %w", err)
+	}
+	if err := a.storeRefreshed(prof, updated); err != nil {
+		return prof, fmt.Errorf("the access token has expired and the refreshed one could not be saved: %w", err)
+	}
+	fmt.Fprintf(a.Stderr, "Access token for %s was expiring; refreshed it.\n", prof.Name)
+	return updated, nil
 }
 
 func (a *App) runRevoke(args []string) int {
@@ -304,6 +1130,8 @@ func (a *App) runRevoke(args []string) int {
 	fs.SetOutput(a.Stderr)
 	profile := fs.String("profile", "", "profile name")
 	provider := fs.String("provider", "", "provider name")
+	brokerURL := fs.String("broker", "", "override broker base URL")
+	localOnly := fs.Bool("local-only", false, "only remove the local credentials; do not revoke with the provider")
 	if err := fs.Parse(args); err != nil {
 		return 1
 	}
@@ -311,6 +1139,31 @@ func (a *App) runRevoke(args []string) int {
 		fmt.Fprintln(a.Stderr, "--provider is required")
 		return 1
 	}
+	if !*localOnly {
+		prof, err := a.loadProfile(*profile, *provider)
+		switch {
+		case errors.Is(err, keyring.ErrKeyNotFound):
+			// Nothing stored, so nothing to revoke upstream.
+		case err != nil:
+			fmt.Fprintf(a.Stderr, "unable to load profile: %v\n", err)
+			return 1
+		default:
+			baseURL := a.BrokerBaseURL
+			if *brokerURL != "" {
+				baseURL = strings.TrimRight(*brokerURL, "/")
+			}
+			err := a.revokeViaBroker(baseURL, *prof)
+			switch {
+			case errors.Is(err, errRevokeUnsupported):
+				fmt.Fprintf(a.Stderr, "%s has no revocation API; revoke access from the provider's app settings if required.\n", prof.Provider)
+			case err != nil:
+				fmt.Fprintf(a.Stderr, "revocation failed: %v\nRe-run with --local-only to remove the local credentials anyway.\n", err)
+				return 1
+			default:
+				fmt.Fprintf(a.Stdout, "Revoked %s tokens with the provider.\n", prof.Provider)
+			}
+		}
+	}
 	key := makeProfileKey(*provider, *profile)
 	if err := a.Keyring.Remove(key); err != nil {
 		if !errors.Is(err, keyring.ErrKeyNotFound) {
@@ -322,17 +1175,75 @@ func (a *App) runRevoke(args []string) int {
 	return 0
 }
 
-func (a *App) startAuth(baseURL, provider, profile string) (*startResponse, error) {
+// errRevokeUnsupported is returned when the broker reports that the provider
+// has no revocation endpoint.
+var errRevokeUnsupported = errors.New("provider does not support token revocation")
+
+// revokeViaBroker asks the broker to revoke the profile's refresh token, or
+// its access token when no refresh token is stored.
+func (a *App) revokeViaBroker(baseURL string, prof ProfileData) error {
 	body := map[string]string{
+		"provider":        prof.Provider,
+		"token":           prof.RefreshToken,
+		"token_type_hint": "refresh_token",
+	}
+	if prof.RefreshToken == "" {
+		body["token"] = prof.AccessToken
+		body["token_type_hint"] = "access_token"
+	}
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/token/revoke", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.setBrokerKey(req)
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		switch resp.StatusCode {
+		case http.StatusNotImplemented:
+			return errRevokeUnsupported
+		case http.StatusTooManyRequests:
+			return rateLimitedFromResponse(resp, payload)
+		}
+		return fmt.Errorf("broker error: %s", strings.TrimSpace(string(payload)))
+	}
+	return nil
+}
+
+// startAuth starts a flow at the broker, waiting out brief rate limiting.
+func (a *App) startAuth(ctx context.Context, baseURL, provider, profile, redirectURI string) (*startResponse, error) {
+	for attempt := 0; ; attempt++ {
+		out, err := a.startAuthOnce(baseURL, provider, profile, redirectURI)
+		if err == nil || !a.backOff(ctx, err, attempt) {
+			return out, err
+		}
+	}
+}
+
+func (a *App) startAuthOnce(baseURL, provider, profile, redirectURI string) (*startResponse, error) {
+	body := map[string]any{
 		"provider": provider,
 		"profile":  profile,
 	}
+	if redirectURI != "" {
+		body["redirect_uri"] = redirectURI
+	}
+	if len(a.authScopes) > 0 {
+		body["scopes"] = a.authScopes
+	}
 	data, _ := json.Marshal(body)
 	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/auth/start", bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	a.setBrokerKey(req)
 	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -340,6 +1251,12 @@ func (a *App) startAuth(baseURL, provider, profile string) (*startResponse, erro
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
 		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if redirectURI != "" && resp.StatusCode == http.StatusBadRequest && loopbackRejected(payload) {
+			return nil, errLoopbackUnavailable
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, rateLimitedFromResponse(resp, payload)
+		}
 		return nil, fmt.Errorf("broker error: %s", strings.TrimSpace(string(payload)))
 	}
 	var out startResponse
@@ -349,33 +1266,74 @@ func (a *App) startAuth(baseURL, provider, profile string) (*startResponse, erro
 	return &out, nil
 }
 
-func (a *App) pollForTokens(pollURL string) (broker.TokenEnvelope, error) {
+// setBrokerKey attaches the broker API key, if one is configured, to a
+// request for the broker.
+func (a *App) setBrokerKey(req *http.Request) {
+	if a.BrokerAPIKey != "" {
+		req.Header.Set("X-Broker-Key", a.BrokerAPIKey)
+	}
+}
+
+// pollForTokens polls the broker every interval until the session
+// completes. It returns errSessionExpired when the broker reports the
+// session gone, and errConnectTimeout or errConnectInterrupted when ctx
+// ends first.
+func (a *App) pollForTokens(ctx context.Context, pollURL string, interval time.Duration) (broker.TokenEnvelope, error) {
+	limited := 0
 	for {
-		req, err := http.NewRequest(http.MethodGet, pollURL, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pollURL, nil)
 		if err != nil {
 			return broker.TokenEnvelope{}, err
 		}
+		a.setBrokerKey(req)
 		resp, err := a.HTTPClient.Do(req)
 		if err != nil {
+			if aborted := connectAborted(ctx); aborted != nil {
+				return broker.TokenEnvelope{}, aborted
+			}
 			return broker.TokenEnvelope{}, err
 		}
 		if resp.StatusCode >= 400 {
 			payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
 			resp.Body.Close()
+			if resp.StatusCode == http.StatusGone && brokerErrorMessage(payload) == "session expired" {
+				return broker.TokenEnvelope{}, errSessionExpired
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				err := rateLimitedFromResponse(resp, payload)
+				if a.backOff(ctx, err, limited) {
+					limited++
+					continue
+				}
+				if aborted := connectAborted(ctx); aborted != nil {
+					return broker.TokenEnvelope{}, aborted
+				}
+				return broker.TokenEnvelope{}, err
+			}
 			return broker.TokenEnvelope{}, fmt.Errorf("broker error: %s", strings.TrimSpace(string(payload)))
 		}
+		limited = 0
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			if aborted := connectAborted(ctx); aborted != nil {
+				return broker.TokenEnvelope{}, aborted
+			}
+			return broker.TokenEnvelope{}, err
+		}
 		var raw map[string]any
-		if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
-			resp.Body.Close()
+		if err := json.Unmarshal(data, &raw); err != nil {
 			return broker.TokenEnvelope{}, err
 		}
-		resp.Body.Close()
 		if status, ok := raw["status"].(string); ok && status == "pending" {
-			time.Sleep(2 * time.Second)
+			select {
+			case <-ctx.Done():
+				return broker.TokenEnvelope{}, connectAborted(ctx)
+			case <-time.After(interval):
+			}
 			continue
 		}
-		data, err := json.Marshal(raw)
-		if err != nil {
+		if err := a.verifyEnvelope(resp, data); err != nil {
 			return broker.TokenEnvelope{}, err
 		}
 		var env broker.TokenEnvelope
@@ -386,17 +1344,45 @@ func (a *App) pollForTokens(pollURL string) (broker.TokenEnvelope, error) {
 	}
 }
 
+// brokerErrorMessage returns the "error" field of a broker JSON error body,
+// or "" when the body is not one.
+func brokerErrorMessage(payload []byte) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return ""
+	}
+	return body.Error
+}
+
+// refreshViaBroker refreshes prof at the broker, waiting out brief rate
+// limiting. A rate limited refresh is refused before the refresh token is
+// used, so retrying it cannot spend the token twice.
 func (a *App) refreshViaBroker(baseURL string, prof ProfileData) (broker.TokenEnvelope, error) {
+	for attempt := 0; ; attempt++ {
+		env, err := a.refreshViaBrokerOnce(baseURL, prof)
+		if err == nil || !a.backOff(context.Background(), err, attempt) {
+			return env, err
+		}
+	}
+}
+
+func (a *App) refreshViaBrokerOnce(baseURL string, prof ProfileData) (broker.TokenEnvelope, error) {
 	body := map[string]string{
 		"provider":      prof.Provider,
 		"refresh_token": prof.RefreshToken,
 	}
+	if prof.Provider == "qbo" && prof.RealmID != "" {
+		body["realmId"] = prof.RealmID
+	}
 	data, _ := json.Marshal(body)
 	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/token/refresh", bytes.NewReader(data))
 	if err != nil {
 		return broker.TokenEnvelope{}, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	a.setBrokerKey(req)
 	resp, err := a.HTTPClient.Do(req)
 	if err != nil {
 		return broker.TokenEnvelope{}, err
@@ -404,15 +1390,37 @@ func (a *App) refreshViaBroker(baseURL string, prof ProfileData) (broker.TokenEn
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
 		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return broker.TokenEnvelope{}, rateLimitedFromResponse(resp, payload)
+		}
 		return broker.TokenEnvelope{}, fmt.Errorf("broker error: %s", strings.TrimSpace(string(payload)))
 	}
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return broker.TokenEnvelope{}, err
+	}
+	if err := a.verifyEnvelope(resp, data); err != nil {
+		return broker.TokenEnvelope{}, err
+	}
 	var env broker.TokenEnvelope
-	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+	if err := json.Unmarshal(data, &env); err != nil {
 		return broker.TokenEnvelope{}, err
 	}
 	return env, nil
 }
 
+// verifyEnvelope checks the broker's signature on an envelope response when a
+// broker public key is configured.
+func (a *App) verifyEnvelope(resp *http.Response, body []byte) error {
+	if len(a.BrokerPublicKeys) == 0 {
+		return nil
+	}
+	if err := broker.VerifyEnvelopeSignature(a.BrokerPublicKeys, body, resp.Header.Get(broker.SignatureHeader)); err != nil {
+		return fmt.Errorf("broker signature check failed: %w", err)
+	}
+	return nil
+}
+
 func (a *App) refreshXero(prof ProfileData) (broker.TokenEnvelope, error) {
 	clientID := os.Getenv("XERO_CLIENT_ID")
 	if clientID == "" {
@@ -439,28 +1447,76 @@ func (a *App) refreshXero(prof ProfileData) (broker.TokenEnvelope, error) {
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
 		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return broker.TokenEnvelope{}, rateLimitedFromResponse(resp, payload)
+		}
 		return broker.TokenEnvelope{}, fmt.Errorf("xero token error: %s", strings.TrimSpace(string(payload)))
 	}
-	var env broker.TokenEnvelope
-	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+	var payload struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+		TokenType    string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 		return broker.TokenEnvelope{}, err
 	}
-	env.Provider = "xero"
+	env := broker.TokenEnvelope{
+		Provider:     "xero",
+		AccessToken:  payload.AccessToken,
+		RefreshToken: payload.RefreshToken,
+		Scope:        payload.Scope,
+		TokenType:    payload.TokenType,
+	}
+	if payload.ExpiresIn > 0 {
+		env.ExpiresAt = time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second)
+	} else {
+		env.NonExpiring = true
+	}
 	return env, nil
 }
 
-func (a *App) promptForXeroTenant(prof *ProfileData, env broker.TokenEnvelope) error {
+// promptForXeroTenant picks the tenant for prof: the --tenant override, then
+// the saved preference, then an interactive choice. With noPrompt set, an
+// ambiguous choice is an error listing the candidates instead of a prompt.
+func (a *App) promptForXeroTenant(prof *ProfileData, env broker.TokenEnvelope, tenant string, noPrompt bool) error {
 	if len(env.Tenants) == 0 {
 		return errors.New("no tenants returned; connect to an organisation before continuing")
 	}
+	if tenant != "" {
+		t, ok := findTenant(env.Tenants, tenant)
+		if !ok {
+			return fmt.Errorf("tenant %q not found in authorised connections", tenant)
+		}
+		applyTenant(prof, t)
+		return nil
+	}
+	if preferred := a.preferredTenant(prof.Name); prof.Name != "" && preferred != "" {
+		if t, ok := findTenant(env.Tenants, preferred); ok {
+			fmt.Fprintf(a.Stdout, "Using saved tenant preference: %s\n", describeTenant(t.TenantName, t.TenantID))
+			applyTenant(prof, t)
+			return nil
+		}
+	}
+	if noPrompt {
+		if len(env.Tenants) == 1 {
+			applyTenant(prof, env.Tenants[0])
+			return nil
+		}
+		names := make([]string, len(env.Tenants))
+		for i, t := range env.Tenants {
+			names[i] = describeTenant(t.TenantName, t.TenantID)
+		}
+		return fmt.Errorf("multiple tenants authorised; pass --tenant with one of: %s", strings.Join(names, ", "))
+	}
 	fmt.Fprintln(a.Stdout, "Select a Xero tenant:")
 	for i, t := range env.Tenants {
-		fmt.Fprintf(a.Stdout, "  [%d] %s (%s)\n", i+1, t.TenantName, t.TenantID)
+		fmt.Fprintf(a.Stdout, "  [%d] %s\n", i+1, describeTenant(t.TenantName, t.TenantID))
 	}
-	reader := bufio.NewReader(a.Stdin)
 	for {
 		fmt.Fprint(a.Stdout, "Enter number: ")
-		line, err := reader.ReadString('\n')
+		line, err := a.input().ReadString('\n')
 		if err != nil {
 			return err
 		}
@@ -470,14 +1526,72 @@ func (a *App) promptForXeroTenant(prof *ProfileData, env broker.TokenEnvelope) e
 			fmt.Fprintf(a.Stderr, "%v\n", err)
 			continue
 		}
-		tenant := env.Tenants[idx]
-		prof.TenantID = tenant.TenantID
-		prof.TenantName = tenant.TenantName
-		prof.TenantType = tenant.TenantType
+		applyTenant(prof, env.Tenants[idx])
+		if prof.Name == "" {
+			// Saved once the profile has been named.
+			return nil
+		}
+		if err := a.savePreferredTenant(prof.Name, prof.TenantID); err != nil {
+			fmt.Fprintf(a.Stderr, "warning: unable to save tenant preference: %v\n", err)
+		}
 		return nil
 	}
 }
 
+func findTenant(tenants []broker.XeroTenant, idOrName string) (broker.XeroTenant, bool) {
+	for _, t := range tenants {
+		if t.TenantID == idOrName || strings.EqualFold(t.TenantName, idOrName) {
+			return t, true
+		}
+	}
+	return broker.XeroTenant{}, false
+}
+
+// xeroRequiredScopes are the scopes the toolkit needs on an active Xero organisation.
+var xeroRequiredScopes = []string{"accounting.transactions"}
+
+// recordTenantScopes stores the scope granted with an authorisation against
+// each tenant it covered, so tenants authorised separately can be told apart.
+func recordTenantScopes(prof *ProfileData, tenants []broker.XeroTenant, scope string) {
+	if scope == "" {
+		return
+	}
+	if prof.TenantScopes == nil {
+		prof.TenantScopes = make(map[string]string)
+	}
+	for _, t := range tenants {
+		if t.TenantID != "" {
+			prof.TenantScopes[t.TenantID] = scope
+		}
+	}
+}
+
+// missingTenantScopes lists required scopes absent from the active tenant's
+// recorded grant. It returns nil when no grant was recorded.
+func missingTenantScopes(prof ProfileData) []string {
+	granted, ok := prof.TenantScopes[prof.TenantID]
+	if !ok {
+		return nil
+	}
+	have := make(map[string]bool)
+	for _, s := range strings.Fields(granted) {
+		have[s] = true
+	}
+	var missing []string
+	for _, s := range xeroRequiredScopes {
+		if !have[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+func applyTenant(prof *ProfileData, t broker.XeroTenant) {
+	prof.TenantID = t.TenantID
+	prof.TenantName = t.TenantName
+	prof.TenantType = t.TenantType
+}
+
 func parseIndex(input string, max int) (int, error) {
 	i, err := strconv.Atoi(input)
 	if err != nil {
@@ -489,10 +1603,19 @@ func parseIndex(input string, max int) (int, error) {
 	return i - 1, nil
 }
 
+// saveProfile writes prof to the keyring, or to the profile file when one is
+// in use. Every command that stores a profile comes through here, so this is
+// where its name is checked.
 func (a *App) saveProfile(prof ProfileData) error {
 	prof.Provider = strings.ToLower(prof.Provider)
 	prof.Name = strings.TrimSpace(prof.Name)
 	prof.ExpiresAt = prof.ExpiresAt.UTC()
+	if err := validateStoredProfileName(prof.Name); err != nil {
+		return err
+	}
+	if a.profileFile != "" {
+		return writeProfileFile(a.profileFile, prof)
+	}
 	data, err := json.Marshal(prof)
 	if err != nil {
 		return err
@@ -502,6 +1625,9 @@ func (a *App) saveProfile(prof ProfileData) error {
 }
 
 func (a *App) loadProfile(name, provider string) (*ProfileData, error) {
+	if a.profileFile != "" {
+		return readProfileFile(a.profileFile, name, provider)
+	}
 	if name == "" {
 		return nil, errors.New("--profile is required")
 	}
@@ -549,11 +1675,17 @@ func (a *App) printProfileSummary(prof ProfileData) {
 	fmt.Fprintf(a.Stdout, "Connected %s (%s).\n", prof.Name, prof.Provider)
 	switch prof.Provider {
 	case "xero":
-		fmt.Fprintf(a.Stdout, "  Tenant: %s (%s)\n", prof.TenantName, prof.TenantID)
+		fmt.Fprintf(a.Stdout, "  Tenant: %s\n", describeTenant(prof.TenantName, prof.TenantID))
+		a.printOtherTenants(prof, "  ")
 	case "deputy":
 		fmt.Fprintf(a.Stdout, "  Endpoint: %s\n", prof.Endpoint)
 	case "qbo":
 		fmt.Fprintf(a.Stdout, "  Realm ID: %s\n", prof.RealmID)
+		fmt.Fprintf(a.Stdout, "  Environment: %s\n", qboEnvironmentLabel(prof))
+	case "myob":
+		fmt.Fprintf(a.Stdout, "  Company file: %s (%s)\n", prof.CompanyFileName, prof.CompanyFileURI)
+	case "freshbooks":
+		fmt.Fprintf(a.Stdout, "  Business: %s (account %s)\n", prof.BusinessName, prof.AccountID)
 	}
 }
 
@@ -565,19 +1697,57 @@ type startResponse struct {
 
 // ProfileData represents stored profile credentials.
 type ProfileData struct {
-	Name         string         `json:"name"`
-	Provider     string         `json:"provider"`
-	AccessToken  string         `json:"access_token"`
-	RefreshToken string         `json:"refresh_token"`
-	ExpiresAt    time.Time      `json:"expires_at"`
-	Scope        string         `json:"scope,omitempty"`
-	RealmID      string         `json:"realmId,omitempty"`
-	Endpoint     string         `json:"endpoint,omitempty"`
-	TenantID     string         `json:"xero_tenant_id,omitempty"`
-	TenantName   string         `json:"xero_tenant_name,omitempty"`
-	TenantType   string         `json:"xero_tenant_type,omitempty"`
-	TokenType    string         `json:"token_type,omitempty"`
-	Extras       map[string]any `json:"extras,omitempty"`
+	Name         string            `json:"name"`
+	Provider     string            `json:"provider"`
+	AccessToken  string            `json:"access_token"`
+	RefreshToken string            `json:"refresh_token"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+	NonExpiring  bool              `json:"non_expiring,omitempty"`
+	Scope        string            `json:"scope,omitempty"`
+	RealmID      string            `json:"realmId,omitempty"`
+	Environment  string            `json:"qbo_environment,omitempty"`
+	Endpoint     string            `json:"endpoint,omitempty"`
+	TenantID     string            `json:"xero_tenant_id,omitempty"`
+	TenantName   string            `json:"xero_tenant_name,omitempty"`
+	TenantType   string            `json:"xero_tenant_type,omitempty"`
+	TenantScopes map[string]string `json:"xero_tenant_scopes,omitempty"`
+	// Tenants is every Xero organisation the authorisation covers; TenantID
+	// is the active one, switched with "tenant use".
+	Tenants []broker.XeroTenant `json:"xero_tenants,omitempty"`
+	// MYOB: the AccountRight company file the profile targets, and the
+	// x-myobapi-cftoken for its sign-on when the file requires one.
+	CompanyFileURI  string `json:"myob_company_file_uri,omitempty"`
+	CompanyFileName string `json:"myob_company_file_name,omitempty"`
+	CFToken         string `json:"myob_cftoken,omitempty"`
+	// FreshBooks: the account id that addresses the business's API calls.
+	AccountID    string `json:"freshbooks_account_id,omitempty"`
+	BusinessName string `json:"freshbooks_business_name,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	// Subject and Email identify the signed-in user when the broker verified
+	// an OpenID id_token at connect time.
+	Subject string         `json:"id_subject,omitempty"`
+	Email   string         `json:"id_email,omitempty"`
+	Extras  map[string]any `json:"extras,omitempty"`
+	// ConnectedAt is when connect authorised the profile; refreshes keep
+	// it. It is zero for profiles connected before it was recorded.
+	ConnectedAt time.Time `json:"connected_at"`
+	// Tags are free-form labels given with connect --tags.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// parseTags splits a --tags value on commas, dropping blanks and repeats.
+func parseTags(val string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, t := range strings.Split(val, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	return tags
 }
 
 func makeProfileKey(provider, name string) string {
@@ -587,21 +1757,45 @@ func makeProfileKey(provider, name string) string {
 	return fmt.Sprintf("%s:%s", provider, name)
 }
 
-func envelopeToProfile(env broker.TokenEnvelope, profileName string) ProfileData {
-	expires := env.ExpiresAt
-	if expires.IsZero() && env.ExpiresUnix != 0 {
-		expires = time.Unix(env.ExpiresUnix, 0)
+// expiryLabel renders the access token expiry for human-readable output.
+func expiryLabel(prof ProfileData) string {
+	if prof.NonExpiring {
+		return "never"
 	}
+	return prof.ExpiresAt.Format(time.RFC3339)
+}
+
+// secondsUntilExpiry returns the whole seconds left on the access token,
+// negative once it has expired. Non-expiring tokens report math.MaxInt32 so
+// threshold checks in scripts never trigger a refresh; a profile with no
+// recorded expiry reports 0.
+func secondsUntilExpiry(prof ProfileData, now time.Time) int64 {
+	if prof.NonExpiring {
+		return math.MaxInt32
+	}
+	if prof.ExpiresAt.IsZero() {
+		return 0
+	}
+	return int64(math.Floor(prof.ExpiresAt.Sub(now).Seconds()))
+}
+
+func envelopeToProfile(env broker.TokenEnvelope, profileName string) ProfileData {
+	env.NormalizeExpiry()
 	p := ProfileData{
 		Name:         profileName,
 		Provider:     env.Provider,
 		AccessToken:  env.AccessToken,
 		RefreshToken: env.RefreshToken,
-		ExpiresAt:    expires,
+		ExpiresAt:    env.ExpiresAt,
+		NonExpiring:  env.NonExpiring,
 		Scope:        env.Scope,
 		RealmID:      env.RealmID,
+		AccountID:    env.AccountID,
+		Environment:  env.Environment,
 		Endpoint:     env.Endpoint,
 		TokenType:    env.TokenType,
+		Subject:      env.Subject,
+		Email:        env.Email,
 	}
 	if env.Raw != nil {
 		p.Extras = env.Raw
@@ -0,0 +1,416 @@
+package cli
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/99designs/keyring"
+	jose "github.com/dvsekhvalnov/jose2go"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// archiveVersion identifies the layout of the decrypted archive payload.
+const archiveVersion = 1
+
+// archiveFormat marks the file envelope written by writeArchive.
+const archiveFormat = "acct-archive"
+
+// scrypt cost for new archives. The parameters are stored in the envelope,
+// so raising them later does not strand older files.
+const (
+	archiveScryptN = 1 << 15
+	archiveScryptR = 8
+	archiveScryptP = 1
+)
+
+// archiveMaxScryptN bounds the cost a file may ask for, so a crafted
+// archive cannot make restore allocate gigabytes.
+const archiveMaxScryptN = 1 << 20
+
+// archiveEnvelope is the file on disk: the archive encrypted with AES-256-GCM
+// under a key derived from the passphrase with scrypt.
+type archiveEnvelope struct {
+	Format     string `json:"format"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// profileArchive is the plaintext inside an exported archive.
+type profileArchive struct {
+	Manifest archiveManifest `json:"manifest"`
+	Profiles []ProfileData   `json:"profiles"`
+}
+
+type archiveManifest struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Host      string         `json:"host,omitempty"`
+	Entries   []archiveEntry `json:"entries"`
+}
+
+type archiveEntry struct {
+	Key         string     `json:"key"`
+	Provider    string     `json:"provider"`
+	Name        string     `json:"name"`
+	Tags        []string   `json:"tags,omitempty"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+}
+
+func (a *App) runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	all := fs.Bool("all", false, "export every stored profile")
+	out := fs.String("out", "", "archive file to write")
+	passFile := fs.String("passphrase-file", "", "read the archive passphrase from this file instead of prompting")
+	pass := fs.String("passphrase", "", "archive passphrase (visible to other local users and kept in shell history; prefer the prompt or --passphrase-file)")
+	profile := fs.String("profile", "", "print this profile's credentials as environment variables")
+	provider := fs.String("provider", "", "provider name (with --profile)")
+	format := fs.String("format", "", "output for --profile: env, dotenv or json (default env, or json with --json)")
+	noRefresh := fs.Bool("no-refresh", false, "print the stored access token without refreshing it (with --profile)")
+	var secretOut secretOutput
+	secretOut.addFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *profile != "" {
+		if *all || *out != "" || *passFile != "" || *pass != "" {
+			fmt.Fprintln(a.Stderr, "--profile cannot be combined with --all, --out, --passphrase or --passphrase-file")
+			return 1
+		}
+		if *format == "" {
+			*format = "env"
+			if a.jsonOutput {
+				*format = "json"
+			}
+		}
+		return a.exportProfileVars(*profile, *provider, *format, *noRefresh, secretOut)
+	}
+	if !*all {
+		fmt.Fprintln(a.Stderr, "--all or --profile is required")
+		return 1
+	}
+	if *format != "" || *provider != "" || *noRefresh || !secretOut.isStdout() {
+		fmt.Fprintln(a.Stderr, "--format, --provider, --no-refresh, --fd and --output only apply with --profile")
+		return 1
+	}
+	return a.backupProfiles(*out, *pass, *passFile)
+}
+
+// runBackup implements "backup", the name under which export --all is
+// documented for moving to a new machine.
+func (a *App) runBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	out := fs.String("out", "", "archive file to write")
+	passFile := fs.String("passphrase-file", "", "read the archive passphrase from this file instead of prompting")
+	pass := fs.String("passphrase", "", "archive passphrase (visible to other local users and kept in shell history; prefer the prompt or --passphrase-file)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	return a.backupProfiles(*out, *pass, *passFile)
+}
+
+// backupProfiles writes every readable profile to a new archive at out.
+func (a *App) backupProfiles(out, pass, passFile string) int {
+	if out == "" {
+		fmt.Fprintln(a.Stderr, "--out is required")
+		return 1
+	}
+	passphrase, err := a.archivePassphrase(pass, passFile, true)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "passphrase: %v\n", err)
+		return 1
+	}
+	if err := a.ensureKeyringReady(); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to unlock credential store: %v\n", err)
+		return 1
+	}
+	entries, err := a.storedProfiles()
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to enumerate profiles: %v\n", err)
+		return 1
+	}
+
+	archive := profileArchive{Manifest: archiveManifest{Version: archiveVersion, CreatedAt: time.Now().UTC()}}
+	archive.Manifest.Host, _ = os.Hostname()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	for _, e := range entries {
+		if e.Err != nil {
+			fmt.Fprintf(a.Stderr, "skipping %s: %v\n", e.Key, e.Err)
+			continue
+		}
+		archive.Profiles = append(archive.Profiles, e.Profile)
+		entry := archiveEntry{
+			Key:      e.Key,
+			Provider: e.Profile.Provider,
+			Name:     e.Profile.Name,
+			Tags:     e.Profile.Tags,
+		}
+		if !e.Profile.ConnectedAt.IsZero() {
+			connected := e.Profile.ConnectedAt.UTC()
+			entry.ConnectedAt = &connected
+		}
+		archive.Manifest.Entries = append(archive.Manifest.Entries, entry)
+	}
+	if len(archive.Profiles) == 0 {
+		fmt.Fprintln(a.Stderr, "no readable profiles to export")
+		return 1
+	}
+
+	if err := writeArchive(out, archive, passphrase); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to write archive: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(a.Stdout, "Exported %d profiles to %s\n", len(archive.Profiles), out)
+	return 0
+}
+
+// runRestore implements "restore": it decrypts an archive written by backup
+// or export --all and saves each profile to the keyring. Profiles that
+// already exist stop the restore before anything is written, unless force
+// is set, when they are replaced.
+func (a *App) runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	in := fs.String("in", "", "archive file to read")
+	passFile := fs.String("passphrase-file", "", "read the archive passphrase from this file instead of prompting")
+	pass := fs.String("passphrase", "", "archive passphrase (visible to other local users and kept in shell history; prefer the prompt or --passphrase-file)")
+	force := fs.Bool("force", false, "replace profiles that already exist")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *in == "" {
+		fmt.Fprintln(a.Stderr, "--in is required")
+		return 1
+	}
+	passphrase, err := a.archivePassphrase(*pass, *passFile, false)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "passphrase: %v\n", err)
+		return 1
+	}
+	archive, err := readArchive(*in, passphrase)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to read archive: %v\n", err)
+		return 1
+	}
+	if err := a.ensureKeyringReady(); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to unlock credential store: %v\n", err)
+		return 1
+	}
+	var existing []string
+	for _, prof := range archive.Profiles {
+		if err := validateStoredProfileName(strings.TrimSpace(prof.Name)); err != nil {
+			fmt.Fprintf(a.Stderr, "archive holds an invalid profile (%s): %v\nNothing was restored.\n", prof.Provider, err)
+			return 1
+		}
+		_, err := a.Keyring.Get(makeProfileKey(prof.Provider, prof.Name))
+		switch {
+		case err == nil:
+			existing = append(existing, fmt.Sprintf("%s (%s)", prof.Name, prof.Provider))
+		case !errors.Is(err, keyring.ErrKeyNotFound):
+			fmt.Fprintf(a.Stderr, "unable to check for existing profile %s: %v\n", prof.Name, err)
+			return 1
+		}
+	}
+	if len(existing) > 0 && !*force {
+		fmt.Fprintf(a.Stderr, "these profiles already exist: %s\nNothing was restored; re-run with --force to replace them.\n", strings.Join(existing, ", "))
+		return 1
+	}
+	for _, prof := range archive.Profiles {
+		if err := a.saveProfile(prof); err != nil {
+			fmt.Fprintf(a.Stderr, "unable to save profile %s (%s): %v\n", prof.Name, prof.Provider, err)
+			return 1
+		}
+	}
+	fmt.Fprintf(a.Stdout, "Restored %d profiles from %s (created %s", len(archive.Profiles), *in, archive.Manifest.CreatedAt.Format(time.RFC3339))
+	if archive.Manifest.Host != "" {
+		fmt.Fprintf(a.Stdout, " on %s", archive.Manifest.Host)
+	}
+	fmt.Fprintln(a.Stdout, ")")
+	if len(existing) > 0 {
+		fmt.Fprintf(a.Stdout, "Replaced: %s\n", strings.Join(existing, ", "))
+	}
+	return 0
+}
+
+// writeArchive encrypts archive under passphrase and writes it to path,
+// refusing to replace an existing file.
+func writeArchive(path string, archive profileArchive, passphrase string) error {
+	payload, err := json.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	env := archiveEnvelope{
+		Format: archiveFormat,
+		KDF:    "scrypt",
+		N:      archiveScryptN,
+		R:      archiveScryptR,
+		P:      archiveScryptP,
+		Salt:   make([]byte, 16),
+	}
+	if _, err := rand.Read(env.Salt); err != nil {
+		return err
+	}
+	aead, err := archiveCipher(passphrase, env)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return err
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, payload, []byte(archiveFormat))
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// archiveCipher derives the AES-256-GCM key for env from passphrase.
+func archiveCipher(passphrase string, env archiveEnvelope) (cipher.AEAD, error) {
+	if env.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation %q", env.KDF)
+	}
+	if env.N > archiveMaxScryptN || env.R <= 0 || env.P <= 0 || env.R*env.P >= 1<<30 || len(env.Salt) == 0 {
+		return nil, errors.New("unsupported scrypt parameters")
+	}
+	key, err := scrypt.Key([]byte(passphrase), env.Salt, env.N, env.R, env.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readArchive decrypts the archive at path with passphrase. Archives written
+// before the scrypt envelope, as a PBES2 + AES-GCM JWE, are still read. Only
+// these password-based schemes are accepted, so a file cannot pass off
+// unencrypted profiles as a backup.
+func readArchive(path, passphrase string) (profileArchive, error) {
+	var archive profileArchive
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return archive, err
+	}
+	payload, err := decryptArchive(strings.TrimSpace(string(data)), passphrase)
+	if err != nil {
+		return archive, err
+	}
+	if err := json.Unmarshal(payload, &archive); err != nil {
+		return archive, fmt.Errorf("corrupt archive: %w", err)
+	}
+	if archive.Manifest.Version > archiveVersion {
+		return archive, fmt.Errorf("archive version %d is newer than this acct supports (%d)", archive.Manifest.Version, archiveVersion)
+	}
+	for _, prof := range archive.Profiles {
+		if prof.Provider == "" || prof.Name == "" {
+			return archive, errors.New("corrupt archive: profile without a provider or name")
+		}
+	}
+	return archive, nil
+}
+
+func decryptArchive(data, passphrase string) ([]byte, error) {
+	if !strings.HasPrefix(data, "{") {
+		payload, headers, err := jose.Decode(data, passphrase)
+		if err != nil {
+			return nil, errors.New("decryption failed; check the passphrase")
+		}
+		if headers["alg"] != jose.PBES2_HS512_A256KW || headers["enc"] != jose.A256GCM {
+			return nil, fmt.Errorf("unexpected encryption %v/%v", headers["alg"], headers["enc"])
+		}
+		return []byte(payload), nil
+	}
+	var env archiveEnvelope
+	if err := json.Unmarshal([]byte(data), &env); err != nil || env.Format != archiveFormat {
+		return nil, errors.New("not an acct archive")
+	}
+	aead, err := archiveCipher(passphrase, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, errors.New("corrupt archive: bad nonce")
+	}
+	payload, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(archiveFormat))
+	if err != nil {
+		return nil, errors.New("decryption failed; check the passphrase")
+	}
+	return payload, nil
+}
+
+// archivePassphrase returns pass when it was given as a flag, reads the
+// passphrase from file, or prompts for it on the terminal without echo.
+// When confirm is set the prompt asks twice.
+func (a *App) archivePassphrase(pass, file string, confirm bool) (string, error) {
+	if pass != "" && file != "" {
+		return "", errors.New("use --passphrase or --passphrase-file, not both")
+	}
+	if pass != "" {
+		return pass, nil
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		pass = strings.TrimRight(string(data), "\r\n")
+		if pass == "" {
+			return "", errors.New("passphrase file is empty")
+		}
+		return pass, nil
+	}
+	f, ok := a.Stdin.(*os.File)
+	if !ok || !term.IsTerminal(int(f.Fd())) {
+		return "", errors.New("no terminal to prompt on; use --passphrase-file or --passphrase")
+	}
+	fmt.Fprint(a.Stderr, "Archive passphrase: ")
+	typed, err := term.ReadPassword(int(f.Fd()))
+	fmt.Fprintln(a.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(typed) == 0 {
+		return "", errors.New("passphrase must not be empty")
+	}
+	if confirm {
+		fmt.Fprint(a.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(a.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(typed) {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+	return string(typed), nil
+}
@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/keyring"
+	jose "github.com/dvsekhvalnov/jose2go"
+)
+
+// archiveTestApp returns an App over an in-memory keyring holding profs.
+func archiveTestApp(t *testing.T, profs ...ProfileData) (*App, *bytes.Buffer) {
+	t.Helper()
+	var errb bytes.Buffer
+	a := &App{ConfigDir: t.TempDir(), Stdout: &bytes.Buffer{}, Stderr: &errb, Stdin: strings.NewReader(""), Keyring: keyring.NewArrayKeyring(nil)}
+	for _, prof := range profs {
+		if err := a.saveProfile(prof); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a, &errb
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	profs := []ProfileData{
+		{Provider: "xero", Name: "acme", AccessToken: "xero-access-secret", RefreshToken: "xero-refresh", TenantID: "t1", ExpiresAt: time.Now().Add(time.Hour).UTC().Truncate(time.Second)},
+		{Provider: "qbo", Name: "books", AccessToken: "qbo-access-secret", RealmID: "r1"},
+	}
+	src, errb := archiveTestApp(t, profs...)
+	path := filepath.Join(t.TempDir(), "profiles.acct")
+	if code := src.runBackup([]string{"--out", path, "--passphrase", "correct horse"}); code != 0 {
+		t.Fatalf("backup failed: %s", errb)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "access-secret") {
+		t.Fatal("archive holds a token in the clear")
+	}
+	var env archiveEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatalf("archive is not a JSON envelope: %v", err)
+	}
+	if env.Format != archiveFormat || env.KDF != "scrypt" || len(env.Salt) == 0 {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("archive mode %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+	if code := src.runBackup([]string{"--out", path, "--passphrase", "correct horse"}); code == 0 {
+		t.Fatal("backup replaced an existing archive")
+	}
+
+	dst, errb := archiveTestApp(t)
+	if code := dst.runRestore([]string{"--in", path, "--passphrase", "wrong"}); code == 0 {
+		t.Fatal("restore with the wrong passphrase succeeded")
+	}
+	if keys, _ := dst.Keyring.Keys(); len(keys) != 0 {
+		t.Fatalf("failed restore wrote %v", keys)
+	}
+	if code := dst.runRestore([]string{"--in", path, "--passphrase", "correct horse"}); code != 0 {
+		t.Fatalf("restore failed: %s", errb)
+	}
+	for _, want := range profs {
+		got, err := dst.loadProfile(want.Name, want.Provider)
+		if err != nil {
+			t.Fatalf("%s not restored: %v", want.Name, err)
+		}
+		if got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken || !got.ExpiresAt.Equal(want.ExpiresAt) {
+			t.Errorf("restored %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestRestoreRefusesExistingProfiles(t *testing.T) {
+	src, errb := archiveTestApp(t, ProfileData{Provider: "xero", Name: "acme", AccessToken: "from-archive"})
+	path := filepath.Join(t.TempDir(), "profiles.acct")
+	if code := src.runBackup([]string{"--out", path, "--passphrase", "pass"}); code != 0 {
+		t.Fatalf("backup failed: %s", errb)
+	}
+
+	dst, errb := archiveTestApp(t, ProfileData{Provider: "xero", Name: "acme", AccessToken: "local"})
+	if code := dst.runRestore([]string{"--in", path, "--passphrase", "pass"}); code == 0 {
+		t.Fatal("restore over an existing profile succeeded without --force")
+	}
+	if !strings.Contains(errb.String(), "acme (xero)") {
+		t.Errorf("error does not name the existing profile: %q", errb)
+	}
+	if got, _ := dst.loadProfile("acme", "xero"); got == nil || got.AccessToken != "local" {
+		t.Fatalf("existing profile changed without --force: %+v", got)
+	}
+	if code := dst.runRestore([]string{"--in", path, "--passphrase", "pass", "--force"}); code != 0 {
+		t.Fatalf("restore --force failed: %s", errb)
+	}
+	if got, _ := dst.loadProfile("acme", "xero"); got == nil || got.AccessToken != "from-archive" {
+		t.Fatalf("--force did not replace the profile: %+v", got)
+	}
+}
+
+func TestRestoreReadsJWEArchive(t *testing.T) {
+	archive := profileArchive{
+		Manifest: archiveManifest{Version: 1, CreatedAt: time.Now().UTC()},
+		Profiles: []ProfileData{{Provider: "deputy", Name: "shop", AccessToken: "a", Endpoint: "shop.au.deputy.com"}},
+	}
+	payload, _ := json.Marshal(archive)
+	token, err := jose.Encrypt(string(payload), jose.PBES2_HS512_A256KW, jose.A256GCM, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "old.jwe")
+	if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, errb := archiveTestApp(t)
+	if code := a.runRestore([]string{"--in", path, "--passphrase", "pass"}); code != 0 {
+		t.Fatalf("restore of a JWE archive failed: %s", errb)
+	}
+	if _, err := a.loadProfile("shop", "deputy"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchivePassphraseSources(t *testing.T) {
+	a, _ := archiveTestApp(t)
+	file := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(file, []byte("from file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.archivePassphrase("", file, true); err != nil || got != "from file" {
+		t.Errorf("from file: got %q, %v", got, err)
+	}
+	if got, err := a.archivePassphrase("flag", "", true); err != nil || got != "flag" {
+		t.Errorf("from flag: got %q, %v", got, err)
+	}
+	if _, err := a.archivePassphrase("flag", file, false); err == nil {
+		t.Error("both --passphrase and --passphrase-file accepted")
+	}
+	if _, err := a.archivePassphrase("", "", false); err == nil {
+		t.Error("prompted without a terminal")
+	}
+}
+
+func TestRestoreRejectsInvalidProfileNames(t *testing.T) {
+	archive := profileArchive{
+		Manifest: archiveManifest{Version: 1, CreatedAt: time.Now().UTC()},
+		Profiles: []ProfileData{
+			{Provider: "xero", Name: "good", AccessToken: "a"},
+			{Provider: "xero", Name: "bad:name", AccessToken: "b"},
+		},
+	}
+	payload, _ := json.Marshal(archive)
+	token, err := jose.Encrypt(string(payload), jose.PBES2_HS512_A256KW, jose.A256GCM, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bad.jwe")
+	if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, errb := archiveTestApp(t)
+	if code := a.runRestore([]string{"--in", path, "--passphrase", "pass"}); code == 0 {
+		t.Fatal("restore of an invalid profile name succeeded")
+	}
+	if !strings.Contains(errb.String(), `"bad:name"`) {
+		t.Errorf("error does not name the profile: %q", errb)
+	}
+	if keys, _ := a.Keyring.Keys(); len(keys) != 0 {
+		t.Fatalf("rejected restore wrote %v", keys)
+	}
+}
+
+func TestBackupManifestRecordsMetadata(t *testing.T) {
+	connected := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	src, errb := archiveTestApp(t,
+		ProfileData{Provider: "xero", Name: "acme", AccessToken: "a", ConnectedAt: connected, Tags: []string{"client", "monthly"}},
+		ProfileData{Provider: "qbo", Name: "legacy", AccessToken: "b"},
+	)
+	path := filepath.Join(t.TempDir(), "profiles.acct")
+	if code := src.runBackup([]string{"--out", path, "--passphrase", "correct horse"}); code != 0 {
+		t.Fatalf("backup failed: %s", errb)
+	}
+	archive, err := readArchive(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]archiveEntry{}
+	for _, e := range archive.Manifest.Entries {
+		entries[e.Name] = e
+	}
+	acme := entries["acme"]
+	if acme.ConnectedAt == nil || !acme.ConnectedAt.Equal(connected) || strings.Join(acme.Tags, ",") != "client,monthly" {
+		t.Fatalf("manifest entry %+v, want connected_at and tags", acme)
+	}
+	if legacy := entries["legacy"]; legacy.ConnectedAt != nil || legacy.Tags != nil {
+		t.Fatalf("manifest entry %+v, want no metadata for a profile without any", legacy)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                      "",
+		"client":                "client",
+		" client , monthly,,":   "client,monthly",
+		"client,monthly,client": "client,monthly",
+	} {
+		if got := strings.Join(parseTags(in), ","); got != want {
+			t.Errorf("parseTags(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
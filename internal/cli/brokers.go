@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// cliConfig is the user-editable settings file in ConfigDir.
+type cliConfig struct {
+	// Brokers maps an alias to a broker base URL.
+	Brokers map[string]string `json:"brokers,omitempty"`
+}
+
+func (a *App) configPath() string {
+	return filepath.Join(a.ConfigDir, "config.json")
+}
+
+func (a *App) loadConfig() (cliConfig, error) {
+	var cfg cliConfig
+	data, err := os.ReadFile(a.configPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", a.configPath(), err)
+	}
+	return cfg, nil
+}
+
+func (a *App) saveConfig(cfg cliConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.ConfigDir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(a.configPath(), data, 0o600)
+}
+
+// resolveBrokerAlias returns the URL saved under alias.
+func (a *App) resolveBrokerAlias(alias string) (string, error) {
+	cfg, err := a.loadConfig()
+	if err != nil {
+		return "", err
+	}
+	u, ok := cfg.Brokers[strings.ToLower(alias)]
+	if !ok {
+		return "", fmt.Errorf("unknown broker alias %q (see 'acct broker list')", alias)
+	}
+	return u, nil
+}
+
+func (a *App) runBroker(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(a.Stderr, "usage: broker add NAME URL | broker list | broker remove NAME")
+		return 1
+	}
+	cfg, err := a.loadConfig()
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to read config: %v\n", err)
+		return 1
+	}
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("broker add", flag.ContinueOnError)
+		fs.SetOutput(a.Stderr)
+		if err := fs.Parse(args[1:]); err != nil {
+			return 1
+		}
+		if fs.NArg() != 2 {
+			fmt.Fprintln(a.Stderr, "usage: broker add NAME URL")
+			return 1
+		}
+		name := strings.ToLower(fs.Arg(0))
+		u, err := url.Parse(fs.Arg(1))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			fmt.Fprintf(a.Stderr, "invalid broker URL %q\n", fs.Arg(1))
+			return 1
+		}
+		if cfg.Brokers == nil {
+			cfg.Brokers = make(map[string]string)
+		}
+		cfg.Brokers[name] = strings.TrimRight(u.String(), "/")
+		if err := a.saveConfig(cfg); err != nil {
+			fmt.Fprintf(a.Stderr, "unable to save config: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(a.Stdout, "Broker %s -> %s saved.\n", name, cfg.Brokers[name])
+		return 0
+	case "list":
+		if len(cfg.Brokers) == 0 {
+			fmt.Fprintln(a.Stdout, "No broker aliases.")
+			return 0
+		}
+		names := make([]string, 0, len(cfg.Brokers))
+		for name := range cfg.Brokers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(a.Stdout, "  %s\t%s\n", name, cfg.Brokers[name])
+		}
+		return 0
+	case "remove":
+		if len(args) != 2 {
+			fmt.Fprintln(a.Stderr, "usage: broker remove NAME")
+			return 1
+		}
+		name := strings.ToLower(args[1])
+		if _, ok := cfg.Brokers[name]; !ok {
+			fmt.Fprintf(a.Stderr, "no broker alias %q\n", name)
+			return 1
+		}
+		delete(cfg.Brokers, name)
+		if err := a.saveConfig(cfg); err != nil {
+			fmt.Fprintf(a.Stderr, "unable to save config: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(a.Stdout, "Broker %s removed.\n", name)
+		return 0
+	default:
+		fmt.Fprintf(a.Stderr, "unknown broker subcommand %q\n", args[0])
+		return 1
+	}
+}
@@ -0,0 +1,262 @@
+package cli
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+// completionCommands lists each command with the flags it accepts, for
+// shell completion. The commands build their flag sets as they run, so this
+// table must be kept in step with them.
+var completionCommands = []struct {
+	name  string
+	flags []string
+}{
+	{"connect", []string{"profile", "broker", "tenant", "no-tenant-prompt", "force", "local-callback", "resume", "refresh-token", "realm",
+		"company-file", "cf-user", "account", "save-to-file", "timeout", "poll-interval", "retry-on-expire", "scopes-from-profile"}},
+	{"list", []string{"stale"}},
+	{"status", []string{"check", "warn-within", "json"}},
+	{"whoami", []string{"profile", "provider", "profile-file", "all", "json", "show-secrets", "probe", "live", "expires-in", "no-refresh"}},
+	{"refresh", []string{"profile", "provider", "profile-file", "broker", "stdout", "allow-unsafe", "org-name", "clear-missing-tenant", "all", "only-expiring"}},
+	{"revoke", []string{"profile", "provider", "broker", "local-only"}},
+	{"disconnect", []string{"profile", "broker"}},
+	{"rename", []string{"provider", "old-name", "new-name"}},
+	{"export", []string{"all", "out", "passphrase", "passphrase-file", "profile", "provider", "format", "no-refresh", "fd", "output"}},
+	{"backup", []string{"out", "passphrase", "passphrase-file"}},
+	{"restore", []string{"in", "passphrase", "passphrase-file", "force"}},
+	{"token", []string{"profile", "provider", "profile-file", "no-refresh", "fd", "output"}},
+	{"tenant", []string{"profile", "tenant-id", "profile-file"}},
+	{"tenants", []string{"profile", "profile-file", "diff", "json"}},
+	{"broker", nil},
+	{"completion", nil},
+	{"help", nil},
+}
+
+// runCompletion prints the completion script for a shell.
+func (a *App) runCompletion(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(a.Stderr, "usage: completion bash|zsh|fish")
+		return 1
+	}
+	script, ok := map[string]string{"bash": bashCompletion, "zsh": zshCompletion, "fish": fishCompletion}[args[0]]
+	if !ok {
+		fmt.Fprintf(a.Stderr, "unsupported shell %q; use bash, zsh or fish\n", args[0])
+		return 1
+	}
+	fmt.Fprint(a.Stdout, script)
+	return 0
+}
+
+// runComplete answers the completion scripts' queries, one candidate per
+// line. It is not listed in the usage, and prints nothing rather than an
+// error, since its output lands on the user's command line.
+//
+//	__complete commands
+//	__complete flags CMD
+//	__complete args CMD
+//	__complete profiles | providers | brokers
+func (a *App) runComplete(args []string) int {
+	if len(args) == 0 {
+		return 1
+	}
+	var words []string
+	switch args[0] {
+	case "commands":
+		for _, c := range completionCommands {
+			words = append(words, c.name)
+		}
+	case "flags":
+		if len(args) == 2 {
+			for _, c := range completionCommands {
+				if c.name == args[1] {
+					for _, f := range c.flags {
+						words = append(words, "--"+f)
+					}
+				}
+			}
+		}
+	case "args":
+		if len(args) == 2 {
+			words = append(words, a.completeArgs(args[1])...)
+		}
+	case "profiles":
+		for _, key := range a.profileKeys() {
+			if _, name, ok := splitProfileKey(key); ok && !slices.Contains(words, name) {
+				words = append(words, name)
+			}
+		}
+	case "providers":
+		words = append(words, broker.KnownProviders...)
+		for _, key := range a.profileKeys() {
+			if provider, _, ok := splitProfileKey(key); ok && !slices.Contains(words, provider) {
+				words = append(words, provider)
+			}
+		}
+	case "brokers":
+		if cfg, err := a.loadConfig(); err == nil {
+			for name := range cfg.Brokers {
+				words = append(words, name)
+			}
+		}
+	}
+	slices.Sort(words)
+	for _, w := range words {
+		fmt.Fprintln(a.Stdout, w)
+	}
+	return 0
+}
+
+// completeArgs returns the positional words a command takes.
+func (a *App) completeArgs(cmd string) []string {
+	switch cmd {
+	case "connect":
+		return broker.KnownProviders
+	case "tenant":
+		return []string{"use"}
+	case "broker":
+		return []string{"add", "list", "remove"}
+	case "completion":
+		return []string{"bash", "fish", "zsh"}
+	}
+	return nil
+}
+
+// profileKeys lists the keyring keys without reading any item, so that
+// completion never waits on a backend asking to be unlocked.
+func (a *App) profileKeys() []string {
+	if a.Keyring == nil {
+		return nil
+	}
+	keys, err := a.Keyring.Keys()
+	if err != nil {
+		return nil
+	}
+	return keys
+}
+
+// splitProfileKey undoes makeProfileKey. Custom providers carry their own
+// colon, as in "custom:acme:books".
+func splitProfileKey(key string) (provider, name string, ok bool) {
+	rest := key
+	prefix := ""
+	if strings.HasPrefix(key, "custom:") {
+		prefix, rest = "custom:", strings.TrimPrefix(key, "custom:")
+	}
+	provider, name, ok = strings.Cut(rest, ":")
+	if !ok || provider == "" || name == "" {
+		return "", "", false
+	}
+	return prefix + provider, name, true
+}
+
+// The scripts ask the binary itself, through __complete, for commands,
+// flags and stored profile names, so they never go stale.
+
+const bashCompletion = `# bash completion for acct
+# Load with: source <(acct completion bash)
+_acct() {
+    local cur prev cmd i
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local acct="${COMP_WORDS[0]}"
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        case "${COMP_WORDS[i]}" in
+            --broker-alias) ((i++)) ;;
+            -*) ;;
+            *) cmd="${COMP_WORDS[i]}"; break ;;
+        esac
+    done
+    case "$prev" in
+        --profile|--scopes-from-profile|--old-name)
+            COMPREPLY=($(compgen -W "$("$acct" __complete profiles 2>/dev/null)" -- "$cur")); return ;;
+        --provider)
+            COMPREPLY=($(compgen -W "$("$acct" __complete providers 2>/dev/null)" -- "$cur")); return ;;
+        --broker-alias)
+            COMPREPLY=($(compgen -W "$("$acct" __complete brokers 2>/dev/null)" -- "$cur")); return ;;
+        --profile-file|--save-to-file|--in|--out|--output|--passphrase-file)
+            COMPREPLY=($(compgen -f -- "$cur")); return ;;
+    esac
+    if [[ -z "$cmd" ]]; then
+        COMPREPLY=($(compgen -W "$("$acct" __complete commands 2>/dev/null) --json --broker-alias" -- "$cur"))
+    elif [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "$("$acct" __complete flags "$cmd" 2>/dev/null)" -- "$cur"))
+    else
+        COMPREPLY=($(compgen -W "$("$acct" __complete args "$cmd" 2>/dev/null)" -- "$cur"))
+    fi
+}
+complete -F _acct acct
+`
+
+const zshCompletion = `#compdef acct
+# zsh completion for acct
+# Load with: source <(acct completion zsh), after compinit
+_acct() {
+    local acct=${words[1]} cmd i
+    local -a candidates
+    for ((i = 2; i < CURRENT; i++)); do
+        case ${words[i]} in
+            --broker-alias) ((i++)) ;;
+            -*) ;;
+            *) cmd=${words[i]}; break ;;
+        esac
+    done
+    case ${words[CURRENT-1]} in
+        --profile|--scopes-from-profile|--old-name)
+            candidates=(${(f)"$($acct __complete profiles 2>/dev/null)"}) ;;
+        --provider)
+            candidates=(${(f)"$($acct __complete providers 2>/dev/null)"}) ;;
+        --broker-alias)
+            candidates=(${(f)"$($acct __complete brokers 2>/dev/null)"}) ;;
+        --profile-file|--save-to-file|--in|--out|--output|--passphrase-file)
+            _files; return ;;
+        *)
+            if [[ -z $cmd ]]; then
+                candidates=(${(f)"$($acct __complete commands 2>/dev/null)"} --json --broker-alias)
+            elif [[ ${words[CURRENT]} == -* ]]; then
+                candidates=(${(f)"$($acct __complete flags $cmd 2>/dev/null)"})
+            else
+                candidates=(${(f)"$($acct __complete args $cmd 2>/dev/null)"})
+            fi ;;
+    esac
+    compadd -a candidates
+}
+compdef _acct acct
+`
+
+const fishCompletion = `# fish completion for acct
+# Load with: acct completion fish | source
+# or save to ~/.config/fish/completions/acct.fish
+function __acct_command
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    while set -q tokens[1]
+        switch $tokens[1]
+            case --broker-alias
+                set -e tokens[1]
+            case '-*'
+            case '*'
+                echo $tokens[1]
+                return 0
+        end
+        set -e tokens[1]
+    end
+    return 1
+end
+
+function __acct_previous
+    set -l tokens (commandline -opc)
+    echo $tokens[-1]
+end
+
+complete -c acct -f
+complete -c acct -n 'not __acct_command >/dev/null; and not contains -- (__acct_previous) --broker-alias' -a '(acct __complete commands) --json --broker-alias'
+complete -c acct -n '__acct_command >/dev/null; and not string match -q -- "-*" (commandline -ct) (__acct_previous)' -a '(acct __complete args (__acct_command))'
+complete -c acct -n '__acct_command >/dev/null; and string match -q -- "-*" (commandline -ct)' -a '(acct __complete flags (__acct_command))'
+complete -c acct -n 'contains -- (__acct_previous) --profile --scopes-from-profile --old-name' -x -a '(acct __complete profiles)'
+complete -c acct -n 'contains -- (__acct_previous) --provider' -x -a '(acct __complete providers)'
+complete -c acct -n 'contains -- (__acct_previous) --broker-alias' -x -a '(acct __complete brokers)'
+complete -c acct -n 'contains -- (__acct_previous) --profile-file --save-to-file --in --out --output --passphrase-file' -F
+`
@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/99designs/keyring"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+// runDisconnect removes every organisation connection a Xero profile holds
+// from the user's Xero account through the broker, then forgets the profile.
+// Revoking the token alone leaves the organisations listed under the app's
+// connections. If a disconnect fails, the profile is kept with the tenants
+// that are still connected, so the command can be run again.
+func (a *App) runDisconnect(args []string) int {
+	fs := flag.NewFlagSet("disconnect", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	profile := fs.String("profile", "", "profile name")
+	brokerURL := fs.String("broker", "", "override broker base URL")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	prof, err := a.loadProfile(*profile, "xero")
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to load profile: %v\n", err)
+		return 1
+	}
+	tenants := prof.Tenants
+	if len(tenants) == 0 && prof.TenantID != "" {
+		tenants = []broker.XeroTenant{{TenantID: prof.TenantID, TenantName: prof.TenantName}}
+	}
+	if len(tenants) == 0 {
+		fmt.Fprintf(a.Stderr, "profile %s has no tenants to disconnect\n", prof.Name)
+		return 1
+	}
+	fresh, err := a.ensureFreshToken(*prof)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to refresh profile: %v\n", err)
+		return 1
+	}
+	baseURL := a.BrokerBaseURL
+	if *brokerURL != "" {
+		baseURL = strings.TrimRight(*brokerURL, "/")
+	}
+	for i, t := range tenants {
+		if err := a.disconnectViaBroker(baseURL, fresh.AccessToken, t); err != nil {
+			fmt.Fprintf(a.Stderr, "disconnect of %s failed: %v\n", describeTenant(t.TenantName, t.TenantID), err)
+			if i > 0 {
+				a.keepConnectedTenants(fresh, tenants[i:])
+			}
+			return 1
+		}
+		fmt.Fprintf(a.Stdout, "Disconnected %s from Xero.\n", describeTenant(t.TenantName, t.TenantID))
+	}
+	if err := a.Keyring.Remove(makeProfileKey("xero", fresh.Name)); err != nil && !errors.Is(err, keyring.ErrKeyNotFound) {
+		fmt.Fprintf(a.Stderr, "unable to remove profile: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(a.Stdout, "Removed stored credentials for %s (xero).\n", fresh.Name)
+	return 0
+}
+
+// keepConnectedTenants saves prof with only the tenants that are still
+// connected, moving the active tenant to the first of them if its own
+// connection was removed.
+func (a *App) keepConnectedTenants(prof ProfileData, connected []broker.XeroTenant) {
+	prof.Tenants = connected
+	if _, ok := findTenant(connected, prof.TenantID); !ok {
+		applyTenant(&prof, connected[0])
+	}
+	if err := a.saveProfile(prof); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to update profile: %v\n", err)
+		return
+	}
+	fmt.Fprintf(a.Stderr, "Profile %s kept with the %d tenant(s) still connected.\n", prof.Name, len(connected))
+}
+
+// disconnectViaBroker asks the broker to delete the Xero connection for
+// tenant. The connection id comes from the stored tenant list when it is
+// there; otherwise the broker looks it up by tenant id.
+func (a *App) disconnectViaBroker(baseURL, accessToken string, tenant broker.XeroTenant) error {
+	body := map[string]string{
+		"access_token": accessToken,
+		"tenant_id":    tenant.TenantID,
+	}
+	if tenant.ID != "" {
+		body["connection_id"] = tenant.ID
+	}
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/xero/disconnect", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.setBrokerKey(req)
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return rateLimitedFromResponse(resp, payload)
+		}
+		return fmt.Errorf("broker error: %s", strings.TrimSpace(string(payload)))
+	}
+	return nil
+}
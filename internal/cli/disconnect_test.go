@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/keyring"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+func disconnectTestApp(t *testing.T, srv *brokertest.Server, prof ProfileData) (*App, *bytes.Buffer) {
+	t.Helper()
+	a, errb := archiveTestApp(t, prof)
+	a.BrokerBaseURL = srv.URL
+	a.HTTPClient = http.DefaultClient
+	return a, errb
+}
+
+func TestDisconnectRemovesEveryTenant(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	a, errb := disconnectTestApp(t, srv, ProfileData{
+		Provider:    "xero",
+		Name:        "acme",
+		AccessToken: "brokertest-access-1",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		TenantID:    "t1",
+		TenantName:  "Acme Ltd",
+		Tenants: []broker.XeroTenant{
+			{ID: "c1", TenantID: "t1", TenantName: "Acme Ltd"},
+			{ID: "c2", TenantID: "t2", TenantName: "Acme Holdings"},
+		},
+	})
+	if code := a.runDisconnect([]string{"--profile", "acme"}); code != 0 {
+		t.Fatalf("disconnect failed: %s", errb)
+	}
+	if got := srv.Upstream.Disconnected(); !slices.Equal(got, []string{"c1", "c2"}) {
+		t.Fatalf("disconnected %v, want both connections", got)
+	}
+	if _, err := a.Keyring.Get(makeProfileKey("xero", "acme")); err != keyring.ErrKeyNotFound {
+		t.Fatalf("profile still stored: %v", err)
+	}
+}
+
+func TestDisconnectFailureKeepsProfile(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	srv.Upstream.FailTokens(http.StatusInternalServerError, `{"error":"outage"}`)
+	a, errb := disconnectTestApp(t, srv, ProfileData{
+		Provider:    "xero",
+		Name:        "acme",
+		AccessToken: "brokertest-access-1",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		TenantID:    "t1",
+		Tenants:     []broker.XeroTenant{{ID: "c1", TenantID: "t1"}, {ID: "c2", TenantID: "t2"}},
+	})
+	if code := a.runDisconnect([]string{"--profile", "acme"}); code == 0 {
+		t.Fatal("disconnect succeeded against a failing provider")
+	}
+	if !strings.Contains(errb.String(), "disconnect of t1 (name unavailable) failed") {
+		t.Errorf("unexpected stderr %q", errb)
+	}
+	if got := srv.Upstream.Disconnected(); len(got) != 0 {
+		t.Fatalf("disconnected %v", got)
+	}
+	prof, err := a.loadProfile("acme", "xero")
+	if err != nil {
+		t.Fatalf("profile removed after a failed disconnect: %v", err)
+	}
+	if len(prof.Tenants) != 2 {
+		t.Fatalf("tenants %+v, want both kept", prof.Tenants)
+	}
+}
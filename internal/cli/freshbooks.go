@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+// selectFreshBooksAccount picks the FreshBooks business the profile will
+// use: the --account choice (an account id or business name), the only
+// business returned, or an interactive choice. An account id the broker
+// already resolved is kept unless --account overrides it.
+func (a *App) selectFreshBooksAccount(prof *ProfileData, businesses []broker.FreshBooksBusiness, choice string, noPrompt bool) error {
+	if choice != "" {
+		if b, ok := findBusiness(businesses, choice); ok {
+			applyBusiness(prof, b)
+			return nil
+		}
+		if len(businesses) == 0 {
+			// Adopted refresh tokens come without the business list.
+			prof.AccountID = choice
+			return nil
+		}
+		return fmt.Errorf("account %q not found among the user's businesses", choice)
+	}
+	if prof.AccountID != "" {
+		if b, ok := findBusiness(businesses, prof.AccountID); ok {
+			applyBusiness(prof, b)
+		}
+		return nil
+	}
+	if len(businesses) == 0 {
+		return errors.New("no businesses returned; pass --account with the FreshBooks account id")
+	}
+	if len(businesses) == 1 {
+		applyBusiness(prof, businesses[0])
+		return nil
+	}
+	if noPrompt {
+		names := make([]string, len(businesses))
+		for i, b := range businesses {
+			names[i] = fmt.Sprintf("%s (%s)", b.Name, b.AccountID)
+		}
+		return fmt.Errorf("multiple businesses available; pass --account with one of: %s", strings.Join(names, ", "))
+	}
+	fmt.Fprintln(a.Stdout, "Select a FreshBooks business:")
+	for i, b := range businesses {
+		fmt.Fprintf(a.Stdout, "  [%d] %s (%s)\n", i+1, b.Name, b.AccountID)
+	}
+	for {
+		fmt.Fprint(a.Stdout, "Enter number: ")
+		line, err := a.input().ReadString('\n')
+		if err != nil {
+			return err
+		}
+		idx, err := parseIndex(strings.TrimSpace(line), len(businesses))
+		if err != nil {
+			fmt.Fprintf(a.Stderr, "%v\n", err)
+			continue
+		}
+		applyBusiness(prof, businesses[idx])
+		return nil
+	}
+}
+
+func findBusiness(businesses []broker.FreshBooksBusiness, idOrName string) (broker.FreshBooksBusiness, bool) {
+	for _, b := range businesses {
+		if b.AccountID == idOrName || strings.EqualFold(b.Name, idOrName) {
+			return b, true
+		}
+	}
+	return broker.FreshBooksBusiness{}, false
+}
+
+func applyBusiness(prof *ProfileData, b broker.FreshBooksBusiness) {
+	prof.AccountID = b.AccountID
+	prof.BusinessName = b.Name
+}
@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errTokenRejected is returned by liveOrganisation when the provider turns
+// down the access token, which only a reconnect can fix once refreshing has
+// not helped.
+var errTokenRejected = errors.New("the provider rejected the access token")
+
+// liveOrganisation asks the provider which business prof's token reaches:
+// the Xero organisation, QuickBooks company, Deputy install or FreshBooks
+// business, by name. Profiles store only ids for some of these, and stored
+// names go stale when a business is renamed.
+func (a *App) liveOrganisation(prof ProfileData) (string, error) {
+	switch prof.Provider {
+	case "xero":
+		if prof.TenantID == "" {
+			return "", errors.New("no tenant id stored")
+		}
+		tenants, err := a.fetchXeroTenants(prof.AccessToken)
+		if err != nil {
+			return "", err
+		}
+		t, ok := findTenant(tenants, prof.TenantID)
+		if !ok {
+			return "", fmt.Errorf("organisation %s is no longer connected", prof.TenantID)
+		}
+		return t.Label(), nil
+	case "qbo":
+		if prof.RealmID == "" {
+			return "", errors.New("no realm id stored")
+		}
+		var out struct {
+			CompanyInfo struct {
+				CompanyName string `json:"CompanyName"`
+				LegalName   string `json:"LegalName"`
+			} `json:"CompanyInfo"`
+		}
+		target := fmt.Sprintf("%s/v3/company/%s/companyinfo/%s", qboAPIBaseURL(prof), prof.RealmID, prof.RealmID)
+		if err := a.getProviderJSON(prof, target, &out); err != nil {
+			return "", err
+		}
+		if out.CompanyInfo.CompanyName == "" {
+			return out.CompanyInfo.LegalName, nil
+		}
+		return out.CompanyInfo.CompanyName, nil
+	case "deputy":
+		if prof.Endpoint == "" {
+			return "", errors.New("no endpoint stored")
+		}
+		var companies []struct {
+			CompanyName string `json:"CompanyName"`
+			Active      bool   `json:"Active"`
+		}
+		if err := a.getProviderJSON(prof, deputyBaseURL(prof.Endpoint)+"/api/v1/resource/Company", &companies); err != nil {
+			return "", err
+		}
+		// An install holds one company per location; name the first active.
+		for _, c := range companies {
+			if c.Active && c.CompanyName != "" {
+				return c.CompanyName, nil
+			}
+		}
+		if len(companies) > 0 {
+			return companies[0].CompanyName, nil
+		}
+		return "", errors.New("the install reports no companies")
+	case "freshbooks":
+		var out struct {
+			Response struct {
+				BusinessMemberships []struct {
+					Business struct {
+						AccountID string `json:"account_id"`
+						Name      string `json:"name"`
+					} `json:"business"`
+				} `json:"business_memberships"`
+			} `json:"response"`
+		}
+		if err := a.getProviderJSON(prof, freshBooksAPIBaseURL+"/auth/api/v1/users/me", &out); err != nil {
+			return "", err
+		}
+		for _, m := range out.Response.BusinessMemberships {
+			if m.Business.AccountID == prof.AccountID {
+				return m.Business.Name, nil
+			}
+		}
+		return "", fmt.Errorf("account %s is not among the user's businesses", prof.AccountID)
+	default:
+		return "", fmt.Errorf("no organisation lookup for %s", prof.Provider)
+	}
+}
+
+// getProviderJSON fetches target with prof's access token and decodes the
+// JSON response into v.
+func (a *App) getProviderJSON(prof ProfileData, target string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+prof.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w (%d)", errTokenRejected, resp.StatusCode)
+	}
+	if resp.StatusCode >= 400 {
+		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("provider returned %d: %s", resp.StatusCode, strings.TrimSpace(string(payload)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// liveOrganisationHint explains a failed lookup, suggesting a reconnect
+// when the token itself was refused.
+func liveOrganisationHint(prof ProfileData, err error) string {
+	if errors.Is(err, errTokenRejected) {
+		return fmt.Sprintf("%v; run acct connect %s --profile %s to authorise again", err, prof.Provider, prof.Name)
+	}
+	return err.Error()
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestLiveOrganisationXero(t *testing.T) {
+	connections := `[
+		{"id":"c1","tenantId":"named","tenantName":"Acme Ltd","tenantType":"ORGANISATION"},
+		{"id":"c2","tenantId":"pending","tenantName":"","tenantType":"ORGANISATION"},
+		{"id":"c3","tenantId":"","tenantName":"Broken"}
+	]`
+	tests := []struct {
+		tenant  string
+		token   string
+		want    string
+		wantErr error
+	}{
+		{tenant: "named", token: "ok", want: "Acme Ltd"},
+		{tenant: "pending", token: "ok", want: "pending (name unavailable)"},
+		{tenant: "gone", token: "ok"},
+		{tenant: "named", token: "rejected", wantErr: errTokenRejected},
+	}
+	for _, tt := range tests {
+		var paths []string
+		a := newTestApp(t, func(r *http.Request) (*http.Response, error) {
+			paths = append(paths, r.URL.String())
+			if r.Header.Get("Authorization") == "Bearer rejected" {
+				return reply(http.StatusUnauthorized, `{"error":"invalid_token"}`), nil
+			}
+			return reply(http.StatusOK, connections), nil
+		})
+		prof := ProfileData{Provider: "xero", Name: "acme", AccessToken: tt.token, TenantID: tt.tenant}
+		got, err := a.liveOrganisation(prof)
+		switch {
+		case tt.wantErr != nil:
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error = %v, want %v", tt.tenant, err, tt.wantErr)
+			}
+		case tt.want == "":
+			if err == nil {
+				t.Errorf("%s: got %q, want an error for a disconnected tenant", tt.tenant, got)
+			}
+		case err != nil || got != tt.want:
+			t.Errorf("%s: got %q, %v; want %q", tt.tenant, got, err, tt.want)
+		}
+		if len(paths) != 1 || paths[0] != xeroAPIBaseURL+"/connections" {
+			t.Errorf("%s: requested %v", tt.tenant, paths)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// profileJSON is the stable machine-readable view of a profile used by
+// --json output. It never carries tokens.
+type profileJSON struct {
+	Key         string       `json:"key,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	Provider    string       `json:"provider,omitempty"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+	NonExpiring bool         `json:"non_expiring,omitempty"`
+	Expired     bool         `json:"expired"`
+	Scope       string       `json:"scope,omitempty"`
+	Subject     string       `json:"subject,omitempty"`
+	Email       string       `json:"email,omitempty"`
+	TenantID    string       `json:"tenant_id,omitempty"`
+	TenantName  string       `json:"tenant_name,omitempty"`
+	Tenants     []tenantJSON `json:"tenants,omitempty"`
+	RealmID     string       `json:"realm_id,omitempty"`
+	Environment string       `json:"environment,omitempty"`
+	Endpoint    string       `json:"endpoint,omitempty"`
+	CompanyFile string       `json:"company_file,omitempty"`
+	CompanyURI  string       `json:"company_file_uri,omitempty"`
+	AccountID   string       `json:"account_id,omitempty"`
+	Business    string       `json:"business,omitempty"`
+	Stale       string       `json:"stale,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+func newProfileJSON(prof ProfileData) profileJSON {
+	out := profileJSON{
+		Name:        prof.Name,
+		Provider:    prof.Provider,
+		NonExpiring: prof.NonExpiring,
+		Expired:     isExpired(prof),
+		Scope:       prof.Scope,
+		Subject:     prof.Subject,
+		Email:       prof.Email,
+	}
+	if !prof.NonExpiring && !prof.ExpiresAt.IsZero() {
+		t := prof.ExpiresAt.UTC()
+		out.ExpiresAt = &t
+	}
+	switch prof.Provider {
+	case "xero":
+		out.TenantID = prof.TenantID
+		out.TenantName = prof.TenantName
+		out.Tenants = profileTenants(prof)
+	case "qbo":
+		out.RealmID = prof.RealmID
+		out.Environment = qboEnvironment(prof)
+	case "deputy":
+		out.Endpoint = prof.Endpoint
+	case "myob":
+		out.CompanyFile = prof.CompanyFileName
+		out.CompanyURI = prof.CompanyFileURI
+	case "freshbooks":
+		out.AccountID = prof.AccountID
+		out.Business = prof.BusinessName
+	}
+	return out
+}
+
+// whoAmIJSON writes a single profile, plus the live check when probe is set
+// and the provider's organisation name when live is.
+func (a *App) whoAmIJSON(prof ProfileData, probe, live bool) int {
+	type liveCheck struct {
+		OK       bool     `json:"ok"`
+		Error    string   `json:"error,omitempty"`
+		Warnings []string `json:"warnings,omitempty"`
+	}
+	type liveOrganisation struct {
+		Name  string `json:"name,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+	out := struct {
+		profileJSON
+		LiveOrganisation *liveOrganisation `json:"live_organisation,omitempty"`
+		LiveCheck        *liveCheck        `json:"live_check,omitempty"`
+	}{profileJSON: newProfileJSON(prof)}
+	code := 0
+	if live {
+		name, err := a.liveOrganisation(prof)
+		out.LiveOrganisation = &liveOrganisation{Name: name}
+		if err != nil {
+			out.LiveOrganisation.Error = liveOrganisationHint(prof, err)
+			code = 1
+		}
+	}
+	if probe {
+		err := a.probeProfile(prof)
+		out.LiveCheck = &liveCheck{OK: err == nil, Warnings: a.probeWarnings(prof, err)}
+		if err != nil {
+			out.LiveCheck.Error = err.Error()
+			code = 1
+		}
+	}
+	if c := a.writeJSON(out); c != 0 {
+		return c
+	}
+	return code
+}
+
+// writeJSON emits v as the command's JSON result.
+func (a *App) writeJSON(v any) int {
+	enc := json.NewEncoder(a.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to encode output: %v\n", err)
+		return 1
+	}
+	a.wroteJSON = true
+	return 0
+}
+
+// runJSONMode runs a command with its diagnostics copied aside as they are
+// written to Stderr, so prompts and progress still appear while it runs. If
+// the command fails without writing a JSON result, the copy is also reported
+// on Stdout as {"error": "..."}.
+func (a *App) runJSONMode(run func() int) int {
+	stderr := a.Stderr
+	var captured bytes.Buffer
+	a.Stderr = io.MultiWriter(stderr, &captured)
+	code := run()
+	a.Stderr = stderr
+	if code == 0 || a.wroteJSON {
+		return code
+	}
+	msg := strings.TrimSpace(captured.String())
+	if msg == "" {
+		msg = "command failed"
+	}
+	a.writeJSON(map[string]string{"error": msg})
+	return code
+}
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestJSONModeStreamsStderr(t *testing.T) {
+	var out, errb bytes.Buffer
+	a := &App{Stdout: &out, Stderr: &errb}
+	code := a.runJSONMode(func() int {
+		fmt.Fprint(a.Stderr, "Archive passphrase: ")
+		if !strings.Contains(errb.String(), "Archive passphrase: ") {
+			t.Error("prompt was held back until the command finished")
+		}
+		fmt.Fprintln(a.Stderr, "unable to load profile: not found")
+		return 1
+	})
+	if code != 1 {
+		t.Fatalf("exit code %d, want 1", code)
+	}
+	want := `"error": "Archive passphrase: unable to load profile: not found"`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("stdout %q lacks %s", out.String(), want)
+	}
+
+	out.Reset()
+	errb.Reset()
+	a = &App{Stdout: &out, Stderr: &errb}
+	a.runJSONMode(func() int {
+		fmt.Fprintln(a.Stderr, "Unlocking credential store...")
+		return a.writeJSON([]string{})
+	})
+	if errb.String() != "Unlocking credential store...\n" {
+		t.Errorf("stderr %q, want the progress line once", errb.String())
+	}
+	if strings.Contains(out.String(), "error") {
+		t.Errorf("successful command reported an error: %q", out.String())
+	}
+}
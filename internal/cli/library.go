@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadProfile reads a stored profile, as the commands' --profile and
+// --provider flags do. An empty provider is detected from the name.
+func (a *App) LoadProfile(name, provider string) (ProfileData, error) {
+	prof, err := a.loadProfile(name, provider)
+	if err != nil {
+		return ProfileData{}, err
+	}
+	return *prof, nil
+}
+
+// RefreshProfile refreshes prof through its provider's refresh path and
+// saves the result over the stored profile, as acct refresh does, returning
+// the refreshed copy.
+func (a *App) RefreshProfile(prof ProfileData) (ProfileData, error) {
+	if prof.Provider == "xero" && os.Getenv("XERO_CLIENT_ID") == "" {
+		return prof, errors.New("xero tokens are refreshed locally; XERO_CLIENT_ID must be set")
+	}
+	_, updated, err := a.fetchRefreshed(a.BrokerBaseURL, prof)
+	if err != nil {
+		return prof, fmt.Errorf("refresh failed: %w", err)
+	}
+	if err := a.storeRefreshed(prof, updated); err != nil {
+		return prof, fmt.Errorf("unable to save refreshed credentials: %w", err)
+	}
+	return updated, nil
+}
+
+// APIBaseURL returns the base URL of the provider API prof's access token is
+// for: the QuickBooks host for its environment, the Deputy install, the MYOB
+// company file, or the fixed Xero and FreshBooks hosts. Custom providers
+// have none the broker knows of.
+func APIBaseURL(prof ProfileData) (string, error) {
+	switch prof.Provider {
+	case "xero":
+		return xeroAPIBaseURL, nil
+	case "qbo":
+		return qboAPIBaseURL(prof), nil
+	case "deputy":
+		if prof.Endpoint == "" {
+			return "", errors.New("no endpoint stored")
+		}
+		return deputyBaseURL(prof.Endpoint), nil
+	case "freshbooks":
+		return freshBooksAPIBaseURL, nil
+	case "myob":
+		if prof.CompanyFileURI == "" {
+			return "", errors.New("no company file stored")
+		}
+		return strings.TrimRight(prof.CompanyFileURI, "/"), nil
+	default:
+		if strings.HasPrefix(prof.Provider, "custom:") {
+			return "", fmt.Errorf("no API endpoint is known for %s; the broker only configures its OAuth endpoints", prof.Provider)
+		}
+		return "", fmt.Errorf("unsupported provider %s", prof.Provider)
+	}
+}
@@ -0,0 +1,177 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/browser"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+// localCallbackTimeout bounds how long connect --local-callback waits for the
+// browser to come back.
+const localCallbackTimeout = 10 * time.Minute
+
+// errLoopbackUnavailable means the local callback flow cannot be used and
+// the caller should fall back to broker polling.
+var errLoopbackUnavailable = errors.New("the broker does not accept a loopback redirect for this provider")
+
+// callbackResult is what the loopback listener caught from the browser.
+type callbackResult struct {
+	code       string
+	realmID    string
+	businessID string
+	err        error
+}
+
+// loopbackRejected reports whether an auth-start error body means the broker
+// refused the loopback redirect, including brokers too old to know the field.
+func loopbackRejected(payload []byte) bool {
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return false
+	}
+	return body.Code == "loopback_unsupported" || strings.Contains(body.Error, `unknown field "redirect_uri"`)
+}
+
+// localCallbackAuthorise runs the browser flow with the provider redirecting
+// to a listener on 127.0.0.1, then hands the code to the broker to exchange.
+// It returns errLoopbackUnavailable when the flow cannot start. The wait for
+// the browser ends after localCallbackTimeout, or sooner when ctx does.
+func (a *App) localCallbackAuthorise(ctx context.Context, baseURL, provider, startProfile string) (broker.TokenEnvelope, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return broker.TokenEnvelope{}, fmt.Errorf("%w (unable to listen locally: %v)", errLoopbackUnavailable, err)
+	}
+	redirectURI := "http://" + ln.Addr().String() + "/callback"
+
+	startResp, err := a.startAuth(ctx, baseURL, provider, startProfile, redirectURI)
+	if err != nil {
+		ln.Close()
+		if errors.Is(err, errLoopbackUnavailable) {
+			return broker.TokenEnvelope{}, err
+		}
+		return broker.TokenEnvelope{}, fmt.Errorf("start auth failed: %w", err)
+	}
+	authURL, err := url.Parse(startResp.AuthURL)
+	if err != nil {
+		ln.Close()
+		return broker.TokenEnvelope{}, fmt.Errorf("invalid auth URL from broker: %w", err)
+	}
+	state := authURL.Query().Get("state")
+
+	results := make(chan callbackResult, 1)
+	srv := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/callback" {
+				http.NotFound(w, r)
+				return
+			}
+			q := r.URL.Query()
+			if q.Get("state") != state {
+				http.Error(w, "state mismatch", http.StatusBadRequest)
+				return
+			}
+			res := callbackResult{code: q.Get("code"), realmID: q.Get("realmId"), businessID: q.Get("businessId")}
+			if e := q.Get("error"); e != "" {
+				res.err = fmt.Errorf("%s: %s", e, q.Get("error_description"))
+				fmt.Fprintln(w, "Authorisation failed. You can close this window and check the terminal.")
+			} else if res.code == "" {
+				res.err = errors.New("callback carried no authorisation code")
+				fmt.Fprintln(w, "Authorisation failed. You can close this window and check the terminal.")
+			} else {
+				fmt.Fprintln(w, "Authorisation received. You can close this window and return to the terminal.")
+			}
+			select {
+			case results <- res:
+			default:
+			}
+		}),
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	fmt.Fprintf(a.Stdout, "Opening browser for %s authorisation...\n", provider)
+	if err := browser.OpenURL(startResp.AuthURL); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to open browser automatically: %v\n", err)
+		fmt.Fprintf(a.Stdout, "Please open this URL manually:\n%s\n", startResp.AuthURL)
+	}
+	fmt.Fprintf(a.Stdout, "Waiting for the browser on %s...\n", redirectURI)
+
+	var res callbackResult
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		return broker.TokenEnvelope{}, connectAborted(ctx)
+	case <-time.After(localCallbackTimeout):
+		return broker.TokenEnvelope{}, errors.New("authorisation failed: timed out waiting for the browser callback")
+	}
+	if res.err != nil {
+		return broker.TokenEnvelope{}, fmt.Errorf("authorisation failed: %w", res.err)
+	}
+
+	envelope, err := a.exchangeViaBroker(baseURL, startResp.Session, state, res)
+	if err != nil {
+		return broker.TokenEnvelope{}, fmt.Errorf("authorisation failed: %w", err)
+	}
+	return envelope, nil
+}
+
+// exchangeViaBroker forwards a loopback authorisation code to the broker,
+// which holds the client secret and PKCE verifier, and returns the tokens.
+func (a *App) exchangeViaBroker(baseURL, session, state string, res callbackResult) (broker.TokenEnvelope, error) {
+	body := map[string]string{
+		"session":  session,
+		"state":    state,
+		"code":     res.code,
+		"realm_id": res.realmID,
+	}
+	if res.businessID != "" {
+		body["business_id"] = res.businessID
+	}
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/v1/auth/exchange", bytes.NewReader(data))
+	if err != nil {
+		return broker.TokenEnvelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.setBrokerKey(req)
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return broker.TokenEnvelope{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return broker.TokenEnvelope{}, rateLimitedFromResponse(resp, payload)
+		}
+		return broker.TokenEnvelope{}, fmt.Errorf("broker error: %s", strings.TrimSpace(string(payload)))
+	}
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return broker.TokenEnvelope{}, err
+	}
+	if err := a.verifyEnvelope(resp, data); err != nil {
+		return broker.TokenEnvelope{}, err
+	}
+	var env broker.TokenEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return broker.TokenEnvelope{}, err
+	}
+	return env, nil
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+	"golang.org/x/term"
+)
+
+// selectMYOBCompanyFile picks the AccountRight company file the profile will
+// use: the --company-file choice (an id, name or full URI), the only file
+// returned, or an interactive choice. With noPrompt set, an ambiguous choice
+// is an error listing the candidates instead of a prompt.
+func (a *App) selectMYOBCompanyFile(prof *ProfileData, files []broker.MYOBCompanyFile, choice string, noPrompt bool) error {
+	if choice != "" {
+		if f, ok := findCompanyFile(files, choice); ok {
+			applyCompanyFile(prof, f)
+			return nil
+		}
+		if strings.HasPrefix(choice, "https://") {
+			prof.CompanyFileURI = strings.TrimRight(choice, "/")
+			return nil
+		}
+		return fmt.Errorf("company file %q not found among those the token can reach", choice)
+	}
+	if len(files) == 0 {
+		return errors.New("no company files returned; pass --company-file with the company file URI")
+	}
+	if len(files) == 1 {
+		applyCompanyFile(prof, files[0])
+		return nil
+	}
+	if noPrompt {
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = fmt.Sprintf("%s (%s)", f.Name, f.ID)
+		}
+		return fmt.Errorf("multiple company files available; pass --company-file with one of: %s", strings.Join(names, ", "))
+	}
+	fmt.Fprintln(a.Stdout, "Select a MYOB company file:")
+	for i, f := range files {
+		fmt.Fprintf(a.Stdout, "  [%d] %s (%s)\n", i+1, f.Name, f.ID)
+	}
+	for {
+		fmt.Fprint(a.Stdout, "Enter number: ")
+		line, err := a.input().ReadString('\n')
+		if err != nil {
+			return err
+		}
+		idx, err := parseIndex(strings.TrimSpace(line), len(files))
+		if err != nil {
+			fmt.Fprintf(a.Stderr, "%v\n", err)
+			continue
+		}
+		applyCompanyFile(prof, files[idx])
+		return nil
+	}
+}
+
+func findCompanyFile(files []broker.MYOBCompanyFile, idOrName string) (broker.MYOBCompanyFile, bool) {
+	for _, f := range files {
+		if strings.EqualFold(f.ID, idOrName) || strings.EqualFold(f.Name, idOrName) || f.URI == strings.TrimRight(idOrName, "/") {
+			return f, true
+		}
+	}
+	return broker.MYOBCompanyFile{}, false
+}
+
+func applyCompanyFile(prof *ProfileData, f broker.MYOBCompanyFile) {
+	prof.CompanyFileURI = strings.TrimRight(f.URI, "/")
+	prof.CompanyFileName = f.Name
+}
+
+// myobCFToken builds the x-myobapi-cftoken header value for the company
+// file sign-on user, reading the password from MYOB_CF_PASSWORD or a prompt.
+// The token is the base64 of "user:password", as AccountRight expects.
+func (a *App) myobCFToken(user string) (string, error) {
+	pass, ok := os.LookupEnv("MYOB_CF_PASSWORD")
+	if !ok {
+		f, isFile := a.Stdin.(*os.File)
+		if !isFile || !term.IsTerminal(int(f.Fd())) {
+			return "", errors.New("no terminal to prompt on; set MYOB_CF_PASSWORD")
+		}
+		fmt.Fprintf(a.Stderr, "Company file password for %s: ", user)
+		b, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(a.Stderr)
+		if err != nil {
+			return "", err
+		}
+		pass = string(b)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass)), nil
+}
+
+// myobAPIKey returns the broker's MYOB client id, which AccountRight API
+// calls must send as x-myobapi-key.
+func myobAPIKey() (string, error) {
+	key := os.Getenv("MYOB_API_KEY")
+	if key == "" {
+		return "", errors.New("MYOB API calls need the broker's MYOB client id; export MYOB_API_KEY")
+	}
+	return key, nil
+}
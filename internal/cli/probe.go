@@ -0,0 +1,318 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeCacheTTL bounds how long a live check result is reused.
+const probeCacheTTL = 5 * time.Minute
+
+type probeResult struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// probeProfile makes a lightweight authenticated call to the provider API to
+// confirm the stored access token is still accepted.
+func (a *App) probeProfile(prof ProfileData) error {
+	var target string
+	switch prof.Provider {
+	case "xero":
+		target = xeroAPIBaseURL + "/connections"
+	case "qbo":
+		if prof.RealmID == "" {
+			return fmt.Errorf("no realm id stored")
+		}
+		target = fmt.Sprintf("%s/v3/company/%s/companyinfo/%s", qboAPIBaseURL(prof), prof.RealmID, prof.RealmID)
+	case "deputy":
+		if prof.Endpoint == "" {
+			return fmt.Errorf("no endpoint stored")
+		}
+		target = deputyBaseURL(prof.Endpoint) + "/api/v1/me"
+	case "freshbooks":
+		target = freshBooksAPIBaseURL + "/auth/api/v1/users/me"
+	case "myob":
+		if prof.CompanyFileURI == "" {
+			return fmt.Errorf("no company file stored")
+		}
+		target = prof.CompanyFileURI
+	default:
+		if strings.HasPrefix(prof.Provider, "custom:") {
+			return fmt.Errorf("no API endpoint is known for %s; the broker only configures its OAuth endpoints", prof.Provider)
+		}
+		return fmt.Errorf("unsupported provider %s", prof.Provider)
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if prof.Provider == "myob" {
+		key, err := myobAPIKey()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("x-myobapi-key", key)
+		req.Header.Set("x-myobapi-version", "v2")
+		if prof.CFToken != "" {
+			req.Header.Set("x-myobapi-cftoken", prof.CFToken)
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+prof.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		payload, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("provider returned %d: %s", resp.StatusCode, strings.TrimSpace(string(payload)))
+	}
+	return nil
+}
+
+const xeroAPIBaseURL = "https://api.xero.com"
+
+const freshBooksAPIBaseURL = "https://api.freshbooks.com"
+
+// qboEnvironment returns the QuickBooks environment prof's token belongs to:
+// the one recorded at connect, else QBO_ENVIRONMENT, else production.
+func qboEnvironment(prof ProfileData) string {
+	if prof.Environment != "" {
+		return prof.Environment
+	}
+	if env := strings.ToLower(os.Getenv("QBO_ENVIRONMENT")); env != "" {
+		return env
+	}
+	return "production"
+}
+
+// qboEnvironmentLabel renders qboEnvironment, flagging profiles connected
+// before the environment was recorded.
+func qboEnvironmentLabel(prof ProfileData) string {
+	if prof.Environment == "" {
+		return qboEnvironment(prof) + " (assumed; not recorded at connect)"
+	}
+	return prof.Environment
+}
+
+func qboAPIBaseURL(prof ProfileData) string {
+	return qboAPIBaseURLFor(qboEnvironment(prof))
+}
+
+func qboAPIBaseURLFor(environment string) string {
+	if environment == "sandbox" {
+		return "https://sandbox-quickbooks.api.intuit.com"
+	}
+	return "https://quickbooks.api.intuit.com"
+}
+
+// qboCompanyInfoStatus fetches the realm's company info from the given
+// environment's API and returns the HTTP status.
+func (a *App) qboCompanyInfoStatus(prof ProfileData, environment string) (int, error) {
+	target := fmt.Sprintf("%s/v3/company/%s/companyinfo/%s", qboAPIBaseURLFor(environment), prof.RealmID, prof.RealmID)
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+prof.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// qboEnvironmentMismatch returns the other QuickBooks environment when the
+// realm is rejected by its own environment's API but answers on the other,
+// and "" when that cannot be shown.
+func (a *App) qboEnvironmentMismatch(prof ProfileData) string {
+	if prof.RealmID == "" || prof.AccessToken == "" {
+		return ""
+	}
+	env := qboEnvironment(prof)
+	other := "sandbox"
+	if env == "sandbox" {
+		other = "production"
+	}
+	status, err := a.qboCompanyInfoStatus(prof, env)
+	if err != nil || status < 400 {
+		return ""
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+	default:
+		return ""
+	}
+	if status, err := a.qboCompanyInfoStatus(prof, other); err != nil || status >= 400 {
+		return ""
+	}
+	return other
+}
+
+// checkQBOEnvironment records which QuickBooks environment a new profile
+// belongs to and warns when the token looks like it is for the other one.
+func (a *App) checkQBOEnvironment(prof *ProfileData) {
+	expected := strings.ToLower(os.Getenv("QBO_ENVIRONMENT"))
+	if prof.Environment == "" {
+		prof.Environment = expected
+	} else if expected != "" && expected != prof.Environment {
+		fmt.Fprintf(a.Stderr, "warning: QBO_ENVIRONMENT is %s but the broker issued this token for %s; API calls will use %s\n", expected, prof.Environment, prof.Environment)
+	}
+	if other := a.qboEnvironmentMismatch(*prof); other != "" {
+		fmt.Fprintf(a.Stderr, "warning: realm %s is rejected by the %s API but answers on %s; the broker's QBO_ENVIRONMENT is probably wrong and API calls will fail with 401\n", prof.RealmID, qboEnvironment(*prof), other)
+	}
+}
+
+func deputyBaseURL(endpoint string) string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "https://" + endpoint
+	}
+	return endpoint
+}
+
+func (a *App) probeCachePath() string {
+	return filepath.Join(a.ConfigDir, "probe-cache.json")
+}
+
+// probeCacheKey ties a cached result to the access token it checked so a
+// refreshed token is always probed afresh.
+func probeCacheKey(prof ProfileData) string {
+	sum := sha256.Sum256([]byte(prof.AccessToken))
+	return makeProfileKey(prof.Provider, prof.Name) + ":" + hex.EncodeToString(sum[:8])
+}
+
+// probeProfiles checks each profile concurrently, reusing recent results.
+func (a *App) probeProfiles(profiles []ProfileData) map[string]error {
+	cache := make(map[string]probeResult)
+	if data, err := os.ReadFile(a.probeCachePath()); err == nil {
+		_ = json.Unmarshal(data, &cache)
+	}
+
+	// Cached results are filled in before any probe starts, so that only the
+	// probes touch results and cache while they run.
+	results := make(map[string]error, len(profiles))
+	var pending []ProfileData
+	for _, prof := range profiles {
+		key := probeCacheKey(prof)
+		if cached, ok := cache[key]; ok && time.Since(cached.CheckedAt) < probeCacheTTL {
+			if cached.Error != "" {
+				results[key] = fmt.Errorf("%s", cached.Error)
+			} else {
+				results[key] = nil
+			}
+			continue
+		}
+		pending = append(pending, prof)
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, prof := range pending {
+		wg.Add(1)
+		go func(prof ProfileData, key string) {
+			defer wg.Done()
+			err := a.probeProfile(prof)
+			mu.Lock()
+			defer mu.Unlock()
+			results[key] = err
+			res := probeResult{CheckedAt: time.Now()}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			cache[key] = res
+		}(prof, probeCacheKey(prof))
+	}
+	wg.Wait()
+
+	for k, v := range cache {
+		if time.Since(v.CheckedAt) >= probeCacheTTL {
+			delete(cache, k)
+		}
+	}
+	if data, err := json.Marshal(cache); err == nil {
+		if err := os.MkdirAll(a.ConfigDir, 0o700); err == nil {
+			_ = os.WriteFile(a.probeCachePath(), data, 0o600)
+		}
+	}
+	return results
+}
+
+// listStale prints profiles whose tokens are expired or rejected by the
+// provider, returning a non-zero exit code if any are found.
+func (a *App) listStale(entries []storedProfile) int {
+	var candidates []ProfileData
+	for _, e := range entries {
+		if e.Err != nil {
+			fmt.Fprintf(a.Stderr, "  %s: %v\n", e.Key, e.Err)
+			continue
+		}
+		candidates = append(candidates, e.Profile)
+	}
+	var live []ProfileData
+	for _, prof := range candidates {
+		if !isExpired(prof) {
+			live = append(live, prof)
+		}
+	}
+	results := a.probeProfiles(live)
+
+	if a.jsonOutput {
+		list := make([]profileJSON, 0)
+		for _, prof := range candidates {
+			entry := newProfileJSON(prof)
+			switch {
+			case isExpired(prof):
+				entry.Stale = "expired"
+			case results[probeCacheKey(prof)] != nil:
+				entry.Stale = "live_check_failed"
+				entry.Error = results[probeCacheKey(prof)].Error()
+			default:
+				continue
+			}
+			list = append(list, entry)
+		}
+		if code := a.writeJSON(list); code != 0 || len(list) == 0 {
+			return code
+		}
+		return 1
+	}
+
+	var stale []string
+	for _, prof := range candidates {
+		switch {
+		case isExpired(prof):
+			stale = append(stale, fmt.Sprintf("  %s (%s) – expired %s", prof.Name, prof.Provider, expiryLabel(prof)))
+		case results[probeCacheKey(prof)] != nil:
+			stale = append(stale, fmt.Sprintf("  %s (%s) – live check failed: %v", prof.Name, prof.Provider, results[probeCacheKey(prof)]))
+		}
+	}
+	if len(stale) == 0 {
+		fmt.Fprintln(a.Stdout, "No stale profiles.")
+		return 0
+	}
+	fmt.Fprintf(a.Stdout, "Stale profiles (%d):\n", len(stale))
+	for _, line := range stale {
+		fmt.Fprintln(a.Stdout, line)
+	}
+	return 1
+}
+
+func isExpired(prof ProfileData) bool {
+	return !prof.NonExpiring && time.Now().After(prof.ExpiresAt)
+}
@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc lets a test stand in for provider APIs without a listener.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func reply(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// newTestApp returns an App with a private config directory whose HTTP
+// requests are answered by fn.
+func newTestApp(t *testing.T, fn roundTripFunc) *App {
+	t.Helper()
+	return &App{
+		ConfigDir:  t.TempDir(),
+		HTTPClient: &http.Client{Transport: fn},
+		Stdout:     io.Discard,
+		Stderr:     io.Discard,
+	}
+}
+
+func TestProbeProfilesMixesCachedAndLiveResults(t *testing.T) {
+	a := newTestApp(t, func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("Authorization") == "Bearer rejected" {
+			return reply(http.StatusUnauthorized, `{"error":"invalid_token"}`), nil
+		}
+		return reply(http.StatusOK, `[]`), nil
+	})
+
+	var profiles []ProfileData
+	for i := 0; i < 8; i++ {
+		profiles = append(profiles, ProfileData{Provider: "xero", Name: fmt.Sprintf("live-%d", i), AccessToken: fmt.Sprintf("token-%d", i)})
+	}
+	rejected := ProfileData{Provider: "xero", Name: "rejected", AccessToken: "rejected"}
+	cachedOK := ProfileData{Provider: "xero", Name: "cached-ok", AccessToken: "cached-ok"}
+	cachedBad := ProfileData{Provider: "xero", Name: "cached-bad", AccessToken: "cached-bad"}
+	profiles = append(profiles, rejected, cachedOK, cachedBad)
+
+	cache := map[string]probeResult{
+		probeCacheKey(cachedOK):  {CheckedAt: time.Now()},
+		probeCacheKey(cachedBad): {CheckedAt: time.Now(), Error: "provider returned 401"},
+	}
+	data, _ := json.Marshal(cache)
+	if err := os.WriteFile(a.probeCachePath(), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	results := a.probeProfiles(profiles)
+	if len(results) != len(profiles) {
+		t.Fatalf("got %d results for %d profiles", len(results), len(profiles))
+	}
+	for _, prof := range profiles {
+		err, ok := results[probeCacheKey(prof)]
+		switch {
+		case !ok:
+			t.Errorf("%s: no result", prof.Name)
+		case prof.Name == "rejected" || prof.Name == "cached-bad":
+			if err == nil {
+				t.Errorf("%s: want an error", prof.Name)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", prof.Name, err)
+		}
+	}
+
+	// Every probe lands in the cache, so a second run makes no requests.
+	a.HTTPClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request to %s", r.URL)
+		return reply(http.StatusOK, `[]`), nil
+	})
+	if again := a.probeProfiles(profiles); len(again) != len(profiles) {
+		t.Fatalf("got %d cached results for %d profiles", len(again), len(profiles))
+	}
+}
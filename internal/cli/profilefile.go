@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// addProfileFileFlag registers --profile-file, which makes a command read
+// (and, after a refresh, rewrite) a profile saved with connect --save-to-file
+// instead of the keyring.
+func (a *App) addProfileFileFlag(fs *flag.FlagSet) {
+	fs.StringVar(&a.profileFile, "profile-file", "", "use the profile JSON at this path (from connect --save-to-file) instead of the keyring")
+}
+
+// warnProfileFile reminds the user that a profile file holds live tokens in
+// plain JSON.
+func (a *App) warnProfileFile() {
+	fmt.Fprintf(a.Stderr, "warning: %s holds the tokens unencrypted; keep it out of version control and logs.\n", a.profileFile)
+}
+
+// readProfileFile loads the profile stored at path. A name or provider, when
+// given, must match the stored one.
+func readProfileFile(path, name, provider string) (*ProfileData, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prof ProfileData
+	if err := json.Unmarshal(data, &prof); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if name != "" && !strings.EqualFold(prof.Name, name) {
+		return nil, fmt.Errorf("%s holds profile %s, not %s", path, prof.Name, name)
+	}
+	if provider != "" && !strings.EqualFold(prof.Provider, provider) {
+		return nil, fmt.Errorf("%s holds a %s profile, not %s", path, prof.Provider, provider)
+	}
+	return &prof, nil
+}
+
+// writeProfileFile saves prof to path with mode 0600. The file is replaced
+// by rename, so a failed write never loses a rotated refresh token that the
+// old file no longer matches.
+func writeProfileFile(path string, prof ProfileData) error {
+	data, err := json.MarshalIndent(prof, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".acct-profile-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
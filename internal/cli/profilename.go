@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// input returns a reader over Stdin shared by every prompt, so input typed
+// ahead for a later prompt is not lost in an earlier prompt's buffer.
+func (a *App) input() *bufio.Reader {
+	if a.stdin == nil {
+		a.stdin = bufio.NewReader(a.Stdin)
+	}
+	return a.stdin
+}
+
+// isInteractive reports whether Stdin is a terminal a user can answer prompts on.
+func (a *App) isInteractive() bool {
+	f, ok := a.Stdin.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// suggestProfileName derives a profile name from the provider and the
+// organisation the user just authorised, e.g. "xero-acme-ltd".
+func suggestProfileName(prof ProfileData) string {
+	var org string
+	switch prof.Provider {
+	case "xero":
+		org = prof.TenantName
+	case "deputy":
+		if u, err := url.Parse(prof.Endpoint); err == nil && u.Host != "" {
+			org = strings.SplitN(u.Host, ".", 2)[0]
+		}
+	case "qbo":
+		org = prof.RealmID
+	case "myob":
+		org = prof.CompanyFileName
+	case "freshbooks":
+		org = prof.BusinessName
+	}
+	// Custom providers ("custom:acme") need the colon gone to be a valid name.
+	base := strings.ReplaceAll(prof.Provider, ":", "-")
+	if slug := slugify(org); slug != "" {
+		return base + "-" + slug
+	}
+	return base
+}
+
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case b.Len() > 0 && !dash:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// confirmProfileName offers the suggested name and lets the user accept it
+// or type another.
+func (a *App) confirmProfileName(suggested string) (string, error) {
+	fmt.Fprintf(a.Stdout, "Use profile name '%s'? [Y/n]: ", suggested)
+	line, err := a.input().ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if answer := strings.ToLower(strings.TrimSpace(line)); answer == "" || answer == "y" || answer == "yes" {
+		return suggested, nil
+	}
+	fmt.Fprint(a.Stdout, "Profile name: ")
+	line, err = a.input().ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(line)
+	if name == "" {
+		return "", fmt.Errorf("no profile name given")
+	}
+	return name, nil
+}
+
+// profileNameChars describes the characters validateProfileName accepts.
+const profileNameChars = "letters, digits, spaces, '-', '_' and '.'"
+
+func profileNameCharOK(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '-' || r == '_' || r == '.' || r == ' '
+}
+
+// validateProfileName rejects names whose characters could collide with the
+// provider:name key format or upset a keyring backend.
+func validateProfileName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("profile name must not be empty")
+	}
+	for _, r := range name {
+		if !profileNameCharOK(r) {
+			return fmt.Errorf("profile name %q contains %q; allowed characters are %s (use --force to escape others)", name, r, profileNameChars)
+		}
+	}
+	return nil
+}
+
+// validateStoredProfileName is the check saveProfile applies to every
+// profile it writes: the characters validateProfileName allows, plus the
+// %XX escapes escapeProfileName produces.
+func validateStoredProfileName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("profile name must not be empty")
+	}
+	for i := 0; i < len(name); {
+		if name[i] == '%' && i+2 < len(name) && isHexDigit(name[i+1]) && isHexDigit(name[i+2]) {
+			i += 3
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if !profileNameCharOK(r) {
+			return fmt.Errorf("profile name %q contains %q; allowed characters are %s", name, r, profileNameChars)
+		}
+		i += size
+	}
+	return nil
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F' || c >= 'a' && c <= 'f'
+}
+
+// escapeProfileName percent-encodes every character validateProfileName
+// would reject, '%' included, so distinct names stay distinct.
+func escapeProfileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if profileNameCharOK(r) {
+			b.WriteRune(r)
+			continue
+		}
+		for _, c := range []byte(string(r)) {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// checkProfileName validates a new profile name, or escapes it when force is
+// set, telling the user what the stored name became.
+func (a *App) checkProfileName(name string, force bool) (string, error) {
+	if err := validateProfileName(name); err == nil {
+		return name, nil
+	} else if !force || strings.TrimSpace(name) == "" {
+		return "", err
+	}
+	escaped := escapeProfileName(name)
+	fmt.Fprintf(a.Stderr, "Profile name %q stored as %q.\n", name, escaped)
+	return escaped, nil
+}
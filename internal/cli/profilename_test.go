@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveProfileValidatesName(t *testing.T) {
+	a, _ := archiveTestApp(t)
+	for _, name := range []string{"acme", "Acme Ltd", "acme.2", escapeProfileName("acme/ltd:100%")} {
+		if err := a.saveProfile(ProfileData{Provider: "xero", Name: name}); err != nil {
+			t.Errorf("saveProfile(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "  ", "acme:ltd", "acme/ltd", "100%", "bad%zz"} {
+		if err := a.saveProfile(ProfileData{Provider: "xero", Name: name}); err == nil {
+			t.Errorf("saveProfile(%q) succeeded", name)
+		}
+	}
+
+	// --save-to-file goes through the same check.
+	a.profileFile = filepath.Join(t.TempDir(), "profile.json")
+	if err := a.saveProfile(ProfileData{Provider: "xero", Name: "acme:ltd"}); err == nil {
+		t.Fatal("profile file written with an invalid name")
+	}
+	if _, err := os.Stat(a.profileFile); !os.IsNotExist(err) {
+		t.Fatalf("profile file exists after a rejected save: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxRateLimitRetries is how many times a rate limited broker call is
+	// retried before its error is returned.
+	maxRateLimitRetries = 3
+	// maxRateLimitWait is the longest Retry-After worth waiting out; a
+	// longer one, such as a provider's daily limit, fails at once.
+	maxRateLimitWait = time.Minute
+	// defaultRateLimitWait is used when a 429 gives no Retry-After.
+	defaultRateLimitWait = 5 * time.Second
+)
+
+// rateLimitedError reports that the broker or an upstream provider asked the
+// client to back off.
+type rateLimitedError struct {
+	RetryAfter time.Duration
+	Code       string
+}
+
+func (e *rateLimitedError) Error() string {
+	what := "rate limited"
+	if e.Code == "provider_rate_limited" {
+		what = "provider rate limited"
+	}
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s; retry after %s", what, e.RetryAfter)
+	}
+	return what
+}
+
+// rateLimitedFromResponse builds a rateLimitedError from a 429 response,
+// preferring the Retry-After header and falling back to the JSON body.
+func rateLimitedFromResponse(resp *http.Response, payload []byte) error {
+	var body struct {
+		Code       string `json:"code"`
+		RetryAfter int64  `json:"retry_after_seconds"`
+	}
+	_ = json.Unmarshal(payload, &body)
+	out := &rateLimitedError{Code: body.Code}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		out.RetryAfter = time.Duration(secs) * time.Second
+	} else if body.RetryAfter > 0 {
+		out.RetryAfter = time.Duration(body.RetryAfter) * time.Second
+	}
+	return out
+}
+
+// backOff waits out the Retry-After of err, a failed call's attempt-th
+// failure, and reports whether the call should be tried again. It declines
+// for errors other than rate limiting, once maxRateLimitRetries is reached,
+// for waits over maxRateLimitWait, and when ctx ends.
+func (a *App) backOff(ctx context.Context, err error, attempt int) bool {
+	var rl *rateLimitedError
+	if !errors.As(err, &rl) || attempt >= maxRateLimitRetries || rl.RetryAfter > maxRateLimitWait {
+		return false
+	}
+	wait := rl.RetryAfter
+	if wait <= 0 {
+		wait = defaultRateLimitWait
+	}
+	by := "the broker"
+	if rl.Code == "provider_rate_limited" {
+		by = "the provider"
+	}
+	fmt.Fprintf(a.Stderr, "Rate limited by %s; retrying in %s...\n", by, wait)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recoveryPath returns the on-disk location used to stash refreshed
+// credentials while they are being written to the keyring.
+func (a *App) recoveryPath(prof ProfileData) string {
+	key := strings.ReplaceAll(makeProfileKey(prof.Provider, prof.Name), ":", "_")
+	return filepath.Join(a.ConfigDir, "recovery", key+".json")
+}
+
+func (a *App) writeRecovery(prof ProfileData) (string, error) {
+	path := a.recoveryPath(prof)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(prof)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (a *App) clearRecovery(prof ProfileData) {
+	if err := os.Remove(a.recoveryPath(prof)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(a.Stderr, "warning: unable to remove recovery file: %v\n", err)
+	}
+}
+
+// offerRecovery checks for credentials left behind by a refresh whose keyring
+// write failed and, if the user agrees, restores them. It returns the restored
+// profile, or nil when nothing was recovered. The prompt goes to Stderr so
+// that refresh --stdout output stays parseable; without a terminal to answer
+// it, the file is only reported.
+func (a *App) offerRecovery(prof ProfileData, interactive bool) *ProfileData {
+	path := a.recoveryPath(prof)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var recovered ProfileData
+	if err := json.Unmarshal(data, &recovered); err != nil {
+		fmt.Fprintf(a.Stderr, "warning: ignoring unreadable recovery file %s: %v\n", path, err)
+		return nil
+	}
+	fmt.Fprintf(a.Stderr, "Found refreshed credentials for %s (%s) that were never saved, in %s.\n", prof.Name, prof.Provider, path)
+	if !interactive {
+		fmt.Fprintln(a.Stderr, "Run refresh from a terminal to restore them.")
+		return nil
+	}
+	fmt.Fprint(a.Stderr, "Restore them before continuing? [Y/n]: ")
+	line, _ := a.input().ReadString('\n')
+	if answer := strings.ToLower(strings.TrimSpace(line)); answer != "" && answer != "y" && answer != "yes" {
+		fmt.Fprintf(a.Stderr, "Leaving %s in place.\n", path)
+		return nil
+	}
+	if err := a.saveProfile(recovered); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to restore recovered credentials: %v\n", err)
+		return nil
+	}
+	a.clearRecovery(recovered)
+	fmt.Fprintln(a.Stderr, "Recovered credentials restored.")
+	return &recovered
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+func TestRefreshKeepsRotatedTokenOutOfOutput(t *testing.T) {
+	srv := brokertest.NewServer(t)
+	a, errb := archiveTestApp(t)
+	a.BrokerBaseURL = srv.URL
+	a.HTTPClient = http.DefaultClient
+	a.Keyring = readOnlyKeyring{a.Keyring}
+
+	prof := ProfileData{Provider: "deputy", Name: "acme", AccessToken: "old-access", RefreshToken: "old-refresh", Endpoint: "https://acme.example.com"}
+	if _, err := a.RefreshProfile(prof); err == nil {
+		t.Fatal("refresh succeeded although the profile could not be saved")
+	}
+	if strings.Contains(errb.String(), "brokertest-refresh-1") {
+		t.Fatalf("rotated refresh token printed: %s", errb)
+	}
+	path := a.recoveryPath(prof)
+	if !strings.Contains(errb.String(), path) {
+		t.Fatalf("recovery file %s not named in: %s", path, errb)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved ProfileData
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.RefreshToken != "brokertest-refresh-1" {
+		t.Fatalf("recovery file holds refresh token %q, want the rotated one", saved.RefreshToken)
+	}
+}
+
+func TestOfferRecovery(t *testing.T) {
+	stored := ProfileData{Provider: "deputy", Name: "acme", AccessToken: "old-access", RefreshToken: "old-refresh"}
+	rotated := stored
+	rotated.AccessToken, rotated.RefreshToken = "new-access", "new-refresh"
+	tests := []struct {
+		name        string
+		interactive bool
+		answer      string
+		garbage     bool
+		restored    bool
+		stderr      string
+	}{
+		{name: "restore", interactive: true, answer: "\n", restored: true, stderr: "Recovered credentials restored."},
+		{name: "decline", interactive: true, answer: "n\n", stderr: "Leaving"},
+		{name: "not a terminal", answer: "\n", stderr: "Run refresh from a terminal"},
+		{name: "unreadable file", interactive: true, answer: "\n", garbage: true, stderr: "ignoring unreadable recovery file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, errb := archiveTestApp(t, stored)
+			a.Stdin = strings.NewReader(tt.answer)
+			path, err := a.writeRecovery(rotated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.garbage {
+				if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := a.offerRecovery(stored, tt.interactive)
+			if (got != nil) != tt.restored {
+				t.Fatalf("offerRecovery returned %+v, want restored=%v: %s", got, tt.restored, errb)
+			}
+			if !strings.Contains(errb.String(), tt.stderr) {
+				t.Fatalf("stderr %q does not mention %q", errb, tt.stderr)
+			}
+			if out := a.Stdout.(*bytes.Buffer).String(); out != "" {
+				t.Fatalf("recovery wrote to stdout: %q", out)
+			}
+			loaded, err := a.LoadProfile("acme", "deputy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := stored.RefreshToken
+			if tt.restored {
+				want = rotated.RefreshToken
+			}
+			if loaded.RefreshToken != want {
+				t.Fatalf("stored refresh token %q, want %q", loaded.RefreshToken, want)
+			}
+			if _, err := os.Stat(path); tt.restored != errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("recovery file after offer: %v, want removed=%v", err, tt.restored)
+			}
+		})
+	}
+}
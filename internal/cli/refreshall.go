@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+)
+
+// refreshAll refreshes every stored profile, or with within > 0 only those
+// whose access token expires within that long, and prints a line per
+// profile. A failure is reported and the run continues; the exit status is
+// non-zero if any profile failed.
+func (a *App) refreshAll(baseURL string, within time.Duration) int {
+	if err := a.ensureKeyringReady(); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to unlock credential store: %v\n", err)
+		return 1
+	}
+	entries, err := a.storedProfiles()
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to enumerate profiles: %v\n", err)
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(a.Stdout, "No stored profiles.")
+		return 0
+	}
+	var refreshed, skipped, failed int
+	for _, e := range entries {
+		if e.Err != nil {
+			fmt.Fprintf(a.Stdout, "  %s – failed: %v\n", e.Key, e.Err)
+			failed++
+			continue
+		}
+		prof := e.Profile
+		label := fmt.Sprintf("%s (%s)", prof.Name, prof.Provider)
+		switch {
+		case within > 0 && (prof.NonExpiring || time.Until(prof.ExpiresAt) > within):
+			fmt.Fprintf(a.Stdout, "  %s – skipped: expires %s\n", label, expiryLabel(prof))
+			skipped++
+			continue
+		case prof.RefreshToken == "":
+			fmt.Fprintf(a.Stdout, "  %s – skipped: no refresh token stored\n", label)
+			skipped++
+			continue
+		}
+		_, updated, err := a.fetchRefreshed(baseURL, prof)
+		if err == nil {
+			err = a.storeRefreshed(prof, updated)
+		}
+		if err != nil {
+			fmt.Fprintf(a.Stdout, "  %s – failed: %v\n", label, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(a.Stdout, "  %s – refreshed, expires %s\n", label, expiryLabel(updated))
+		refreshed++
+	}
+	fmt.Fprintf(a.Stdout, "Refreshed %d, skipped %d, failed %d.\n", refreshed, skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
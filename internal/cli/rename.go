@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/99designs/keyring"
+)
+
+// runRename moves a profile to a new name. The keyring key is derived from
+// the provider and name, so the stored item is rewritten under the new key
+// and the old one removed; the token fields are carried over byte for byte.
+func (a *App) runRename(args []string) int {
+	fs := flag.NewFlagSet("rename", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	provider := fs.String("provider", "", "provider name")
+	oldName := fs.String("old-name", "", "current profile name")
+	newName := fs.String("new-name", "", "new profile name")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *provider == "" || *oldName == "" || *newName == "" {
+		fmt.Fprintln(a.Stderr, "--provider, --old-name and --new-name are required")
+		return 1
+	}
+	to := strings.TrimSpace(*newName)
+	if err := validateProfileName(to); err != nil {
+		fmt.Fprintf(a.Stderr, "invalid --new-name %q; allowed characters are %s\n", *newName, profileNameChars)
+		return 1
+	}
+	prov := strings.ToLower(*provider)
+	oldKey := makeProfileKey(prov, *oldName)
+	newKey := makeProfileKey(prov, to)
+	if oldKey == newKey {
+		fmt.Fprintln(a.Stderr, "--old-name and --new-name name the same profile")
+		return 1
+	}
+	item, err := a.Keyring.Get(oldKey)
+	if errors.Is(err, keyring.ErrKeyNotFound) {
+		fmt.Fprintf(a.Stderr, "no %s profile named %s\n", prov, *oldName)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to read profile: %v\n", err)
+		return 1
+	}
+	if _, err := a.Keyring.Get(newKey); err == nil {
+		fmt.Fprintf(a.Stderr, "a %s profile named %s already exists; remove or rename it first\n", prov, to)
+		return 1
+	} else if !errors.Is(err, keyring.ErrKeyNotFound) {
+		fmt.Fprintf(a.Stderr, "unable to check for an existing profile: %v\n", err)
+		return 1
+	}
+	// Rewrite only the name, keeping any field this version does not know.
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(item.Data, &fields); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to read profile: corrupt entry: %v\n", err)
+		return 1
+	}
+	fields["name"], _ = json.Marshal(to)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to encode profile: %v\n", err)
+		return 1
+	}
+	item.Key, item.Data = newKey, data
+	if err := a.Keyring.Set(item); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to save profile: %v\n", err)
+		return 1
+	}
+	if err := a.Keyring.Remove(oldKey); err != nil && !errors.Is(err, keyring.ErrKeyNotFound) {
+		fmt.Fprintf(a.Stderr, "saved %s but unable to remove %s: %v\nRemove it with: acct revoke --local-only --provider %s --profile %q\n", to, *oldName, err, prov, *oldName)
+		return 1
+	}
+	if prov == "xero" {
+		if err := a.renamePreferredTenant(*oldName, to); err != nil {
+			fmt.Fprintf(a.Stderr, "warning: unable to move tenant preference: %v\n", err)
+		}
+	}
+	fmt.Fprintf(a.Stdout, "Renamed %s profile %s to %s.\n", prov, *oldName, to)
+	return 0
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/keyring"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker/brokertest"
+)
+
+func TestRevoke(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		fail     bool
+		wantCode int
+		revoked  []string
+		kept     bool
+		stderr   string
+	}{
+		{name: "revoked upstream", provider: "qbo", revoked: []string{"stored-refresh"}},
+		{name: "upstream failure", provider: "qbo", fail: true, wantCode: 1, kept: true, stderr: "token revocation failed"},
+		{name: "no revocation api", provider: "deputy", stderr: "has no revocation API"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := brokertest.NewServer(t)
+			a, errb := disconnectTestApp(t, srv, ProfileData{
+				Provider:     tt.provider,
+				Name:         "acme",
+				AccessToken:  "stored-access",
+				RefreshToken: "stored-refresh",
+				RealmID:      "r1",
+				Endpoint:     "https://acme.example.com",
+				ExpiresAt:    time.Now().Add(time.Hour),
+			})
+			if tt.fail {
+				srv.Upstream.FailTokens(http.StatusBadRequest, `{"error":"invalid_request"}`)
+			}
+
+			if code := a.runRevoke([]string{"--profile", "acme", "--provider", tt.provider}); code != tt.wantCode {
+				t.Fatalf("revoke returned %d, want %d: %s", code, tt.wantCode, errb)
+			}
+			if got := srv.Upstream.Revoked(); !slices.Equal(got, tt.revoked) {
+				t.Fatalf("provider revoked %v, want %v", got, tt.revoked)
+			}
+			_, err := a.Keyring.Get(makeProfileKey(tt.provider, "acme"))
+			switch {
+			case tt.kept && err != nil:
+				t.Fatalf("profile removed after a failed revocation: %v", err)
+			case !tt.kept && !errors.Is(err, keyring.ErrKeyNotFound):
+				t.Fatalf("profile still stored after revoke: %v", err)
+			}
+			if !strings.Contains(errb.String(), tt.stderr) {
+				t.Fatalf("stderr %q does not mention %q", errb, tt.stderr)
+			}
+		})
+	}
+}
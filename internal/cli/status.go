@@ -0,0 +1,336 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// defaultStatusWarnWithin is how close to expiry an access token must be
+// before status flags it as expiring.
+const defaultStatusWarnWithin = 15 * time.Minute
+
+// Profile states reported by status. Only statusBroken fails the command:
+// an expired access token with a refresh token behind it is routine, since
+// Xero access tokens last only thirty minutes.
+const (
+	statusOK       = "ok"
+	statusExpiring = "expiring"
+	statusExpired  = "expired"
+	statusBroken   = "broken"
+)
+
+// statusJSON is one profile in status --json output.
+type statusJSON struct {
+	profileJSON
+	State           string           `json:"state"`
+	ExpiresIn       *int64           `json:"expires_in,omitempty"`
+	HasRefreshToken bool             `json:"has_refresh_token"`
+	LiveCheck       *statusLiveCheck `json:"live_check,omitempty"`
+}
+
+// statusLiveCheck is the outcome of status --check for one profile.
+// Skipped is set when the access token had already expired.
+type statusLiveCheck struct {
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runStatus summarises every stored profile: where it points, how long its
+// access token has left and whether it can be refreshed. Nothing leaves the
+// machine unless --check asks for a live provider call per profile. The
+// exit status is non-zero when any profile is broken: unreadable, expired
+// without a refresh token, or failing its live check.
+func (a *App) runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	check := fs.Bool("check", false, "make a lightweight provider API call per profile to confirm its token is accepted")
+	warnWithin := fs.Duration("warn-within", defaultStatusWarnWithin, "flag access tokens expiring within this long")
+	asJSON := fs.Bool("json", false, "write the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if err := a.ensureKeyringReady(); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to unlock credential store: %v\n", err)
+		return 1
+	}
+	entries, err := a.storedProfiles()
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to enumerate profiles: %v\n", err)
+		return 1
+	}
+	var results map[string]error
+	if *check {
+		var live []ProfileData
+		for _, e := range entries {
+			if e.Err == nil && !isExpired(e.Profile) {
+				live = append(live, e.Profile)
+			}
+		}
+		results = a.probeProfiles(live)
+	}
+
+	now := time.Now()
+	out := make([]statusJSON, 0, len(entries))
+	broken := 0
+	for _, e := range entries {
+		if e.Err != nil {
+			out = append(out, statusJSON{profileJSON: profileJSON{Key: e.Key, Error: e.Err.Error()}, State: statusBroken})
+			broken++
+			continue
+		}
+		s := profileStatus(e.Profile, now, *warnWithin)
+		if *check {
+			s.LiveCheck = &statusLiveCheck{Skipped: isExpired(e.Profile)}
+			if !s.LiveCheck.Skipped {
+				if err := results[probeCacheKey(e.Profile)]; err != nil {
+					s.LiveCheck.Error = err.Error()
+					s.State = statusBroken
+				} else {
+					s.LiveCheck.OK = true
+				}
+			}
+		}
+		if s.State == statusBroken {
+			broken++
+		}
+		out = append(out, s)
+	}
+
+	code := 0
+	if broken > 0 {
+		code = 1
+	}
+	if *asJSON || a.jsonOutput {
+		if c := a.writeJSON(out); c != 0 {
+			return c
+		}
+		return code
+	}
+	if len(out) == 0 {
+		fmt.Fprintln(a.Stdout, "No stored profiles.")
+		return 0
+	}
+	a.printStatus(out, *check)
+	return code
+}
+
+// profileStatus classifies prof as of now. An expired access token is only
+// broken when there is no refresh token to replace it.
+func profileStatus(prof ProfileData, now time.Time, warnWithin time.Duration) statusJSON {
+	s := statusJSON{
+		profileJSON:     newProfileJSON(prof),
+		State:           statusOK,
+		HasRefreshToken: prof.RefreshToken != "",
+	}
+	if prof.NonExpiring || prof.ExpiresAt.IsZero() {
+		return s
+	}
+	secs := secondsUntilExpiry(prof, now)
+	s.ExpiresIn = &secs
+	left := prof.ExpiresAt.Sub(now)
+	switch {
+	case left <= 0 && !s.HasRefreshToken:
+		s.State = statusBroken
+	case left <= 0:
+		s.State = statusExpired
+	case left < warnWithin:
+		s.State = statusExpiring
+	}
+	return s
+}
+
+// printStatus writes the status table, colouring the state column when
+// stdout is a terminal and NO_COLOR is unset.
+func (a *App) printStatus(list []statusJSON, check bool) {
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+	header := "PROFILE\tPROVIDER\tTARGET\tSTATE\tEXPIRES\tREFRESH"
+	if check {
+		header += "\tLIVE"
+	}
+	fmt.Fprintln(tw, header)
+	states := make([]string, len(list))
+	for i, s := range list {
+		if s.Name == "" {
+			states[i] = statusBroken
+			fmt.Fprintf(tw, "%s\t-\t-\t%s\t-\t-", s.Key, statusBroken)
+			if check {
+				fmt.Fprint(tw, "\t-")
+			}
+			fmt.Fprintln(tw)
+			continue
+		}
+		states[i] = s.State
+		refresh := "no"
+		if s.HasRefreshToken {
+			refresh = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s", s.Name, s.Provider, statusTarget(s.profileJSON), s.State, expiresInLabel(s), refresh)
+		if check {
+			fmt.Fprintf(tw, "\t%s", liveLabel(s.LiveCheck))
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	out := table.String()
+	if a.stdoutColour() {
+		out = paintStateColumn(out, states)
+	}
+	fmt.Fprint(a.Stdout, out)
+	fmt.Fprintf(a.Stdout, "\n%d profiles: %s\n", len(list), statusSummary(list))
+	for _, s := range list {
+		switch {
+		case s.Name == "":
+			fmt.Fprintf(a.Stdout, "%s: %s\n", s.Key, s.Error)
+		case s.LiveCheck != nil && s.LiveCheck.Error != "":
+			fmt.Fprintf(a.Stdout, "%s (%s): live check failed: %s\n", s.Name, s.Provider, s.LiveCheck.Error)
+		case s.State == statusBroken:
+			fmt.Fprintf(a.Stdout, "%s (%s): access token expired and no refresh token is stored; run connect again\n", s.Name, s.Provider)
+		}
+	}
+}
+
+// statusTarget names what a profile's token reaches: the Xero tenant, QBO
+// realm, Deputy install, MYOB company file or FreshBooks business.
+func statusTarget(p profileJSON) string {
+	switch {
+	case p.TenantID != "":
+		return describeTenant(p.TenantName, p.TenantID)
+	case p.RealmID != "":
+		return fmt.Sprintf("realm %s (%s)", p.RealmID, p.Environment)
+	case p.Endpoint != "":
+		return p.Endpoint
+	case p.CompanyFile != "":
+		return p.CompanyFile
+	case p.Business != "":
+		return p.Business
+	case p.AccountID != "":
+		return "account " + p.AccountID
+	}
+	return "-"
+}
+
+// expiresInLabel renders the time left on the access token, to the minute.
+func expiresInLabel(s statusJSON) string {
+	if s.ExpiresIn == nil {
+		if s.NonExpiring {
+			return "never"
+		}
+		return "unknown"
+	}
+	left := time.Duration(*s.ExpiresIn) * time.Second
+	if left <= 0 {
+		return "expired " + shortDuration(-left) + " ago"
+	}
+	return "in " + shortDuration(left)
+}
+
+// shortDuration formats d to the minute as "2d3h", "1h5m" or "12m", keeping
+// anything under a minute in seconds.
+func shortDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d/time.Second))
+	}
+	mins := int(d.Round(time.Minute) / time.Minute)
+	days, hours, mins := mins/(24*60), mins/60%24, mins%60
+	var b strings.Builder
+	if days > 0 {
+		fmt.Fprintf(&b, "%dd", days)
+	}
+	if hours > 0 {
+		fmt.Fprintf(&b, "%dh", hours)
+	}
+	if mins > 0 && days == 0 {
+		fmt.Fprintf(&b, "%dm", mins)
+	}
+	if b.Len() == 0 {
+		return "0m"
+	}
+	return b.String()
+}
+
+func liveLabel(c *statusLiveCheck) string {
+	switch {
+	case c == nil:
+		return "-"
+	case c.Skipped:
+		return "skipped"
+	case c.OK:
+		return "ok"
+	default:
+		return "failed"
+	}
+}
+
+// stdoutColour reports whether output may carry ANSI colours.
+func (a *App) stdoutColour() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := a.Stdout.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// paintState colours a state for a terminal. The text is unchanged, so the
+// state still reads without colour.
+func paintState(state string, colour bool) string {
+	if !colour {
+		return state
+	}
+	code := map[string]string{
+		statusOK:       "32",
+		statusExpiring: "33",
+		statusExpired:  "33",
+		statusBroken:   "31",
+	}[state]
+	if code == "" {
+		return state
+	}
+	return "\x1b[" + code + "m" + state + "\x1b[0m"
+}
+
+// paintStateColumn colours the STATE cell of each row of a laid-out status
+// table, one state per row below the header. Colour goes on after tabwriter
+// has padded the cells, since it counts the escape codes as visible width.
+func paintStateColumn(table string, states []string) string {
+	lines := strings.SplitAfter(table, "\n")
+	at := strings.Index(lines[0], "STATE")
+	if at < 0 {
+		return table
+	}
+	col := utf8.RuneCountInString(lines[0][:at])
+	for i, state := range states {
+		if i+1 >= len(lines) {
+			break
+		}
+		line := []rune(lines[i+1])
+		if col+len(state) > len(line) || string(line[col:col+len(state)]) != state {
+			continue
+		}
+		lines[i+1] = string(line[:col]) + paintState(state, true) + string(line[col+len(state):])
+	}
+	return strings.Join(lines, "")
+}
+
+// statusSummary counts profiles by state, for the line under the table.
+func statusSummary(list []statusJSON) string {
+	counts := map[string]int{}
+	for _, s := range list {
+		counts[s.State]++
+	}
+	var parts []string
+	for _, state := range []string{statusOK, statusExpiring, statusExpired, statusBroken} {
+		if counts[state] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[state], state))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
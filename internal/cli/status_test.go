@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPaintStateColumnKeepsAlignment(t *testing.T) {
+	var plain strings.Builder
+	a := &App{Stdout: &plain}
+	list := []statusJSON{
+		{profileJSON: profileJSON{Name: "acme", Provider: "xero"}, State: statusOK},
+		{profileJSON: profileJSON{Name: "café", Provider: "qbo"}, State: statusExpiring},
+		{profileJSON: profileJSON{Key: "xero:broken"}},
+	}
+	a.printStatus(list, false)
+	table := plain.String()[:strings.Index(plain.String(), "\n\n")+1]
+
+	painted := paintStateColumn(table, []string{statusOK, statusExpiring, statusBroken})
+	for _, want := range []string{"\x1b[32mok\x1b[0m", "\x1b[33mexpiring\x1b[0m", "\x1b[31mbroken\x1b[0m"} {
+		if !strings.Contains(painted, want) {
+			t.Errorf("painted table lacks %q:\n%s", want, painted)
+		}
+	}
+	ansi := regexp.MustCompile("\x1b\\[[0-9;]*m")
+	if got := ansi.ReplaceAllString(painted, ""); got != table {
+		t.Fatalf("colour moved the columns:\n%s\nwant:\n%s", got, table)
+	}
+}
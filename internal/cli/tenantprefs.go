@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tenantPrefsPath is the file mapping profile names to their preferred Xero tenant id.
+func (a *App) tenantPrefsPath() string {
+	return filepath.Join(a.ConfigDir, "tenant-prefs.json")
+}
+
+func (a *App) loadTenantPrefs() (map[string]string, error) {
+	prefs := make(map[string]string)
+	data, err := os.ReadFile(a.tenantPrefsPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return prefs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// preferredTenant returns the saved tenant id for a profile, or "" if none.
+func (a *App) preferredTenant(profile string) string {
+	prefs, err := a.loadTenantPrefs()
+	if err != nil {
+		return ""
+	}
+	return prefs[strings.ToLower(strings.TrimSpace(profile))]
+}
+
+func (a *App) savePreferredTenant(profile, tenantID string) error {
+	prefs, err := a.loadTenantPrefs()
+	if err != nil {
+		return err
+	}
+	prefs[strings.ToLower(strings.TrimSpace(profile))] = tenantID
+	return a.writeTenantPrefs(prefs)
+}
+
+// renamePreferredTenant moves a profile's saved tenant to its new name. It
+// leaves alone a preference the new name already has.
+func (a *App) renamePreferredTenant(oldName, newName string) error {
+	prefs, err := a.loadTenantPrefs()
+	if err != nil {
+		return err
+	}
+	oldKey := strings.ToLower(strings.TrimSpace(oldName))
+	newKey := strings.ToLower(strings.TrimSpace(newName))
+	tenantID, ok := prefs[oldKey]
+	if !ok || oldKey == newKey {
+		return nil
+	}
+	delete(prefs, oldKey)
+	if _, taken := prefs[newKey]; !taken {
+		prefs[newKey] = tenantID
+	}
+	return a.writeTenantPrefs(prefs)
+}
+
+func (a *App) writeTenantPrefs(prefs map[string]string) error {
+	data, err := json.MarshalIndent(prefs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.ConfigDir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(a.tenantPrefsPath(), data, 0o600)
+}
@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+// tenantJSON is one Xero tenant a profile's authorisation covers.
+type tenantJSON struct {
+	TenantID   string `json:"tenant_id"`
+	TenantName string `json:"tenant_name,omitempty"`
+	TenantType string `json:"tenant_type,omitempty"`
+	Active     bool   `json:"active"`
+}
+
+// profileTenants returns every tenant recorded for a Xero profile, with the
+// active one marked. Profiles saved before the full list was kept report
+// only their active tenant.
+func profileTenants(prof ProfileData) []tenantJSON {
+	tenants := prof.Tenants
+	if len(tenants) == 0 && prof.TenantID != "" {
+		tenants = []broker.XeroTenant{{TenantID: prof.TenantID, TenantName: prof.TenantName, TenantType: prof.TenantType}}
+	}
+	return tenantViews(tenants, prof.TenantID)
+}
+
+// tenantViews converts tenants for output, marking activeID as active.
+func tenantViews(tenants []broker.XeroTenant, activeID string) []tenantJSON {
+	out := make([]tenantJSON, 0, len(tenants))
+	for _, t := range tenants {
+		out = append(out, tenantJSON{
+			TenantID:   t.TenantID,
+			TenantName: t.TenantName,
+			TenantType: t.TenantType,
+			Active:     t.TenantID == activeID,
+		})
+	}
+	return out
+}
+
+// printOtherTenants lists, under a profile already shown, the tenants its
+// authorisation covers besides the active one.
+func (a *App) printOtherTenants(prof ProfileData, indent string) {
+	for _, t := range profileTenants(prof) {
+		if !t.Active {
+			fmt.Fprintf(a.Stdout, "%sAlso authorised: %s\n", indent, describeTenant(t.TenantName, t.TenantID))
+		}
+	}
+}
+
+// usableTenants drops, with a warning, connections Xero returned without a
+// tenant id: they cannot be selected or called against.
+func (a *App) usableTenants(tenants []broker.XeroTenant) []broker.XeroTenant {
+	out := tenants[:0:0]
+	for _, t := range tenants {
+		if strings.TrimSpace(t.TenantID) == "" {
+			fmt.Fprintf(a.Stderr, "warning: ignoring Xero connection %s with no tenant id\n", t.ID)
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// runTenant handles "tenant use", which switches a Xero profile's active
+// tenant to another one its authorisation already covers.
+func (a *App) runTenant(args []string) int {
+	if len(args) == 0 || args[0] != "use" {
+		fmt.Fprintln(a.Stderr, "usage: tenant use --profile NAME --tenant-id ID|NAME")
+		return 1
+	}
+	fs := flag.NewFlagSet("tenant use", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	profile := fs.String("profile", "", "profile name")
+	tenant := fs.String("tenant-id", "", "Xero tenant id or name to make active")
+	a.addProfileFileFlag(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 1
+	}
+	if *tenant == "" {
+		fmt.Fprintln(a.Stderr, "--tenant-id is required")
+		return 1
+	}
+	prof, err := a.loadProfile(*profile, "xero")
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to load profile: %v\n", err)
+		return 1
+	}
+	if len(prof.Tenants) == 0 {
+		fmt.Fprintf(a.Stderr, "profile %s has no stored tenant list; run connect again to record every authorised tenant\n", prof.Name)
+		return 1
+	}
+	t, ok := findTenant(prof.Tenants, *tenant)
+	if !ok {
+		fmt.Fprintf(a.Stderr, "tenant %q is not among those authorised for profile %s (see whoami)\n", *tenant, prof.Name)
+		return 1
+	}
+	applyTenant(prof, t)
+	if err := a.saveProfile(*prof); err != nil {
+		fmt.Fprintf(a.Stderr, "unable to save profile: %v\n", err)
+		return 1
+	}
+	if a.profileFile == "" {
+		if err := a.savePreferredTenant(prof.Name, prof.TenantID); err != nil {
+			fmt.Fprintf(a.Stderr, "warning: unable to save tenant preference: %v\n", err)
+		}
+	}
+	fmt.Fprintf(a.Stdout, "Profile %s now uses tenant %s.\n", prof.Name, describeTenant(prof.TenantName, prof.TenantID))
+	return 0
+}
+
+// tenantDiff is how the organisations a Xero authorisation reaches have
+// changed since its tenant list was stored.
+type tenantDiff struct {
+	Profile   string       `json:"profile"`
+	Added     []tenantJSON `json:"added"`
+	Removed   []tenantJSON `json:"removed"`
+	Unchanged []tenantJSON `json:"unchanged"`
+}
+
+// diffTenants compares a profile's stored tenants with the live connections,
+// matching them by tenant id. Unchanged tenants carry their live name, as
+// organisations can be renamed.
+func diffTenants(prof ProfileData, live []broker.XeroTenant) tenantDiff {
+	d := tenantDiff{Profile: prof.Name, Added: []tenantJSON{}, Removed: []tenantJSON{}, Unchanged: []tenantJSON{}}
+	liveView := tenantViews(live, prof.TenantID)
+	stored := make(map[string]bool)
+	for _, t := range profileTenants(prof) {
+		stored[t.TenantID] = true
+		if !slices.ContainsFunc(liveView, func(l tenantJSON) bool { return l.TenantID == t.TenantID }) {
+			d.Removed = append(d.Removed, t)
+		}
+	}
+	for _, t := range liveView {
+		if stored[t.TenantID] {
+			d.Unchanged = append(d.Unchanged, t)
+		} else {
+			d.Added = append(d.Added, t)
+		}
+	}
+	return d
+}
+
+// runTenants lists the Xero tenants stored for a profile or, with --diff,
+// compares them with the organisations the authorisation reaches now, for
+// reviewing which organisations an integration can touch. Nothing is saved;
+// refresh records the live list.
+func (a *App) runTenants(args []string) int {
+	fs := flag.NewFlagSet("tenants", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	profile := fs.String("profile", "", "profile name")
+	diff := fs.Bool("diff", false, "fetch the current Xero connections and show tenants added or removed since the stored list")
+	asJSON := fs.Bool("json", false, "write the result as JSON")
+	a.addProfileFileFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	prof, err := a.loadProfile(*profile, "xero")
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to load profile: %v\n", err)
+		return 1
+	}
+	jsonOut := *asJSON || a.jsonOutput
+	if !*diff {
+		if jsonOut {
+			return a.writeJSON(profileTenants(*prof))
+		}
+		for _, t := range profileTenants(*prof) {
+			marker := " "
+			if t.Active {
+				marker = "*"
+			}
+			fmt.Fprintf(a.Stdout, "%s %s\n", marker, describeTenant(t.TenantName, t.TenantID))
+		}
+		return 0
+	}
+	if len(prof.Tenants) == 0 {
+		fmt.Fprintf(a.Stderr, "warning: profile %s has no stored tenant list; comparing with its active tenant only\n", prof.Name)
+	}
+	fresh, err := a.ensureFreshToken(*prof)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to refresh profile: %v\n", err)
+		return 1
+	}
+	live, err := a.fetchXeroTenants(fresh.AccessToken)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to list Xero connections: %v\n", err)
+		return 1
+	}
+	d := diffTenants(fresh, live)
+	if jsonOut {
+		return a.writeJSON(d)
+	}
+	for _, section := range []struct {
+		title   string
+		tenants []tenantJSON
+	}{{"Added", d.Added}, {"Removed", d.Removed}, {"Unchanged", d.Unchanged}} {
+		fmt.Fprintf(a.Stdout, "%s (%d):\n", section.title, len(section.tenants))
+		for _, t := range section.tenants {
+			fmt.Fprintf(a.Stdout, "  %s\n", describeTenant(t.TenantName, t.TenantID))
+		}
+	}
+	return 0
+}
+
+// revalidateXeroTenant compares a refreshed Xero profile's tenants with the
+// organisations still connected, and records the live list. A vanished
+// active tenant is reported, and cleared when clearMissing is set, rather
+// than kept as a dead id. orgName, when set, selects the active tenant by
+// name or id from the live connections. Problems are warnings unless they
+// defeat orgName, because the refreshed tokens must be saved regardless.
+func (a *App) revalidateXeroTenant(prof *ProfileData, orgName string, clearMissing bool) error {
+	live, err := a.fetchXeroTenants(prof.AccessToken)
+	if err != nil {
+		if orgName != "" {
+			return fmt.Errorf("list xero tenants: %w", err)
+		}
+		fmt.Fprintf(a.Stderr, "warning: unable to check connected organisations: %v\n", err)
+		return nil
+	}
+	live = a.usableTenants(live)
+	prof.Tenants = live
+	if orgName != "" {
+		t, ok := findTenant(live, orgName)
+		if !ok {
+			return fmt.Errorf("organisation %q is not connected to this authorisation", orgName)
+		}
+		applyTenant(prof, t)
+		return nil
+	}
+	if prof.TenantID == "" {
+		return nil
+	}
+	if t, ok := findTenant(live, prof.TenantID); ok {
+		// Organisations can be renamed in Xero.
+		applyTenant(prof, t)
+		return nil
+	}
+	fmt.Fprintf(a.Stderr, "warning: organisation %s is no longer connected; run connect again, or tenant use to pick another\n", describeTenant(prof.TenantName, prof.TenantID))
+	if clearMissing {
+		applyTenant(prof, broker.XeroTenant{})
+		fmt.Fprintln(a.Stderr, "The profile's tenant has been cleared.")
+	}
+	return nil
+}
+
+// describeTenant formats a tenant as "name (id)", or, for an organisation
+// Xero has not yet given a name, "id (name unavailable)".
+func describeTenant(name, id string) string {
+	if name == "" {
+		return id + " (name unavailable)"
+	}
+	return fmt.Sprintf("%s (%s)", name, id)
+}
@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"auth.industrial-linguistics.com/accounting-ops/internal/broker"
+)
+
+func TestXeroTenantPromptMixedCompleteness(t *testing.T) {
+	var out, errb bytes.Buffer
+	a := &App{ConfigDir: t.TempDir(), Stdout: &out, Stderr: &errb, Stdin: strings.NewReader("2\n")}
+	tenants := a.usableTenants([]broker.XeroTenant{
+		{ID: "c1", TenantID: "t1", TenantName: "Complete Ltd"},
+		{ID: "c2", TenantID: "t2"},
+		{ID: "c3", TenantName: "No Id Ltd"},
+	})
+	if len(tenants) != 2 {
+		t.Fatalf("want 2 usable tenants, got %+v", tenants)
+	}
+	if !strings.Contains(errb.String(), "ignoring Xero connection c3 with no tenant id") {
+		t.Errorf("no warning for the id-less connection: %q", errb.String())
+	}
+
+	var prof ProfileData
+	if err := a.promptForXeroTenant(&prof, broker.TokenEnvelope{Tenants: tenants}, "", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"[1] Complete Ltd (t1)", "[2] t2 (name unavailable)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("prompt lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "No Id Ltd") {
+		t.Errorf("prompt offers the id-less connection:\n%s", out.String())
+	}
+	if prof.TenantID != "t2" || prof.TenantName != "" {
+		t.Errorf("selected %q (%q), want the unnamed t2", prof.TenantID, prof.TenantName)
+	}
+
+	err := a.promptForXeroTenant(&ProfileData{}, broker.TokenEnvelope{Tenants: tenants}, "", true)
+	if err == nil || !strings.Contains(err.Error(), "Complete Ltd (t1), t2 (name unavailable)") {
+		t.Errorf("non-interactive error does not list both tenants: %v", err)
+	}
+}
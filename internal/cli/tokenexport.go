@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// exportVar is one NAME=value pair written by `acct export --profile`.
+type exportVar struct {
+	Name  string
+	Value string
+}
+
+// profileExportVars returns the environment variables that let another tool
+// call the provider API with prof, named after the provider
+// (XERO_ACCESS_TOKEN, QBO_REALM_ID, CUSTOM_ACME_ACCESS_TOKEN for
+// custom:acme, …). Empty values are left out.
+func profileExportVars(prof ProfileData) []exportVar {
+	prefix := strings.ReplaceAll(strings.ToUpper(prof.Provider), ":", "_") + "_"
+	vars := []exportVar{{prefix + "ACCESS_TOKEN", prof.AccessToken}}
+	switch prof.Provider {
+	case "xero":
+		vars = append(vars, exportVar{prefix + "TENANT_ID", prof.TenantID})
+	case "qbo":
+		vars = append(vars,
+			exportVar{prefix + "REALM_ID", prof.RealmID},
+			exportVar{prefix + "ENVIRONMENT", qboEnvironment(prof)},
+			exportVar{prefix + "API_BASE_URL", qboAPIBaseURL(prof)},
+		)
+	case "deputy":
+		vars = append(vars, exportVar{prefix + "ENDPOINT", prof.Endpoint})
+	case "myob":
+		vars = append(vars,
+			exportVar{prefix + "COMPANY_FILE_URI", prof.CompanyFileURI},
+			exportVar{prefix + "CFTOKEN", prof.CFToken},
+		)
+	case "freshbooks":
+		vars = append(vars, exportVar{prefix + "ACCOUNT_ID", prof.AccountID})
+	}
+	out := vars[:0]
+	for _, v := range vars {
+		if v.Value != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// writeExportVars renders vars in format: "env" for `eval "$(acct export …)"`
+// or "dotenv" for a .env file.
+func writeExportVars(w io.Writer, vars []exportVar, format string) {
+	for _, v := range vars {
+		if format == "env" {
+			fmt.Fprint(w, "export ")
+		}
+		fmt.Fprintf(w, "%s=%s\n", v.Name, shellQuote(v.Value))
+	}
+}
+
+// shellQuote single-quotes val so a POSIX shell (and dotenv parsers, which
+// treat single-quoted values literally) reads it back unchanged.
+func shellQuote(val string) string {
+	return "'" + strings.ReplaceAll(val, "'", `'\''`) + "'"
+}
+
+// exportProfileVars implements `acct export --profile`: load the profile,
+// refresh it if it is close to expiry, and write its credentials to out.
+func (a *App) exportProfileVars(name, provider, format string, noRefresh bool, out secretOutput) int {
+	switch format {
+	case "env", "dotenv", "json":
+	default:
+		fmt.Fprintf(a.Stderr, "unknown --format %q (want env, dotenv or json)\n", format)
+		return 1
+	}
+	prof, ok := a.loadFreshProfile(name, provider, noRefresh)
+	if !ok {
+		return 1
+	}
+	vars := profileExportVars(prof)
+	if format == "json" && out.isStdout() {
+		return a.writeJSON(exportVarsObject(vars))
+	}
+	w, closeOut, err := a.openSecretOutput(out)
+	if err != nil {
+		fmt.Fprintln(a.Stderr, err)
+		return 1
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(exportVarsObject(vars))
+	} else {
+		writeExportVars(w, vars, format)
+	}
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to write credentials: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func exportVarsObject(vars []exportVar) map[string]string {
+	obj := make(map[string]string, len(vars))
+	for _, v := range vars {
+		obj[v.Name] = v.Value
+	}
+	return obj
+}
+
+// runToken implements `acct token`: write just the access token, refreshed
+// if it is close to expiry, for tools that take a bearer token.
+func (a *App) runToken(args []string) int {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	fs.SetOutput(a.Stderr)
+	profile := fs.String("profile", "", "profile name")
+	provider := fs.String("provider", "", "provider name")
+	noRefresh := fs.Bool("no-refresh", false, "write the stored access token without refreshing it")
+	a.addProfileFileFlag(fs)
+	var out secretOutput
+	out.addFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	prof, ok := a.loadFreshProfile(*profile, *provider, *noRefresh)
+	if !ok {
+		return 1
+	}
+	w, closeOut, err := a.openSecretOutput(out)
+	if err != nil {
+		fmt.Fprintln(a.Stderr, err)
+		return 1
+	}
+	_, err = fmt.Fprintln(w, prof.AccessToken)
+	if cerr := closeOut(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to write token: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// loadFreshProfile loads a profile and, unless noRefresh is set, refreshes
+// it when its access token is within the refresh leeway. Failures are
+// reported on Stderr.
+func (a *App) loadFreshProfile(name, provider string, noRefresh bool) (ProfileData, bool) {
+	prof, err := a.loadProfile(name, provider)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to load profile: %v\n", err)
+		return ProfileData{}, false
+	}
+	if noRefresh {
+		return *prof, true
+	}
+	fresh, err := a.ensureFreshToken(*prof)
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "unable to refresh profile: %v\n", err)
+		return ProfileData{}, false
+	}
+	return fresh, true
+}
+
+// secretOutput is where `token` and `export --profile` write credentials:
+// stdout by default, an inherited file descriptor, or a file.
+type secretOutput struct {
+	fd   int
+	path string
+}
+
+func (o *secretOutput) addFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.fd, "fd", -1, "write to this inherited file descriptor (3 or higher) instead of stdout")
+	fs.StringVar(&o.path, "output", "", "write to this file, or /dev/fd/N for an inherited descriptor, instead of stdout")
+}
+
+func (o secretOutput) isStdout() bool { return o.fd < 0 && o.path == "" }
+
+// openSecretOutput resolves out to a writer and a function that closes it.
+// Descriptors are used directly, so /dev/fd/N works for pipes and sockets
+// even where reopening the path would not; new files are created mode 0600.
+func (a *App) openSecretOutput(out secretOutput) (io.Writer, func() error, error) {
+	fd := out.fd
+	if out.path != "" {
+		if fd >= 0 {
+			return nil, nil, errors.New("--fd and --output cannot be combined")
+		}
+		if n, ok := strings.CutPrefix(out.path, "/dev/fd/"); ok {
+			v, err := strconv.Atoi(n)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid descriptor path %s", out.path)
+			}
+			fd = v
+		} else {
+			f, err := os.OpenFile(out.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+			if err != nil {
+				return nil, nil, err
+			}
+			return f, f.Close, nil
+		}
+	}
+	if fd < 0 {
+		return a.Stdout, func() error { return nil }, nil
+	}
+	if fd < 3 {
+		return nil, nil, fmt.Errorf("file descriptor %d is a standard stream; use 3 or higher, or omit --fd to write to stdout", fd)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if f == nil {
+		return nil, nil, fmt.Errorf("file descriptor %d is not valid", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, nil, fmt.Errorf("file descriptor %d is not open; the calling process must set it up (e.g. 3>file)", fd)
+	}
+	return f, f.Close, nil
+}
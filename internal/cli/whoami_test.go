@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWhoAmIJSONSpellings(t *testing.T) {
+	prof := ProfileData{Provider: "deputy", Name: "acme", AccessToken: "stored-access", Endpoint: "https://acme.example.com", ExpiresAt: time.Now().Add(time.Hour).UTC().Truncate(time.Second)}
+	var outputs []string
+	for _, args := range [][]string{
+		{"--json", "whoami", "--profile", "acme", "--provider", "deputy"},
+		{"whoami", "--json", "--profile", "acme", "--provider", "deputy"},
+	} {
+		a, errb := archiveTestApp(t, prof)
+		if code := a.Run(args); code != 0 {
+			t.Fatalf("%v returned %d: %s", args, code, errb)
+		}
+		outputs = append(outputs, a.Stdout.(*bytes.Buffer).String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Fatalf("acct --json whoami wrote %q but acct whoami --json wrote %q", outputs[0], outputs[1])
+	}
+	if !strings.HasPrefix(outputs[0], "{") {
+		t.Fatalf("whoami --json wrote %q, want a JSON object", outputs[0])
+	}
+}